@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aggregator counts a stream's lines rather than shipping them, for the
+// aggregate stream option. Every interval it sends a single summary event
+// with the number of lines and bytes, and, if by is set, a count of lines
+// by the value of that field in JSON lines.
+type aggregator struct {
+	every time.Duration
+	by    string
+
+	sync.Mutex
+	lines  int64
+	bytes  int64
+	counts map[string]int64
+}
+
+// newAggregator parses an aggregate option value, like 10s or 1m,by=status.
+func newAggregator(val string) (*aggregator, error) {
+	parts := strings.Split(val, ",")
+	every, err := time.ParseDuration(parts[0])
+	if err != nil || every <= 0 {
+		return nil, fmt.Errorf("bad stream aggregate interval: %s", parts[0])
+	}
+	a := &aggregator{every: every}
+	for _, p := range parts[1:] {
+		if !strings.HasPrefix(p, "by=") || len(p) == len("by=") {
+			return nil, fmt.Errorf("bad stream aggregate setting: %s", p)
+		}
+		a.by = strings.TrimPrefix(p, "by=")
+	}
+	return a, nil
+}
+
+// add counts a raw line. Blank lines aren't counted.
+func (a *aggregator) add(buf []byte) {
+	buf = bytes.TrimSpace(buf)
+	if len(buf) == 0 {
+		return
+	}
+	key := ""
+	if a.by != "" {
+		key = "-"
+		if looksLikeObject(buf) {
+			if fields, err := decodeObject(buf); err == nil {
+				if i := findField(fields, a.by); i >= 0 {
+					key = fieldText(fields[i].val)
+				}
+			}
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.lines++
+	a.bytes += int64(len(buf))
+	if a.by != "" {
+		if a.counts == nil {
+			a.counts = make(map[string]int64)
+		}
+		a.counts[key]++
+	}
+}
+
+// fieldText returns a JSON value as text: strings without their quotes, and
+// everything else as it's written.
+func fieldText(val json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(val, &s); err == nil {
+		return s
+	}
+	return string(val)
+}
+
+// summary returns the body of the summary event for the interval so far,
+// and starts a new interval.
+func (a *aggregator) summary() []byte {
+	a.Lock()
+	defer a.Unlock()
+	body := fmt.Sprintf("{\"lines\":%d,\"bytes\":%d,\"interval_ms\":%d", a.lines, a.bytes, a.every/time.Millisecond)
+	if a.by != "" {
+		var keys []string
+		for k := range a.counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var counts []string
+		for _, k := range keys {
+			counts = append(counts, fmt.Sprintf("%s:%d", jsonString([]byte(k)), a.counts[k]))
+		}
+		body += fmt.Sprintf(",\"by\":%s,\"counts\":{%s}", jsonString([]byte(a.by)), strings.Join(counts, ","))
+	}
+	a.lines, a.bytes, a.counts = 0, 0, nil
+	return []byte(body + "}")
+}
+
+// writeSummary sends a stream's summary event for the interval so far. Like
+// any other write, it waits while we're paused; the interval keeps going
+// until then.
+func (m *Mux) writeSummary(s Stream, a *aggregator) error {
+	m.pause.wait(s)
+	return m.sink(s).Write([]event{{tag: s.Tag(), buf: m.opts.ownEvent(a.summary(), s.Tag())}})
+}
+
+// runAggregate sends a stream's summary event every interval, until stop
+// is closed.
+func (m *Mux) runAggregate(s Stream, a *aggregator, stop <-chan struct{}) {
+	tick := time.NewTicker(a.every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			if err := m.writeSummary(s, a); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: couldn't send aggregate summary: %s\n", s.Tag(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	tests := []struct {
+		name  string
+		opt   string
+		lines []string
+		want  string
+	}{
+		{
+			name:  "counts",
+			opt:   "10s",
+			lines: []string{"one", "two", "", "  ", "three  "},
+			want:  `{"lines":3,"bytes":11,"interval_ms":10000}`,
+		},
+		{
+			name:  "by field",
+			opt:   "1m,by=status",
+			lines: []string{`{"status":200}`, `{"status":"200"}`, `{"status":404}`, `{"path":"/"}`, "plain", `{"status":{"code":500}}`},
+			want:  `{"lines":6,"bytes":84,"interval_ms":60000,"by":"status","counts":{"-":2,"200":2,"404":1,"{\"code\":500}":1}}`,
+		},
+		{
+			name: "empty interval",
+			opt:  "1s,by=status",
+			want: `{"lines":0,"bytes":0,"interval_ms":1000,"by":"status","counts":{}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAggregator(tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range tt.lines {
+				a.add([]byte(l + "\n"))
+			}
+			if got := string(a.summary()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			// Each summary starts a new interval.
+			if got := string(a.summary()); !strings.HasPrefix(got, `{"lines":0,"bytes":0,`) {
+				t.Errorf("next interval starts with %s", got)
+			}
+		})
+	}
+}
+
+func TestBadAggregate(t *testing.T) {
+	for _, opt := range []string{"", "0s", "-1s", "soon", "10s,by=", "10s,status"} {
+		if _, err := newAggregator(opt); err == nil {
+			t.Errorf("%q: no error", opt)
+		}
+	}
+}
+
+func TestAggregateStream(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--duration", "300ms",
+		pipeSpec(t, "access", []string{`{"status":200}`, `{"status":200}`, `{"status":500}`})+";aggregate=1h,by=status")
+	got := c.lines(t, 0, 1)
+	want := `{"lines":3,"bytes":42,"interval_ms":3600000,"by":"status","counts":{"200":2,"500":1},"tag":"access"}`
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %s", got, want)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// amqpBroker plays the broker's side of an AMQP connection, step by step,
+// over one end of a pipe.
+type amqpBroker struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// amqpPublish is a message as the broker got it.
+type amqpPublish struct {
+	exchange, key string
+	mode          byte
+	body          string
+	frames        int
+}
+
+// startAMQP connects an amqpWriter for the given URL to a scripted broker.
+// The handshake runs in the background, and the writer comes out of the
+// returned channel once the broker's been walked through it.
+func startAMQP(t *testing.T, raw string) (*amqpBroker, <-chan *amqpWriter, <-chan error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writers := make(chan *amqpWriter, 1)
+	errs := make(chan error, 1)
+	go func() {
+		a, err := newAMQPWriter(client, u, "logs")
+		if err != nil {
+			errs <- err
+			return
+		}
+		writers <- a
+	}()
+	return &amqpBroker{t, server, bufio.NewReader(server)}, writers, errs
+}
+
+// frame reads the next frame from the client.
+func (b *amqpBroker) frame() (byte, uint16, []byte) {
+	b.t.Helper()
+	var hdr [7]byte
+	if _, err := io.ReadFull(b.in, hdr[:]); err != nil {
+		b.t.Fatal(err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr[3:])+1)
+	if _, err := io.ReadFull(b.in, payload); err != nil {
+		b.t.Fatal(err)
+	}
+	if payload[len(payload)-1] != amqpFrameEnd {
+		b.t.Fatal("bad frame end")
+	}
+	return hdr[0], binary.BigEndian.Uint16(hdr[1:3]), payload[:len(payload)-1]
+}
+
+// expect reads the next frame, which has to be the given method on the
+// given channel, and returns its arguments.
+func (b *amqpBroker) expect(channel uint16, id uint32) []byte {
+	b.t.Helper()
+	typ, ch, payload := b.frame()
+	if typ != amqpMethod || ch != channel || len(payload) < 4 {
+		b.t.Fatalf("got frame type %d on channel %d, want a method on channel %d", typ, ch, channel)
+	}
+	if got := binary.BigEndian.Uint32(payload); got != id {
+		b.t.Fatalf("got method %d.%d, want %d.%d", got>>16, got&0xFFFF, id>>16, id&0xFFFF)
+	}
+	return payload[4:]
+}
+
+// send sends a method to the client.
+func (b *amqpBroker) send(channel uint16, id uint32, args amqpArgs) {
+	var out bytes.Buffer
+	writeAMQPFrame(&out, amqpMethod, channel, args.methodPayload(id))
+	if _, err := b.conn.Write(out.Bytes()); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// handshake walks the client through connecting with the given frame-max,
+// and returns the login it sent and the vhost it opened.
+func (b *amqpBroker) handshake(frameMax uint32) (string, string) {
+	b.t.Helper()
+	var proto [8]byte
+	if _, err := io.ReadFull(b.in, proto[:]); err != nil {
+		b.t.Fatal(err)
+	}
+	if string(proto[:]) != "AMQP\x00\x00\x09\x01" {
+		b.t.Fatalf("got protocol header %q", proto)
+	}
+	var m amqpArgs
+	m.octet(0)
+	m.octet(9)
+	m.table(map[string]string{"product": "fake"})
+	m.longstr("PLAIN AMQPLAIN")
+	m.longstr("en_US")
+	b.send(0, amqpConnectionStart, m)
+
+	args := b.expect(0, amqpConnectionStartOk)
+	args = args[4+binary.BigEndian.Uint32(args):]
+	if mech := string(args[1 : 1+args[0]]); mech != "PLAIN" {
+		b.t.Errorf("got mechanism %s", mech)
+	}
+	args = args[1+args[0]:]
+	login := string(args[4 : 4+binary.BigEndian.Uint32(args)])
+
+	m = amqpArgs{}
+	m.short(2047)
+	m.long(frameMax)
+	m.short(60)
+	b.send(0, amqpConnectionTune, m)
+	tuneOk := b.expect(0, amqpConnectionTuneOk)
+	if hb := binary.BigEndian.Uint16(tuneOk[6:8]); hb != 0 {
+		b.t.Errorf("client asked for %ds heartbeats", hb)
+	}
+	args = b.expect(0, amqpConnectionOpen)
+	vhost := string(args[1 : 1+args[0]])
+	m = amqpArgs{}
+	m.shortstr("")
+	b.send(0, amqpConnectionOpenOk, m)
+
+	b.expect(1, amqpChannelOpen)
+	m = amqpArgs{}
+	m.longstr("")
+	b.send(1, amqpChannelOpenOk, m)
+	b.expect(1, amqpConfirmSelect)
+	b.send(1, amqpConfirmSelectOk, nil)
+	return login, vhost
+}
+
+// publish reads a published message: its method, content header and body.
+func (b *amqpBroker) publish() amqpPublish {
+	b.t.Helper()
+	args := b.expect(1, amqpBasicPublish)
+	args = args[2:]
+	var p amqpPublish
+	p.exchange, args = string(args[1:1+args[0]]), args[1+args[0]:]
+	p.key = string(args[1 : 1+args[0]])
+	typ, _, hdr := b.frame()
+	if typ != amqpHeader || len(hdr) < 15 {
+		b.t.Fatalf("got frame type %d, want a content header", typ)
+	}
+	size := binary.BigEndian.Uint64(hdr[4:12])
+	if flags := binary.BigEndian.Uint16(hdr[12:14]); flags == 0x1000 {
+		p.mode = hdr[14]
+	}
+	var body []byte
+	for uint64(len(body)) < size {
+		typ, _, payload := b.frame()
+		if typ != amqpBody {
+			b.t.Fatalf("got frame type %d, want a body", typ)
+		}
+		body = append(body, payload...)
+		p.frames++
+	}
+	p.body = string(body)
+	return p
+}
+
+// confirm acks or nacks messages up to seq.
+func (b *amqpBroker) confirm(id uint32, seq uint64, multiple bool) {
+	var m amqpArgs
+	m.longlong(seq)
+	if multiple {
+		m.octet(1)
+	} else {
+		m.octet(0)
+	}
+	b.send(1, id, m)
+}
+
+func (b *amqpBroker) heartbeat() {
+	var out bytes.Buffer
+	writeAMQPFrame(&out, 8, 0, nil)
+	b.conn.Write(out.Bytes())
+}
+
+func handshakeDone(t *testing.T, writers <-chan *amqpWriter, errs <-chan error) *amqpWriter {
+	t.Helper()
+	select {
+	case a := <-writers:
+		return a
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestAMQPHandshake(t *testing.T) {
+	tests := []struct {
+		url, login, vhost string
+		frameMax          uint32
+		wantMax           int
+	}{
+		{"amqp://app:s3cret@mq/logs", "\x00app\x00s3cret", "logs", 4096, 4096},
+		{"amqp://mq", "\x00guest\x00guest", "/", 0, 128 << 10},
+	}
+	for _, tt := range tests {
+		b, writers, errs := startAMQP(t, tt.url)
+		login, vhost := b.handshake(tt.frameMax)
+		a := handshakeDone(t, writers, errs)
+		if login != tt.login || vhost != tt.vhost {
+			t.Errorf("%s: logged in as %q to %q, want %q to %q", tt.url, login, vhost, tt.login, tt.vhost)
+		}
+		if a.frameMax != tt.wantMax {
+			t.Errorf("%s: frame max %d, want %d", tt.url, a.frameMax, tt.wantMax)
+		}
+	}
+}
+
+func TestAMQPPublishAndConfirm(t *testing.T) {
+	b, writers, errs := startAMQP(t, "amqp://mq")
+	b.handshake(32)
+	a := handshakeDone(t, writers, errs)
+
+	long := "web: a line long enough to take a few body frames"
+	done := make(chan error, 1)
+	go func() {
+		done <- a.writeEvents([]event{{tag: "web", buf: []byte(long + "\n")}, {tag: "db", buf: []byte("db: short\n")}})
+	}()
+	want := []amqpPublish{
+		{"logs", "web", 2, long, 3},
+		{"logs", "db", 2, "db: short", 1},
+	}
+	for i, w := range want {
+		if p := b.publish(); p != w {
+			t.Errorf("message %d = %+v, want %+v", i, p, w)
+		}
+	}
+	// Heartbeats are skipped, and the write waits for every message to be
+	// confirmed.
+	b.heartbeat()
+	b.confirm(amqpBasicAck, 1, false)
+	select {
+	case err := <-done:
+		t.Fatalf("write returned with a message unconfirmed: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.confirm(amqpBasicAck, 2, false)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// An ack with the multiple bit covers the messages before it.
+	go func() {
+		done <- a.writeEvents([]event{{tag: "web", buf: []byte("web: 3\n")}, {tag: "web", buf: []byte("web: 4\n")}})
+	}()
+	b.publish()
+	b.publish()
+	b.confirm(amqpBasicAck, 4, true)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAMQPErrors(t *testing.T) {
+	t.Run("nack", func(t *testing.T) {
+		b, writers, errs := startAMQP(t, "amqp://mq")
+		b.handshake(0)
+		a := handshakeDone(t, writers, errs)
+		done := make(chan error, 1)
+		go func() { done <- a.writeEvents([]event{{tag: "web", buf: []byte("web: one\n")}}) }()
+		b.publish()
+		b.confirm(amqpBasicNack, 1, false)
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "nacked message 1") {
+			t.Errorf("got %v, want a nack error", err)
+		}
+	})
+	t.Run("channel closed", func(t *testing.T) {
+		b, writers, errs := startAMQP(t, "amqp://mq")
+		b.handshake(0)
+		a := handshakeDone(t, writers, errs)
+		done := make(chan error, 1)
+		go func() { done <- a.writeEvents([]event{{tag: "web", buf: []byte("web: one\n")}}) }()
+		b.publish()
+		var m amqpArgs
+		m.short(404)
+		m.shortstr("NOT_FOUND - no exchange 'logs'")
+		m.short(60)
+		m.short(40)
+		b.send(1, amqpChannelClose, m)
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "404 NOT_FOUND - no exchange 'logs'") {
+			t.Errorf("got %v, want the broker's reason", err)
+		}
+	})
+	t.Run("bad login", func(t *testing.T) {
+		b, _, errs := startAMQP(t, "amqp://app:wrong@mq")
+		io.ReadFull(b.in, make([]byte, 8))
+		var m amqpArgs
+		m.octet(0)
+		m.octet(9)
+		m.table(nil)
+		m.longstr("PLAIN")
+		m.longstr("en_US")
+		b.send(0, amqpConnectionStart, m)
+		b.expect(0, amqpConnectionStartOk)
+		m = amqpArgs{}
+		m.short(403)
+		m.shortstr("ACCESS_REFUSED - Login was refused")
+		m.short(0)
+		m.short(0)
+		b.send(0, amqpConnectionClose, m)
+		if err := <-errs; err == nil || !strings.Contains(err.Error(), "403 ACCESS_REFUSED") {
+			t.Errorf("got %v, want the broker's reason", err)
+		}
+	})
+	t.Run("unexpected method", func(t *testing.T) {
+		b, _, errs := startAMQP(t, "amqp://mq")
+		io.ReadFull(b.in, make([]byte, 8))
+		b.send(0, amqpConnectionTune, amqpArgs{0, 0, 0, 0, 0, 0, 0, 0})
+		if err := <-errs; err == nil || !strings.Contains(err.Error(), "expected method 10.10, got 10.30") {
+			t.Errorf("got %v, want an unexpected method error", err)
+		}
+	})
+}
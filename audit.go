@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog is an append-only record of logmux's own actions (connections,
+// streams, exits), kept in the --audit-file as JSON lines. It's for
+// compliance rather than operators, so every entry is synced to disk before
+// we move on. A nil auditLog records nothing.
+type auditLog struct {
+	sync.Mutex
+	f *os.File
+}
+
+// openAudit opens the audit file for appending, creating it if need be.
+func openAudit(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record writes an entry for the given action, with extra string fields
+// given as key, value pairs.
+func (a *auditLog) record(action string, kv ...string) {
+	if a == nil {
+		return
+	}
+	ev := []byte(`{"time":`)
+	ev = append(ev, jsonString([]byte(time.Now().UTC().Format(time.RFC3339Nano)))...)
+	ev = append(ev, `,"action":`...)
+	ev = append(ev, jsonString([]byte(action))...)
+	for i := 0; i+1 < len(kv); i += 2 {
+		ev = append(ev, ',')
+		ev = append(ev, jsonString([]byte(kv[i]))...)
+		ev = append(ev, ':')
+		ev = append(ev, jsonString([]byte(kv[i+1]))...)
+	}
+	ev = append(ev, '}', '\n')
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.f.Write(ev); err == nil {
+		a.f.Sync()
+	}
+}
+
+// redactArgs masks the passwords in the URLs on a command line, like the one
+// in --logstash amqp://<user>:<password>@<hostname>, before it's recorded.
+// Flags given as --flag=value have their value checked.
+func redactArgs(args []string) []string {
+	var ret []string
+	for _, arg := range args {
+		prefix, val := "", arg
+		if i := strings.Index(arg, "="); strings.HasPrefix(arg, "-") && i > 0 {
+			prefix, val = arg[:i+1], arg[i+1:]
+		}
+		if u, err := url.Parse(val); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				arg = prefix + u.Redacted()
+			}
+		}
+		ret = append(ret, arg)
+	}
+	return ret
+}
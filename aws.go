@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsSigner signs requests to an AWS service in a region with Signature
+// Version 4, using the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type awsSigner struct {
+	service, region      string
+	keyID, secret, token string
+}
+
+func newAWSSigner(service, region string) awsSigner {
+	return awsSigner{
+		service: service,
+		region:  region,
+		keyID:   os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:   os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// awsCredentials checks that there are AWS credentials in the environment
+// for the sink that needs them.
+func awsCredentials(sink string) error {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return fmt.Errorf("%s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY set", sink)
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to a request with the given body.
+func (a awsSigner) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	if a.token != "" {
+		req.Header.Set("X-Amz-Security-Token", a.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for _, name := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Target"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = v
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, path, req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, sha256Hex(body))
+
+	scope := date + "/" + a.region + "/" + a.service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical.String()))
+	key := []byte("AWS4" + a.secret)
+	for _, part := range []string{date, a.region, a.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.keyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// beatsAckTimeout is how long we wait on logstash for an ack, full or
+// partial, before giving up on a window. Logstash sends partial acks as
+// keepalives far more often than this while it's working through one.
+var beatsAckTimeout = 30 * time.Second
+
+// beatsWriter speaks the lumberjack v2 protocol that logstash's beats input
+// expects. Each write is sent as one window of JSON frames, compressed, and
+// doesn't return until logstash has acked the whole window, which gives us
+// at-least-once delivery. Plain events are wrapped into JSON, with the line
+// under messageField.
+type beatsWriter struct {
+	sync.Mutex
+	conn         net.Conn
+	acks         *bufio.Reader
+	messageField string
+}
+
+func newBeatsWriter(conn net.Conn, messageField string) *beatsWriter {
+	return &beatsWriter{conn: conn, acks: bufio.NewReader(conn), messageField: messageField}
+}
+
+func openBeats(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	return newBeatsWriter(conn, s.opts.messageField), nil
+}
+
+// writeEvents sends events as a single window, a frame apiece.
+func (b *beatsWriter) writeEvents(evs []event) error {
+	var frames bytes.Buffer
+	for i, ev := range evs {
+		payload := jsonEvent(ev, b.messageField)
+		frames.Write([]byte{'2', 'J'})
+		binary.Write(&frames, binary.BigEndian, uint32(i+1))
+		binary.Write(&frames, binary.BigEndian, uint32(len(payload)))
+		frames.Write(payload)
+	}
+
+	var compressed bytes.Buffer
+	z := zlib.NewWriter(&compressed)
+	z.Write(frames.Bytes())
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	var window bytes.Buffer
+	window.Write([]byte{'2', 'W'})
+	binary.Write(&window, binary.BigEndian, uint32(len(evs)))
+	window.Write([]byte{'2', 'C'})
+	binary.Write(&window, binary.BigEndian, uint32(compressed.Len()))
+	window.Write(compressed.Bytes())
+
+	b.Lock()
+	defer b.Unlock()
+	if _, err := b.conn.Write(window.Bytes()); err != nil {
+		return err
+	}
+	return b.waitForAck(uint32(len(evs)))
+}
+
+// waitForAck reads acks off of the connection until logstash has acked
+// sequence number seq. Logstash sends partial acks as keepalives while it's
+// still working through a window, so each one gives it beatsAckTimeout
+// more. A logstash that goes quiet for longer fails the write, which fails
+// over to the fallback if there is one.
+func (b *beatsWriter) waitForAck(seq uint32) error {
+	defer b.conn.SetReadDeadline(time.Time{})
+	var frame [6]byte
+	for {
+		b.conn.SetReadDeadline(time.Now().Add(beatsAckTimeout))
+		if _, err := io.ReadFull(b.acks, frame[:]); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("no ack from logstash for %s waiting on a window of %d events", beatsAckTimeout, seq)
+			}
+			return err
+		}
+		if frame[0] != '2' || frame[1] != 'A' {
+			return fmt.Errorf("unexpected beats frame from logstash: %q", frame[:2])
+		}
+		if binary.BigEndian.Uint32(frame[2:]) == seq {
+			return nil
+		}
+	}
+}
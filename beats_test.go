@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// beatsFrame is a data frame as a lumberjack v2 server reads it.
+type beatsFrame struct {
+	seq     uint32
+	payload string
+}
+
+// readBeatsWindow reads a window of compressed JSON frames off of conn, as
+// logstash's beats input would.
+func readBeatsWindow(t *testing.T, conn net.Conn) (uint32, []beatsFrame) {
+	t.Helper()
+	var hdr [6]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr[:2]) != "2W" {
+		t.Fatalf("expected a window frame, got %q", hdr[:2])
+	}
+	size := binary.BigEndian.Uint32(hdr[2:])
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr[:2]) != "2C" {
+		t.Fatalf("expected a compressed frame, got %q", hdr[:2])
+	}
+	compressed := make([]byte, binary.BigEndian.Uint32(hdr[2:]))
+	if _, err := io.ReadFull(conn, compressed); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []beatsFrame
+	for {
+		var fh [10]byte
+		if _, err := io.ReadFull(z, fh[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if string(fh[:2]) != "2J" {
+			t.Fatalf("expected a JSON frame, got %q", fh[:2])
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(fh[6:]))
+		if _, err := io.ReadFull(z, payload); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, beatsFrame{binary.BigEndian.Uint32(fh[2:6]), string(payload)})
+	}
+	return size, frames
+}
+
+func beatsAck(conn net.Conn, seq uint32) {
+	var ack [6]byte
+	copy(ack[:], "2A")
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	conn.Write(ack[:])
+}
+
+func TestBeatsFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	b := newBeatsWriter(client, "msg")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.writeEvents([]event{
+			{tag: "app", buf: []byte("{\"level\":\"info\",\"tag\":\"app\"}\n")},
+			{tag: "app", buf: []byte("app: plain \"quoted\" line\n")},
+			{tag: "web.access", buf: []byte("web.access: GET /\n")},
+		})
+	}()
+	size, frames := readBeatsWindow(t, server)
+	want := []beatsFrame{
+		{1, `{"level":"info","tag":"app"}`},
+		{2, `{"msg":"plain \"quoted\" line","tag":"app"}`},
+		{3, `{"msg":"GET /","tag":"web.access"}`},
+	}
+	if size != uint32(len(want)) {
+		t.Errorf("window size = %d, want %d", size, len(want))
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames, want %d: %v", len(frames), len(want), frames)
+	}
+	for i, f := range frames {
+		if f != want[i] {
+			t.Errorf("frame %d = %d %s, want %d %s", i, f.seq, f.payload, want[i].seq, want[i].payload)
+		}
+	}
+	beatsAck(server, 3)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBeatsWaitsForTheWholeWindow(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	b := newBeatsWriter(client, "message")
+
+	for window := 0; window < 2; window++ {
+		done := make(chan error, 1)
+		go func() {
+			done <- b.writeEvents([]event{{tag: "a", buf: []byte("a: 1\n")}, {tag: "a", buf: []byte("a: 2\n")}, {tag: "a", buf: []byte("a: 3\n")}})
+		}()
+		if size, _ := readBeatsWindow(t, server); size != 3 {
+			t.Fatalf("window size = %d, want 3", size)
+		}
+		// Logstash acks what it's done so far as a keepalive while it
+		// works through a window, and that's not the end of it.
+		for _, seq := range []uint32{0, 1, 2} {
+			beatsAck(server, seq)
+			select {
+			case err := <-done:
+				t.Fatalf("write returned after a partial ack of %d: %v", seq, err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		beatsAck(server, 3)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBeatsErrors(t *testing.T) {
+	t.Run("bad frame", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		b := newBeatsWriter(client, "message")
+		done := make(chan error, 1)
+		go func() { done <- b.writeEvents([]event{{tag: "a", buf: []byte("a: 1\n")}}) }()
+		readBeatsWindow(t, server)
+		server.Write([]byte("2X\x00\x00\x00\x01"))
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "unexpected beats frame") {
+			t.Errorf("got %v, want an unexpected frame error", err)
+		}
+	})
+	t.Run("closed before the ack", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		b := newBeatsWriter(client, "message")
+		done := make(chan error, 1)
+		go func() {
+			done <- b.writeEvents([]event{{tag: "a", buf: []byte("a: 1\n")}, {tag: "a", buf: []byte("a: 2\n")}})
+		}()
+		readBeatsWindow(t, server)
+		beatsAck(server, 1)
+		server.Close()
+		if err := <-done; err == nil {
+			t.Error("write succeeded without the whole window acked")
+		}
+	})
+	t.Run("no ack in time", func(t *testing.T) {
+		saved := beatsAckTimeout
+		defer func() { beatsAckTimeout = saved }()
+		beatsAckTimeout = 50 * time.Millisecond
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		b := newBeatsWriter(client, "message")
+		done := make(chan error, 1)
+		go func() {
+			done <- b.writeEvents([]event{{tag: "a", buf: []byte("a: 1\n")}, {tag: "a", buf: []byte("a: 2\n")}})
+		}()
+		readBeatsWindow(t, server)
+		// A partial ack buys logstash more time, but not forever.
+		time.Sleep(30 * time.Millisecond)
+		beatsAck(server, 1)
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "no ack from logstash") {
+				t.Errorf("got %v, want an ack timeout", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("write never gave up on the ack")
+		}
+	})
+}
+
+func TestBeatsAckTimeoutFailsOver(t *testing.T) {
+	saved := beatsAckTimeout
+	defer func() { beatsAckTimeout = saved }()
+	beatsAckTimeout = 50 * time.Millisecond
+	// The primary takes windows but never acks them.
+	silent, fallback := captureTCP(t), captureTCP(t)
+	runMux(t, "--logstash", "beats://"+silent.url().Host, "--logstash-fallback", fallback.url().String(),
+		pipeSpec(t, "app", []string{"one"}))
+	if got := fallback.lines(t, 0, 1); got[0] != "app: one" {
+		t.Errorf("fallback got %q", got)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CloudWatch Logs' limits on a PutLogEvents call and its events, each of
+// which counts for cloudwatchOverhead bytes more than its message, and the
+// longest we hold events for a call before making it.
+const (
+	cloudwatchBatch    = 10000
+	cloudwatchMaxBytes = 1 << 20
+	cloudwatchMaxEvent = 256 << 10
+	cloudwatchOverhead = 26
+	cloudwatchEvery    = time.Second
+)
+
+// cloudwatchAPI ships events to AWS CloudWatch Logs with PutLogEvents calls,
+// for cloudwatch://<region>/<log-group>/<log-stream> URLs. Each event is a
+// log event of its own, timestamped when it's batched. A {tag} in the log
+// stream's name is filled in with the event's tag, so each tag can have a
+// log stream of its own; log streams are created as they're needed, but
+// the log group has to exist.
+type cloudwatchAPI struct {
+	awsSigner
+	group    string
+	stream   string
+	endpoint string
+	client   *http.Client
+
+	// tokens are the sequence tokens to send with the next call for each
+	// log stream. CloudWatch no longer insists on them, but still hands
+	// them out.
+	tokens map[string]string
+}
+
+func openCloudWatch(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	group, stream := cloudwatchNames(s)
+	return newCloudWatchWriter(s.url.Host, group, stream), nil
+}
+
+func newCloudWatchWriter(region, group, stream string) *bulkWriter {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_CLOUDWATCH_LOGS")
+	if endpoint == "" {
+		endpoint = "https://logs." + region + ".amazonaws.com/"
+	}
+	api := &cloudwatchAPI{
+		awsSigner: newAWSSigner("logs", region),
+		group:     group,
+		stream:    stream,
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: time.Minute},
+		tokens:    map[string]string{},
+	}
+	return &bulkWriter{api: api, name: "cloudwatch", size: cloudwatchBatch, maxBytes: cloudwatchMaxBytes, every: cloudwatchEvery}
+}
+
+// cloudwatchNames splits a cloudwatch:// URL's path into its log group,
+// which can have slashes of its own, and its log stream, which is last. A
+// log group that starts with a slash, like /aws/lambda/fn, takes two after
+// the region.
+func cloudwatchNames(s *LogstashService) (string, string) {
+	path := strings.TrimPrefix(s.url.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", ""
+	}
+	return path[:i], path[i+1:]
+}
+
+// checkCloudWatch checks that a cloudwatch:// URL names a region, a log
+// group and a log stream, and that we have credentials to call it with.
+func checkCloudWatch(s *LogstashService) error {
+	if group, stream := cloudwatchNames(s); s.url.Host == "" || group == "" || stream == "" {
+		return fmt.Errorf("bad --logstash value: %s; want cloudwatch://<region>/<log-group>/<log-stream>", s.raw)
+	}
+	return awsCredentials("a cloudwatch:// logstash")
+}
+
+// cloudwatchItem is an event in a batch: the log event, and the log stream
+// it goes to.
+type cloudwatchItem struct {
+	Stream    string `json:"stream"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// item makes an event into a log event for its tag's log stream, dropping
+// it if it's over CloudWatch's limit (or empty, which it doesn't take).
+func (c *cloudwatchAPI) item(ev event, now time.Time) []byte {
+	msg := bytes.TrimSuffix(ev.buf, []byte("\n"))
+	if len(msg) == 0 {
+		return nil
+	}
+	if len(msg)+cloudwatchOverhead > cloudwatchMaxEvent {
+		fmt.Fprintf(os.Stderr, "dropping a %d-byte event that's over CloudWatch Logs' event limit\n", len(msg))
+		return nil
+	}
+	item, err := json.Marshal(cloudwatchItem{
+		Stream:    c.streamFor(ev.tag),
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		Message:   string(msg),
+	})
+	if err != nil {
+		return nil
+	}
+	return item
+}
+
+// streamFor names the log stream for an event from the given tag. Log
+// stream names can't have colons or asterisks in them.
+func (c *cloudwatchAPI) streamFor(tag string) string {
+	tag = strings.Map(func(r rune) rune {
+		if r == ':' || r == '*' {
+			return '_'
+		}
+		return r
+	}, tag)
+	return strings.ReplaceAll(c.stream, "{tag}", tag)
+}
+
+// post sends a PutLogEvents call for each log stream in the batch, in the
+// order they first come up, and returns the events for log streams whose
+// calls were throttled, to be retried. The batch is in the order events
+// were written, so each call's events are in the time order that
+// CloudWatch wants. If a call fails, the events for its log stream and the
+// ones after it are all that's kept, along with any that were throttled,
+// as the ones before it are already in CloudWatch.
+func (c *cloudwatchAPI) post(batch [][]byte) ([][]byte, error) {
+	var streams []string
+	items := map[string][]int{}
+	events := map[string][]cloudwatchItem{}
+	for i, rec := range batch {
+		var item cloudwatchItem
+		if err := json.Unmarshal(rec, &item); err != nil {
+			return nil, err
+		}
+		if _, ok := items[item.Stream]; !ok {
+			streams = append(streams, item.Stream)
+		}
+		items[item.Stream] = append(items[item.Stream], i)
+		events[item.Stream] = append(events[item.Stream], item)
+	}
+	var retry [][]byte
+	for n, stream := range streams {
+		throttled, err := c.put(stream, events[stream])
+		if err != nil {
+			for _, stream := range streams[n:] {
+				for _, i := range items[stream] {
+					retry = append(retry, batch[i])
+				}
+			}
+			return nil, &partialError{err: err, rest: retry}
+		}
+		if throttled {
+			for _, i := range items[stream] {
+				retry = append(retry, batch[i])
+			}
+		}
+	}
+	return retry, nil
+}
+
+// cloudwatchLogEvent is a log event in a PutLogEvents request.
+type cloudwatchLogEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// cloudwatchResponse is the part of a PutLogEvents response, or of an error
+// response, that we look at.
+type cloudwatchResponse struct {
+	NextSequenceToken     string          `json:"nextSequenceToken"`
+	RejectedLogEventsInfo json.RawMessage `json:"rejectedLogEventsInfo"`
+
+	Type                  string `json:"__type"`
+	Message               string `json:"message"`
+	ExpectedSequenceToken string `json:"expectedSequenceToken"`
+}
+
+// errorType is the name of the exception in an error response, without the
+// namespace that it sometimes comes with.
+func (r cloudwatchResponse) errorType() string {
+	return r.Type[strings.LastIndex(r.Type, "#")+1:]
+}
+
+// put sends the events for a log stream in a PutLogEvents call, and returns
+// true if it was throttled. A log stream that doesn't exist yet is created,
+// and a call with the wrong sequence token is made again with the one
+// CloudWatch expects. Events that CloudWatch rejects for their timestamps
+// can't be helped by a retry, so they're dropped with a note on stderr.
+func (c *cloudwatchAPI) put(stream string, items []cloudwatchItem) (bool, error) {
+	events := make([]cloudwatchLogEvent, len(items))
+	for i, item := range items {
+		events[i] = cloudwatchLogEvent{item.Timestamp, item.Message}
+	}
+	created, resequenced := false, false
+	for {
+		req := struct {
+			LogGroupName  string               `json:"logGroupName"`
+			LogStreamName string               `json:"logStreamName"`
+			LogEvents     []cloudwatchLogEvent `json:"logEvents"`
+			SequenceToken string               `json:"sequenceToken,omitempty"`
+		}{c.group, stream, events, c.tokens[stream]}
+		status, r, body, err := c.call("PutLogEvents", req)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusOK {
+			c.tokens[stream] = r.NextSequenceToken
+			if len(r.RejectedLogEventsInfo) > 0 {
+				fmt.Fprintf(os.Stderr, "CloudWatch Logs rejected some events for log stream %s for being too old or too new: %s\n", stream, r.RejectedLogEventsInfo)
+			}
+			return false, nil
+		}
+		switch r.errorType() {
+		case "ThrottlingException", "ServiceUnavailableException":
+			return true, nil
+		case "DataAlreadyAcceptedException":
+			c.tokens[stream] = r.ExpectedSequenceToken
+			return false, nil
+		case "InvalidSequenceTokenException":
+			if !resequenced {
+				c.tokens[stream] = r.ExpectedSequenceToken
+				resequenced = true
+				continue
+			}
+		case "ResourceNotFoundException":
+			if !created {
+				if err := c.createStream(stream); err != nil {
+					return false, err
+				}
+				delete(c.tokens, stream)
+				created = true
+				continue
+			}
+		}
+		return false, fmt.Errorf("cloudwatch PutLogEvents failed: %d: %s", status, bytes.TrimSpace(body))
+	}
+}
+
+// createStream creates a log stream in our log group. One that already
+// exists is fine, as another logmux could have just created it.
+func (c *cloudwatchAPI) createStream(stream string) error {
+	req := struct {
+		LogGroupName  string `json:"logGroupName"`
+		LogStreamName string `json:"logStreamName"`
+	}{c.group, stream}
+	status, r, body, err := c.call("CreateLogStream", req)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK || r.errorType() == "ResourceAlreadyExistsException" {
+		return nil
+	}
+	return fmt.Errorf("cloudwatch CreateLogStream failed: %d: %s", status, bytes.TrimSpace(body))
+}
+
+// call makes a signed call to the CloudWatch Logs API, and returns its
+// status along with its decoded and raw response.
+func (c *cloudwatchAPI) call(action string, args interface{}) (int, cloudwatchResponse, []byte, error) {
+	var r cloudwatchResponse
+	body, err := json.Marshal(args)
+	if err != nil {
+		return 0, r, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, r, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+	c.sign(req, body, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, r, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, r, nil, err
+	}
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		if err := json.Unmarshal(respBody, &r); err != nil {
+			return 0, r, nil, fmt.Errorf("bad cloudwatch %s response: %s", action, err)
+		}
+	}
+	return resp.StatusCode, r, respBody, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCloudWatch is a CloudWatch Logs API with one log group, which answers
+// each PutLogEvents with the next of its scripted exceptions before taking
+// the call. An empty exception in the script takes the call.
+type fakeCloudWatch struct {
+	sync.Mutex
+	group   string
+	streams map[string][]string
+	tokens  map[string]string
+	script  []string
+	calls   []string
+}
+
+func (f *fakeCloudWatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		LogGroupName  string `json:"logGroupName"`
+		LogStreamName string `json:"logStreamName"`
+		SequenceToken string `json:"sequenceToken"`
+		LogEvents     []struct {
+			Message string `json:"message"`
+		} `json:"logEvents"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &req)
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+	f.calls = append(f.calls, action+" "+req.LogStreamName)
+	fail := func(typ, extra string) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazonaws.logs#`+typ+`"`+extra+`}`)
+	}
+	if req.LogGroupName != f.group {
+		fail("ResourceNotFoundException", "")
+		return
+	}
+	switch action {
+	case "CreateLogStream":
+		f.streams[req.LogStreamName] = []string{}
+		io.WriteString(w, `{}`)
+	case "PutLogEvents":
+		if len(f.script) > 0 {
+			typ := f.script[0]
+			f.script = f.script[1:]
+			if typ != "" {
+				fail(typ, "")
+				return
+			}
+		}
+		if _, ok := f.streams[req.LogStreamName]; !ok {
+			fail("ResourceNotFoundException", "")
+			return
+		}
+		if want := f.tokens[req.LogStreamName]; want != "" && req.SequenceToken != want {
+			fail("InvalidSequenceTokenException", `,"expectedSequenceToken":"`+want+`"`)
+			return
+		}
+		for _, ev := range req.LogEvents {
+			f.streams[req.LogStreamName] = append(f.streams[req.LogStreamName], ev.Message)
+		}
+		next := req.LogStreamName + "-" + strconv.Itoa(len(f.streams[req.LogStreamName]))
+		f.tokens[req.LogStreamName] = next
+		io.WriteString(w, `{"nextSequenceToken":"`+next+`"}`)
+	default:
+		http.Error(w, `{"__type":"UnknownOperationException"}`, http.StatusBadRequest)
+	}
+}
+
+// testCloudWatch points a cloudwatch:// sink at a fake CloudWatch Logs API.
+func testCloudWatch(t *testing.T, stream string, script ...string) (*fakeCloudWatch, *cloudwatchAPI) {
+	f := &fakeCloudWatch{group: "app/prod", streams: map[string][]string{}, tokens: map[string]string{}, script: script}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL_CLOUDWATCH_LOGS", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	u, err := url.Parse("cloudwatch://us-east-1/app/prod/" + stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &LogstashService{url: u, raw: u.String()}
+	if err := checkCloudWatch(s); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openCloudWatch(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, w.(*bulkWriter).api.(*cloudwatchAPI)
+}
+
+func cloudwatchItems(c *cloudwatchAPI, evs ...event) [][]byte {
+	var batch [][]byte
+	for _, ev := range evs {
+		batch = append(batch, c.item(ev, time.Now()))
+	}
+	return batch
+}
+
+func TestCloudWatchCreatesStreamsPerTag(t *testing.T) {
+	f, c := testCloudWatch(t, "logmux-{tag}")
+	batch := cloudwatchItems(c,
+		event{tag: "web", buf: []byte("web: one\n")},
+		event{tag: "db:main", buf: []byte("db:main: two\n")},
+		event{tag: "web", buf: []byte("web: three\n")},
+	)
+	retry, err := c.post(batch)
+	if err != nil || len(retry) != 0 {
+		t.Fatalf("post = %d to retry, %v", len(retry), err)
+	}
+	if got := strings.Join(f.streams["logmux-web"], "|"); got != "web: one|web: three" {
+		t.Errorf("logmux-web got %q", got)
+	}
+	if got := strings.Join(f.streams["logmux-db_main"], "|"); got != "db:main: two" {
+		t.Errorf("logmux-db_main got %q", got)
+	}
+	want := "PutLogEvents logmux-web,CreateLogStream logmux-web,PutLogEvents logmux-web," +
+		"PutLogEvents logmux-db_main,CreateLogStream logmux-db_main,PutLogEvents logmux-db_main"
+	if got := strings.Join(f.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestCloudWatchSequenceTokens(t *testing.T) {
+	f, c := testCloudWatch(t, "main")
+	if _, err := c.post(cloudwatchItems(c, event{tag: "app", buf: []byte("one\n")})); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else writes to the log stream, so our token's out of date.
+	f.tokens["main"] = "theirs"
+	if _, err := c.post(cloudwatchItems(c, event{tag: "app", buf: []byte("two\n")})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.post(cloudwatchItems(c, event{tag: "app", buf: []byte("three\n")})); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.streams["main"], "|"); got != "one|two|three" {
+		t.Errorf("main got %q", got)
+	}
+	if n := strings.Count(strings.Join(f.calls, ","), "PutLogEvents"); n != 5 {
+		t.Errorf("%d PutLogEvents calls, want 5 (one retried for a new stream, one for a stale token): %v", n, f.calls)
+	}
+}
+
+func TestCloudWatchThrottling(t *testing.T) {
+	f, c := testCloudWatch(t, "main", "ThrottlingException")
+	f.streams["main"] = []string{}
+	batch := cloudwatchItems(c, event{tag: "app", buf: []byte("one\n")}, event{tag: "app", buf: []byte("two\n")})
+	retry, err := c.post(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retry) != 2 {
+		t.Fatalf("throttled call should retry both events, got %d", len(retry))
+	}
+	if retry, err = c.post(retry); err != nil || len(retry) != 0 {
+		t.Fatalf("retry = %d to retry, %v", len(retry), err)
+	}
+	if got := strings.Join(f.streams["main"], "|"); got != "one|two" {
+		t.Errorf("main got %q", got)
+	}
+}
+
+func TestCloudWatchKeepsOnlyWhatFailed(t *testing.T) {
+	// The second log stream's call fails, after the first's went through.
+	f, c := testCloudWatch(t, "{tag}", "", "InvalidParameterException")
+	f.streams["web"], f.streams["db"], f.streams["app"] = []string{}, []string{}, []string{}
+	w := &bulkWriter{api: c, name: "cloudwatch", size: 10, every: time.Hour}
+	w.writeEvents([]event{
+		{tag: "web", buf: []byte("web one\n")},
+		{tag: "db", buf: []byte("db one\n")},
+		{tag: "web", buf: []byte("web two\n")},
+		{tag: "app", buf: []byte("app one\n")},
+	})
+	if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "InvalidParameterException") {
+		t.Fatalf("got %v, want the failed call's error", err)
+	}
+	if w.count != 2 {
+		t.Errorf("kept %d events, want the 2 for the failed log stream and the one after it", w.count)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"web": "web one|web two", "db": "db one", "app": "app one"}
+	for stream, msgs := range want {
+		if got := strings.Join(f.streams[stream], "|"); got != msgs {
+			t.Errorf("%s got %q, want %q", stream, got, msgs)
+		}
+	}
+}
+
+func TestCloudWatchErrors(t *testing.T) {
+	f, c := testCloudWatch(t, "main")
+	f.group = "other"
+	if _, err := c.post(cloudwatchItems(c, event{tag: "app", buf: []byte("one\n")})); err == nil || !strings.Contains(err.Error(), "CreateLogStream") {
+		t.Errorf("a missing log group should fail creating the log stream, got %v", err)
+	}
+	if item := c.item(event{tag: "app", buf: []byte("\n")}, time.Now()); item != nil {
+		t.Errorf("empty events should be dropped, got %s", item)
+	}
+	big := event{tag: "app", buf: []byte(strings.Repeat("x", cloudwatchMaxEvent))}
+	if item := c.item(big, time.Now()); item != nil {
+		t.Error("events over the limit should be dropped")
+	}
+}
+
+func TestCloudWatchURLs(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	tests := []struct {
+		url           string
+		group, stream string
+	}{
+		{"cloudwatch://us-east-1/app/main", "app", "main"},
+		{"cloudwatch://us-east-1/app/prod/{tag}", "app/prod", "{tag}"},
+		{"cloudwatch://us-east-1//aws/lambda/fn/main", "/aws/lambda/fn", "main"},
+		{"cloudwatch://us-east-1/app", "", ""},
+		{"cloudwatch://us-east-1/app/", "app", ""},
+		{"cloudwatch:///app/main", "app", "main"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		s := &LogstashService{url: u, raw: tt.url}
+		group, stream := cloudwatchNames(s)
+		if group != tt.group || stream != tt.stream {
+			t.Errorf("%s: got %q, %q, want %q, %q", tt.url, group, stream, tt.group, tt.stream)
+		}
+		if err := checkCloudWatch(s); (err == nil) != (u.Host != "" && tt.stream != "") {
+			t.Errorf("%s: check = %v", tt.url, err)
+		}
+	}
+}
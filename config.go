@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configPoll is how often --watch-config checks the --config file, and
+// configSettle is how long it has to have gone unchanged before it's
+// reread, so that we don't read it halfway through being written.
+var (
+	configPoll   = time.Second
+	configSettle = 2 * time.Second
+)
+
+// readConfig reads the stream specifiers in a --config file, one per line.
+// Blank lines, and lines starting with #, are skipped.
+func readConfig(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if seen[line] {
+			return nil, fmt.Errorf("%s: stream %s is in it twice", path, line)
+		}
+		seen[line] = true
+		specs = append(specs, line)
+	}
+	return specs, nil
+}
+
+// reloadConfig rereads the --config file, and reconciles the streams from it
+// with what's in it now: the ones that are gone from it are stopped, once
+// they've written out what they've read, and the new ones are opened, and
+// returned to be run. A stream whose options have changed is both. If the
+// file can't be read, or a new stream is bad or can't be opened, nothing
+// changes. Either way, how it went is noted on stderr and in the audit file.
+func (m *Mux) reloadConfig() []Stream {
+	added, removed, err := m.reconcile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logmux: couldn't reload %s, so keeping the streams we have: %s\n", m.configPath, err)
+		m.audit.record("config_reload_failed", "path", m.configPath, "error", err.Error())
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "logmux: reloaded %s: %d streams started, %d stopped\n", m.configPath, len(added), removed)
+	m.audit.record("config_reload", "path", m.configPath, "started", strconv.Itoa(len(added)), "stopped", strconv.Itoa(removed))
+	return added
+}
+
+// reconcile does the work of reloadConfig, returning the streams it opened,
+// and how many it stopped.
+func (m *Mux) reconcile() ([]Stream, int, error) {
+	specs, err := readConfig(m.configPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	keep := make(map[string]bool)
+	var added []*TailStream
+	var errs []error
+	for _, spec := range specs {
+		keep[spec] = true
+		if m.config[spec] != nil {
+			continue
+		}
+		t, err := m.configStream(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		added = append(added, t)
+	}
+	if len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	for i, t := range added {
+		t.state = m.state
+		t.files = m.files
+		if err := t.Open(); err != nil {
+			for _, opened := range added[:i] {
+				opened.close()
+			}
+			return nil, 0, err
+		}
+		m.audit.record("stream_open", "tag", t.Tag(), "source", t.Raw())
+	}
+
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+	removed := 0
+	for spec, t := range m.config {
+		if !keep[spec] {
+			close(t.removed)
+			delete(m.config, spec)
+			removed++
+		}
+	}
+	running := m.streams[:0]
+	for _, s := range m.streams {
+		if t, ok := s.(*TailStream); !ok || t.removed == nil || m.config[t.raw] == t {
+			running = append(running, s)
+		}
+	}
+	var ret []Stream
+	for _, t := range added {
+		m.config[t.raw] = t
+		running = append(running, t)
+		ret = append(ret, t)
+	}
+	m.streams = running
+	return ret, removed, nil
+}
+
+// watchConfigFile asks for the --config file to be reloaded, on reload, once
+// it's changed and then settled, until stop is closed. A file that's
+// replaced, rather than written to, counts as changed.
+func (m *Mux) watchConfigFile(reload chan<- struct{}, stop <-chan struct{}) {
+	last, _ := os.Stat(m.configPath)
+	var changedAt time.Time
+	tick := time.NewTicker(configPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		fi, err := os.Stat(m.configPath)
+		if err != nil {
+			// It may be in the middle of being replaced.
+			continue
+		}
+		if last == nil || !os.SameFile(fi, last) || fi.ModTime() != last.ModTime() || fi.Size() != last.Size() {
+			last, changedAt = fi, time.Now()
+			continue
+		}
+		if !changedAt.IsZero() && time.Since(changedAt) >= configSettle {
+			changedAt = time.Time{}
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
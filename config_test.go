@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func fastConfig(t *testing.T) {
+	fastTail(t)
+	poll, settle := configPoll, configSettle
+	configPoll, configSettle = 10*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { configPoll, configSettle = poll, settle })
+}
+
+func writeConfig(t *testing.T, path string, specs ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(specs, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runningTags waits for the streams running to have the given tags.
+func runningTags(t *testing.T, m *Mux, want string) {
+	t.Helper()
+	var got []string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		got = nil
+		for _, s := range m.StreamStatuses() {
+			got = append(got, s.Tag)
+		}
+		if strings.Join(got, ",") == want {
+			return
+		}
+	}
+	t.Fatalf("got streams %q, want %q", got, want)
+}
+
+// waitFor waits for a file to have the given text in it.
+func waitFor(t *testing.T, path, want string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if buf, _ := os.ReadFile(path); strings.Contains(string(buf), want) {
+			return
+		}
+	}
+	t.Fatalf("%s never got %q", path, want)
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logmux.conf")
+	writeConfig(t, path, "# app logs", "file:///var/log/a.log:a", "", "  file:///var/log/b.log:b;tail-from=beginning  ")
+	specs, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(specs, "|"); got != "file:///var/log/a.log:a|file:///var/log/b.log:b;tail-from=beginning" {
+		t.Errorf("got %q", got)
+	}
+
+	writeConfig(t, path, "file:///var/log/a.log:a", "file:///var/log/a.log:a")
+	if _, err := readConfig(path); err == nil || !strings.Contains(err.Error(), "twice") {
+		t.Errorf("got %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"--watch-config"},
+		{"--config", path, "--connection-per-stream"},
+		{"--config", filepath.Join(t.TempDir(), "missing.conf")},
+	} {
+		if _, err := parseTestArgs(append([]string{"--logstash", "tcp://localhost:5000"}, args...)...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+	writeConfig(t, path, "0:app")
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--config", path); err == nil || !strings.Contains(err.Error(), "only file:// streams") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	fastConfig(t)
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	cfg, audit := filepath.Join(dir, "logmux.conf"), filepath.Join(dir, "audit.log")
+	appendFile(t, a, "a1\n")
+	appendFile(t, b, "b1\n")
+	writeConfig(t, cfg, "# to start with", "file://"+a+":a")
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--tail-from", "beginning", "--config", cfg, "--watch-config",
+		"--audit-file", audit, "--duration", "2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+	c.lines(t, 0, 1)
+	runningTags(t, m, "a")
+
+	// a is swapped for b, and stops being shipped.
+	writeConfig(t, cfg, "file://"+b+":b")
+	runningTags(t, m, "b")
+	appendFile(t, a, "a2\n")
+	appendFile(t, b, "b2\n")
+	c.lines(t, 0, 3)
+	waitFor(t, audit, `"action":"config_reload","path":`+string(jsonString([]byte(cfg)))+`,"started":"1","stopped":"1"`)
+
+	// A bad stream leaves things as they were.
+	writeConfig(t, cfg, "file://"+b+":b", "file://"+a+":a;bogus=1")
+	waitFor(t, audit, "config_reload_failed")
+	appendFile(t, b, "b3\n")
+	runningTags(t, m, "b")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	want := "a: a1,b: b1,b: b2,b: b3"
+	if got := c.lines(t, 0, 4); strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigReloadOnSIGHUP(t *testing.T) {
+	fastConfig(t)
+	// Nothing's killed by a SIGHUP that logmux isn't listening for yet.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	dir := t.TempDir()
+	a, cfg := filepath.Join(dir, "a.log"), filepath.Join(dir, "logmux.conf")
+	appendFile(t, a, "a1\n")
+	writeConfig(t, cfg)
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--tail-from", "beginning", "--config", cfg, "--duration", "1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+	runningTags(t, m, "")
+
+	// Without --watch-config, it takes a SIGHUP to pick up the change.
+	writeConfig(t, cfg, "file://"+a+":a")
+	time.Sleep(100 * time.Millisecond)
+	runningTags(t, m, "")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	runningTags(t, m, "a")
+	if got := c.lines(t, 0, 1); strings.Join(got, ",") != "a: a1" {
+		t.Errorf("got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Submitter feeds lines into a Mux from a program that embeds logmux,
+// rather than from a stream that logmux reads itself. Each line is tagged
+// and processed as a stream's would be, except that lines aren't joined by
+// multiline-start, or held for --reorder-window.
+//
+// A line can come with an ack, which is called once everything made from
+// it is done with: written to logstash, or for sinks that batch events up,
+// like the bulk APIs, once the batch it went out in was sent. It's called
+// with the error if that failed, or nil, including for a line that made no
+// events, like one that was filtered out. Acks are called in the order that
+// their lines went out, from a goroutine of the Submitter's own, and never
+// with a lock held, so they can submit more lines.
+type Submitter struct {
+	BaseStream
+	m *Mux
+
+	// submitting keeps lines going out in the order they're submitted.
+	submitting sync.Mutex
+
+	// acks are the acks that are due, waiting to be called in order, and
+	// ready is signaled once there are some.
+	sync.Mutex
+	acks  []func()
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// NewSubmitter returns a Submitter for lines with the given tag, which can
+// be followed by ;key=value stream options, as in a stream specifier. The
+// Mux has to have been configured.
+func (m *Mux) NewSubmitter(spec string) (*Submitter, error) {
+	parts := strings.Split(spec, ";")
+	if parts[0] == "" {
+		return nil, errors.New("submitter needs a tag")
+	}
+	s := &Submitter{m: m, ready: make(chan struct{}, 1), done: make(chan struct{})}
+	s.tag, s.raw = parts[0], spec
+	for _, kv := range parts[1:] {
+		if err := s.opts.set(kv); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case s.opts.multilineStart != nil:
+		return nil, errors.New("submitted lines can't take a multiline-start option")
+	case s.opts.tailFrom != "" || s.opts.pathPattern != nil:
+		return nil, errors.New("submitted lines can't take file:// stream options")
+	case s.opts.framing == "raw":
+		return nil, errors.New("submitted lines can't take raw framing")
+	}
+	// Whatever the Submitter doesn't set comes from the global flags, as
+	// for a stream.
+	d := m.defaults
+	if s.opts.format == "" {
+		s.opts.format = d.format
+	}
+	if s.opts.framing == "" {
+		s.opts.framing = "line"
+	}
+	if s.opts.minLineBytes == 0 {
+		s.opts.minLineBytes = d.minLineBytes
+	}
+	if s.opts.recordSeparator == "" {
+		s.opts.recordSeparator = d.recordSeparator
+	}
+	s.opts.retryable = d.retryable
+	s.opts.timestamp = s.opts.timestamp.withDefaults(d.timestamp)
+	s.opts.reconnect = s.opts.reconnect.withDefaults(d.reconnect)
+	if err := s.opts.timestamp.check(); err != nil {
+		return nil, err
+	}
+	s.stats.setState("open")
+	go s.callAcks()
+	return s, nil
+}
+
+// Submit ships a line, with an ack to call once it's done with, if ack
+// isn't nil. It returns the error if the line couldn't be written, which
+// its ack is called with as well.
+func (s *Submitter) Submit(line []byte, ack func(error)) error {
+	s.submitting.Lock()
+	defer s.submitting.Unlock()
+	if ack != nil {
+		user := ack
+		ack = func(err error) { s.queue(func() { user(err) }) }
+	}
+	return s.m.writeLineAck(s, line, time.Now(), ack)
+}
+
+// Flush sends out whatever lines are batched up in the sinks, so that their
+// acks are called.
+func (s *Submitter) Flush() error {
+	return s.m.logstash.Flush()
+}
+
+// Close waits for the acks that are due to be called, and stops the
+// Submitter. Lines that are still batched up in a sink have their acks
+// called once they go out, as long as the Submitter is open; call Flush
+// first to send them.
+func (s *Submitter) Close() {
+	s.queue(nil)
+	<-s.done
+	s.stats.setState("ended")
+}
+
+// queue adds an ack to be called, or nil to stop once the ones before it
+// have been.
+func (s *Submitter) queue(f func()) {
+	s.Lock()
+	s.acks = append(s.acks, f)
+	s.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// callAcks calls acks as they're due, in order, until it's stopped.
+func (s *Submitter) callAcks() {
+	defer close(s.done)
+	for range s.ready {
+		s.Lock()
+		acks := s.acks
+		s.acks = nil
+		s.Unlock()
+		for _, f := range acks {
+			if f == nil {
+				return
+			}
+			f()
+		}
+	}
+}
+
+// Open, Preread and Source make a Submitter a Stream, for the pipeline it
+// sends lines down. It's never read from.
+func (s *Submitter) Open() error {
+	return nil
+}
+
+func (s *Submitter) Preread() error {
+	return nil
+}
+
+func (s *Submitter) Source() *bufio.Reader {
+	return nil
+}
+
+var _ Stream = (*Submitter)(nil)
+
+// ackAfter returns the ack for each of the n events made from one line,
+// which calls the line's ack once they've all been acked, with the first
+// error, if any.
+func ackAfter(n int, ack func(error)) func(error) {
+	var mu sync.Mutex
+	var first error
+	return func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		n--
+		last := n == 0
+		mu.Unlock()
+		if last {
+			ack(first)
+		}
+	}
+}
+
+// ackEvents calls the acks of events that a write is done with, with how it
+// went. Sinks that hold on to events to send later take their acks (leaving
+// nil in their place) and call them once they're sent.
+func ackEvents(evs []event, err error) {
+	for i := range evs {
+		if evs[i].ack != nil {
+			evs[i].ack(err)
+			evs[i].ack = nil
+		}
+	}
+}
+
+// withoutAcks returns a copy of evs for another sink, like a mirror, whose
+// writes the events' acks don't wait on.
+func withoutAcks(evs []event) []event {
+	ret := make([]event, len(evs))
+	for i, ev := range evs {
+		ev.ack = nil
+		ret[i] = ev
+	}
+	return ret
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ackLog records the acks that come in, in order.
+type ackLog struct {
+	sync.Mutex
+	got []string
+}
+
+func (a *ackLog) ack(name string) func(error) {
+	return func(err error) {
+		a.Lock()
+		defer a.Unlock()
+		if err != nil {
+			name += " " + err.Error()
+		}
+		a.got = append(a.got, name)
+	}
+}
+
+func (a *ackLog) String() string {
+	a.Lock()
+	defer a.Unlock()
+	return strings.Join(a.got, ",")
+}
+
+// wait waits for the acks to be as given.
+func (a *ackLog) wait(t *testing.T, want string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if a.String() == want {
+			return
+		}
+	}
+	t.Fatalf("got acks %q, want %q", a.String(), want)
+}
+
+func configuredMux(t *testing.T, args ...string) *Mux {
+	t.Helper()
+	m, err := parseTestArgs(append(args, "--allow-no-streams")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSubmitAcks(t *testing.T) {
+	c := captureTCP(t)
+	m := configuredMux(t, "--logstash", c.url().String(), "--min-line-bytes", "2")
+	sub, err := m.NewSubmitter("app;record-separator=|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acks ackLog
+	for _, line := range []string{"one", "x", "two|three", "", "four"} {
+		if err := sub.Submit([]byte(line), acks.ack(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No ack is fine too.
+	if err := sub.Submit([]byte("five"), nil); err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+	// Lines that make no events, like ones that are too short, are done
+	// with right away, and one split into records is only acked once.
+	if got := acks.String(); got != "one,x,two|three,,four" {
+		t.Errorf("got acks %q", got)
+	}
+	want := []string{"app: one", "app: two", "app: three", "app: four", "app: five"}
+	if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, spec := range []string{"", ";format=json", "app;multiline-start=^x", "app;tail-from=end", "app;bogus=1"} {
+		if _, err := m.NewSubmitter(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestSubmitAcksAfterBatch(t *testing.T) {
+	saved := bulkBackoff
+	defer func() { bulkBackoff = saved }()
+	bulkBackoff = time.Millisecond
+
+	// The first produce is turned away by a partition that's moved.
+	k := newFakeKafka(t, 1, 6)
+	m := configuredMux(t, "--logstash", k.url("logs"), "--kafka-batch-size", "2", "--kafka-linger", "1h")
+	sub, err := m.NewSubmitter("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	var acks ackLog
+	for _, line := range []string{"one", "two", "three"} {
+		if err := sub.Submit([]byte(line), acks.ack(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first two filled a batch, which was retried until it went
+	// through; the third waits for the next one.
+	acks.wait(t, "one,two")
+	if got := len(k.got()); got != 2 {
+		t.Errorf("got %d messages, want 2", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := acks.String(); got != "one,two" {
+		t.Errorf("got acks %q before the flush", got)
+	}
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	acks.wait(t, "one,two,three")
+}
+
+// failingAPI is a bulkAPI that fails every post on the server's end.
+type failingAPI struct{}
+
+func (failingAPI) item(ev event, now time.Time) []byte {
+	return ev.buf
+}
+
+func (failingAPI) post(batch [][]byte) ([][]byte, error) {
+	return nil, &serverError{errors.New("503 Service Unavailable")}
+}
+
+func TestBulkAcks(t *testing.T) {
+	saved := bulkBackoff
+	defer func() { bulkBackoff = saved }()
+	bulkBackoff = time.Millisecond
+
+	var acks ackLog
+	evs := plainEvents("app", "one", "two")
+	for i := range evs {
+		evs[i].ack = acks.ack(fmt.Sprint(i))
+	}
+	w := &bulkWriter{api: failingAPI{}, name: "test", size: 10, every: time.Hour}
+	if err := w.writeEvents(evs); err != nil {
+		t.Fatal(err)
+	}
+	if evs[0].ack != nil || evs[1].ack != nil || acks.String() != "" {
+		t.Fatal("acks weren't taken until the batch was sent")
+	}
+	// A batch that's dropped after failing over and over is done with,
+	// for the error.
+	if err := w.Flush(); err == nil {
+		t.Fatal("no error")
+	}
+	if got := acks.String(); got != "0 503 Service Unavailable,1 503 Service Unavailable" {
+		t.Errorf("got acks %q", got)
+	}
+}
+
+func TestUDPPackerAcks(t *testing.T) {
+	var buf bytes.Buffer
+	var acks ackLog
+	u := &udpPacker{w: &buf, max: 10, every: time.Hour}
+	evs := []event{{buf: []byte("aaaa\n"), ack: acks.ack("a")}, {buf: []byte("bbbb\n"), ack: acks.ack("b")}, {buf: []byte("cc\n"), ack: acks.ack("c")}}
+	if err := u.writeEvents(evs); err != nil {
+		t.Fatal(err)
+	}
+	// The first datagram went once c didn't fit in it.
+	if got := acks.String(); got != "a,b" {
+		t.Errorf("got acks %q", got)
+	}
+	u.Flush()
+	if got := acks.String(); got != "a,b,c" {
+		t.Errorf("got acks %q", got)
+	}
+	ackEvents(evs, errors.New("already acked"))
+	if got := acks.String(); got != "a,b,c" {
+		t.Errorf("acked twice: %q", got)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+)
+
+// utf16Writer transcodes the UTF-8 written to it into UTF-16LE on its way
+// out to w. Each Write must hold whole characters, which is true of the whole
+// events we write.
+type utf16Writer struct {
+	w io.Writer
+}
+
+func (u utf16Writer) Write(buf []byte) (int, error) {
+	units := utf16.Encode([]rune(string(buf)))
+	out := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(out[2*i:], unit)
+	}
+	if _, err := u.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// encodeSink wraps a freshly opened connection to logstash in the output
+// encoding, and writes out a byte order mark if we were asked for one.
+func (s *LogstashService) encodeSink(w io.Writer) (io.Writer, error) {
+	if s.encoding == "utf-16le" {
+		w = utf16Writer{w: w}
+	}
+	if s.bom {
+		if _, err := w.Write([]byte("\uFEFF")); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUTF16Writer(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []byte
+	}{
+		{"hi\n", []byte{'h', 0, 'i', 0, '\n', 0}},
+		{"é", []byte{0xe9, 0}},
+		{"€", []byte{0xac, 0x20}},
+		{"😀", []byte{0x3d, 0xd8, 0x00, 0xde}},
+		{"", []byte{}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		n, err := utf16Writer{w: &buf}.Write([]byte(tt.in))
+		if err != nil || n != len(tt.in) {
+			t.Errorf("%q: wrote %d, %v", tt.in, n, err)
+		}
+		if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%q: got % x, want % x", tt.in, buf.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestBOMOncePerConnection(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		want     []byte
+	}{
+		{"utf-8", "utf-8", []byte("\xef\xbb\xbfapp: one\napp: two\n")},
+		{"utf-16le", "utf-16le", []byte("\xff\xfea\x00p\x00p\x00:\x00 \x00o\x00n\x00e\x00\n\x00a\x00p\x00p\x00:\x00 \x00t\x00w\x00o\x00\n\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			conns := make(chan []byte, 2)
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						buf, _ := io.ReadAll(conn)
+						conns <- buf
+					}()
+				}
+			}()
+
+			u := &url.URL{Scheme: "tcp", Host: ln.Addr().String()}
+			opts := testOptions()
+			l := &LogstashService{url: u, raw: u.String(), opts: &opts, encoding: tt.encoding, bom: true}
+			// Two connections, as when one's closed for being idle
+			// and reopened by the next write, each with a BOM.
+			for i := 0; i < 2; i++ {
+				for _, line := range []string{"one", "two"} {
+					if err := l.Write([]event{{tag: "app", buf: []byte("app: " + line + "\n")}}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				l.Lock()
+				l.close(nil)
+				l.Unlock()
+			}
+			for i := 0; i < 2; i++ {
+				select {
+				case got := <-conns:
+					if !bytes.Equal(got, tt.want) {
+						t.Errorf("connection got % x, want % x", got, tt.want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d connections", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bulkAttempts is how many times we send a bulk request that keeps getting
+// events turned away for being too fast (like Elasticsearch's 429s), or
+// that keeps failing on the server's end, before giving up, and bulkBackoff
+// is how long we wait before the first retry. The wait doubles after each.
+const bulkAttempts = 5
+
+var bulkBackoff = 500 * time.Millisecond
+
+// bulkAPI is somewhere that takes events in batches, like Elasticsearch's
+// bulk API or Firehose.
+type bulkAPI interface {
+	// item turns an event into its entry in a batch, or nil to drop it.
+	item(ev event, now time.Time) []byte
+	// post sends a batch, and returns the entries that were turned away but
+	// are worth retrying. If it fails after part of the batch went out, it
+	// returns a *partialError with what's left.
+	post(batch [][]byte) ([][]byte, error)
+}
+
+// partialError is a bulkAPI's error for a batch that it sent in more than
+// one call, some of which went through before one failed. Only rest is
+// kept to go out again, so the events that made it aren't sent twice.
+type partialError struct {
+	err  error
+	rest [][]byte
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+// serverError is a bulkAPI's error for a batch that failed on the server's
+// end, which sending again later might fix. It's retried with backoff like
+// entries that were turned away, but after bulkAttempts the batch is
+// dropped, so a batch that keeps failing can't hold up the ones behind it.
+type serverError struct {
+	err error
+}
+
+func (e *serverError) Error() string {
+	return e.err.Error()
+}
+
+// bulkWriter batches events up for a bulkAPI until there are size of them
+// (or maxBytes of them, if set), or until every has passed since the first.
+// Events from streams with a higher priority option go into batches ahead
+// of ones that were queued before them from lower-priority streams. Entries
+// that the API turns away are retried with backoff. A batch that can't be
+// sent is kept, to go out ahead of the next one, so with a
+// --logstash-fallback its events can end up delivered twice.
+type bulkWriter struct {
+	api      bulkAPI
+	name     string
+	size     int
+	maxBytes int
+	every    time.Duration
+
+	// posting is held while batches are being sent, so that they go out
+	// one at a time and in order. The lock is only held to add to the batch
+	// or take it, so that writes aren't held up while a send is backing
+	// off, unless they fill another batch. posting is taken first.
+	posting sync.Mutex
+
+	sync.Mutex
+	// retry is what's left of a batch that couldn't be sent, which goes out
+	// before anything else. Everything else is queued by priority, highest
+	// first. A stream only has the one priority, so its events still go
+	// out in order. count and bytes are across all of them.
+	retry  [][]byte
+	queues []bulkQueue
+	count  int
+	bytes  int
+	timer  *time.Timer
+	// acks are the acks of the events that entries were made from, by the
+	// entry's first byte, which the APIs hand back as they are.
+	acks map[*byte]func(error)
+	// err is from a flush in the background, and is returned by the next
+	// write.
+	err error
+}
+
+// bulkQueue is a bulkWriter's queue of entries from streams of one
+// priority.
+type bulkQueue struct {
+	priority int
+	items    [][]byte
+}
+
+// esBulk ships events straight to Elasticsearch's bulk API rather than to
+// logstash, for http:// and https:// URLs like https://es:9200/_bulk. Each
+// event goes into the index that indexFor names for its stream's tag.
+type esBulk struct {
+	url          string
+	user         *url.Userinfo
+	client       *http.Client
+	index        string
+	messageField string
+}
+
+func newESWriter(u *url.URL, config *tls.Config, index, messageField string, size int, every time.Duration) *bulkWriter {
+	target := *u
+	target.User = nil
+	if target.Path == "" || target.Path == "/" {
+		target.Path = "/_bulk"
+	}
+	api := &esBulk{
+		url:          target.String(),
+		user:         u.User,
+		client:       &http.Client{Timeout: time.Minute, Transport: &http.Transport{TLSClientConfig: config}},
+		index:        index,
+		messageField: messageField,
+	}
+	return &bulkWriter{api: api, name: "elasticsearch", size: size, every: every}
+}
+
+// openES makes a sink for the bulk API, which has no connection of our own.
+func openES(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	return newESWriter(s.url, s.tlsConfig, s.esIndex, s.opts.messageField, s.esBatch, s.esEvery), nil
+}
+
+// indexFor names the index for an event from the given tag, by filling in
+// the {tag} and {date} (like 2006.01.02) in the --es-index template.
+// Elasticsearch only takes lowercase index names.
+func (b *esBulk) indexFor(tag string, now time.Time) string {
+	name := strings.ReplaceAll(b.index, "{tag}", tag)
+	name = strings.ReplaceAll(name, "{date}", now.UTC().Format("2006.01.02"))
+	return strings.ToLower(name)
+}
+
+// checkIndex makes sure that the --es-index template names an index that
+// Elasticsearch will take for each of the streams' tags, so that a bad one
+// fails at startup rather than with the first bulk request, which could be
+// a while on a quiet stream.
+func checkIndex(index string, streams []Stream) error {
+	rest := strings.NewReplacer("{tag}", "", "{date}", "").Replace(index)
+	if i := strings.Index(rest, "{"); i >= 0 {
+		end := strings.Index(rest[i:], "}")
+		if end < 0 {
+			return fmt.Errorf("bad --es-index value: %s; unclosed {", index)
+		}
+		return fmt.Errorf("bad --es-index value: %s; %s isn't {tag} or {date}", index, rest[i:i+end+1])
+	}
+	b := &esBulk{index: index}
+	tags := []string{"tag"}
+	if len(streams) > 0 {
+		tags = nil
+		for _, s := range streams {
+			tags = append(tags, s.Tag())
+		}
+	}
+	for _, tag := range tags {
+		name := b.indexFor(tag, time.Now())
+		var why string
+		switch {
+		case name == "":
+			why = "it's empty"
+		case name == "." || name == "..":
+			why = "it's . or .."
+		case len(name) > 255:
+			why = "it's over 255 bytes"
+		case strings.ContainsAny(name[:1], "-_+"):
+			why = "it starts with " + name[:1]
+		case strings.ContainsAny(name, "\\/*?\"<>|, #:"):
+			why = `it has one of \/*?"<>|,#: or a space in it`
+		default:
+			continue
+		}
+		return fmt.Errorf("bad --es-index value: %s; the index for tag %q would be %q, which Elasticsearch won't take, as %s", index, tag, name, why)
+	}
+	return nil
+}
+
+// item makes an event into an index action and its document.
+func (b *esBulk) item(ev event, now time.Time) []byte {
+	action := fmt.Sprintf("{\"index\":{\"_index\":%s}}\n", jsonString([]byte(b.indexFor(ev.tag, now))))
+	return append(append([]byte(action), jsonEvent(ev, b.messageField)...), '\n')
+}
+
+// writeEvents adds events to the batch, and sends it if it's full.
+func (b *bulkWriter) writeEvents(evs []event) error {
+	b.Lock()
+	if err := b.err; err != nil {
+		b.err = nil
+		b.Unlock()
+		return err
+	}
+	now := time.Now()
+	for i, ev := range evs {
+		if item := b.api.item(ev, now); item != nil {
+			b.add(ev.priority, item)
+			if ev.ack != nil {
+				if b.acks == nil {
+					b.acks = map[*byte]func(error){}
+				}
+				b.acks[&item[0]], evs[i].ack = ev.ack, nil
+			}
+		}
+	}
+	full := b.full()
+	b.schedule()
+	b.Unlock()
+	if !full {
+		return nil
+	}
+	return b.send(false)
+}
+
+// add queues an entry from a stream with the given priority. The lock must
+// be held.
+func (b *bulkWriter) add(priority int, item []byte) {
+	i := sort.Search(len(b.queues), func(i int) bool { return b.queues[i].priority <= priority })
+	if i == len(b.queues) || b.queues[i].priority != priority {
+		b.queues = append(b.queues, bulkQueue{})
+		copy(b.queues[i+1:], b.queues[i:])
+		b.queues[i] = bulkQueue{priority: priority}
+	}
+	b.queues[i].items = append(b.queues[i].items, item)
+	b.count++
+	b.bytes += len(item)
+}
+
+// full returns true if the batch is ready to send. The lock must be held.
+func (b *bulkWriter) full() bool {
+	return b.count >= b.size || (b.maxBytes > 0 && b.bytes >= b.maxBytes)
+}
+
+// schedule starts the timer for sending the batch once it's waited long
+// enough, or stops it if there's nothing left to send. The lock must be
+// held.
+func (b *bulkWriter) schedule() {
+	if b.count > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.every, b.flushLater)
+	} else if b.count == 0 && b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// flushLater sends the batch once it's been waiting long enough.
+func (b *bulkWriter) flushLater() {
+	b.Lock()
+	b.timer = nil
+	b.Unlock()
+	if err := b.send(true); err != nil {
+		b.Lock()
+		b.err = err
+		b.Unlock()
+	}
+}
+
+// Flush sends whatever is in the batch, as when we're exiting.
+func (b *bulkWriter) Flush() error {
+	return b.send(true)
+}
+
+// send posts batches off of the front of what's batched up for as long as
+// there's a full one, or until there's nothing left if all is set. If a post
+// fails, its entries go back on the front, to be retried first, and the
+// error is returned.
+func (b *bulkWriter) send(all bool) error {
+	b.posting.Lock()
+	defer b.posting.Unlock()
+	for {
+		b.Lock()
+		batch := b.take(all)
+		b.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		rest, err := b.post(batch)
+		if err != nil {
+			b.Lock()
+			b.retry = append(rest, b.retry...)
+			b.count += len(rest)
+			for _, item := range rest {
+				b.bytes += len(item)
+			}
+			b.schedule()
+			b.Unlock()
+			return err
+		}
+	}
+}
+
+// take takes the next batch to send off of the front of what's batched up:
+// as much as fits in one, if there's a full one or all is set. What's being
+// retried goes first, then the queues from the highest priority down. The
+// lock must be held.
+func (b *bulkWriter) take(all bool) [][]byte {
+	if b.count == 0 || (!all && !b.full()) {
+		return nil
+	}
+	var batch [][]byte
+	taken := 0
+	// from takes entries off of the front of a queue into the batch, and
+	// returns false once the batch can't take any more.
+	from := func(q *[][]byte) bool {
+		for ; len(*q) > 0; *q = (*q)[1:] {
+			item := (*q)[0]
+			if len(batch) == b.size || (b.maxBytes > 0 && len(batch) > 0 && taken+len(item) > b.maxBytes) {
+				return false
+			}
+			batch = append(batch, item)
+			taken += len(item)
+		}
+		return true
+	}
+	if from(&b.retry) {
+		for i := range b.queues {
+			if !from(&b.queues[i].items) {
+				break
+			}
+		}
+	}
+	b.count, b.bytes = b.count-len(batch), b.bytes-taken
+	b.schedule()
+	return batch
+}
+
+// post sends a batch, retrying the entries that the API turns away, and
+// batches that fail on the server's end, with backoff. It returns the
+// entries that didn't make it if it fails.
+func (b *bulkWriter) post(batch [][]byte) ([][]byte, error) {
+	wait := bulkBackoff
+	for attempt := 1; len(batch) > 0; attempt++ {
+		if attempt > 1 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		retry, err := b.api.post(batch)
+		if p, ok := err.(*partialError); ok {
+			b.ack(batch, p.rest, nil)
+			return p.rest, p.err
+		}
+		if _, ok := err.(*serverError); ok {
+			if attempt < bulkAttempts {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "dropping %d events that %s failed to take %d times\n", len(batch), b.name, attempt)
+			b.ack(batch, nil, err)
+			return nil, err
+		}
+		if err != nil {
+			return batch, err
+		}
+		b.ack(batch, retry, nil)
+		batch = retry
+		if len(batch) > 0 && attempt == bulkAttempts {
+			return batch, fmt.Errorf("%s is still turning away %d events after %d attempts", b.name, len(batch), attempt)
+		}
+	}
+	return nil, nil
+}
+
+// ack calls the acks for the entries of a batch that are done with, which
+// are the ones that aren't kept to go out again, with err. Entries that the
+// API dropped for good count as done.
+func (b *bulkWriter) ack(batch, kept [][]byte, err error) {
+	b.Lock()
+	if len(b.acks) == 0 {
+		b.Unlock()
+		return
+	}
+	keep := map[*byte]bool{}
+	for _, item := range kept {
+		keep[&item[0]] = true
+	}
+	var acks []func(error)
+	for _, item := range batch {
+		if ack, ok := b.acks[&item[0]]; ok && !keep[&item[0]] {
+			acks = append(acks, ack)
+			delete(b.acks, &item[0])
+		}
+	}
+	b.Unlock()
+	for _, ack := range acks {
+		ack(err)
+	}
+}
+
+// bulkResponse is the part of a bulk API response that we look at.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// post sends a single bulk request, and returns the events that were turned
+// away with a 429, to be retried. Events that fail for any other reason
+// can't be helped by a retry, so they're dropped with a note on stderr, as
+// is a whole request that gets a 4xx other than a 429. A 5xx is a
+// serverError, to be retried.
+func (b *esBulk) post(batch [][]byte) ([][]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, b.url, bytes.NewReader(bytes.Join(batch, nil)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if b.user != nil {
+		pass, _ := b.user.Password()
+		req.SetBasicAuth(b.user.Username(), pass)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(io.Discard, resp.Body)
+		return batch, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 4 {
+		// The request itself is bad, like a 400 for a malformed document
+		// or a 413 for one that's too big, and will be just as bad again.
+		fmt.Fprintf(os.Stderr, "elasticsearch rejected a bulk request of %d events, which are dropped: %s: %s\n", len(batch), resp.Status, bytes.TrimSpace(body))
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &serverError{fmt.Errorf("elasticsearch bulk request failed: %s: %s", resp.Status, bytes.TrimSpace(body))}
+	}
+	var r bulkResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("bad elasticsearch bulk response: %s", err)
+	}
+	if !r.Errors {
+		return nil, nil
+	}
+	var retry [][]byte
+	dropped := 0
+	var firstErr json.RawMessage
+	for i, item := range r.Items {
+		for _, result := range item {
+			switch {
+			case i >= len(batch) || result.Status/100 == 2:
+			case result.Status == http.StatusTooManyRequests:
+				retry = append(retry, batch[i])
+			default:
+				dropped++
+				if firstErr == nil {
+					firstErr = result.Error
+				}
+			}
+		}
+	}
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "elasticsearch rejected %d events; the first error was: %s\n", dropped, firstErr)
+	}
+	return retry, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeES is an Elasticsearch bulk API that answers each request with the
+// next of its scripted responses, or with success once they run out. A
+// response is a status, and for a 200, the status of each item.
+type fakeES struct {
+	sync.Mutex
+	script   []esReply
+	requests []esRequest
+}
+
+type esReply struct {
+	status int
+	items  []int
+}
+
+// esRequest is a bulk request, as the fake got it.
+type esRequest struct {
+	path, auth, contentType string
+	lines                   []string
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	user, pass, _ := r.BasicAuth()
+	req := esRequest{r.URL.Path, user + ":" + pass, r.Header.Get("Content-Type"), strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")}
+	f.requests = append(f.requests, req)
+	reply := esReply{status: http.StatusOK}
+	if len(f.script) > 0 {
+		reply, f.script = f.script[0], f.script[1:]
+	}
+	if reply.status != http.StatusOK {
+		w.WriteHeader(reply.status)
+		io.WriteString(w, `{"error":"scripted"}`)
+		return
+	}
+	var items []string
+	failed := false
+	for i := 0; i < len(req.lines)/2; i++ {
+		status := http.StatusCreated
+		if i < len(reply.items) {
+			status = reply.items[i]
+		}
+		if status/100 == 2 {
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		} else {
+			failed = true
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"scripted_%d"}}}`, status, status))
+		}
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, failed, strings.Join(items, ","))
+}
+
+// sent returns the documents sent in each request so far, by their message.
+func (f *fakeES) sent(t *testing.T) []string {
+	f.Lock()
+	defer f.Unlock()
+	var ret []string
+	for _, req := range f.requests {
+		var msgs []string
+		for i := 1; i < len(req.lines); i += 2 {
+			msgs = append(msgs, fmt.Sprint(eventField(t, req.lines[i], "message")))
+		}
+		ret = append(ret, strings.Join(msgs, " "))
+	}
+	return ret
+}
+
+// testES points an elasticsearch sink with the given batch size at a fake
+// bulk API.
+func testES(t *testing.T, size int, script ...esReply) (*fakeES, *bulkWriter) {
+	f := &fakeES{script: script}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("elastic", "changeme")
+	return f, newESWriter(u, nil, "logs-{tag}-{date}", "message", size, time.Hour)
+}
+
+func plainEvents(tag string, msgs ...string) []event {
+	var evs []event
+	for _, msg := range msgs {
+		evs = append(evs, event{tag: tag, buf: []byte(tag + ": " + msg + "\n")})
+	}
+	return evs
+}
+
+func TestESIndexFromTag(t *testing.T) {
+	now := time.Date(2024, 1, 2, 23, 0, 0, 0, time.FixedZone("behind", -2*3600))
+	tests := []struct {
+		index, tag, want string
+	}{
+		{"logs-{tag}-{date}", "web", "logs-web-2024.01.03"},
+		{"logs-{tag}", "Web.Access", "logs-web.access"},
+		{"logmux", "web", "logmux"},
+		{"{tag}-{tag}", "db", "db-db"},
+	}
+	for _, tt := range tests {
+		b := &esBulk{index: tt.index, messageField: "message"}
+		if got := b.indexFor(tt.tag, now); got != tt.want {
+			t.Errorf("%s for %s: got %s, want %s", tt.index, tt.tag, got, tt.want)
+		}
+	}
+	b := &esBulk{index: "logs-{tag}", messageField: "msg"}
+	got := string(b.item(event{tag: "web", buf: []byte("web: GET /\n")}, now))
+	if want := "{\"index\":{\"_index\":\"logs-web\"}}\n{\"msg\":\"GET /\",\"tag\":\"web\"}\n"; got != want {
+		t.Errorf("item = %q, want %q", got, want)
+	}
+	got = string(b.item(event{tag: "web", buf: []byte("{\"n\":1,\"tag\":\"web\"}\n")}, now))
+	if want := "{\"index\":{\"_index\":\"logs-web\"}}\n{\"n\":1,\"tag\":\"web\"}\n"; got != want {
+		t.Errorf("item = %q, want %q", got, want)
+	}
+}
+
+func TestESBulkRequests(t *testing.T) {
+	f, w := testES(t, 2)
+	if err := w.writeEvents(plainEvents("web", "one", "two", "three")); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.sent(t); len(got) != 1 || got[0] != "one two" {
+		t.Fatalf("a full batch should go out right away, got %q", got)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.sent(t); len(got) != 2 || got[1] != "three" {
+		t.Fatalf("flush should send the rest, got %q", got)
+	}
+	req := f.requests[0]
+	if req.path != "/_bulk" || req.auth != "elastic:changeme" || req.contentType != "application/x-ndjson" {
+		t.Errorf("request went to %s as %s with %s", req.path, req.auth, req.contentType)
+	}
+	index := fmt.Sprintf(`{"index":{"_index":"logs-web-%s"}}`, time.Now().UTC().Format("2006.01.02"))
+	if req.lines[0] != index {
+		t.Errorf("action %s, want %s", req.lines[0], index)
+	}
+}
+
+func TestESRetriesTooManyRequests(t *testing.T) {
+	// The whole request is turned away, and then one item of it.
+	f, w := testES(t, 3,
+		esReply{status: http.StatusTooManyRequests},
+		esReply{status: http.StatusOK, items: []int{201, 429, 201}},
+	)
+	if err := w.writeEvents(plainEvents("web", "one", "two", "three")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"one two three", "one two three", "two"}
+	if got := f.sent(t); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestESErrors(t *testing.T) {
+	t.Run("server error", func(t *testing.T) {
+		f, w := testES(t, 10, esReply{status: http.StatusInternalServerError})
+		w.writeEvents(plainEvents("web", "one"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.sent(t); strings.Join(got, "|") != "one|one" {
+			t.Errorf("got %q", got)
+		}
+	})
+	t.Run("server errors are only retried so often", func(t *testing.T) {
+		saved := bulkBackoff
+		defer func() { bulkBackoff = saved }()
+		bulkBackoff = time.Millisecond
+		var script []esReply
+		for i := 0; i < bulkAttempts; i++ {
+			script = append(script, esReply{status: http.StatusServiceUnavailable})
+		}
+		f, w := testES(t, 10, script...)
+		w.writeEvents(plainEvents("web", "one"))
+		if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "503") {
+			t.Fatalf("got %v, want the 503", err)
+		}
+		// The batch is dropped, rather than going out ahead of what's
+		// written next.
+		w.writeEvents(plainEvents("web", "two"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.sent(t); len(got) != bulkAttempts+1 || got[0] != "one" || got[bulkAttempts] != "two" {
+			t.Errorf("got %q", got)
+		}
+	})
+	for _, status := range []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge} {
+		t.Run(fmt.Sprintf("%d drops the batch", status), func(t *testing.T) {
+			f, w := testES(t, 10, esReply{status: status})
+			w.writeEvents(plainEvents("web", "bad", "worse"))
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			w.writeEvents(plainEvents("web", "next"))
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.sent(t); strings.Join(got, "|") != "bad worse|next" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+	t.Run("rejected items are dropped", func(t *testing.T) {
+		f, w := testES(t, 10, esReply{status: http.StatusOK, items: []int{400, 201}})
+		w.writeEvents(plainEvents("web", "bad", "good"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		w.writeEvents(plainEvents("web", "next"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.sent(t); strings.Join(got, "|") != "bad good|next" {
+			t.Errorf("got %q", got)
+		}
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		u, _ := url.Parse("http://127.0.0.1:1/_bulk")
+		w := newESWriter(u, nil, "logs", "message", 10, time.Hour)
+		w.writeEvents(plainEvents("web", "one"))
+		if err := w.Flush(); err == nil {
+			t.Error("flush to nowhere succeeded")
+		}
+	})
+}
+
+func TestBadESIndex(t *testing.T) {
+	tests := []struct {
+		index, spec, want string
+	}{
+		{"logs-{host}", "0:app", "{host} isn't {tag} or {date}"},
+		{"logs-{tag", "0:app", "unclosed {"},
+		{"{tag}", "0:_internal", `the index for tag "_internal" would be "_internal"`},
+		{"logs {tag}", "0:app", "or a space in it"},
+		{"logs-{tag}", "0:web/access", `would be "logs-web/access"`},
+		{"{date}" + strings.Repeat("x", 250), "0:app", "over 255 bytes"},
+	}
+	for _, tt := range tests {
+		_, err := parseTestArgs("--logstash", "http://localhost:9200", "--es-index", tt.index, tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s for %s: got %v, want %q", tt.index, tt.spec, err, tt.want)
+		}
+	}
+	for _, index := range []string{"logs-{tag}-{date}", "logmux", ".hidden-{tag}"} {
+		if _, err := parseTestArgs("--logstash", "http://localhost:9200", "--es-index", index, "0:Web.Access"); err != nil {
+			t.Errorf("%s: %s", index, err)
+		}
+	}
+	// It's only an index template for Elasticsearch.
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--es-index", "logs {host}", "0:app"); err != nil {
+		t.Error(err)
+	}
+}
+
+// heldAPI is a bulkAPI that hands over each batch it's sent, and holds the
+// post until it's let go.
+type heldAPI struct {
+	posted  chan [][]byte
+	release chan struct{}
+}
+
+func (a heldAPI) item(ev event, now time.Time) []byte {
+	return ev.buf
+}
+
+func (a heldAPI) post(batch [][]byte) ([][]byte, error) {
+	a.posted <- batch
+	<-a.release
+	return nil, nil
+}
+
+func TestBulkPriority(t *testing.T) {
+	api := heldAPI{posted: make(chan [][]byte, 10), release: make(chan struct{})}
+	w := &bulkWriter{api: api, name: "test", size: 2, every: time.Hour}
+	queued := func(n int) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			w.Lock()
+			count := w.count
+			w.Unlock()
+			if count == n {
+				return
+			}
+		}
+		t.Fatalf("never got %d events queued", n)
+	}
+	debug := func(msgs ...string) []event {
+		var evs []event
+		for _, msg := range msgs {
+			evs = append(evs, event{tag: "debug", buf: []byte(msg)})
+		}
+		return evs
+	}
+
+	done := make(chan error, 3)
+	go func() { done <- w.writeEvents(debug("d1", "d2")) }()
+	if got := <-api.posted; fmt.Sprintf("%s", got) != "[d1 d2]" {
+		t.Fatalf("first batch is %s", got)
+	}
+	// While that's being sent, a backlog of debug lines builds up, and then
+	// errors come in behind them.
+	go func() { done <- w.writeEvents(debug("d3", "d4", "d5", "d6")) }()
+	queued(4)
+	go func() {
+		done <- w.writeEvents([]event{{tag: "error", buf: []byte("e1"), priority: 1}, {tag: "error", buf: []byte("e2"), priority: 1}})
+	}()
+	queued(6)
+	close(api.release)
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for len(api.posted) > 0 {
+		got = append(got, fmt.Sprintf("%s", <-api.posted))
+	}
+	if s := strings.Join(got, " "); s != "[e1 e2] [d3 d4] [d5 d6]" {
+		t.Errorf("got batches %s", s)
+	}
+
+	m, err := parseTestArgs("--logstash", "http://localhost:9200", "0:app;priority=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m.streams[0].Options().priority; p != 2 {
+		t.Errorf("got priority %d", p)
+	}
+	if _, err := parseTestArgs("--logstash", "http://localhost:9200", "0:app;priority=high"); err == nil {
+		t.Error("no error for a bad priority")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// field is a single key and its raw JSON value in a reparsed JSON line.
+// Values are kept raw, so they're re-emitted byte-for-byte; that way large
+// integers never go through a float64.
+type field struct {
+	key string
+	val json.RawMessage
+}
+
+// decodeObject reparses a JSON object line into its fields, keeping their
+// order.
+func decodeObject(buf []byte) ([]field, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	var ret []field
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.New("bad JSON object key")
+		}
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return nil, err
+		}
+		ret = append(ret, field{key: key, val: val})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON object")
+	}
+	return ret, nil
+}
+
+// encodeObject turns fields back into a JSON object.
+func encodeObject(fields []field) []byte {
+	ret := []byte{'{'}
+	for i, f := range fields {
+		if i > 0 {
+			ret = append(ret, ',')
+		}
+		ret = append(ret, jsonString([]byte(f.key))...)
+		ret = append(ret, ':')
+		ret = append(ret, f.val...)
+	}
+	return append(ret, '}')
+}
+
+// findField returns the index of the field with the given key, or -1.
+func findField(fields []field, key string) int {
+	for i, f := range fields {
+		if f.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// fieldMap renames the field "from" to "to" in JSON lines.
+type fieldMap struct {
+	from string
+	to   string
+}
+
+// fieldMaps are the --map-field rules, which can be given more than once.
+type fieldMaps []fieldMap
+
+// We can parse command line flags directly into a fieldMaps value
+var _ flag.Value = (*fieldMaps)(nil)
+
+// Set adds a from=to rule as read in from the command line.
+func (f *fieldMaps) Set(r string) error {
+	parts := strings.SplitN(r, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("bad field mapping %q; want from=to", r)
+	}
+	*f = append(*f, fieldMap{from: parts[0], to: parts[1]})
+	return nil
+}
+
+// String representation of the field mappings
+func (f *fieldMaps) String() string {
+	var parts []string
+	for _, m := range *f {
+		parts = append(parts, m.from+"="+m.to)
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply renames fields, in the order the rules were given. If the target
+// field already exists, then the renamed field overwrites it.
+func (f fieldMaps) apply(fields []field) []field {
+	for _, m := range f {
+		i, j := findField(fields, m.from), findField(fields, m.to)
+		if i < 0 || i == j {
+			continue
+		}
+		fields[i].key = m.to
+		if j >= 0 {
+			fields = append(fields[:j], fields[j+1:]...)
+		}
+	}
+	return fields
+}
+
+// reparse runs the transforms that need a JSON line's fields, rather than
+// just splicing into its text. If the line doesn't decode, it's left as is,
+// unless there are keys to redact, as we can't tell what it would give away.
+// A plain line is only redacted. It returns false if the line should be
+// dropped.
+func (o *Options) reparse(buf []byte, plain bool) ([]byte, bool) {
+	fields, err := decodeObject(buf)
+	if err != nil {
+		return buf, len(o.redactKeys) == 0
+	}
+	fields = o.redact(fields)
+	if plain {
+		return encodeObject(fields), true
+	}
+	fields = o.mapFields.apply(fields)
+	if o.maxFields > 0 && len(fields) > o.maxFields {
+		if o.maxFieldsAction == "drop" {
+			return nil, false
+		}
+		fields = fields[:o.maxFields]
+	}
+	return encodeObject(fields), true
+}
+
+// needsReparse returns true if any transform needs JSON lines reparsed.
+func (o *Options) needsReparse() bool {
+	return len(o.mapFields) > 0 || o.maxFields > 0 || len(o.redactKeys) > 0
+}
+
+// staticFields are the --add-field fields, which can be given more than
+// once.
+type staticFields []field
+
+// We can parse command line flags directly into a staticFields value
+var _ flag.Value = (*staticFields)(nil)
+
+// Set adds a key=value field as read in from the command line. The value is
+// always a string.
+func (f *staticFields) Set(r string) error {
+	parts := strings.SplitN(r, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("bad field %q; want key=value", r)
+	}
+	*f = append(*f, field{key: parts[0], val: jsonString([]byte(parts[1]))})
+	return nil
+}
+
+// String representation of the static fields
+func (f *staticFields) String() string {
+	var parts []string
+	for _, sf := range *f {
+		var val string
+		json.Unmarshal(sf.val, &val)
+		parts = append(parts, sf.key+"="+val)
+	}
+	return strings.Join(parts, ",")
+}
+
+// fieldExtract pulls the first capture group of re out of plain lines, into
+// a field with the given key.
+type fieldExtract struct {
+	re  *regexp.Regexp
+	key string
+}
+
+// fieldExtracts are the --extract-field rules, which can be given more than
+// once.
+type fieldExtracts []fieldExtract
+
+// We can parse command line flags directly into a fieldExtracts value
+var _ flag.Value = (*fieldExtracts)(nil)
+
+// Set adds a pattern=field rule as read in from the command line. The field
+// name comes after the last '=', so the pattern itself can contain '='.
+func (f *fieldExtracts) Set(r string) error {
+	i := strings.LastIndex(r, "=")
+	if i <= 0 || i == len(r)-1 {
+		return fmt.Errorf("bad field extraction %q; want pattern=field", r)
+	}
+	re, err := regexp.Compile(r[:i])
+	if err != nil {
+		return fmt.Errorf("bad field extraction %q: %s", r, err)
+	}
+	if re.NumSubexp() < 1 {
+		return fmt.Errorf("bad field extraction %q: pattern needs a capture group", r)
+	}
+	*f = append(*f, fieldExtract{re: re, key: r[i+1:]})
+	return nil
+}
+
+// String representation of the field extractions
+func (f *fieldExtracts) String() string {
+	var parts []string
+	for _, e := range *f {
+		parts = append(parts, e.re.String()+"="+e.key)
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply runs each extraction over a plain line, and returns the fields it
+// found. If remove is set, then each match is cut out of the returned line.
+func (f fieldExtracts) apply(buf []byte, remove bool) ([]byte, []field) {
+	var ret []field
+	for _, e := range f {
+		m := e.re.FindSubmatchIndex(buf)
+		if m == nil || m[2] < 0 || m[2] == m[3] {
+			continue
+		}
+		ret = append(ret, field{key: e.key, val: jsonString(buf[m[2]:m[3]])})
+		if remove {
+			before := bytes.TrimRight(buf[:m[0]], " \t")
+			after := bytes.TrimLeft(buf[m[1]:], " \t")
+			tmp := append(append([]byte(nil), before...), ' ')
+			buf = bytes.TrimSpace(append(tmp, after...))
+		}
+	}
+	return buf, ret
+}
+
+// jsonEvent makes a processed event into a JSON object, for sinks whose
+// consumers only take JSON. JSON events go as they are. Plain events are
+// wrapped the way --format json would have: the line, without the "tag: "
+// it was prefixed with, goes under the message field, along with the tag.
+func jsonEvent(ev event, messageField string) []byte {
+	buf := bytes.TrimSuffix(ev.buf, []byte("\n"))
+	if looksLikeObject(buf) {
+		return buf
+	}
+	buf = bytes.TrimPrefix(buf, []byte(ev.tag+": "))
+	return []byte(fmt.Sprintf("{%s:%s,\"tag\":%q}", jsonString([]byte(messageField)), jsonString(buf), ev.tag))
+}
+
+// hashField is the --add-hash field for a line: the hex SHA-256 of the
+// stream's tag, a NUL, and the line's content after trimming and
+// normalization. Nothing that varies between replays of a line (like lag or
+// the GELF timestamp) goes into it.
+func hashField(tag string, content []byte) field {
+	h := sha256.New()
+	h.Write([]byte(tag))
+	h.Write([]byte{0})
+	h.Write(content)
+	return field{key: "logmux_hash", val: jsonString([]byte(hex.EncodeToString(h.Sum(nil))))}
+}
+
+// orderEvent rewrites an object event with its top-level fields in the
+// --field-order order: the listed fields first, in the order given, then the
+// rest sorted by key. Plain text events, and events that don't decode, are
+// left as they are.
+func (o *Options) orderEvent(ev []byte) []byte {
+	if !isObjectEvent(ev) {
+		return ev
+	}
+	fields, err := decodeObject(ev[:len(ev)-1])
+	if err != nil {
+		return ev
+	}
+	rank := func(key string) int {
+		for i, k := range o.fieldOrder {
+			if k == key {
+				return i
+			}
+		}
+		return len(o.fieldOrder)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		ri, rj := rank(fields[i].key), rank(fields[j].key)
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == len(o.fieldOrder) && fields[i].key < fields[j].key
+	})
+	return append(encodeObject(fields), ev[len(ev)-1])
+}
+
+// tagSplit splits a stream's dotted tag (or one with another separator) into
+// named fields, for --split-tag.
+type tagSplit struct {
+	sep   string
+	names []string
+
+	// missing is "absent" to leave out fields for components the tag
+	// doesn't have, or "empty" to add them as empty strings.
+	missing string
+}
+
+// We can parse command line flags directly into a tagSplit value
+var _ flag.Value = (*tagSplit)(nil)
+
+// Set the split from a sep=.,fields=a,b,c[,missing=absent|empty] spec as
+// read in from the command line. Everything after fields= up to the next
+// setting is a field name.
+func (t *tagSplit) Set(r string) error {
+	ret := tagSplit{sep: ".", missing: "absent"}
+	inFields := false
+	for _, part := range strings.Split(r, ",") {
+		switch {
+		case strings.HasPrefix(part, "sep="):
+			ret.sep, inFields = strings.TrimPrefix(part, "sep="), false
+		case strings.HasPrefix(part, "missing="):
+			ret.missing, inFields = strings.TrimPrefix(part, "missing="), false
+		case strings.HasPrefix(part, "fields="):
+			ret.names, inFields = []string{strings.TrimPrefix(part, "fields=")}, true
+		case inFields && !strings.Contains(part, "="):
+			ret.names = append(ret.names, part)
+		default:
+			return fmt.Errorf("bad tag split setting %q", part)
+		}
+	}
+	if ret.sep == "" || len(ret.names) == 0 {
+		return fmt.Errorf("bad tag split %q; want sep=.,fields=a,b,c", r)
+	}
+	for _, name := range ret.names {
+		if name == "" {
+			return fmt.Errorf("bad tag split %q: empty field name", r)
+		}
+	}
+	if ret.missing != "absent" && ret.missing != "empty" {
+		return fmt.Errorf("bad tag split %q: missing must be absent or empty", r)
+	}
+	*t = ret
+	return nil
+}
+
+// String representation of the tag split
+func (t *tagSplit) String() string {
+	if len(t.names) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("sep=%s,fields=%s,missing=%s", t.sep, strings.Join(t.names, ","), t.missing)
+}
+
+// fields returns the fields for the given tag. A tag with more components
+// than there are names keeps the rest in the last field.
+func (t *tagSplit) fields(tag string) []field {
+	if len(t.names) == 0 {
+		return nil
+	}
+	parts := strings.SplitN(tag, t.sep, len(t.names))
+	var ret []field
+	for i, name := range t.names {
+		if i < len(parts) {
+			ret = append(ret, field{key: name, val: jsonString([]byte(parts[i]))})
+		} else if t.missing == "empty" {
+			ret = append(ret, field{key: name, val: jsonString(nil)})
+		}
+	}
+	return ret
+}
+
+// jsonFields are the --add-json fields, whose values are arbitrary JSON,
+// which can be given more than once.
+type jsonFields []field
+
+// We can parse command line flags directly into a jsonFields value
+var _ flag.Value = (*jsonFields)(nil)
+
+// Set adds a field=json field as read in from the command line. The JSON is
+// validated and compacted once, here.
+func (f *jsonFields) Set(r string) error {
+	parts := strings.SplitN(r, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("bad JSON field %q; want field=json", r)
+	}
+	var val bytes.Buffer
+	if err := json.Compact(&val, []byte(parts[1])); err != nil {
+		return fmt.Errorf("bad JSON field %q: %s", r, err)
+	}
+	*f = append(*f, field{key: parts[0], val: val.Bytes()})
+	return nil
+}
+
+// String representation of the JSON fields
+func (f *jsonFields) String() string {
+	var parts []string
+	for _, jf := range *f {
+		parts = append(parts, jf.key+"="+string(jf.val))
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactedValue replaces the value of a masked key.
+var redactedValue = json.RawMessage(`"[REDACTED]"`)
+
+// redactKey masks or removes the field at the given dotted path, like
+// headers.authorization, where each step but the last is a nested object.
+// Every field with a matching key is redacted, as a line with the key twice
+// would otherwise ship the second one as it is.
+func redactKey(fields []field, path []string, remove bool) []field {
+	ret := fields[:0]
+	for _, f := range fields {
+		if f.key == path[0] {
+			if len(path) > 1 {
+				if nested, err := decodeObject(f.val); err == nil {
+					f.val = encodeObject(redactKey(nested, path[1:], remove))
+				}
+			} else if remove {
+				continue
+			} else {
+				f.val = redactedValue
+			}
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// redactJSON redacts the --redact-json-keys fields from a JSON object line,
+// for when it's shipped in some other form, like --include-raw's raw field.
+func (o *Options) redactJSON(buf []byte) []byte {
+	fields, err := decodeObject(buf)
+	if err != nil || len(o.redactKeys) == 0 {
+		return buf
+	}
+	return encodeObject(o.redact(fields))
+}
+
+// redact masks or removes each of the --redact-json-keys fields.
+func (o *Options) redact(fields []field) []field {
+	for _, path := range o.redactKeys {
+		fields = redactKey(fields, path, o.redactRemove)
+	}
+	return fields
+}
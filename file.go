@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// fileSink appends events to a file, for file:///<path> URLs, as for a local
+// archive kept alongside what goes to logstash. Once the next event would
+// take the file past maxBytes, it's rotated: renamed to <path>.1, with the
+// older ones shifted along to <path>.2 and so on, keeping backups of them,
+// and a new file is started. Events are never split across files.
+type fileSink struct {
+	s        *LogstashService
+	path     string
+	maxBytes int64
+	backups  int
+
+	f    *os.File
+	w    io.Writer
+	size int64
+}
+
+func openFile(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	f := &fileSink{s: s, path: s.url.Path, maxBytes: s.fileMaxBytes, backups: s.fileBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// checkFile checks that a file:// URL is a path on this host.
+func checkFile(s *LogstashService) error {
+	if (s.url.Host != "" && s.url.Host != "localhost") || s.url.Path == "" {
+		return fmt.Errorf("bad --logstash value: %s; want file:///<path>", s.raw)
+	}
+	return nil
+}
+
+// open opens the file to append to, and picks up its size.
+func (f *fileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w, err := f.s.encodeSink(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.w, f.size = file, w, fi.Size()
+	return nil
+}
+
+// rotate closes the file, shifts it along with its backups, and opens a
+// new one. If the shift fails, as on a full disk, the old file is opened
+// again, to be rotated with the next write.
+func (f *fileSink) rotate() error {
+	f.f.Close()
+	err := f.shift()
+	if oerr := f.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// shift renames the file to <path>.1, and its backups each one along, with
+// the oldest falling off the end. With no backups, the file is just started
+// over.
+func (f *fileSink) shift() error {
+	if f.backups == 0 {
+		return os.Truncate(f.path, 0)
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *fileSink) writeEvents(evs []event) error {
+	var buf []byte
+	for _, ev := range evs {
+		pending := f.size + int64(len(buf))
+		if f.maxBytes > 0 && pending > 0 && pending+int64(len(ev.buf)) > f.maxBytes {
+			if err := f.write(buf); err != nil {
+				return err
+			}
+			buf = nil
+			if err := f.rotate(); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, ev.buf...)
+	}
+	return f.write(buf)
+}
+
+// write appends bytes to the file.
+func (f *fileSink) write(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := f.w.Write(buf); err != nil {
+		return err
+	}
+	f.size += int64(len(buf))
+	return nil
+}
+
+// Flush makes sure that what's been written is on disk, as we're exiting.
+// Files that can't be synced, like devices, are left be.
+func (f *fileSink) Flush() error {
+	if err := f.f.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
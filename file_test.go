@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "<none>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups int
+		writes  [][]string
+		want    []string // the file, then its backups, newest first
+	}{
+		{
+			name:    "no rotation needed",
+			backups: 2,
+			writes:  [][]string{{"one", "two"}},
+			want:    []string{"one\ntwo\n", "<none>"},
+		},
+		{
+			name:    "rotates between events",
+			backups: 2,
+			writes:  [][]string{{"aaaaa", "bbbbb", "ccccc"}, {"ddddd"}},
+			want:    []string{"ccccc\nddddd\n", "aaaaa\nbbbbb\n", "<none>"},
+		},
+		{
+			name:    "oldest backups fall off",
+			backups: 2,
+			writes:  [][]string{{"aaaaaaaaaa"}, {"bbbbbbbbbb"}, {"cccccccccc"}, {"dddddddddd"}},
+			want:    []string{"dddddddddd\n", "cccccccccc\n", "bbbbbbbbbb\n", "<none>"},
+		},
+		{
+			name:    "an oversized event gets a file of its own",
+			backups: 1,
+			writes:  [][]string{{"one", strings.Repeat("x", 20), "two"}},
+			want:    []string{"two\n", strings.Repeat("x", 20) + "\n", "<none>"},
+		},
+		{
+			name:    "no backups",
+			backups: 0,
+			writes:  [][]string{{"aaaaaaaaaa"}, {"bbbbbbbbbb"}},
+			want:    []string{"bbbbbbbbbb\n", "<none>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "archive.log")
+			s := &LogstashService{fileMaxBytes: 16, fileBackups: tt.backups}
+			f := &fileSink{s: s, path: path, maxBytes: s.fileMaxBytes, backups: s.fileBackups}
+			if err := f.open(); err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if err := f.writeEvents(udpEvents(w...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readFile(t, path); got != tt.want[0] {
+				t.Errorf("got %q in the file, want %q", got, tt.want[0])
+			}
+			for i, want := range tt.want[1:] {
+				if got := readFile(t, path+"."+string(rune('1'+i))); got != want {
+					t.Errorf("got %q in backup %d, want %q", got, i+1, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.log")
+	if err := os.WriteFile(path, []byte("before\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runMux(t, "--logstash", "file://"+path, pipeSpec(t, "app", []string{"one", `{"n":2}`}))
+	if got := readFile(t, path); got != "before\napp: one\n{\"n\":2,\"tag\":\"app\"}\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBroadcastToTCPAndFile(t *testing.T) {
+	c := captureTCP(t)
+	path := filepath.Join(t.TempDir(), "archive.log")
+	runMux(t, "--logstash", c.url().String(), "--logstash", "file://"+path,
+		pipeSpec(t, "app", []string{"one", "two", "three"}))
+	if got := strings.Join(c.lines(t, 0, 3), ","); got != "app: one,app: two,app: three" {
+		t.Errorf("logstash got %q", got)
+	}
+	if got := readFile(t, path); got != "app: one\napp: two\napp: three\n" {
+		t.Errorf("file got %q", got)
+	}
+}
+
+func TestFullDiskDoesNotStopTheOthers(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to stand in for a full disk")
+	}
+	c := captureTCP(t)
+	runMux(t, "--logstash", "file:///dev/full", "--logstash", c.url().String(),
+		pipeSpec(t, "app", []string{"one", "two", "three"}))
+	if got := strings.Join(c.lines(t, 0, 3), ","); got != "app: one,app: two,app: three" {
+		t.Errorf("logstash got %q", got)
+	}
+
+	m, err := parseTestArgs("--logstash", "file:///dev/full", pipeSpec(t, "app", []string{"one"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err == nil {
+		t.Error("writing only to a full disk: no error")
+	}
+}
+
+func TestBadFileSink(t *testing.T) {
+	for _, args := range [][]string{
+		{"--logstash", "file://somehost/archive.log"},
+		{"--logstash", "file://"},
+		{"--logstash", "file:///tmp/archive.log", "--file-max-bytes", "-1"},
+		{"--logstash", "file:///tmp/archive.log", "--file-backups", "-1"},
+	} {
+		if _, err := parseTestArgs(append(args, "0:app")...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Firehose's limits on a PutRecordBatch call and its records, and the
+// longest we hold records for a call before making it.
+const (
+	firehoseBatch     = 500
+	firehoseMaxBytes  = 4 << 20
+	firehoseMaxRecord = 1000 << 10
+	firehoseEvery     = time.Second
+)
+
+// firehoseAPI ships events to an AWS Kinesis Data Firehose delivery stream
+// with PutRecordBatch calls, for firehose://<delivery-stream> URLs. Each
+// event is a record of its own, newline-terminated so that they stay apart
+// once Firehose strings them together into an S3 object. Credentials come
+// from the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type firehoseAPI struct {
+	awsSigner
+	stream   string
+	endpoint string
+	client   *http.Client
+}
+
+func newFirehoseWriter(stream, region string) *bulkWriter {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_FIREHOSE")
+	if endpoint == "" {
+		endpoint = "https://firehose." + region + ".amazonaws.com/"
+	}
+	api := &firehoseAPI{
+		awsSigner: newAWSSigner("firehose", region),
+		stream:    stream,
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	return &bulkWriter{api: api, name: "firehose", size: firehoseBatch, maxBytes: firehoseMaxBytes, every: firehoseEvery}
+}
+
+func openFirehose(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	return newFirehoseWriter(s.url.Host, s.firehoseRegion), nil
+}
+
+// checkFirehose checks that a firehose:// URL names a delivery stream, and
+// that we have what we need to call Firehose.
+func checkFirehose(s *LogstashService) error {
+	if s.url.Host == "" {
+		return fmt.Errorf("bad --logstash value: %s; want firehose://<delivery-stream>", s.raw)
+	}
+	return firehoseCredentials(s.firehoseRegion)
+}
+
+// firehoseCredentials checks that there are AWS credentials in the
+// environment, and that we know the region.
+func firehoseCredentials(region string) error {
+	if region == "" {
+		return errors.New("a firehose:// logstash needs --firehose-region or AWS_REGION")
+	}
+	return awsCredentials("a firehose:// logstash")
+}
+
+// item makes an event into a record, dropping it if it's over Firehose's
+// limit.
+func (f *firehoseAPI) item(ev event, now time.Time) []byte {
+	rec := bytes.TrimSuffix(ev.buf, []byte("\n"))
+	if len(rec)+1 > firehoseMaxRecord {
+		fmt.Fprintf(os.Stderr, "dropping a %d-byte event that's over Firehose's record limit\n", len(rec))
+		return nil
+	}
+	return append(append([]byte(nil), rec...), '\n')
+}
+
+// firehoseRecord is a record in a PutRecordBatch request; encoding/json
+// base64s its data for us.
+type firehoseRecord struct {
+	Data []byte `json:"Data"`
+}
+
+// firehoseResponse is the part of a PutRecordBatch response that we look at.
+type firehoseResponse struct {
+	FailedPutCount   int `json:"FailedPutCount"`
+	RequestResponses []struct {
+		ErrorCode    string `json:"ErrorCode"`
+		ErrorMessage string `json:"ErrorMessage"`
+	} `json:"RequestResponses"`
+}
+
+// post sends a single PutRecordBatch call, and returns the records that
+// failed, to be retried. Firehose only fails records for being throttled or
+// for its own internal errors, so they're all worth another try, as is the
+// whole batch if the call was throttled.
+func (f *firehoseAPI) post(batch [][]byte) ([][]byte, error) {
+	records := make([]firehoseRecord, len(batch))
+	for i, rec := range batch {
+		records[i].Data = rec
+	}
+	body, err := json.Marshal(struct {
+		DeliveryStreamName string           `json:"DeliveryStreamName"`
+		Records            []firehoseRecord `json:"Records"`
+	}{f.stream, records})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Firehose_20150804.PutRecordBatch")
+	f.sign(req, body, time.Now())
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if bytes.Contains(respBody, []byte("ServiceUnavailableException")) || bytes.Contains(respBody, []byte("ThrottlingException")) {
+			return batch, nil
+		}
+		return nil, fmt.Errorf("firehose PutRecordBatch failed: %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	var r firehoseResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("bad firehose PutRecordBatch response: %s", err)
+	}
+	if r.FailedPutCount == 0 {
+		return nil, nil
+	}
+	var retry [][]byte
+	for i, result := range r.RequestResponses {
+		if i < len(batch) && result.ErrorCode != "" {
+			retry = append(retry, batch[i])
+		}
+	}
+	return retry, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFirehose is a Firehose API with one delivery stream. It answers each
+// PutRecordBatch call with the next of its scripted outcomes: "" to take
+// every record, "fail-first" to fail the first record of the batch, or an
+// exception's name to fail the whole call.
+type fakeFirehose struct {
+	sync.Mutex
+	stream  string
+	records []string
+	script  []string
+	calls   int
+}
+
+func (f *fakeFirehose) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls++
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-Amz-Target") != "Firehose_20150804.PutRecordBatch" {
+		http.Error(w, `{"__type":"UnknownOperationException"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		DeliveryStreamName string
+		Records            []struct{ Data []byte }
+	}
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &req)
+	if req.DeliveryStreamName != f.stream {
+		http.Error(w, `{"__type":"ResourceNotFoundException"}`, http.StatusBadRequest)
+		return
+	}
+	outcome := ""
+	if len(f.script) > 0 {
+		outcome, f.script = f.script[0], f.script[1:]
+	}
+	switch outcome {
+	case "":
+	case "fail-first":
+		for _, rec := range req.Records[1:] {
+			f.records = append(f.records, string(rec.Data))
+		}
+		resp := `{"FailedPutCount":1,"RequestResponses":[{"ErrorCode":"ServiceUnavailableException"}`
+		resp += strings.Repeat(`,{"RecordId":"x"}`, len(req.Records)-1) + `]}`
+		io.WriteString(w, resp)
+		return
+	default:
+		http.Error(w, `{"__type":"`+outcome+`"}`, http.StatusBadRequest)
+		return
+	}
+	for _, rec := range req.Records {
+		f.records = append(f.records, string(rec.Data))
+	}
+	io.WriteString(w, `{"FailedPutCount":0}`)
+}
+
+// testFirehose points a firehose:// sink at a fake Firehose API.
+func testFirehose(t *testing.T, script ...string) (*fakeFirehose, *firehoseAPI) {
+	f := &fakeFirehose{stream: "logs", script: script}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL_FIREHOSE", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	u, err := url.Parse("firehose://logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &LogstashService{url: u, raw: u.String(), firehoseRegion: "us-east-1"}
+	if err := checkFirehose(s); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openFirehose(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, w.(*bulkWriter).api.(*firehoseAPI)
+}
+
+func firehoseItems(f *firehoseAPI, lines ...string) [][]byte {
+	var batch [][]byte
+	for _, l := range lines {
+		batch = append(batch, f.item(event{tag: "app", buf: []byte(l + "\n")}, time.Now()))
+	}
+	return batch
+}
+
+func TestFirehosePost(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    []string
+		wantRetry []string
+		wantErr   string
+		records   []string
+	}{
+		{"taken", nil, nil, "", []string{"one\n", "two\n"}},
+		{"a failed record", []string{"fail-first"}, []string{"one\n"}, "", []string{"two\n"}},
+		{"throttled", []string{"ThrottlingException"}, []string{"one\n", "two\n"}, "", nil},
+		{"unavailable", []string{"ServiceUnavailableException"}, []string{"one\n", "two\n"}, "", nil},
+		{"other errors", []string{"InvalidArgumentException"}, nil, "InvalidArgumentException", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, api := testFirehose(t, tt.script...)
+			retry, err := api.post(firehoseItems(api, "one", "two"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rec := range retry {
+				got = append(got, string(rec))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.wantRetry, "|") {
+				t.Errorf("retry %q, want %q", got, tt.wantRetry)
+			}
+			if strings.Join(f.records, "|") != strings.Join(tt.records, "|") {
+				t.Errorf("delivered %q, want %q", f.records, tt.records)
+			}
+		})
+	}
+}
+
+func TestFirehoseRetriesThroughBulkWriter(t *testing.T) {
+	saved := bulkBackoff
+	bulkBackoff = time.Millisecond
+	defer func() { bulkBackoff = saved }()
+	f, api := testFirehose(t, "fail-first", "ThrottlingException")
+	w := &bulkWriter{api: api, name: "firehose", size: 10, every: time.Hour}
+	w.writeEvents([]event{{tag: "app", buf: []byte("app: one\n")}, {tag: "app", buf: []byte("app: two\n")}})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.records, "|"); got != "app: two\n|app: one\n" {
+		t.Errorf("delivered %q", got)
+	}
+}
+
+func TestFirehoseChecks(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	tests := []struct {
+		url    string
+		region string
+		ok     bool
+	}{
+		{"firehose://logs", "us-east-1", true},
+		{"firehose://", "us-east-1", false},
+		{"firehose://logs", "", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		s := &LogstashService{url: u, raw: tt.url, firehoseRegion: tt.region}
+		if err := checkFirehose(s); (err == nil) != tt.ok {
+			t.Errorf("%s in %q: check = %v", tt.url, tt.region, err)
+		}
+	}
+	_, api := testFirehose(t)
+	if item := api.item(event{tag: "app", buf: []byte(strings.Repeat("x", firehoseMaxRecord))}, time.Now()); item != nil {
+		t.Error("records over the limit should be dropped")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// gelfField maps a field name from a JSON line to the name of a GELF
+// additional field, which must start with an underscore and only contain
+// word characters, dots and dashes. GELF reserves _id, so id becomes _id_.
+func gelfField(key string) string {
+	if key == "id" {
+		return "_id_"
+	}
+	ret := []byte("_" + key)
+	for i, c := range ret {
+		ok := c == '_' || c == '.' || c == '-' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !ok {
+			ret[i] = '_'
+		}
+	}
+	return string(ret)
+}
+
+// gelfEvent shapes a trimmed line into a GELF 1.1 message for Graylog,
+// terminated by the NUL byte that GELF's TCP framing expects. The tag goes in
+// _tag. For JSON lines, a string --message-field field becomes the
+// short_message and the other fields become additional fields; otherwise the
+// whole line is the short_message.
+func (o *Options) gelfEvent(buf []byte, tag string) []byte {
+	msg := make(map[string]interface{})
+	var fields map[string]json.RawMessage
+	if looksLikeObject(buf) && json.Unmarshal(buf, &fields) == nil {
+		for k, v := range fields {
+			var str string
+			if k == o.messageField && json.Unmarshal(v, &str) == nil {
+				msg["short_message"] = str
+			} else {
+				msg[gelfField(k)] = v
+			}
+		}
+	}
+	if _, ok := msg["short_message"]; !ok {
+		msg["short_message"] = string(buf)
+	}
+	msg["version"] = "1.1"
+	msg["host"] = o.host
+	msg["timestamp"] = float64(time.Now().UnixNano()/int64(time.Millisecond)) / 1000
+	msg["_tag"] = tag
+	ret, _ := json.Marshal(msg)
+	return append(ret, 0)
+}
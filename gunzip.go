@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipReader reads a pipe that might be gzipped, decompressing it if it
+// starts with the gzip magic. It doesn't look until the first Read, so that
+// opening a pipe never blocks waiting for data.
+type gunzipReader struct {
+	src io.Reader
+	r   io.Reader
+}
+
+// sniffGzip returns a reader that transparently decompresses src if it turns
+// out to be gzipped, and otherwise passes it through as is.
+func sniffGzip(src io.Reader) io.Reader {
+	return &gunzipReader{src: src}
+}
+
+// Read sniffs the first read for the gzip magic. Only a first byte that
+// could start it makes us wait for a second one, so a writer that sends a
+// single byte of plain text and then waits isn't held up.
+func (g *gunzipReader) Read(buf []byte) (int, error) {
+	if g.r == nil {
+		br := bufio.NewReader(g.src)
+		g.r = br
+		if first, err := br.Peek(1); err == nil && first[0] == gzipMagic[0] {
+			if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+				zr, err := gzip.NewReader(br)
+				if err != nil {
+					return 0, err
+				}
+				g.r = zr
+			}
+		}
+	}
+	return g.r.Read(buf)
+}
+
+// decompress wraps a stream's source to be gunzipped if it turns out to be
+// gzipped, for line framing. Other framings are binary, and a raw stream's
+// bytes have to be passed through exactly as they are, gzip or not.
+func (b *BaseStream) decompress(src io.Reader) io.Reader {
+	if b.opts.framing != "line" {
+		return src
+	}
+	return sniffGzip(src)
+}
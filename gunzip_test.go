@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffGzip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"plain", []byte("one\ntwo\n"), "one\ntwo\n"},
+		{"gzipped", gzipped(t, "one\ntwo\n"), "one\ntwo\n"},
+		{"one byte", []byte("x"), "x"},
+		{"magic's first byte only", []byte{0x1f, 'x'}, "\x1fx"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := io.ReadAll(sniffGzip(bytes.NewReader(tt.in)))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSniffGzipDoesNotWaitForASecondByte(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("x"))
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := sniffGzip(r).Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case s := <-got:
+		if s != "x" {
+			t.Errorf("got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read blocked after a single byte")
+	}
+}
+
+func TestRawFramingPassesGzipThrough(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The stream's bytes come over a connection of their own, so the one
+	// that has any is the one we want.
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if buf, _ := io.ReadAll(conn); len(buf) > 0 {
+					got <- buf
+				}
+			}()
+		}
+	}()
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	want := gzipped(t, "one\ntwo\n")
+	w := os.NewFile(uintptr(fds[1]), "pipe")
+	go func() {
+		defer w.Close()
+		w.Write(want)
+	}()
+	runMux(t, "--logstash", "tcp://"+ln.Addr().String(), "--connection-per-stream", fmt.Sprintf("%d:app;framing=raw", fds[0]))
+	select {
+	case buf := <-got:
+		if !bytes.Equal(buf, want) {
+			t.Errorf("got %q, want the gzipped bytes %q", buf, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing relayed")
+	}
+}
+
+// rawPipeSpec is pipeSpec for bytes that aren't lines of text.
+func rawPipeSpec(t *testing.T, tag string, buf []byte) string {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	w := os.NewFile(uintptr(fds[1]), "pipe")
+	go func() {
+		defer w.Close()
+		w.Write(buf)
+	}()
+	return fmt.Sprintf("%d:%s", fds[0], tag)
+}
+
+func TestGzippedAndPlainPipesTogether(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"gzipped", gzipped(t, "one\ntwo\n"), "gz: one,gz: two"},
+		{"plain", []byte("three\nfour\n"), "plain: three,plain: four"},
+		{"gzipped, one line", gzipped(t, "five\n"), "gz1: five"},
+		{"plain, starting with 0x1f", []byte("\x1fsix\n"), "plain1: \x1fsix"},
+	}
+	tags := []string{"gz", "plain", "gz1", "plain1"}
+	c := captureTCP(t)
+	args := []string{"--logstash", c.url().String()}
+	for i, tt := range tests {
+		args = append(args, rawPipeSpec(t, tags[i], tt.in))
+	}
+	runMux(t, args...)
+
+	got := map[string][]string{}
+	for _, l := range c.lines(t, 0, 6) {
+		tag := l[:strings.Index(l, ":")]
+		got[tag] = append(got[tag], l)
+	}
+	for i, tt := range tests {
+		if s := strings.Join(got[tags[i]], ","); s != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, s, tt.want)
+		}
+	}
+}
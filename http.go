@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// StreamStatus is a snapshot of an incoming log stream, as served by the
+// /streams endpoint.
+type StreamStatus struct {
+	Tag      string     `json:"tag"`
+	Spec     string     `json:"spec"`
+	State    string     `json:"state"`
+	Lines    int64      `json:"lines"`
+	Dropped  int64      `json:"dropped"`
+	Rejected int64      `json:"rejected_connections,omitempty"`
+	LastLine *time.Time `json:"last_line,omitempty"`
+}
+
+// StreamStatuses returns a snapshot of all of the incoming log streams. It's
+// safe to call while the streams are running.
+func (m *Mux) StreamStatuses() []StreamStatus {
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+	ret := make([]StreamStatus, 0, len(m.streams))
+	for _, s := range m.streams {
+		st := s.Stats()
+		st.Lock()
+		status := StreamStatus{
+			Tag:      s.Tag(),
+			Spec:     s.Raw(),
+			State:    st.state,
+			Lines:    st.lines,
+			Dropped:  st.dropped,
+			Rejected: st.rejected,
+		}
+		if !st.lastLine.IsZero() {
+			t := st.lastLine
+			status.LastLine = &t
+		}
+		st.Unlock()
+		if status.State == "" {
+			status.State = "new"
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
+
+// handleStreams serves the status of all incoming log streams as JSON.
+func (m *Mux) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.StreamStatuses())
+}
+
+// RuntimeStatus is a snapshot of logmux's own Go runtime, as served by the
+// /runtime endpoint. A goroutine count that keeps climbing usually means
+// wedged streams, like named pipes stuck reopening.
+type RuntimeStatus struct {
+	Goroutines    int     `json:"goroutines"`
+	HeapBytes     uint64  `json:"heap_bytes"`
+	TotalBytes    uint64  `json:"total_bytes"`
+	GCCycles      uint64  `json:"gc_cycles"`
+	GCPauseP99Sec float64 `json:"gc_pause_p99_seconds"`
+}
+
+// runtimeSamples are the runtime/metrics we report in a RuntimeStatus.
+var runtimeSamples = []string{
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/total:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/gc/pauses:seconds",
+}
+
+// RuntimeStatus returns a snapshot of our Go runtime stats.
+func (m *Mux) RuntimeStatus() RuntimeStatus {
+	samples := make([]metrics.Sample, len(runtimeSamples))
+	for i, name := range runtimeSamples {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	ret := RuntimeStatus{Goroutines: runtime.NumGoroutine()}
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			switch s.Name {
+			case "/memory/classes/heap/objects:bytes":
+				ret.HeapBytes = s.Value.Uint64()
+			case "/memory/classes/total:bytes":
+				ret.TotalBytes = s.Value.Uint64()
+			case "/gc/cycles/total:gc-cycles":
+				ret.GCCycles = s.Value.Uint64()
+			}
+		case metrics.KindFloat64Histogram:
+			ret.GCPauseP99Sec = histogramQuantile(s.Value.Float64Histogram(), 0.99)
+		}
+	}
+	return ret
+}
+
+// histogramQuantile estimates the q quantile of a runtime/metrics
+// histogram, as the upper bound of the bucket it falls in (or the lower
+// bound, for the unbounded last bucket).
+func histogramQuantile(h *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if float64(seen) >= q*float64(total) {
+			if math.IsInf(h.Buckets[i+1], 1) {
+				return h.Buckets[i]
+			}
+			return h.Buckets[i+1]
+		}
+	}
+	return 0
+}
+
+// handleRuntime serves our Go runtime stats as JSON.
+func (m *Mux) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.RuntimeStatus())
+}
+
+// openHTTP starts serving the status endpoints in the background. It listens
+// right away, so that a bad address is an error at startup.
+func (m *Mux) openHTTP() error {
+	ln, err := net.Listen("tcp", m.httpAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/streams", m.handleStreams)
+	mux.HandleFunc("/runtime", m.handleRuntime)
+	mux.HandleFunc("/pause", m.handlePause)
+	mux.HandleFunc("/resume", m.handleResume)
+	go func() {
+		err := http.Serve(ln, mux)
+		fmt.Fprintf(os.Stderr, "status server stopped: %s\n", err)
+	}()
+	return nil
+}
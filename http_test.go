@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime/metrics"
+	"testing"
+)
+
+func TestStreamsEndpoint(t *testing.T) {
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "3:app", "4:web.access;format=plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := m.streams[0].Stats()
+	app.setState("open")
+	app.shipped(3)
+	app.drop()
+
+	tests := []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusOK},
+		{"POST", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		m.handleStreams(w, httptest.NewRequest(tt.method, "/streams", nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s: got %d, want %d", tt.method, w.Code, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s", ct)
+		}
+		var got []StreamStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("bad JSON %q: %s", w.Body, err)
+		}
+		want := []StreamStatus{
+			{Tag: "app", Spec: "3:app", State: "open", Lines: 3, Dropped: 1},
+			{Tag: "web.access", Spec: "4:web.access;format=plain", State: "new"},
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d streams, want %d: %+v", len(got), len(want), got)
+		}
+		for i := range want {
+			last := got[i].LastLine
+			got[i].LastLine = nil
+			if got[i] != want[i] {
+				t.Errorf("stream %d = %+v, want %+v", i, got[i], want[i])
+			}
+			if (last != nil) != (want[i].Lines > 0) {
+				t.Errorf("stream %d last_line = %v", i, last)
+			}
+		}
+	}
+}
+
+func TestRuntimeEndpoint(t *testing.T) {
+	m := &Mux{}
+	w := httptest.NewRecorder()
+	m.handleRuntime(w, httptest.NewRequest("GET", "/runtime", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON %q: %s", w.Body, err)
+	}
+	for _, k := range []string{"goroutines", "heap_bytes", "total_bytes", "gc_cycles", "gc_pause_p99_seconds"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("missing %s in %s", k, w.Body)
+		}
+	}
+	if n, _ := got["goroutines"].(float64); n < 1 {
+		t.Errorf("goroutines = %v", got["goroutines"])
+	}
+	if n, _ := got["heap_bytes"].(float64); n <= 0 {
+		t.Errorf("heap_bytes = %v", got["heap_bytes"])
+	}
+
+	w = httptest.NewRecorder()
+	m.handleRuntime(w, httptest.NewRequest("POST", "/runtime", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %d", w.Code)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name    string
+		counts  []uint64
+		buckets []float64
+		q       float64
+		want    float64
+	}{
+		{"empty", []uint64{0, 0}, []float64{0, 1, 2}, 0.99, 0},
+		{"all in one bucket", []uint64{0, 5}, []float64{0, 1, 2}, 0.99, 2},
+		{"p99 in the tail", []uint64{99, 1}, []float64{0, 1, 2}, 0.99, 1},
+		{"p99 past the tail", []uint64{98, 2}, []float64{0, 1, 2}, 0.99, 2},
+		{"unbounded last bucket", []uint64{1, 9}, []float64{0, 1, inf}, 0.99, 1},
+	}
+	for _, tt := range tests {
+		h := &metrics.Float64Histogram{Counts: tt.counts, Buckets: tt.buckets}
+		if got := histogramQuantile(h, tt.q); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ingestSecretHeader is the header that HTTP clients must send the shared
+// secret in, if one is configured.
+const ingestSecretHeader = "X-Logmux-Secret"
+
+// HTTPStream is a subclass of a BaseStream that's made from listening for
+// lines POSTed over HTTP, as given by a listen-http://<hostname>:<port>/<path>
+// specifier. A POST body is either newline-delimited lines, or a JSON array
+// whose elements are each taken as a line.
+type HTTPStream struct {
+	BaseStream
+	url *url.URL
+
+	// secret, if set, must be sent in the X-Logmux-Secret header.
+	secret string
+	// maxBody is the biggest POST body we'll take, in bytes.
+	maxBody int64
+	// conns, if non-nil, caps how many connections can be open at once.
+	conns chan struct{}
+
+	// Request bodies are written into a pipe that the read loop reads
+	// lines from. The lock keeps bodies from interleaving.
+	sync.Mutex
+	pipe *io.PipeWriter
+}
+
+// Open an HTTPStream by listening on its address. It listens right away, so
+// that a bad address is an error at startup.
+func (h *HTTPStream) Open() error {
+	ln, err := net.Listen("tcp", h.url.Host)
+	if err != nil {
+		return err
+	}
+	r, w := io.Pipe()
+	h.source = newBufferedReader(r)
+	h.pipe = w
+	path := h.url.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+	go func() {
+		err := http.Serve(limitConns(ln, h.conns, &h.stats), mux)
+		fmt.Fprintf(os.Stderr, "http listener for tag %s stopped: %s\n", h.tag, err)
+	}()
+	return nil
+}
+
+// Preread is called before an HTTPStream is read from. Its source never
+// closes, so there's nothing to do.
+func (h *HTTPStream) Preread() error {
+	return nil
+}
+
+// ingestLines turns a POST body into newline-delimited lines. Each element
+// of a JSON array is a line: strings are the line itself, and anything else
+// is compacted onto a line of its own.
+func ingestLines(body []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+		return body, nil
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elems); err != nil {
+		return nil, err
+	}
+	var ret bytes.Buffer
+	for _, e := range elems {
+		if len(e) > 0 && e[0] == '"' {
+			var line string
+			if err := json.Unmarshal(e, &line); err != nil {
+				return nil, err
+			}
+			ret.WriteString(strings.TrimSuffix(line, "\n"))
+		} else if err := json.Compact(&ret, e); err != nil {
+			return nil, err
+		}
+		ret.WriteByte('\n')
+	}
+	return ret.Bytes(), nil
+}
+
+// ServeHTTP takes a POST of lines. It replies 204 once the lines have been
+// handed off to the read loop, 401 for a bad secret, 413 for a body over the
+// size limit, and 400 for a malformed JSON array.
+func (h *HTTPStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(ingestSecretHeader)), []byte(h.secret)) != 1 {
+		http.Error(w, "bad secret", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBody))
+	if err != nil {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	lines, err := ingestLines(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad JSON array: %s", err), http.StatusBadRequest)
+		return
+	}
+	h.Lock()
+	_, err = h.pipe.Write(lines)
+	h.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var _ Stream = (*HTTPStream)(nil)
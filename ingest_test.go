@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestLines(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+		err  bool
+	}{
+		{"one\ntwo\n", "one\ntwo\n", false},
+		{"one\ntwo", "one\ntwo\n", false},
+		{"", "", false},
+		{`[{"a": 1}, {"b": [1, 2]}]`, "{\"a\":1}\n{\"b\":[1,2]}\n", false},
+		{"  [\"x\", 2]\n", "x\n2\n", false},
+		{`["one", "two \"2\"\n", "\u00e9"]`, "one\ntwo \"2\"\né\n", false},
+		{"[]", "", false},
+		{`[{"a": 1}`, "", true},
+		{`[{"a": 1}, oops]`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := ingestLines([]byte(tt.body))
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err = %v", tt.body, err)
+			continue
+		}
+		if !tt.err && string(got) != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// testHTTPStream serves an HTTPStream, and returns the lines that its read
+// loop would get.
+func testHTTPStream(t *testing.T, secret string, maxBody int64) (*httptest.Server, <-chan string) {
+	r, w := io.Pipe()
+	h := &HTTPStream{BaseStream: BaseStream{tag: "job.logs"}, secret: secret, maxBody: maxBody, pipe: w}
+	h.source = bufio.NewReader(r)
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		srv.Close()
+		w.Close()
+	})
+	lines := make(chan string, 16)
+	go func() {
+		for {
+			ln, err := h.source.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSuffix(ln, "\n")
+		}
+	}()
+	return srv, lines
+}
+
+func TestHTTPStreamResponses(t *testing.T) {
+	srv, lines := testHTTPStream(t, "s3cret", 64)
+	tests := []struct {
+		name   string
+		method string
+		secret string
+		body   string
+		status int
+		want   []string
+	}{
+		{"ndjson", "POST", "s3cret", "one\ntwo\n", http.StatusNoContent, []string{"one", "two"}},
+		{"json array", "POST", "s3cret", `[{"n":1},"two"]`, http.StatusNoContent, []string{`{"n":1}`, "two"}},
+		{"no trailing newline", "POST", "s3cret", "three", http.StatusNoContent, []string{"three"}},
+		{"get", "GET", "s3cret", "", http.StatusMethodNotAllowed, nil},
+		{"no secret", "POST", "", "one\n", http.StatusUnauthorized, nil},
+		{"bad secret", "POST", "guess", "one\n", http.StatusUnauthorized, nil},
+		{"too big", "POST", "s3cret", strings.Repeat("x", 65), http.StatusRequestEntityTooLarge, nil},
+		{"bad array", "POST", "s3cret", `[{"n":1}`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.secret != "" {
+			req.Header.Set(ingestSecretHeader, tt.secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		for _, want := range tt.want {
+			select {
+			case got := <-lines:
+				if got != want {
+					t.Errorf("%s: got line %q, want %q", tt.name, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: no line %q", tt.name, want)
+			}
+		}
+	}
+	select {
+	case got := <-lines:
+		t.Errorf("rejected POSTs let through %q", got)
+	default:
+	}
+}
+
+func TestListenHTTPTagsLines(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--duration", "2s",
+		fmt.Sprintf("listen-http://%s/ingest:job.logs", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+
+	post := func(body string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			resp, err := http.Post("http://"+addr+"/ingest", "application/x-ndjson", strings.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusNoContent {
+					t.Fatalf("POST got %s", resp.Status)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+		}
+	}
+	post("plain line\n{\"n\":1}\n")
+	post(`[{"n":2},{"n":3}]`)
+	want := []string{
+		"job.logs: plain line",
+		`{"n":1,"tag":"job.logs"}`,
+		`{"n":2,"tag":"job.logs"}`,
+		`{"n":3,"tag":"job.logs"}`,
+	}
+	if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
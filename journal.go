@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// readJournalEntry reads a single record in the systemd journal export
+// format, and returns it as a JSON object line. Records are FIELD=value
+// lines ended by a blank line. Binary fields come as a FIELD line, then a
+// 64-bit little-endian length, the data, and a newline; they're kept as
+// strings if they're valid UTF-8, and skipped otherwise. A field that
+// appears more than once becomes an array of its values. It returns EOF
+// only if the stream ends between records.
+func readJournalEntry(r *bufio.Reader) ([]byte, error) {
+	var fields []field
+	for {
+		ln, err := r.ReadBytes('\n')
+		ln = bytes.TrimSuffix(ln, []byte("\n"))
+		if len(ln) == 0 {
+			if err == nil && len(fields) == 0 {
+				continue
+			}
+			if len(fields) == 0 {
+				return nil, err
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return encodeObject(fields), err
+		}
+		var key string
+		var val []byte
+		if i := bytes.IndexByte(ln, '='); i >= 0 {
+			key, val = string(ln[:i]), ln[i+1:]
+		} else if err == nil {
+			key = string(ln)
+			if val, err = readJournalBinary(r); err != nil {
+				return nil, err
+			}
+		}
+		if key != "" && utf8.Valid(val) {
+			fields = addJournalField(fields, key, jsonString(val))
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return encodeObject(fields), err
+		}
+	}
+}
+
+// readJournalBinary reads the length-prefixed data of a binary field.
+func readJournalBinary(r *bufio.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := binary.LittleEndian.Uint64(hdr[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("journal export field too big (%d bytes)", n)
+	}
+	buf := make([]byte, n+1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if buf[n] != '\n' {
+		return nil, fmt.Errorf("journal export binary field not followed by a newline")
+	}
+	return buf[:n], nil
+}
+
+// addJournalField adds a value to a record's fields, turning a field that's
+// seen again into an array.
+func addJournalField(fields []field, key string, val []byte) []field {
+	i := findField(fields, key)
+	if i < 0 {
+		return append(fields, field{key: key, val: val})
+	}
+	prev := fields[i].val
+	if prev[0] == '[' {
+		prev = prev[:len(prev)-1]
+	} else {
+		prev = append([]byte{'['}, prev...)
+	}
+	fields[i].val = append(append(append(prev, ','), val...), ']')
+	return fields
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// journalBinary is a field in the journal export format's binary form.
+func journalBinary(key string, val []byte) string {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(val)))
+	return key + "\n" + string(n[:]) + string(val) + "\n"
+}
+
+func TestReadJournalEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+		err  string
+	}{
+		{
+			name: "records",
+			in: "__CURSOR=s=1\n__REALTIME_TIMESTAMP=1700000000000000\nMESSAGE=started\n_PID=42\n\n" +
+				"MESSAGE=stopped\n_SYSTEMD_UNIT=app.service\n\n",
+			want: []string{
+				`{"__CURSOR":"s=1","__REALTIME_TIMESTAMP":"1700000000000000","MESSAGE":"started","_PID":"42"}`,
+				`{"MESSAGE":"stopped","_SYSTEMD_UNIT":"app.service"}`,
+			},
+		},
+		{
+			name: "no blank line at the end",
+			in:   "MESSAGE=last",
+			want: []string{`{"MESSAGE":"last"}`},
+		},
+		{
+			name: "extra blank lines",
+			in:   "\n\nMESSAGE=a\n\n\n\nMESSAGE=b\n\n",
+			want: []string{`{"MESSAGE":"a"}`, `{"MESSAGE":"b"}`},
+		},
+		{
+			name: "value with an equals sign",
+			in:   "MESSAGE=a=b\n\n",
+			want: []string{`{"MESSAGE":"a=b"}`},
+		},
+		{
+			name: "binary field with a newline",
+			in:   journalBinary("MESSAGE", []byte("line one\nline two")) + "_PID=1\n\n",
+			want: []string{`{"MESSAGE":"line one\nline two","_PID":"1"}`},
+		},
+		{
+			name: "non-UTF-8 binary field skipped",
+			in:   journalBinary("COREDUMP", []byte{0xff, 0xfe, 0}) + "MESSAGE=crashed\n\n",
+			want: []string{`{"MESSAGE":"crashed"}`},
+		},
+		{
+			name: "repeated field",
+			in:   "TAG=a\nTAG=b\nTAG=c\n\n",
+			want: []string{`{"TAG":["a","b","c"]}`},
+		},
+		{
+			name: "truncated binary field",
+			in:   "MESSAGE\n\x10\x00\x00\x00\x00\x00\x00\x00short",
+			err:  io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name: "binary field without its newline",
+			in:   "MESSAGE\n\x02\x00\x00\x00\x00\x00\x00\x00hiX\n",
+			err:  "not followed by a newline",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			for _, want := range tt.want {
+				got, err := readJournalEntry(r)
+				if err != nil || string(got) != want {
+					t.Fatalf("got %s, %v, want %s", got, err, want)
+				}
+			}
+			_, err := readJournalEntry(r)
+			if tt.err == "" && err != io.EOF {
+				t.Errorf("got %v after the last record, want EOF", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestJournalExportStream(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--parse", "journal-export",
+		pipeSpec(t, "journal", []string{"MESSAGE=one", "PRIORITY=6", "", "MESSAGE=two", ""}))
+	want := []string{`{"MESSAGE":"one","PRIORITY":"6","tag":"journal"}`, `{"MESSAGE":"two","tag":"journal"}`}
+	if got := c.lines(t, 0, 2); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kafka's default limit on a message, or a batch of them for a partition,
+// which we keep under; its default port; and how long we give a broker to
+// answer.
+const (
+	kafkaMaxMessage = 1000000
+	kafkaPort       = "9092"
+	kafkaTimeout    = 30 * time.Second
+)
+
+// The Kafka API calls we make, and the versions we make them at: the oldest
+// that every broker since Kafka 1.0 still takes.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaRetriable are the errors that a produce can get that are worth
+// retrying once we've looked up the partitions' leaders again, as for a
+// leader that's moved.
+var kafkaRetriable = map[int16]string{
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	13: "NETWORK_EXCEPTION",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	56: "KAFKA_STORAGE_ERROR",
+}
+
+// kafkaTopic is what Kafka takes for a topic name.
+var kafkaTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// kafkaAPI produces events as messages to a Kafka topic, for
+// kafka://<broker>[,<broker>...]/<topic> URLs. The brokers are only for
+// finding the topic's partitions and their leaders, which are produced to
+// directly, with acks from all in-sync replicas. With --kafka-key-tag, each
+// message is keyed by its event's tag, and goes to the partition that a
+// Java producer would pick for the key, so that a tag's events stay in
+// order; otherwise each batch goes to the next partition in turn.
+//
+// Posts are made one at a time by the bulkWriter, so none of this is
+// locked.
+type kafkaAPI struct {
+	brokers []string
+	topic   string
+	keyTag  bool
+
+	// leaders is the leader of each partition, by its index, from the last
+	// metadata lookup, and addrs where each broker is. They're looked up
+	// again after a produce fails in a way that suggests they've changed.
+	// conns are the connections to the leaders, and next is the partition
+	// for the next batch's unkeyed messages.
+	leaders []int32
+	addrs   map[int32]string
+	conns   map[int32]*kafkaConn
+	next    int
+}
+
+func newKafkaWriter(brokers []string, topic string, keyTag bool, size int, every time.Duration) *bulkWriter {
+	api := &kafkaAPI{brokers: brokers, topic: topic, keyTag: keyTag, conns: map[int32]*kafkaConn{}}
+	return &bulkWriter{api: api, name: "kafka", size: size, maxBytes: kafkaMaxMessage, every: every}
+}
+
+func openKafka(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	brokers, topic := kafkaTarget(s)
+	return newKafkaWriter(brokers, topic, s.kafkaKeyTag, s.kafkaBatch, s.kafkaLinger), nil
+}
+
+// kafkaTarget splits a kafka:// URL into its brokers, with the default port
+// for ones without, and its topic.
+func kafkaTarget(s *LogstashService) ([]string, string) {
+	var brokers []string
+	for _, b := range strings.Split(s.url.Host, ",") {
+		if b == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, kafkaPort)
+		}
+		brokers = append(brokers, b)
+	}
+	return brokers, strings.TrimPrefix(s.url.Path, "/")
+}
+
+// checkKafka checks that a kafka:// URL has brokers and a topic.
+func checkKafka(s *LogstashService) error {
+	brokers, topic := kafkaTarget(s)
+	if len(brokers) == 0 || !kafkaTopic.MatchString(topic) {
+		return fmt.Errorf("bad --logstash value: %s; want kafka://<broker>[,<broker>...]/<topic>", s.raw)
+	}
+	return nil
+}
+
+// item makes an event into a message: its key, if it's keyed by tag, and
+// its value, the event without its newline. It's dropped if it's over
+// Kafka's limit.
+func (k *kafkaAPI) item(ev event, now time.Time) []byte {
+	value := bytes.TrimSuffix(ev.buf, []byte("\n"))
+	key := ""
+	if k.keyTag {
+		key = ev.tag
+	}
+	if len(key)+len(value) > kafkaMaxMessage-100 {
+		fmt.Fprintf(os.Stderr, "dropping a %d-byte event that's over Kafka's message limit\n", len(value))
+		return nil
+	}
+	item := binary.AppendUvarint(nil, uint64(len(key)))
+	return append(append(item, key...), value...)
+}
+
+// splitItem splits an item back into its key, which is nil if there isn't
+// one, and its value.
+func splitItem(item []byte) ([]byte, []byte) {
+	n, size := binary.Uvarint(item)
+	item = item[size:]
+	if n == 0 {
+		return nil, item
+	}
+	return item[:n], item[n:]
+}
+
+// post produces a batch, and returns the messages that should be retried,
+// as when a broker is down or a partition's leader has moved. Messages that
+// Kafka turns away for good, like for being too big, are dropped with a
+// note on stderr.
+func (k *kafkaAPI) post(batch [][]byte) ([][]byte, error) {
+	if k.leaders == nil {
+		if err := k.lookup(); err != nil {
+			if errors.Is(err, errKafkaRetry) {
+				fmt.Fprintf(os.Stderr, "kafka: %s; retrying\n", err)
+				return batch, nil
+			}
+			return nil, err
+		}
+	}
+	byPartition := map[int32][][]byte{}
+	unkeyed := int32(k.next % len(k.leaders))
+	for _, item := range batch {
+		p := unkeyed
+		if key, _ := splitItem(item); key != nil {
+			p = int32(kafkaPartition(key, len(k.leaders)))
+		}
+		byPartition[p] = append(byPartition[p], item)
+	}
+	k.next++
+
+	byLeader := map[int32][]int32{}
+	var retry [][]byte
+	for p := range byPartition {
+		leader := k.leaders[p]
+		if leader < 0 {
+			retry = append(retry, byPartition[p]...)
+			continue
+		}
+		byLeader[leader] = append(byLeader[leader], p)
+	}
+	stale := len(retry) > 0
+	for leader, partitions := range byLeader {
+		failed, err := k.produce(leader, partitions, byPartition)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kafka: couldn't produce to broker %d at %s: %s; retrying\n", leader, k.addrs[leader], err)
+			k.drop(leader)
+			for _, p := range partitions {
+				retry = append(retry, byPartition[p]...)
+			}
+			stale = true
+			continue
+		}
+		for p, code := range failed {
+			if name, ok := kafkaRetriable[code]; ok {
+				fmt.Fprintf(os.Stderr, "kafka: %s-%d: %s; retrying\n", k.topic, p, name)
+				retry = append(retry, byPartition[p]...)
+				stale = true
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "kafka: dropping %d messages that %s-%d turned away with error %d\n", len(byPartition[p]), k.topic, p, code)
+		}
+	}
+	if stale {
+		k.leaders = nil
+	}
+	return retry, nil
+}
+
+// errKafkaRetry is for metadata that isn't ready yet, like for a topic
+// that's still being made.
+var errKafkaRetry = errors.New("partition leaders aren't known yet")
+
+// lookup asks the brokers in turn for the topic's partitions and their
+// leaders.
+func (k *kafkaAPI) lookup() error {
+	var err error
+	for _, addr := range k.brokers {
+		var c *kafkaConn
+		if c, err = dialKafka(addr); err != nil {
+			continue
+		}
+		err = k.metadata(c)
+		c.Close()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errKafkaRetry) {
+			return err
+		}
+	}
+	return fmt.Errorf("kafka: couldn't look up topic %s: %s", k.topic, err)
+}
+
+// metadata makes a metadata request for the topic.
+func (k *kafkaAPI) metadata(c *kafkaConn) error {
+	var req kafkaWriter
+	req.int32(1)
+	req.string(k.topic)
+	req.int8(1) // allow_auto_topic_creation
+	r, err := c.call(kafkaMetadata, kafkaMetadataVersion, req)
+	if err != nil {
+		return err
+	}
+	r.int32() // throttle_time_ms
+	addrs := map[int32]string{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		addrs[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	r.string() // cluster_id
+	r.int32()  // controller_id
+	var leaders []int32
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code, name := r.int16(), r.string()
+		r.int8() // is_internal
+		var found []int32
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			r.int16() // error_code
+			p, leader := r.int32(), r.int32()
+			r.int32s() // replica_nodes
+			r.int32s() // isr_nodes
+			for int(p) >= len(found) {
+				found = append(found, -1)
+			}
+			found[p] = leader
+		}
+		if name != k.topic {
+			continue
+		}
+		switch {
+		case code == 5 || (code == 0 && len(found) == 0):
+			return errKafkaRetry
+		case code == 3:
+			return fmt.Errorf("no topic %s", k.topic)
+		case code != 0:
+			return fmt.Errorf("error %d for topic %s", code, k.topic)
+		}
+		leaders = found
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if leaders == nil {
+		return fmt.Errorf("no topic %s", k.topic)
+	}
+	k.leaders, k.addrs = leaders, addrs
+	return nil
+}
+
+// produce sends a produce request to a broker for the given partitions, and
+// returns the partitions that it failed, with their error codes.
+func (k *kafkaAPI) produce(leader int32, partitions []int32, byPartition map[int32][][]byte) (map[int32]int16, error) {
+	c, err := k.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+	var req kafkaWriter
+	req.int16(-1) // transactional_id
+	req.int16(-1) // acks, from all in-sync replicas
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(k.topic)
+	req.int32(int32(len(partitions)))
+	now := time.Now()
+	for _, p := range partitions {
+		req.int32(p)
+		req.bytes(recordBatch(byPartition[p], now))
+	}
+	r, err := c.call(kafkaProduce, kafkaProduceVersion, req)
+	if err != nil {
+		return nil, err
+	}
+	failed := map[int32]int16{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string() // name
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			p, code := r.int32(), r.int16()
+			r.int64() // base_offset
+			r.int64() // log_append_time_ms
+			if code != 0 {
+				failed[p] = code
+			}
+		}
+	}
+	return failed, r.err
+}
+
+// conn returns the connection to a broker, dialing it if need be.
+func (k *kafkaAPI) conn(id int32) (*kafkaConn, error) {
+	if c := k.conns[id]; c != nil {
+		return c, nil
+	}
+	addr, ok := k.addrs[id]
+	if !ok {
+		return nil, fmt.Errorf("no address for broker %d", id)
+	}
+	c, err := dialKafka(addr)
+	if err != nil {
+		return nil, err
+	}
+	k.conns[id] = c
+	return c, nil
+}
+
+// drop closes the connection to a broker that failed, to be dialed again
+// next time.
+func (k *kafkaAPI) drop(id int32) {
+	if c := k.conns[id]; c != nil {
+		c.Close()
+		delete(k.conns, id)
+	}
+}
+
+// recordBatch encodes messages as a batch of records, in the format that
+// Kafka has taken since 0.11, without compression.
+func recordBatch(items [][]byte, now time.Time) []byte {
+	var records []byte
+	for i, item := range items {
+		key, value := splitItem(item)
+		var rec []byte
+		rec = append(rec, 0) // attributes
+		rec = binary.AppendVarint(rec, 0)
+		rec = binary.AppendVarint(rec, int64(i))
+		if key == nil {
+			rec = binary.AppendVarint(rec, -1)
+		} else {
+			rec = binary.AppendVarint(rec, int64(len(key)))
+			rec = append(rec, key...)
+		}
+		rec = binary.AppendVarint(rec, int64(len(value)))
+		rec = append(rec, value...)
+		rec = binary.AppendVarint(rec, 0) // headers
+		records = append(binary.AppendVarint(records, int64(len(rec))), rec...)
+	}
+
+	// What the CRC covers: everything from the attributes on.
+	var tail kafkaWriter
+	ms := now.UnixMilli()
+	tail.int16(0) // attributes
+	tail.int32(int32(len(items) - 1))
+	tail.int64(ms)
+	tail.int64(ms)
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(int32(len(items)))
+	tail = append(tail, records...)
+
+	var b kafkaWriter
+	b.int64(0) // base_offset
+	b.int32(int32(4 + 1 + 4 + len(tail)))
+	b.int32(-1) // partition_leader_epoch
+	b.int8(2)   // magic
+	b.int32(int32(crc32.Checksum(tail, crc32.MakeTable(crc32.Castagnoli))))
+	return append(b, tail...)
+}
+
+// kafkaPartition picks the partition for a key the way Java producers do,
+// by its murmur2 hash.
+func kafkaPartition(key []byte, partitions int) int {
+	return int(uint32(murmur2(key))&0x7fffffff) % partitions
+}
+
+// murmur2 is the hash that Kafka's Java client partitions keys with.
+func murmur2(data []byte) int32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) % 4 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaConn is a connection to a broker, which takes one request at a time.
+type kafkaConn struct {
+	net.Conn
+	r           *bufio.Reader
+	correlation int32
+}
+
+func dialKafka(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// call makes a request, and returns a reader for the body of its response.
+func (c *kafkaConn) call(api, version int16, body kafkaWriter) (*kafkaReader, error) {
+	c.correlation++
+	var req kafkaWriter
+	req.int32(0) // the size, filled in below
+	req.int16(api)
+	req.int16(version)
+	req.int32(c.correlation)
+	req.string("logmux")
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	c.SetDeadline(time.Now().Add(kafkaTimeout + 5*time.Second))
+	defer c.SetDeadline(time.Time{})
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	var size uint32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > 64<<20 {
+		return nil, fmt.Errorf("bad response size %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{buf: resp}
+	if id := r.int32(); id != c.correlation {
+		return nil, fmt.Errorf("got a response to request %d, want %d", id, c.correlation)
+	}
+	return r, nil
+}
+
+// kafkaWriter encodes the fields of a request.
+type kafkaWriter []byte
+
+func (w *kafkaWriter) int8(n int8) {
+	*w = append(*w, byte(n))
+}
+
+func (w *kafkaWriter) int16(n int16) {
+	*w = binary.BigEndian.AppendUint16(*w, uint16(n))
+}
+
+func (w *kafkaWriter) int32(n int32) {
+	*w = binary.BigEndian.AppendUint32(*w, uint32(n))
+}
+
+func (w *kafkaWriter) int64(n int64) {
+	*w = binary.BigEndian.AppendUint64(*w, uint64(n))
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	*w = append(*w, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	*w = append(*w, b...)
+}
+
+// kafkaReader decodes the fields of a response. Once it runs out, it keeps
+// its error, and every field reads as zero.
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		if r.err == nil {
+			r.err = errors.New("short response")
+		}
+		return make([]byte, max(n, 0))
+	}
+	ret := r.buf[:n]
+	r.buf = r.buf[n:]
+	return ret
+}
+
+func (r *kafkaReader) int8() int8 {
+	return int8(r.take(1)[0])
+}
+
+func (r *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(r.take(2)))
+}
+
+func (r *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(r.take(4)))
+}
+
+func (r *kafkaReader) int64() int64 {
+	return int64(binary.BigEndian.Uint64(r.take(8)))
+}
+
+// string reads a string, or a null one as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *kafkaReader) int32s() []int32 {
+	var ret []int32
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		ret = append(ret, r.int32())
+	}
+	return ret
+}
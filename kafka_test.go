@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kafkaMessage is a message as a fakeKafka took it, with a nil key shown as
+// "<nil>".
+type kafkaMessage struct {
+	partition  int32
+	key, value string
+}
+
+// fakeKafka is a Kafka cluster of one broker, which leads every partition of
+// whatever topic it's asked about. Each produce is answered with the next of
+// its scripted error codes, for every partition, or with success once they
+// run out, and a -1 closes the connection instead. Messages are only kept
+// from produces that succeed.
+type fakeKafka struct {
+	ln         net.Listener
+	partitions int
+
+	sync.Mutex
+	script    []int16
+	metadatas int
+	messages  []kafkaMessage
+}
+
+func newFakeKafka(t *testing.T, partitions int, script ...int16) *fakeKafka {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	k := &fakeKafka{ln: ln, partitions: partitions, script: script}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(t, conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) url(topic string) string {
+	return "kafka://" + k.ln.Addr().String() + "/" + topic
+}
+
+// got returns the messages taken so far.
+func (k *fakeKafka) got() []kafkaMessage {
+	k.Lock()
+	defer k.Unlock()
+	return append([]kafkaMessage(nil), k.messages...)
+}
+
+func (k *fakeKafka) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := &kafkaReader{buf: make([]byte, size)}
+		if _, err := io.ReadFull(conn, req.buf); err != nil {
+			return
+		}
+		api, version, correlation := req.int16(), req.int16(), req.int32()
+		req.string() // client_id
+		var resp kafkaWriter
+		resp.int32(0) // the size, filled in below
+		resp.int32(correlation)
+		switch {
+		case api == kafkaMetadata && version == kafkaMetadataVersion:
+			k.metadata(req, &resp)
+		case api == kafkaProduce && version == kafkaProduceVersion:
+			if !k.produce(t, req, &resp) {
+				return
+			}
+		default:
+			t.Errorf("unexpected request %d at version %d", api, version)
+			return
+		}
+		binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (k *fakeKafka) metadata(req *kafkaReader, resp *kafkaWriter) {
+	k.Lock()
+	k.metadatas++
+	k.Unlock()
+	req.int32()
+	topic := req.string()
+	host, port, _ := net.SplitHostPort(k.ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.int32(0)
+	resp.string(host)
+	resp.int32(int32(n))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster_id
+	resp.int32(0)  // controller_id
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(topic)
+	resp.int8(0) // is_internal
+	resp.int32(int32(k.partitions))
+	for p := 0; p < k.partitions; p++ {
+		resp.int16(0)
+		resp.int32(int32(p))
+		resp.int32(0) // leader
+		resp.int32(1) // replica_nodes
+		resp.int32(0)
+		resp.int32(1) // isr_nodes
+		resp.int32(0)
+	}
+}
+
+// produce takes a produce request, and returns false if the connection
+// should be closed instead of answered.
+func (k *fakeKafka) produce(t *testing.T, req *kafkaReader, resp *kafkaWriter) bool {
+	k.Lock()
+	defer k.Unlock()
+	var code int16
+	if len(k.script) > 0 {
+		code, k.script = k.script[0], k.script[1:]
+	}
+	if code < 0 {
+		return false
+	}
+	req.int16() // transactional_id
+	if acks := req.int16(); acks != -1 {
+		t.Errorf("acks = %d", acks)
+	}
+	req.int32() // timeout_ms
+	resp.int32(req.int32())
+	topic := req.string()
+	resp.string(topic)
+	n := req.int32()
+	resp.int32(n)
+	for ; n > 0; n-- {
+		p := req.int32()
+		batch := req.take(int(req.int32()))
+		if code == 0 {
+			k.messages = append(k.messages, decodeRecordBatch(t, p, batch)...)
+		}
+		resp.int32(p)
+		resp.int16(code)
+		resp.int64(0) // base_offset
+		resp.int64(-1)
+	}
+	resp.int32(0) // throttle_time_ms
+	return req.err == nil
+}
+
+// decodeRecordBatch checks a record batch, and returns its messages.
+func decodeRecordBatch(t *testing.T, partition int32, batch []byte) []kafkaMessage {
+	r := &kafkaReader{buf: batch}
+	r.int64() // base_offset
+	if n := r.int32(); int(n) != len(r.buf) {
+		t.Errorf("batch_length = %d, want %d", n, len(r.buf))
+	}
+	r.int32() // partition_leader_epoch
+	if magic := r.int8(); magic != 2 {
+		t.Errorf("magic = %d", magic)
+	}
+	if crc := uint32(r.int32()); crc != crc32.Checksum(r.buf, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Error("bad CRC")
+	}
+	r.int16() // attributes
+	last := r.int32()
+	r.int64() // base_timestamp
+	r.int64() // max_timestamp
+	r.int64() // producer_id
+	r.int16() // producer_epoch
+	r.int32() // base_sequence
+	n := r.int32()
+	if last != n-1 {
+		t.Errorf("last_offset_delta = %d for %d records", last, n)
+	}
+	varint := func() int64 {
+		v, size := binary.Varint(r.buf)
+		r.take(size)
+		return v
+	}
+	var ret []kafkaMessage
+	for i := int32(0); i < n; i++ {
+		varint() // length
+		r.int8() // attributes
+		varint() // timestamp_delta
+		if d := varint(); d != int64(i) {
+			t.Errorf("offset_delta = %d for record %d", d, i)
+		}
+		key := "<nil>"
+		if size := varint(); size >= 0 {
+			key = string(r.take(int(size)))
+		}
+		value := string(r.take(int(varint())))
+		varint() // headers
+		ret = append(ret, kafkaMessage{partition: partition, key: key, value: value})
+	}
+	if r.err != nil || len(r.buf) > 0 {
+		t.Errorf("bad record batch: %v, %d bytes left", r.err, len(r.buf))
+	}
+	return ret
+}
+
+func TestMurmur2(t *testing.T) {
+	// These are from the Java client's tests.
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestKafkaKeyedByTag(t *testing.T) {
+	k := newFakeKafka(t, 3)
+	runMux(t, "--logstash", k.url("logs"), "--kafka-key-tag",
+		pipeSpec(t, "web", []string{"one", "two", "three"}),
+		pipeSpec(t, "db", []string{"four", "five"}))
+	byKey := map[string][]string{}
+	for _, m := range k.got() {
+		if want := int32(kafkaPartition([]byte(m.key), 3)); m.partition != want {
+			t.Errorf("%s went to partition %d, want %d", m.key, m.partition, want)
+		}
+		byKey[m.key] = append(byKey[m.key], m.value)
+	}
+	if got := strings.Join(byKey["web"], ","); got != "web: one,web: two,web: three" {
+		t.Errorf("web got %q", got)
+	}
+	if got := strings.Join(byKey["db"], ","); got != "db: four,db: five" {
+		t.Errorf("db got %q", got)
+	}
+}
+
+func TestKafkaUnkeyed(t *testing.T) {
+	k := newFakeKafka(t, 3)
+	w := newKafkaWriter([]string{k.ln.Addr().String()}, "logs", false, 2, time.Hour)
+	if err := w.writeEvents(plainEvents("web", "one", "two", "three", "four")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Each batch goes to the next partition.
+	want := []kafkaMessage{{0, "<nil>", "web: one"}, {0, "<nil>", "web: two"}, {1, "<nil>", "web: three"}, {1, "<nil>", "web: four"}}
+	if got := k.got(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestKafkaRetries(t *testing.T) {
+	saved := bulkBackoff
+	defer func() { bulkBackoff = saved }()
+	bulkBackoff = time.Millisecond
+
+	tests := []struct {
+		name      string
+		script    []int16
+		want      string
+		metadatas int
+	}{
+		{"leader moved", []int16{6}, "web: one,web: two", 2},
+		{"connection dropped", []int16{-1}, "web: one,web: two", 2},
+		{"too big", []int16{10}, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newFakeKafka(t, 1, tt.script...)
+			w := newKafkaWriter([]string{k.ln.Addr().String()}, "logs", false, 10, time.Hour)
+			if err := w.writeEvents(plainEvents("web", "one", "two")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range k.got() {
+				got = append(got, m.value)
+			}
+			if s := strings.Join(got, ","); s != tt.want {
+				t.Errorf("got %q, want %q", s, tt.want)
+			}
+			if k.metadatas != tt.metadatas {
+				t.Errorf("looked up the topic %d times, want %d", k.metadatas, tt.metadatas)
+			}
+		})
+	}
+
+	t.Run("still failing", func(t *testing.T) {
+		k := newFakeKafka(t, 1, 6, 6, 6, 6, 6)
+		w := newKafkaWriter([]string{k.ln.Addr().String()}, "logs", false, 10, time.Hour)
+		w.writeEvents(plainEvents("web", "one"))
+		if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "still turning away 1 events") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+func TestKafkaBrokersDown(t *testing.T) {
+	w := newKafkaWriter([]string{freeAddr(t), freeAddr(t)}, "logs", false, 10, time.Hour)
+	w.writeEvents(plainEvents("web", "one"))
+	err := w.Flush()
+	if err == nil || !strings.Contains(err.Error(), "couldn't look up topic logs") {
+		t.Errorf("got %v", err)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		t.Errorf("got %v, want it wrapped as a kafka error", err)
+	}
+}
+
+func TestBadKafkaSink(t *testing.T) {
+	for _, args := range [][]string{
+		{"--logstash", "kafka:///logs"},
+		{"--logstash", "kafka://localhost:9092"},
+		{"--logstash", "kafka://localhost:9092/logs/app"},
+		{"--logstash", "kafka://localhost:9092/logs", "--kafka-batch-size", "0"},
+		{"--logstash", "kafka://localhost:9092/logs", "--kafka-linger", "0s"},
+	} {
+		if _, err := parseTestArgs(append(args, "0:app")...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+	m, err := parseTestArgs("--logstash", "kafka://one,two:9093/logs", "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brokers, topic := kafkaTarget(&m.logstash); strings.Join(brokers, ",") != "one:9092,two:9093" || topic != "logs" {
+		t.Errorf("got %q, %q", brokers, topic)
+	}
+}
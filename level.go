@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// levelWord finds a log level in a plain line, for --detect-level: the first
+// of the level names that stands as a word of its own, like ERROR or [warn].
+var levelWord = regexp.MustCompile(`(?i)\b(emerg|emergency|panic|alert|crit|critical|fatal|err|error|warn|warning|notice|info|debug|trace)\b`)
+
+// syslogSeverities are the default --add-severity numbers for each level
+// name, per RFC 5424.
+var syslogSeverities = map[string]int{
+	"emerg":     0,
+	"emergency": 0,
+	"panic":     0,
+	"alert":     1,
+	"crit":      2,
+	"critical":  2,
+	"fatal":     2,
+	"err":       3,
+	"error":     3,
+	"warn":      4,
+	"warning":   4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+	"trace":     7,
+}
+
+// severityMap are the --severity-map overrides of the syslog severity
+// numbers, by lowercased level name, which can be given more than once.
+type severityMap map[string]int
+
+// We can parse command line flags directly into a severityMap value
+var _ flag.Value = (*severityMap)(nil)
+
+// Set adds a level=number mapping as read in from the command line.
+func (m *severityMap) Set(r string) error {
+	parts := strings.SplitN(r, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("bad severity mapping %q; want level=number", r)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 0 || n > 7 {
+		return fmt.Errorf("bad severity mapping %q: want a number from 0 to 7", r)
+	}
+	if *m == nil {
+		*m = severityMap{}
+	}
+	(*m)[strings.ToLower(parts[0])] = n
+	return nil
+}
+
+// String representation of the severity mappings
+func (m *severityMap) String() string {
+	var parts []string
+	for level, n := range *m {
+		parts = append(parts, level+"="+strconv.Itoa(n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// severity returns the number for a level name, from the overrides and then
+// the syslog defaults, or false for a level that neither knows.
+func (m severityMap) severity(level string) (int, bool) {
+	level = strings.ToLower(level)
+	if n, ok := m[level]; ok {
+		return n, true
+	}
+	n, ok := syslogSeverities[level]
+	return n, ok
+}
+
+// levelFields returns the level field for a plain line, with the level name
+// lowercased, and its severity field if --add-severity is set. A line with
+// no level name gets neither.
+func (o *Options) levelFields(buf []byte) []field {
+	level := strings.ToLower(string(levelWord.Find(buf)))
+	if level == "" {
+		return nil
+	}
+	ret := []field{{key: "level", val: jsonString([]byte(level))}}
+	return append(ret, o.severityField(level)...)
+}
+
+// objectSeverity returns the severity field for a JSON line from its own
+// level field, if it has one that's a known level name and no severity field
+// already.
+func (o *Options) objectSeverity(buf []byte) []field {
+	fields, err := decodeObject(buf)
+	if err != nil || findField(fields, "severity") >= 0 {
+		return nil
+	}
+	i := findField(fields, "level")
+	if i < 0 {
+		return nil
+	}
+	var level string
+	if json.Unmarshal(fields[i].val, &level) != nil {
+		return nil
+	}
+	return o.severityField(level)
+}
+
+// severityField returns the severity field for a level name, or nothing for
+// an unknown level.
+func (o *Options) severityField(level string) []field {
+	if !o.addSeverity {
+		return nil
+	}
+	n, ok := o.severities.severity(level)
+	if !ok {
+		return nil
+	}
+	return []field{{key: "severity", val: []byte(strconv.Itoa(n))}}
+}
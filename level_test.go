@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSeverityMap(t *testing.T) {
+	var m severityMap
+	for _, r := range []string{"Verbose=7", "warn=5"} {
+		if err := m.Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		level string
+		want  int
+		ok    bool
+	}{
+		{"emerg", 0, true},
+		{"panic", 0, true},
+		{"alert", 1, true},
+		{"FATAL", 2, true},
+		{"critical", 2, true},
+		{"error", 3, true},
+		{"Err", 3, true},
+		{"warning", 4, true},
+		{"warn", 5, true},
+		{"notice", 5, true},
+		{"info", 6, true},
+		{"debug", 7, true},
+		{"trace", 7, true},
+		{"VERBOSE", 7, true},
+		{"chatty", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := m.severity(tt.level); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %d, %t, want %d, %t", tt.level, got, ok, tt.want, tt.ok)
+		}
+	}
+	if got := m.String(); got != "verbose=7,warn=5" {
+		t.Errorf("got %q", got)
+	}
+
+	for _, r := range []string{"warn", "=3", "warn=high", "warn=8", "warn=-1"} {
+		var m severityMap
+		if err := m.Set(r); err == nil {
+			t.Errorf("%q: no error", r)
+		}
+	}
+}
+
+func TestDetectLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		severity bool
+		line     string
+		want     string
+	}{
+		{
+			name: "level only",
+			line: "2024-01-01 ERROR disk full",
+			want: `{"message":"2024-01-01 ERROR disk full","tag":"app","level":"error"}`,
+		},
+		{
+			name:     "with severity",
+			severity: true,
+			line:     "[Warn] slow query",
+			want:     `{"message":"[Warn] slow query","tag":"app","level":"warn","severity":4}`,
+		},
+		{
+			name:     "first level wins",
+			severity: true,
+			line:     "INFO retrying after error",
+			want:     `{"message":"INFO retrying after error","tag":"app","level":"info","severity":6}`,
+		},
+		{
+			name:     "not part of a word",
+			severity: true,
+			line:     "information about errors",
+			want:     "app: information about errors",
+		},
+		{
+			name:     "json level",
+			severity: true,
+			line:     `{"level":"CRITICAL","msg":"down"}`,
+			want:     `{"level":"CRITICAL","msg":"down","tag":"app","severity":2}`,
+		},
+		{
+			name:     "json unknown level",
+			severity: true,
+			line:     `{"level":"chatty","msg":"hi"}`,
+			want:     `{"level":"chatty","msg":"hi","tag":"app"}`,
+		},
+		{
+			name:     "json severity kept",
+			severity: true,
+			line:     `{"level":"error","severity":1}`,
+			want:     `{"level":"error","severity":1,"tag":"app"}`,
+		},
+		{
+			name: "json without --add-severity",
+			line: `{"level":"error"}`,
+			want: `{"level":"error","tag":"app"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.detectLevel, o.addSeverity = true, tt.severity
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, "0:app")), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The overrides apply to both detected levels and JSON ones.
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--detect-level", "--add-severity", "--severity-map", "error=2", "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line, want := range map[string]string{
+		"ERROR boom":          `{"message":"ERROR boom","tag":"app","level":"error","severity":2}`,
+		`{"level":"error"}`:   `{"level":"error","tag":"app","severity":2}`,
+		"nothing to see here": "app: nothing to see here",
+	} {
+		got := string(bytes.TrimSuffix(m.opts.processLine([]byte(line), testStream(t, "0:app")), []byte("\n")))
+		if got != want {
+			t.Errorf("%q: got %s, want %s", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lineListener feeds the newline-delimited lines sent over every connection
+// accepted on a listener into a stream's source. Lines from all connections
+// are written into a pipe that the read loop reads from; the lock keeps them
+// from interleaving.
+type lineListener struct {
+	sync.Mutex
+	pipe *io.PipeWriter
+
+	// conns, if non-nil, is a semaphore shared by all listeners that caps
+	// how many connections can be open at once.
+	conns chan struct{}
+}
+
+// limitListener caps how many connections accepted on a listener can be open
+// at once. Connections over the cap are closed right away, and counted as
+// rejected in the stream's stats.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+	stats *StreamStats
+}
+
+// limitConns wraps ln so that it holds to the given connection slots, if
+// there are any.
+func limitConns(ln net.Listener, slots chan struct{}, stats *StreamStats) net.Listener {
+	if slots == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, slots: slots, stats: stats}
+}
+
+// Accept the next connection that there's a slot for.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: conn, slots: l.slots}, nil
+		default:
+			conn.Close()
+			l.stats.reject()
+		}
+	}
+}
+
+// limitedConn gives its slot back when it's closed.
+type limitedConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
+
+// start accepting connections on ln, as the source for the given stream.
+// The caller has already capped its connections with limitConns.
+func (l *lineListener) start(b *BaseStream, ln net.Listener) {
+	r, w := io.Pipe()
+	b.source = newBufferedReader(r)
+	l.pipe = w
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "listener for tag %s stopped: %s\n", b.tag, err)
+				return
+			}
+			go l.serve(b.tag, conn)
+		}
+	}()
+}
+
+// serve reads lines off of a single client connection until it closes. A
+// failed TLS handshake is logged, and the connection dropped.
+func (l *lineListener) serve(tag string, conn net.Conn) {
+	defer conn.Close()
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			fmt.Fprintf(os.Stderr, "tls handshake for tag %s from %s failed: %s\n", tag, conn.RemoteAddr(), err)
+			return
+		}
+	}
+	r := bufio.NewReader(conn)
+	for {
+		buf, err := r.ReadBytes('\n')
+		if len(buf) > 0 {
+			if buf[len(buf)-1] != '\n' {
+				buf = append(buf, '\n')
+			}
+			l.Lock()
+			_, werr := l.pipe.Write(buf)
+			l.Unlock()
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// TLSStream is a subclass of a BaseStream that's made from listening for
+// connections over mutually-authenticated TLS, as given by a
+// listen-tls://<hostname>:<port> specifier. Each connection sends
+// newline-delimited lines.
+type TLSStream struct {
+	BaseStream
+	lineListener
+	addr string
+
+	// config is the server side of the TLS handshake, which requires a
+	// client cert signed by one of our client CAs.
+	config *tls.Config
+}
+
+// Open a TLSStream by listening on its address. It listens right away, so
+// that a bad address is an error at startup.
+func (t *TLSStream) Open() error {
+	if t.config == nil {
+		return fmt.Errorf("%s: need --listen-tls-cert, --listen-tls-key and --listen-tls-client-ca", t.raw)
+	}
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	// The cap on connections has to apply underneath TLS, so that the
+	// handshake happens on the connections we let through.
+	t.start(&t.BaseStream, tls.NewListener(limitConns(ln, t.conns, &t.stats), t.config))
+	return nil
+}
+
+// Preread is called before a TLSStream is read from. Its source never
+// closes, so there's nothing to do.
+func (t *TLSStream) Preread() error {
+	return nil
+}
+
+var _ Stream = (*TLSStream)(nil)
+
+// listenTLSConfig builds the server config for listen-tls:// streams from
+// our cert and key, and the CA bundle that client certs must chain to.
+func listenTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" || key == "" || clientCA == "" {
+		return nil, errors.New("need all of --listen-tls-cert, --listen-tls-key and --listen-tls-client-ca")
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certs found in %s", clientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}, nil
+}
+
+// sdListenFdsStart is the first fd that systemd passes listening sockets
+// on.
+const sdListenFdsStart = 3
+
+// ActivatedStream is a subclass of a BaseStream that's made from a
+// listening socket passed in by systemd socket activation, as given by a
+// listen-fd://<n> specifier. <n> is either the socket's index among the
+// passed sockets, or its FileDescriptorName. Each connection sends
+// newline-delimited lines.
+type ActivatedStream struct {
+	BaseStream
+	lineListener
+	name string
+}
+
+// activatedFd finds the fd for a socket passed in by systemd, by index or
+// by name, following sd_listen_fds(3).
+func activatedFd(name string) (int, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return 0, errors.New("no sockets passed in by systemd (LISTEN_PID isn't us)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0, errors.New("no sockets passed in by systemd (LISTEN_FDS isn't set)")
+	}
+	i, err := strconv.Atoi(name)
+	if err != nil {
+		i = -1
+		for j, fdName := range strings.Split(os.Getenv("LISTEN_FDNAMES"), ":") {
+			if fdName == name {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("no socket %s among the %d passed in by systemd", name, n)
+	}
+	return sdListenFdsStart + i, nil
+}
+
+// Open an ActivatedStream by taking over its passed-in socket.
+func (a *ActivatedStream) Open() error {
+	fd, err := activatedFd(a.name)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.raw, err)
+	}
+	f := os.NewFile(uintptr(fd), a.name)
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.raw, err)
+	}
+	a.start(&a.BaseStream, limitConns(ln, a.conns, &a.stats))
+	return nil
+}
+
+// Preread is called before an ActivatedStream is read from. Its source
+// never closes, so there's nothing to do.
+func (a *ActivatedStream) Preread() error {
+	return nil
+}
+
+var _ Stream = (*ActivatedStream)(nil)
+
+// UnixStream is a subclass of a BaseStream that's made from listening for
+// connections on a Unix socket, as given by a listen-unix://<path>
+// specifier, or listen-unix://@<name> for a socket in Linux's abstract
+// namespace, which has no file to clean up. Each connection sends
+// newline-delimited lines.
+type UnixStream struct {
+	BaseStream
+	lineListener
+	path string
+}
+
+// Open a UnixStream by listening on its socket. A socket file left behind
+// by a run that's gone is removed first; one that's still being listened
+// on is an error.
+func (u *UnixStream) Open() error {
+	addr := u.path
+	if strings.HasPrefix(u.path, "@") {
+		var err error
+		if addr, err = abstractSocket(u.path[1:]); err != nil {
+			return fmt.Errorf("%s: %s", u.raw, err)
+		}
+	} else if fi, err := os.Stat(u.path); err == nil && fi.Mode().Type() == os.ModeSocket {
+		if conn, err := net.Dial("unix", u.path); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s: something's already listening on %s", u.raw, u.path)
+		}
+		os.Remove(u.path)
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", u.raw, err)
+	}
+	u.start(&u.BaseStream, limitConns(ln, u.conns, &u.stats))
+	return nil
+}
+
+// Preread is called before a UnixStream is read from. Its source never
+// closes, so there's nothing to do.
+func (u *UnixStream) Preread() error {
+	return nil
+}
+
+var _ Stream = (*UnixStream)(nil)
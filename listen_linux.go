@@ -0,0 +1,9 @@
+//go:build linux
+
+package main
+
+// abstractSocket returns the address to listen on for the named socket in
+// the abstract namespace, which Go takes as a leading @.
+func abstractSocket(name string) (string, error) {
+	return "@" + name, nil
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixAbstractStream(t *testing.T) {
+	name := fmt.Sprintf("@logmux-test-%d", os.Getpid())
+	c := captureTCP(t)
+	go sendUnix(name, "one\ntwo\n")
+	runMux(t, "--logstash", c.url().String(), "--duration", "500ms", "listen-unix://"+name+":app")
+	want := []string{"app: one", "app: two"}
+	if got := c.lines(t, 0, 2); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
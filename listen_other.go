@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// abstractSocket fails, as abstract Unix sockets are Linux's own. Elsewhere,
+// a leading @ would just be part of a socket file's name.
+func abstractSocket(name string) (string, error) {
+	return "", errors.New("abstract Unix sockets (listen-unix://@<name>) are only supported on Linux")
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority made up for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert, key}
+}
+
+func (ca testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue makes a cert signed by the CA, for a server on 127.0.0.1 or for a
+// client, and returns it along with its PEM cert and key.
+func (ca testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair, certPEM, keyPEM
+}
+
+// writeFile writes a file into dir, and returns its path.
+func writeFile(t *testing.T, dir, name string, buf []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// freeAddr finds a port on 127.0.0.1 that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// tlsSetup is a listen-tls stream that's listening, and what clients need
+// to connect to it.
+type tlsSetup struct {
+	stream  *TLSStream
+	roots   *x509.CertPool
+	client  tls.Certificate
+	unknown tls.Certificate
+}
+
+// listenTLS opens a listen-tls stream with a server cert and client CA
+// made up for the test, as --listen-tls-cert, --listen-tls-key and
+// --listen-tls-client-ca files.
+func listenTLS(t *testing.T, conns chan struct{}) tlsSetup {
+	dir := t.TempDir()
+	serverCA, clientCA, otherCA := newTestCA(t, "server CA"), newTestCA(t, "client CA"), newTestCA(t, "other CA")
+	_, certPEM, keyPEM := serverCA.issue(t, "logmux", x509.ExtKeyUsageServerAuth)
+	config, err := listenTLSConfig(writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM),
+		writeFile(t, dir, "clients.pem", clientCA.pem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &TLSStream{BaseStream: BaseStream{tag: "net.secure"}, addr: freeAddr(t), config: config}
+	s.conns = conns
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	client, _, _ := clientCA.issue(t, "app", x509.ExtKeyUsageClientAuth)
+	unknown, _, _ := otherCA.issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+	return tlsSetup{s, roots, client, unknown}
+}
+
+// dial connects to the stream with the given client certs, which may be
+// none.
+func (ts tlsSetup) dial(t *testing.T, certs ...tls.Certificate) *tls.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", ts.stream.addr, &tls.Config{RootCAs: ts.roots, Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readLine reads the next line the stream's read loop would get.
+func (ts tlsSetup) readLine(t *testing.T) string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		ln, _ := ts.stream.Source().ReadString('\n')
+		got <- ln
+	}()
+	select {
+	case ln := <-got:
+		return ln
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line read")
+		return ""
+	}
+}
+
+// rejected writes a line as a client that the server should turn away, and
+// checks that it's hung up on.
+func (ts tlsSetup) rejected(t *testing.T, certs ...tls.Certificate) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", ts.stream.addr, &tls.Config{RootCAs: ts.roots, Certificates: certs})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("let me in\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadByte(); err == nil {
+		t.Error("the server sent something to a rejected client")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("the server didn't hang up on a rejected client")
+	}
+}
+
+func TestListenTLSClientCerts(t *testing.T) {
+	ts := listenTLS(t, nil)
+	// Clients without a cert, or with one from the wrong CA, don't get a
+	// line in.
+	ts.rejected(t)
+	ts.rejected(t, ts.unknown)
+
+	conn := ts.dial(t, ts.client)
+	if _, err := conn.Write([]byte("hello\npartial")); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.readLine(t); got != "hello\n" {
+		t.Errorf("got %q, want the client's line", got)
+	}
+	conn.Close()
+	if got := ts.readLine(t); got != "partial\n" {
+		t.Errorf("got %q, want the unterminated line with a newline", got)
+	}
+}
+
+func TestListenTLSMaxConnections(t *testing.T) {
+	ts := listenTLS(t, make(chan struct{}, 1))
+	first := ts.dial(t, ts.client)
+	first.Write([]byte("first\n"))
+	if got := ts.readLine(t); got != "first\n" {
+		t.Fatalf("got %q", got)
+	}
+	// The second connection is closed before the handshake, while the first
+	// holds the only slot.
+	if _, err := tls.Dial("tcp", ts.stream.addr, &tls.Config{RootCAs: ts.roots, Certificates: []tls.Certificate{ts.client}}); err == nil {
+		t.Error("a connection over the cap got through the handshake")
+	}
+	ts.stream.stats.Lock()
+	rejected := ts.stream.stats.rejected
+	ts.stream.stats.Unlock()
+	if rejected != 1 {
+		t.Errorf("%d connections rejected, want 1", rejected)
+	}
+	// Its slot comes back once it's closed.
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := tls.Dial("tcp", ts.stream.addr, &tls.Config{RootCAs: ts.roots, Certificates: []tls.Certificate{ts.client}})
+		if err == nil {
+			defer conn.Close()
+			conn.Write([]byte("second\n"))
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	if got := ts.readLine(t); got != "second\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestListenTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "CA")
+	_, certPEM, keyPEM := ca.issue(t, "logmux", x509.ExtKeyUsageServerAuth)
+	cert, key := writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)
+	tests := []struct {
+		cert, key, clientCA string
+		want                string
+	}{
+		{cert, key, "", "need all of"},
+		{"", key, writeFile(t, dir, "ca.pem", ca.pem()), "need all of"},
+		{cert, key, writeFile(t, dir, "empty.pem", []byte("not a cert\n")), "no certs found"},
+		{cert, key, filepath.Join(dir, "missing.pem"), "no such file"},
+		{key, cert, writeFile(t, dir, "ca2.pem", ca.pem()), "PEM"},
+	}
+	for _, tt := range tests {
+		_, err := listenTLSConfig(tt.cert, tt.key, tt.clientCA)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q, %q, %q: got %v, want %q", filepath.Base(tt.cert), filepath.Base(tt.key), filepath.Base(tt.clientCA), err, tt.want)
+		}
+	}
+}
+
+func TestActivatedFd(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		pid     string
+		fds     string
+		fdNames string
+		want    int
+		err     string
+	}{
+		{name: "0", pid: pid, fds: "2", want: 3},
+		{name: "1", pid: pid, fds: "2", want: 4},
+		{name: "2", pid: pid, fds: "2", err: "no socket 2 among the 2"},
+		{name: "syslog", pid: pid, fds: "2", fdNames: "app:syslog", want: 4},
+		{name: "other", pid: pid, fds: "2", fdNames: "app:syslog", err: "no socket other"},
+		{name: "0", pid: "1", fds: "2", err: "LISTEN_PID isn't us"},
+		{name: "0", pid: "", fds: "2", err: "LISTEN_PID isn't us"},
+		{name: "0", pid: pid, fds: "", err: "LISTEN_FDS isn't set"},
+		{name: "0", pid: pid, fds: "0", err: "LISTEN_FDS isn't set"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_PID", tt.pid)
+		t.Setenv("LISTEN_FDS", tt.fds)
+		t.Setenv("LISTEN_FDNAMES", tt.fdNames)
+		fd, err := activatedFd(tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s with LISTEN_PID=%s LISTEN_FDS=%s: got %d, %v, want %s", tt.name, tt.pid, tt.fds, fd, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || fd != tt.want {
+			t.Errorf("%s with LISTEN_FDNAMES=%s: got %d, %v, want %d", tt.name, tt.fdNames, fd, err, tt.want)
+		}
+	}
+}
+
+func TestListenFdStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream takes over the fd, and closes it, so it can't be f's.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if systemd had passed in every fd up to this one, and named this
+	// one "app".
+	i := fd - sdListenFdsStart
+	names := strings.Repeat("other:", i) + "app"
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(i+1))
+	t.Setenv("LISTEN_FDNAMES", names)
+
+	c := captureTCP(t)
+	go func() {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				continue
+			}
+			conn.Write([]byte("one\ntwo\n"))
+			conn.Close()
+			return
+		}
+	}()
+	runMux(t, "--logstash", c.url().String(), "--duration", "500ms", "listen-fd://app:app")
+	want := []string{"app: one", "app: two"}
+	if got := c.lines(t, 0, 2); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// sendUnix connects to the Unix socket at addr once it's being listened on,
+// and sends it lines.
+func sendUnix(addr string, lines string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			continue
+		}
+		conn.Write([]byte(lines))
+		conn.Close()
+		return
+	}
+}
+
+func TestListenUnixStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	// A socket file left behind by a run that's gone doesn't get in the way.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	c := captureTCP(t)
+	go sendUnix(path, "one\ntwo\n")
+	runMux(t, "--logstash", c.url().String(), "--duration", "500ms", "listen-unix://"+path+":app")
+	want := []string{"app: one", "app: two"}
+	if got := c.lines(t, 0, 2); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBadListenUnixStream(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live.sock")
+	ln, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, spec := range []string{"listen-unix://:app", "listen-unix://@:app", "listen-unix://" + live + ":app", "listen-unix://" + dir + "/missing/app.sock:app"} {
+		s, err := parseStreamArg(spec)
+		if err == nil {
+			err = s.Open()
+		}
+		if err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
@@ -3,6 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,328 +16,3168 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // LogstashService is a wrapper around a locally running logstash server.
 // Specify as a raw string like `tcp://localhost:3000`, then it is parsed into
-// a URL, and eventually it's opened as an io.Writer that we can write to
+// a URL, and eventually it's opened as an io.Writer that we can write to.
+// Use a `beats://` URL to talk to logstash's beats input rather than its
+// tcp input, or an `srv://` URL like `srv://_logstash._tcp.example.com` to
+// find logstash through DNS SRV records. Giving more than one URL mirrors
+// every event to each of them.
 type LogstashService struct {
 	url  *url.URL
 	raw  string
-	sink io.Writer
+	sink eventWriter
+	conn net.Conn
+
+	// The lock guards the connection, which can be closed when idle and
+	// reopened on the next write.
+	sync.Mutex
+	idleTimeout time.Duration
+	lastWrite   time.Time
+
+	// done is set once the run is over and the connection's closed for
+	// good, so that it isn't reopened; stopIdle stops closeWhenIdle then.
+	done     bool
+	stopIdle chan struct{}
+
+	// lines is the number of events sent over the connection since it was
+	// opened, for the footer that emitFooter has us send before it's
+	// closed.
+	lines      int64
+	emitFooter bool
+
+	// encoding is the output encoding, "utf-8" or "utf-16le", and bom is set
+	// to write a byte order mark at the start of each connection.
+	encoding string
+	bom      bool
+
+	// tlsConfig is the client side of the handshake for tls:// URLs.
+	tlsConfig *tls.Config
+
+	// udpMax is the biggest event we'll send in a datagram to a udp://
+	// logstash. udpPack, if set, is the biggest datagram to pack events
+	// into instead, and udpEvery the longest an event waits in one.
+	udpMax   int
+	udpPack  int
+	udpEvery time.Duration
+
+	// esIndex, esBatch and esEvery are the index name template, batch size
+	// and longest batch wait for an Elasticsearch bulk API URL.
+	esIndex string
+	esBatch int
+	esEvery time.Duration
+
+	// firehoseRegion is the AWS region of a firehose:// delivery stream.
+	firehoseRegion string
+
+	// amqpExchange is the exchange that an amqp:// logstash publishes to.
+	amqpExchange string
+
+	// kafkaBatch and kafkaLinger are the most messages that a kafka://
+	// logstash produces at once, and the longest it holds them for, and
+	// kafkaKeyTag keys each message by its tag.
+	kafkaBatch  int
+	kafkaLinger time.Duration
+	kafkaKeyTag bool
+
+	// fileMaxBytes, if non-zero, is how big a file:// sink's file gets
+	// before it's rotated, keeping fileBackups of the old ones.
+	fileMaxBytes int64
+	fileBackups  int
+
+	// opts are the options that events were processed with, for sinks that
+	// reshape them, like redis:// wrapping plain events into JSON.
+	opts *Options
+
+	// lookupSRV resolves srv:// URLs; it's net.LookupSRV if nil.
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+
+	// audit records connections opening and closing, if set.
+	audit *auditLog
+
+	// mirrors are the logstashes after the first --logstash, which get a
+	// copy of everything written to this one.
+	mirrors []*LogstashService
+
+	// fallback, if set, is written to instead while writes to this
+	// logstash fail. failedAt is when they last did, and we try this
+	// logstash again once fallbackRetry has passed since.
+	fallback      *LogstashService
+	fallbackRetry time.Duration
+	failedAt      time.Time
+
+	// carried are the events that a sink was batching up for a connection
+	// that failed, to go out first on the next one. While we're on the
+	// fallback, they wait for us to switch back.
+	carried []event
+
+	// writeErr is why the last write to this logstash failed, if it did,
+	// while it's one of several that events are mirrored to.
+	writeErr error
+
+	// Hooks are called as the connection opens and closes; hooked are the
+	// calls waiting for the lock to be released.
+	Hooks
+	hooked []func()
+}
+
+// Hooks are callbacks on a logstash connection's lifecycle, for a program
+// that embeds logmux to drive its own metrics or alerts from. They're called
+// in order, but never with the LogstashService's lock held, so they can call
+// back into it.
+type Hooks struct {
+	// OnConnect, if set, is called once the connection is opened, or
+	// reopened, with the address it's connected to. Sinks without a
+	// connection of their own, like the bulk APIs, give their URL.
+	OnConnect func(addr string)
+
+	// OnDisconnect, if set, is called once the connection is closed, with
+	// the error that it was closed for, or nil if it was closed for being
+	// idle, or because the run is over.
+	OnDisconnect func(err error)
 }
 
 // We can parse command line flags directly into a LogstashService value
 var _ flag.Value = (*LogstashService)(nil)
 
-// Open a connection to a logstash service by dialing TCP.
-func (s *LogstashService) Open() error {
-	f, err := net.Dial("tcp", s.url.Host)
-	if err != nil {
-		return err
-	}
-	s.sink = f
-	return nil
+// event is a processed event on its way out to logstash, shaped by the
+// codec, along with the tag and priority of the stream it came from, and
+// the ack for a Submitter's line that it was made from, if it has one.
+type event struct {
+	tag      string
+	buf      []byte
+	priority int
+	ack      func(error)
 }
 
-// Set the hostname/port of a logstash service as read in from the command line.
-func (s *LogstashService) Set(r string) error {
-	url, err := url.Parse(r)
-	if err != nil {
-		return err
-	}
-	s.url = url
-	s.raw = r
-	return nil
+// eventWriter is an open sink that events are written to. Each write is a
+// batch of whole events, so that sinks that frame events themselves, like
+// message queues, never have to find where one ends.
+type eventWriter interface {
+	writeEvents(evs []event) error
 }
 
-// String representation of a logstash service
-func (s *LogstashService) String() string {
-	return s.raw
+// carrier is a sink that batches events up for the connection it's made
+// over. When that connection fails, the batch is taken to be carried over to
+// the next one, rather than sent down the one that failed, so that nothing
+// in it is lost, or sent over both.
+type carrier interface {
+	carry() []event
 }
 
-// BaseStream is the base class for incoming log streams, which contains a "tag"
-// to apply to all loglines in the stream, a "raw" value that specifies where
-// the stream comes from and the tag, and a "source" from which we can read lines.
-type BaseStream struct {
-	tag    string
-	raw    string
-	source *bufio.Reader
+// streamWriter is a sink that takes events as a stream of bytes, one after
+// another, like logstash's tcp input.
+type streamWriter struct {
+	w io.Writer
 }
 
-// Source returns the buffered IO reader that's the source of this incoming
-// log stream.
-func (b *BaseStream) Source() *bufio.Reader {
-	return b.source
+func (s streamWriter) writeEvents(evs []event) error {
+	var buf []byte
+	for _, ev := range evs {
+		buf = append(buf, ev.buf...)
+	}
+	_, err := s.w.Write(buf)
+	return err
 }
 
-// MarkClosed marks this Stream as closed.
-func (b *BaseStream) MarkClosed() {
-	b.source = nil
+// Open a connection to a logstash service, and to each of its mirrors. If
+// the logstash can't be reached but has a fallback, we start out on the
+// fallback, which is only dialed once it's written to.
+func (s *LogstashService) Open() error {
+	err := s.open()
+	s.runHooks()
+	if err != nil {
+		if s.fallback == nil {
+			return err
+		}
+		s.failOver(err)
+	}
+	for _, l := range s.mirrors {
+		if err := l.Open(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Raw returns the raw string specification of what this stream is.
-func (b *BaseStream) Raw() string {
-	return b.raw
+// sinkScheme is what a --logstash URL scheme's sink can do, and how to
+// connect to it.
+type sinkScheme struct {
+	// dial connects to the sink at the URL's host:port, or is nil for sinks
+	// without a connection of their own, like the bulk APIs, which take a
+	// request per batch. port is the default port, if the URL doesn't give
+	// one.
+	dial func(s *LogstashService, addr string) (net.Conn, error)
+	port string
+
+	// codecs are the --codec values that the sink takes.
+	codecs []string
+
+	// framed is set for sinks that frame each event themselves, as a
+	// datagram, message, record or document, rather than taking a stream of
+	// bytes. Those can't change the output encoding or take raw bytes, and
+	// what says why in errors. documents is set for sinks that only take
+	// JSON documents.
+	framed    bool
+	documents bool
+	what      string
+
+	// check validates a URL of the scheme at startup, if set.
+	check func(s *LogstashService) error
+
+	// open makes the sink, over the connection that dial made.
+	open func(s *LogstashService, conn net.Conn) (eventWriter, error)
 }
 
-// Tag returns the 'tag' that identifies this incoming log stream. Examples
-// might include 'ngingx.access' or 'app.error'.
-func (b *BaseStream) Tag() string {
-	return b.tag
+// allCodecs are the --codec values for sinks that take a stream of bytes.
+var allCodecs = []string{"gelf", "msgpack", "syslog"}
+
+// sinkSchemes are the --logstash URL schemes that we know.
+var sinkSchemes = map[string]sinkScheme{
+	"tcp":    {dial: (*LogstashService).dialTCP, codecs: allCodecs, open: openStream},
+	"tls":    {dial: (*LogstashService).dialTLS, codecs: allCodecs, open: openStream},
+	"srv":    {dial: (*LogstashService).dialSRV, codecs: allCodecs, open: openStream},
+	"unix":   {dial: (*LogstashService).dialUnix, codecs: allCodecs, open: openStream, check: checkUnix},
+	"stdout": {codecs: allCodecs, open: openStdout},
+	"file":   {codecs: allCodecs, open: openFile, check: checkFile},
+	"syslog": {
+		dial: (*LogstashService).dialTCP, codecs: []string{"syslog"}, open: openSyslog,
+		framed: true, what: "a syslog:// logstash",
+	},
+	"udp": {
+		dial: (*LogstashService).dialUDP, open: openUDP,
+		framed: true, what: "a udp:// logstash, whose datagrams are newline-delimited events",
+	},
+	"beats": {
+		dial: (*LogstashService).dialTCP, open: openBeats,
+		framed: true, what: "a beats:// logstash, which takes JSON events",
+	},
+	"redis": {
+		dial: (*LogstashService).dialTCP, port: "6379", open: openRedis, check: checkRedis,
+		framed: true, what: "a redis:// list, whose entries are JSON events",
+	},
+	"nats": {
+		dial: (*LogstashService).dialTCP, port: "4222", open: openNats,
+		framed: true, what: "nats://, which publishes each event as a message",
+	},
+	"amqp": {
+		dial: (*LogstashService).dialTCP, port: "5672", open: openAMQP,
+		framed: true, what: "amqp://, which publishes each event as a message",
+	},
+	"http": {
+		open: openES, framed: true, documents: true,
+		what: "Elasticsearch, which takes JSON documents",
+	},
+	"https": {
+		open: openES, framed: true, documents: true,
+		what: "Elasticsearch, which takes JSON documents",
+	},
+	"firehose": {
+		open: openFirehose, check: checkFirehose,
+		framed: true, what: "a firehose:// delivery stream, whose records are newline-terminated events",
+	},
+	"kafka": {
+		open: openKafka, check: checkKafka,
+		framed: true, what: "a kafka:// topic, which takes each event as a message",
+	},
+	"cloudwatch": {
+		open: openCloudWatch, check: checkCloudWatch,
+		framed: true, what: "a cloudwatch:// log stream, which takes each event as a log event",
+	},
 }
 
-// NamedPipeStream is a subclass of a BaseStream that's made from opening a
-// named pipe at the given path.
-type NamedPipeStream struct {
-	BaseStream
-	path string
+// takes returns true if the sink takes the given --codec value.
+func (k sinkScheme) takes(codec string) bool {
+	if codec == "" {
+		return true
+	}
+	for _, c := range k.codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
 }
 
-// Open a NamedPipeStream. If no file exists, then make a FIFO. If one exists,
-// that's a FIFO, then return it. Otherwise, error out.
-func (n *NamedPipeStream) Open() error {
-	s, err := os.Stat(n.path)
+// Flush sends out anything that's batched up for the logstash, its mirrors
+// and its fallback, as we're exiting.
+func (s *LogstashService) Flush() error {
+	var err error
+	for _, l := range s.each() {
+		l.Lock()
+		if len(l.carried) > 0 && !l.done {
+			if serr := l.send(nil); serr != nil && err == nil {
+				err = serr
+			}
+		}
+		if f, ok := l.sink.(interface{ Flush() error }); ok {
+			if ferr := f.Flush(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+		l.Unlock()
+	}
+	return err
+}
 
-	if err != nil {
-		err = syscall.Mkfifo(n.path, 0666)
-	} else if (s.Mode() & os.ModeNamedPipe) == 0 {
-		err = fmt.Errorf("not overwriting non-named pipe: %s", n.path)
+// hasScheme returns true if the logstash, or any of its mirrors or its
+// fallback, has a URL with the given scheme.
+func (s *LogstashService) hasScheme(scheme string) bool {
+	for _, l := range s.each() {
+		if l.url != nil && l.url.Scheme == scheme {
+			return true
+		}
 	}
-	if err != nil {
-		return err
+	return false
+}
+
+// each returns the logstash service followed by its mirrors, and its
+// fallback if it has one.
+func (s *LogstashService) each() []*LogstashService {
+	ret := append([]*LogstashService{s}, s.mirrors...)
+	if s.fallback != nil {
+		ret = append(ret, s.fallback)
 	}
-	return nil
+	return ret
 }
 
-// Preread is called before every read. It allows us to reopen a
-// NamedPipeStream if it had been closed the previous iteration in the read
-// loop.
-func (n *NamedPipeStream) Preread() error {
-	if n.source != nil {
-		return nil
+// open a connection to just this logstash, without its mirrors, and make
+// the sink for its scheme over it.
+func (s *LogstashService) open() error {
+	if s.done {
+		// A stream that's still going after the run ended on another's
+		// error doesn't get to open it again.
+		return errors.New("logmux is exiting")
 	}
-	file, err := os.OpenFile(n.path, os.O_RDONLY, os.ModeNamedPipe)
+	scheme := sinkSchemes[s.url.Scheme]
+	var conn net.Conn
+	addr := s.redacted()
+	if scheme.dial != nil {
+		addr = s.url.Host
+		if scheme.port != "" && s.url.Port() == "" {
+			addr = net.JoinHostPort(s.url.Hostname(), scheme.port)
+		}
+		f, err := scheme.dial(s, addr)
+		if err != nil {
+			s.audit.record("sink_dial_failed", "logstash", s.redacted(), "error", err.Error())
+			return err
+		}
+		s.audit.record("sink_open", "logstash", s.redacted(), "addr", f.RemoteAddr().String())
+		conn, addr = f, f.RemoteAddr().String()
+	} else {
+		s.audit.record("sink_open", "logstash", s.redacted())
+	}
+	// The connection is ours before the sink is made, so that it can be
+	// watched for the peer closing it.
+	s.conn, s.lastWrite, s.lines = conn, time.Now(), 0
+	sink, err := scheme.open(s, conn)
 	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		s.conn = nil
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "opened named pipe for tag %s: %s\n", n.tag, n.path)
-	n.source = newBufferedReader(file)
+	s.sink = sink
+	if s.OnConnect != nil {
+		s.hook(func() { s.OnConnect(addr) })
+	}
 	return nil
 }
 
-// PipeStream wraps a standard nameless pipe, as handed to the process by a
-// file descript. It can't be reopened once it closes.
-type PipeStream struct {
-	BaseStream
-	fd int64
+// hook queues a lifecycle callback for runHooks. The lock must be held, or
+// the service not yet shared.
+func (s *LogstashService) hook(f func()) {
+	s.hooked = append(s.hooked, f)
 }
 
-// Preread is called before a PipeStream incoming log stream is read from.
-// If the source has been closed, then we just return EOF and abandon ship,
-// since we can't reopen it.
-func (p *PipeStream) Preread() error {
-	if p.source == nil {
-		return io.EOF
+// runHooks calls the queued lifecycle callbacks, in order. The lock mustn't
+// be held.
+func (s *LogstashService) runHooks() {
+	s.Lock()
+	hooked := s.hooked
+	s.hooked = nil
+	s.Unlock()
+	for _, f := range hooked {
+		f()
 	}
-	return nil
 }
 
-// Open is called to open a PipeStream, which simply wraps the given file descriptor
-// in a buffered reader.
-func (p *PipeStream) Open() error {
-	p.source = newBufferedReader(os.NewFile(uintptr(p.fd), fmt.Sprintf("fd=%d", p.fd)))
-	return nil
+// disconnected queues the OnDisconnect callback for the connection having
+// closed, for the given error. The lock must be held.
+func (s *LogstashService) disconnected(err error) {
+	if s.OnDisconnect != nil {
+		s.hook(func() { s.OnDisconnect(err) })
+	}
 }
 
-// Stream is the interface to either a PipeStream or a NamedPipeStream. Most
-// methods are handled by the BaseStream class, but openings and prereads
-// are handled by the subclasses.
-type Stream interface {
-	Open() error
-	Preread() error
-	Raw() string
-	MarkClosed()
-	Source() *bufio.Reader
-	Tag() string
+// openStream makes a sink that takes events as a stream of bytes over conn.
+func openStream(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	s.drain(conn)
+	w, err := s.encodeSink(conn)
+	return streamWriter{w}, err
 }
 
-// PipeStream and NamedPipeStream are the two instantiations of the Stream interface.
-var _ Stream = (*PipeStream)(nil)
-var _ Stream = (*NamedPipeStream)(nil)
+// openStdout makes a stdout:// sink, which is already open.
+func openStdout(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	w, err := s.encodeSink(os.Stdout)
+	return streamWriter{w}, err
+}
 
-// Mux is the high level object that has all of the configuration for this run
-// of logmux. Meaning, it knows where the logs are coming from, and to which
-// logstash service they are going to.
-type Mux struct {
-	logstash LogstashService
-	streams  []Stream
+// drain reads whatever comes back on a connection to a sink that we never
+// expect anything from, like a tcp input, so that logstash's send buffer
+// can't fill up and stall the connection.
+func (s *LogstashService) drain(conn net.Conn) {
+	go func() {
+		io.Copy(io.Discard, conn)
+		s.closedByPeer(conn)
+	}()
 }
 
-// Configure a Mux, opening the logstash connection and all of the incoming
-// log streams.
-func (m *Mux) Configure() error {
-	err := m.logstash.Open()
-	if err != nil {
-		return err
+// clone returns an unopened copy of the service, for its own connection to
+// the same logstash.
+func (s *LogstashService) clone() *LogstashService {
+	var mirrors []*LogstashService
+	for _, l := range s.mirrors {
+		mirrors = append(mirrors, l.clone())
 	}
-	for _, s := range m.streams {
-		if err := s.Open(); err != nil {
-			return err
-		}
+	var fallback *LogstashService
+	if s.fallback != nil {
+		fallback = s.fallback.clone()
+	}
+	return &LogstashService{
+		url:         s.url,
+		raw:         s.raw,
+		idleTimeout: s.idleTimeout,
+		emitFooter:  s.emitFooter,
+		encoding:    s.encoding,
+		bom:         s.bom,
+		tlsConfig:   s.tlsConfig,
+		udpMax:      s.udpMax,
+		udpPack:     s.udpPack,
+		udpEvery:    s.udpEvery,
+		esIndex:     s.esIndex,
+		esBatch:     s.esBatch,
+		esEvery:     s.esEvery,
+		lookupSRV:   s.lookupSRV,
+		audit:       s.audit,
+		mirrors:     mirrors,
+
+		fallback:      fallback,
+		fallbackRetry: s.fallbackRetry,
+		Hooks:         s.Hooks,
+
+		firehoseRegion: s.firehoseRegion,
+		amqpExchange:   s.amqpExchange,
+		kafkaBatch:     s.kafkaBatch,
+		kafkaLinger:    s.kafkaLinger,
+		kafkaKeyTag:    s.kafkaKeyTag,
+		fileMaxBytes:   s.fileMaxBytes,
+		fileBackups:    s.fileBackups,
+		opts:           s.opts,
 	}
-	return nil
 }
 
-func newBufferedReader(r io.Reader) *bufio.Reader {
-	return bufio.NewReaderSize(r, 1024*1024*4)
+// Write events out to logstash, and a copy to each of its mirrors. Every one
+// of them is written to even if another fails. With mirrors, a write only
+// fails if it failed for all of them, with the first error; one that fails
+// while the others don't is noted, and tried again with the next write, so
+// that a sink that's down (or a file:// sink on a full disk) can't hold up
+// the rest.
+func (s *LogstashService) Write(evs []event) error {
+	err := s.writeAll(evs)
+	ackEvents(evs, err)
+	return err
 }
 
-func hasNonSpace(buf []byte) bool {
-	for _, b := range buf {
-		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
-			return true
+// writeAll writes events to this logstash and its mirrors, for Write. The
+// events' acks only go with the copy written to this one.
+func (s *LogstashService) writeAll(evs []event) error {
+	err := s.write(evs)
+	if len(s.mirrors) == 0 {
+		return err
+	}
+	ok := s.wrote(err)
+	copied := withoutAcks(evs)
+	for _, l := range s.mirrors {
+		merr := l.write(copied)
+		if merr != nil && err == nil {
+			err = fmt.Errorf("mirror %s: %s", l.redacted(), merr)
 		}
+		ok = l.wrote(merr) || ok
 	}
-	return false
+	if ok {
+		return nil
+	}
+	return err
 }
 
-func processLine(buf []byte, tag string) []byte {
-	buf = bytes.TrimSpace(buf)
-	if len(buf) == 0 {
-		return buf
-	}
-	lst := len(buf) - 1
-	if buf[0] == '{' && buf[lst] == '}' {
-		if hasNonSpace(buf[1:lst]) {
-			buf = append(buf[0:lst], []byte(fmt.Sprintf(",\"tag\":%q}", tag))...)
-		} else {
-			buf = []byte(fmt.Sprintf("{\"tag\":%q}", tag))
+// wrote records how a write to one of several mirrored logstashes went, and
+// returns true if it went through. Its first failure, and its recovery, are
+// noted on stderr and in the audit file. A failed connection is closed, to
+// be redialed by the next write.
+func (s *LogstashService) wrote(err error) bool {
+	defer s.runHooks()
+	s.Lock()
+	defer s.Unlock()
+	if err == nil {
+		if s.writeErr != nil {
+			s.audit.record("sink_recovered", "logstash", s.redacted())
+			fmt.Fprintf(os.Stderr, "writes to logstash at %s are going through again\n", s.redacted())
 		}
-	} else {
-		tmp := append([]byte(tag), []byte(": ")...)
-		buf = append(tmp, buf...)
+		s.writeErr = nil
+		return true
 	}
-	buf = append(buf, '\n')
-	return buf
+	if s.writeErr == nil {
+		s.audit.record("sink_write_failed", "logstash", s.redacted(), "error", err.Error())
+		fmt.Fprintf(os.Stderr, "couldn't write to logstash at %s (%s); still writing to the others\n", s.redacted(), err)
+	}
+	s.writeErr = err
+	if s.conn != nil {
+		s.close(err)
+	}
+	return false
 }
 
-func readOne(s Stream, l *LogstashService) error {
-	err := s.Preread()
-	if err != nil {
-		return err
+// reconnect closes the connection after a failed write, for it to be
+// redialed by the next one. Sinks without a connection of their own are
+// kept.
+func (s *LogstashService) reconnect(err error) {
+	defer s.runHooks()
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		s.close(err)
 	}
-	buf, err := s.Source().ReadBytes('\n')
-	var e2 error
-	if len(buf) > 0 {
-		buf = processLine(buf, s.Tag())
-		_, e2 = l.sink.Write(buf)
-	}
-	if err == io.EOF {
-		s.MarkClosed()
-		return nil
+}
+
+// write events out to just this logstash, or its fallback while this one is
+// failing. Once the fallback retry has passed, we try this one again, and
+// switch back if it takes the write.
+func (s *LogstashService) write(evs []event) error {
+	defer s.runHooks()
+	s.Lock()
+	defer s.Unlock()
+	failing := !s.failedAt.IsZero()
+	if failing && time.Since(s.failedAt) < s.fallbackRetry {
+		return s.fallback.write(evs)
 	}
-	if err != nil {
-		return err
+	err := s.send(evs)
+	if err != nil && s.fallback != nil {
+		s.failOver(err)
+		return s.fallback.write(evs)
 	}
-	if e2 != nil {
-		return e2
+	if err == nil && failing {
+		s.failedAt = time.Time{}
+		s.audit.record("sink_failback", "logstash", s.redacted(), "fallback", s.fallback.redacted())
+		fmt.Fprintf(os.Stderr, "logstash at %s is back; switching back to it from %s\n", s.redacted(), s.fallback.redacted())
 	}
-	return nil
+	return err
 }
 
-// Run the given stream, reading incoming log lines from it, and outputting
-// tagged lines to logstash.  If there's an error, the send it to the given
-// channel.
-func Run(s Stream, l *LogstashService, ch chan<- error, single bool) {
-	for {
-		err := readOne(s, l)
-		if err != nil {
-			if !single {
-				fmt.Fprintf(os.Stderr, "%s: ending log read loop on condition: %s\n", s.Tag(), err)
-			}
-			ch <- err
-			break
-		}
+// failOver drops our connection after a failure, so that writes go to the
+// fallback until it's time to retry.
+func (s *LogstashService) failOver(err error) {
+	if s.failedAt.IsZero() {
+		s.audit.record("sink_failover", "logstash", s.redacted(), "fallback", s.fallback.redacted(), "error", err.Error())
+		fmt.Fprintf(os.Stderr, "couldn't write to logstash at %s (%s); switching to %s\n", s.redacted(), err, s.fallback.redacted())
 	}
-	return
+	// Sinks without a connection of their own, like a bulk API's, are
+	// kept, along with whatever they have batched up, for when we switch
+	// back.
+	if s.conn != nil {
+		s.close(err)
+	}
+	s.failedAt = time.Now()
 }
 
-// Run the logmux, by first configuring it, and then by running each incoming
-// log stream in its own go routine. End the program with an error when the first
-// incoming stream dies on an non-EOF error.
-func (m *Mux) Run() error {
-	err := m.Configure()
-	if err != nil {
-		return err
+// closedByPeer is called once logstash closes the given connection. With a
+// fallback, we fail over right away, rather than lose the next write to a
+// connection that's already gone.
+func (s *LogstashService) closedByPeer(f net.Conn) {
+	defer s.runHooks()
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == f && s.fallback != nil {
+		s.failOver(errors.New("connection closed by logstash"))
 	}
-	ch := make(chan error, 10)
-	n := 0
-	isSingle := len(m.streams) == 1
-	for _, s := range m.streams {
-		n++
-		go Run(s, &m.logstash, ch, isSingle)
+}
+
+// send writes events to this logstash's connection, reopening it first if
+// it was closed, and writing anything carried over from the one before. Over
+// a unix socket, a failed write is tried once more on a new connection,
+// since logstash recreates its socket file when it restarts, and likewise
+// for AMQP, whose broker connections can be dropped under us. The lock must be held.
+func (s *LogstashService) send(evs []event) error {
+	if s.sink == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
 	}
-	for err := range ch {
-		n--
-		if err != io.EOF {
+	if len(s.carried) > 0 {
+		if err := s.sink.writeEvents(s.carried); err != nil {
 			return err
 		}
-		if n == 0 {
-			return nil
+		s.lines += int64(len(s.carried))
+		s.carried = nil
+	}
+	s.lastWrite = time.Now()
+	err := s.sink.writeEvents(evs)
+	if err != nil && (s.url.Scheme == "unix" || s.url.Scheme == "amqp") {
+		s.close(err)
+		if err := s.open(); err != nil {
+			return err
 		}
+		err = s.sink.writeEvents(evs)
 	}
-	return nil
+	if err == nil {
+		s.lines += int64(len(evs))
+	}
+	return err
 }
 
-// parseStreamArg takes an input a raw stream specification (as collected
-// from the OS CLI), and returns a stream object that represents an incoming
-// log stream. The format is <specifier>:<tag>. Integer specifiers are treated
-// as nameless pipes, while string specifiers are treated as paths that indicate
-// named pipes.
-func parseStreamArg(raw string) (ret Stream, err error) {
-	parts := strings.Split(raw, ":")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("Specified stream %s has wrong number of components (%d)", raw, len(parts))
+// footerTimeout is how long we give the footer on a connection that's being
+// closed, which may well be closing because it's stopped taking writes.
+const footerTimeout = 5 * time.Second
+
+// close sends the footer over the connection, along with anything the sink
+// is holding on to, and closes it, for the given error, or for being idle if
+// it's nil. A batch for a connection that's failed is carried over to the
+// next one instead. The lock must be held.
+func (s *LogstashService) close(err error) {
+	if c, ok := s.sink.(carrier); ok && err != nil {
+		s.carried = append(s.carried, c.carry()...)
 	}
-	baseStream := BaseStream{tag: parts[1], raw: raw}
-	fd, err := strconv.ParseInt(parts[0], 10, 64)
-	if err == nil {
-		ret = &PipeStream{BaseStream: baseStream, fd: fd}
-	} else {
-		ret = &NamedPipeStream{BaseStream: baseStream, path: parts[0]}
+	s.conn.SetDeadline(time.Now().Add(footerTimeout))
+	s.writeFooter()
+	if f, ok := s.sink.(interface{ Flush() error }); ok {
+		f.Flush()
 	}
-	return ret, nil
+	s.conn.Close()
+	s.sink, s.conn = nil, nil
+	reason := "idle"
+	if err != nil {
+		reason = err.Error()
+	}
+	s.audit.record("sink_close", "logstash", s.redacted(), "reason", reason)
+	s.disconnected(err)
 }
 
-func printHelp(fs *flag.FlagSet) {
-	fmt.Printf(`NAME
-	logmux -- mux several input log streams into one
+// shutdown closes the connection for good once the run is over, without a
+// footer, as Run has already sent one. The lock must be held.
+func (s *LogstashService) shutdown() {
+	s.done = true
+	if s.stopIdle != nil {
+		close(s.stopIdle)
+		s.stopIdle = nil
+	}
+	ackEvents(s.carried, errors.New("logmux is exiting"))
+	s.carried = nil
+	if s.conn == nil {
+		return
+	}
+	s.conn.Close()
+	s.sink, s.conn = nil, nil
+	s.audit.record("sink_close", "logstash", s.redacted(), "reason", "exit")
+	s.disconnected(nil)
+}
 
-OVERVIEW
-	A simple program that takes one or more log streams, and smashes them
-	together into one stream that's sent into a logstash server process.
-	Likely that process is on localhost, but it doesn't have to be. Each
-	incoming stream gets it own tag so that the streams can be disambiguated
-	in ELK.
+// writeFooter sends a footer event with the number of events sent over the
+// connection, with --emit-footer, so that a consumer can tell if it missed
+// any. The lock must be held.
+func (s *LogstashService) writeFooter() error {
+	if !s.emitFooter || s.sink == nil {
+		return nil
+	}
+	body := []byte(fmt.Sprintf("{\"lines\":%d}", s.lines))
+	return s.sink.writeEvents([]event{{tag: footerTag, buf: s.opts.ownEvent(body, footerTag)}})
+}
 
-	Specify the logstash location with:
+// closeWhenIdle closes the connection to logstash (and to each of its
+// mirrors, and its fallback) whenever nothing has been written to it for the
+// idle timeout, until the run is over. The next Write reopens it.
+func (s *LogstashService) closeWhenIdle() {
+	for _, l := range s.each()[1:] {
+		go l.closeWhenIdle()
+	}
+	every := s.idleTimeout / 2
+	if every < time.Millisecond {
+		every = time.Millisecond
+	}
+	s.Lock()
+	if s.done {
+		s.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	s.stopIdle = stop
+	s.Unlock()
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		s.Lock()
+		if s.conn != nil && time.Since(s.lastWrite) >= s.idleTimeout {
+			s.close(nil)
+		}
+		s.Unlock()
+		s.runHooks()
+	}
+}
+
+// srvLookupAttempts is how many times we try an SRV lookup before giving up,
+// and srvLookupWait is how long we wait between tries.
+const srvLookupAttempts = 3
+
+var srvLookupWait = time.Second
+
+// resolveSRV looks up the targets of an srv:// URL, in the order they should
+// be tried. LookupSRV sorts them by priority, and randomizes them by weight
+// within a priority.
+func (s *LogstashService) resolveSRV() ([]string, error) {
+	lookup := s.lookupSRV
+	if lookup == nil {
+		lookup = net.LookupSRV
+	}
+	var err error
+	for i := 0; i < srvLookupAttempts; i++ {
+		if i > 0 {
+			time.Sleep(srvLookupWait)
+		}
+		var srvs []*net.SRV
+		_, srvs, err = lookup("", "", s.url.Host)
+		if err == nil && len(srvs) == 0 {
+			err = fmt.Errorf("no SRV records for %s", s.url.Host)
+		}
+		if err == nil {
+			var ret []string
+			for _, srv := range srvs {
+				ret = append(ret, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+			}
+			return ret, nil
+		}
+	}
+	return nil, fmt.Errorf("resolving logstash SRV records: %s", err)
+}
+
+func (s *LogstashService) dialTCP(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (s *LogstashService) dialTLS(addr string) (net.Conn, error) {
+	return tls.Dial("tcp", addr, s.tlsConfig)
+}
+
+func (s *LogstashService) dialUDP(addr string) (net.Conn, error) {
+	return net.Dial("udp", addr)
+}
+
+// dialUnix connects to the URL's socket path, as there's no host.
+func (s *LogstashService) dialUnix(string) (net.Conn, error) {
+	return net.Dial("unix", s.url.Path)
+}
+
+// checkUnix checks that a unix:// URL has a socket path.
+func checkUnix(s *LogstashService) error {
+	if s.url.Path == "" {
+		return fmt.Errorf("bad --logstash value: %s; want unix:///path/to/socket", s.raw)
+	}
+	return nil
+}
+
+// dialSRV resolves an srv:// URL's host on every dial, and tries its targets
+// in turn until one connects.
+func (s *LogstashService) dialSRV(string) (net.Conn, error) {
+	addrs, err := s.resolveSRV()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var f net.Conn
+		if f, err = net.Dial("tcp", addr); err == nil {
+			return f, nil
+		}
+		fmt.Fprintf(os.Stderr, "couldn't dial logstash at %s: %s\n", addr, err)
+	}
+	return nil, err
+}
+
+// logstashTLSConfig builds the client config for a tls:// logstash at the
+// given host, which must present a cert for that name, signed by one of the
+// system's CAs or the ones in the caFile bundle, if given. If there's a
+// client cert, it's presented to logstash in turn.
+func logstashTLSConfig(host, caFile string, client *clientCert) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if client != nil {
+		config.GetClientCertificate = client.get
+	}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certs found in %s", caFile)
+	}
+	return config, nil
+}
+
+// clientCert is the client cert presented to a tls:// logstash or an
+// https:// Elasticsearch. It's loaded from its files again for each
+// handshake, so that a cert that's rotated on disk goes out on the next
+// connection without a restart. If they don't load, as in the middle of a
+// rotation, the last cert that did is presented instead.
+type clientCert struct {
+	load func() (tls.Certificate, error)
+
+	sync.Mutex
+	last tls.Certificate
+}
+
+// newClientCert loads a client cert for the first time, which has to work.
+func newClientCert(load func() (tls.Certificate, error)) (*clientCert, error) {
+	cert, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &clientCert{load: load, last: cert}, nil
+}
+
+// get is the tls.Config's GetClientCertificate, which reloads the cert.
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+	cert, err := c.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't reload the client cert, so presenting the last one: %s\n", err)
+		cert = c.last
+	}
+	c.last = cert
+	return &cert, nil
+}
+
+// Set the hostname/port of a logstash service as read in from the command
+// line. After the first, they're mirrors. A "-" is short for stdout://.
+func (s *LogstashService) Set(r string) error {
+	u := r
+	if u == "-" {
+		u = "stdout://"
+	}
+	url, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if s.url != nil {
+		s.mirrors = append(s.mirrors, &LogstashService{url: url, raw: r})
+		return nil
+	}
+	s.url = url
+	s.raw = r
+	return nil
+}
+
+// String representation of a logstash service
+func (s *LogstashService) String() string {
+	return s.redacted()
+}
+
+// redacted is the logstash URL as it was given, but with any password in it
+// masked, for stderr and the audit file.
+func (s *LogstashService) redacted() string {
+	if s.url == nil || s.url.User == nil {
+		return s.raw
+	}
+	return s.url.Redacted()
+}
+
+// BaseStream is the base class for incoming log streams, which contains a "tag"
+// to apply to all loglines in the stream, a "raw" value that specifies where
+// the stream comes from and the tag, and a "source" from which we can read lines.
+type BaseStream struct {
+	tag    string
+	raw    string
+	source *bufio.Reader
+	opts   StreamOptions
+	stats  StreamStats
+
+	// pending is the multiline event being assembled, when the stream has
+	// a multiline-start pattern.
+	pending bytes.Buffer
+}
+
+// StreamStats are live counters for an incoming log stream. They're updated
+// by the stream's read loop, and read concurrently by the status server.
+type StreamStats struct {
+	sync.Mutex
+	state    string
+	lines    int64
+	dropped  int64
+	rejected int64
+	lastLine time.Time
+}
+
+// setState records where the stream is in its lifecycle: "open" while it has
+// a source to read from, "closed" when it's waiting to be reopened, "paused"
+// while its writes are held up, and "ended" once its read loop is over.
+func (s *StreamStats) setState(state string) {
+	s.Lock()
+	s.state = state
+	s.Unlock()
+}
+
+// shipped records that n lines were written out to logstash.
+func (s *StreamStats) shipped(n int) {
+	s.Lock()
+	s.lines += int64(n)
+	s.lastLine = time.Now()
+	s.Unlock()
+}
+
+// drop records that a line was dropped rather than written out.
+func (s *StreamStats) drop() {
+	s.Lock()
+	s.dropped++
+	s.Unlock()
+}
+
+// reject records that a connection was turned away by --max-connections.
+func (s *StreamStats) reject() {
+	s.Lock()
+	s.rejected++
+	s.Unlock()
+}
+
+// Stats returns the live counters for this incoming log stream.
+func (b *BaseStream) Stats() *StreamStats {
+	return &b.stats
+}
+
+// StreamOptions are per-stream settings, given after the tag in a stream
+// specification as ;key=value pairs, like `6:app.error;format=plain`.
+type StreamOptions struct {
+	// format is how lines are output: "auto" ships JSON lines as JSON and
+	// everything else as plain text, "plain" ships every line as plain text,
+	// and "json" wraps plain lines into JSON objects. If unset for a stream,
+	// then the global --format applies.
+	format string
+
+	// framing is how records are split: "line" for newline-delimited lines,
+	// or "length" for binary records each prefixed with a 4-byte big-endian
+	// length. Length-framed records are shipped as JSON events with the
+	// payload base64-encoded under "data". "journal-export" reads records in
+	// the systemd journal export format, and ships each as a JSON event.
+	// "raw" relays bytes to logstash as they come, untouched, for streams
+	// that carry a framed protocol of their own. If unset for a stream, then
+	// the global --parse applies.
+	framing string
+
+	// minLineBytes, if non-zero, drops lines whose content (after trimming
+	// whitespace, but before tagging) is shorter than this many bytes. If
+	// zero for a stream, then the global --min-line-bytes applies.
+	minLineBytes int
+
+	// multilineStart, if set, joins lines into multiline events: a line that
+	// matches it starts a new event, and every line up to the next match
+	// (blank or indented lines included) is appended to it. If unset for a
+	// stream, then the global --multiline-start-pattern applies.
+	multilineStart *regexp.Regexp
+
+	// dropBadJSON, if set, drops (and counts) lines that aren't valid JSON,
+	// for streams that should only ever emit JSON, rather than shipping them
+	// as plain text.
+	dropBadJSON bool
+
+	// retryable are the read errors that a line-framed stream retries
+	// rather than ending on. They're always the global --retryable-errors.
+	retryable errnos
+
+	// recordSeparator, if set, splits each line further into records that
+	// are each shipped as their own event, for producers that pack records
+	// into a line with something like an ASCII RS (\x1e). Empty records are
+	// dropped. If unset for a stream, then the global --record-separator
+	// applies.
+	recordSeparator string
+
+	// aggregate, if set, ships a periodic summary of the stream's lines
+	// instead of the lines themselves.
+	aggregate *aggregator
+
+	// timestamp, if set, takes each plain line's @timestamp from the line
+	// itself. Whatever a stream doesn't set comes from the global
+	// --timestamp-* flags.
+	timestamp *timestampParser
+
+	// parseErrors, if set, fails the stream when its timestamp parser
+	// can't find timestamps in its lines, per --fail-on-parse-error.
+	parseErrors *parseErrors
+
+	// tailFrom is where a file:// stream starts reading a file that it has
+	// no --state-dir checkpoint for: "end" for only the lines written to it
+	// from then on, or "beginning" for the whole file. If unset for a
+	// stream, then the global --tail-from applies.
+	tailFrom string
+
+	// pathPattern, if set, pulls fields out of a file:// stream's path with
+	// its named capture groups, like the pod and container of a Kubernetes
+	// container log, and pathFields are what it found, which are added to
+	// each of the stream's events.
+	pathPattern *regexp.Regexp
+	pathFields  []field
+
+	// priority orders the stream's events against other streams' in a
+	// batching sink, like Elasticsearch's bulk API: a higher one's go into
+	// the next batch ahead of a backlog from lower ones. It's 0 by default.
+	priority int
+
+	// reconnect is how the stream's failed writes to logstash are retried.
+	// Whatever a stream doesn't set comes from the global --reconnect-*
+	// flags.
+	reconnect *backoff
+}
+
+// validFormat returns true if f is a known output format.
+func validFormat(f string) bool {
+	return f == "auto" || f == "plain" || f == "json"
+}
+
+// knownErrnos are the errors that --retryable-errors can name.
+var knownErrnos = map[string]syscall.Errno{
+	"EINTR":      syscall.EINTR,
+	"EAGAIN":     syscall.EAGAIN,
+	"EIO":        syscall.EIO,
+	"ECONNRESET": syscall.ECONNRESET,
+	"ETIMEDOUT":  syscall.ETIMEDOUT,
+}
+
+// errnos are the --retryable-errors, which can be given as a comma-separated
+// list. EINTR is always retryable.
+type errnos []syscall.Errno
+
+// We can parse command line flags directly into an errnos value
+var _ flag.Value = (*errnos)(nil)
+
+// Set adds a comma-separated list of errno names as read in from the command
+// line.
+func (e *errnos) Set(r string) error {
+	for _, name := range strings.Split(r, ",") {
+		errno, ok := knownErrnos[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return fmt.Errorf("unknown error %q; want one of EINTR, EAGAIN, EIO, ECONNRESET, ETIMEDOUT", name)
+		}
+		*e = append(*e, errno)
+	}
+	return nil
+}
+
+// String representation of the errnos
+func (e *errnos) String() string {
+	var parts []string
+	for _, errno := range *e {
+		for name, known := range knownErrnos {
+			if known == errno {
+				parts = append(parts, name)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// has returns true if err is one of the errnos, or EINTR.
+func (e errnos) has(err error) bool {
+	if errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	for _, errno := range e {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSeparator reads a separator that can be written with Go escapes, like
+// \x1e.
+func parseSeparator(val string) (string, error) {
+	sep, err := strconv.Unquote(`"` + val + `"`)
+	if err != nil || sep == "" || strings.Contains(sep, "\n") {
+		return "", fmt.Errorf("bad separator: %s", val)
+	}
+	return sep, nil
+}
+
+// validFraming returns true if f is a known record framing.
+func validFraming(f string) bool {
+	return f == "line" || f == "length" || f == "journal-export" || f == "raw"
+}
+
+// set a single key=value stream option.
+func (o *StreamOptions) set(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad stream option %q; want key=value", kv)
+	}
+	key, val := parts[0], parts[1]
+	switch key {
+	case "format":
+		if !validFormat(val) {
+			return fmt.Errorf("bad stream format: %s", val)
+		}
+		o.format = val
+	case "framing":
+		if !validFraming(val) {
+			return fmt.Errorf("bad stream framing: %s", val)
+		}
+		o.framing = val
+	case "min-line-bytes":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad stream min-line-bytes: %s", val)
+		}
+		o.minLineBytes = n
+	case "multiline-start":
+		re, err := regexp.Compile(val)
+		if err != nil {
+			return fmt.Errorf("bad stream multiline-start: %s", err)
+		}
+		o.multilineStart = re
+	case "drop-unparseable-json":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("bad stream drop-unparseable-json: %s", val)
+		}
+		o.dropBadJSON = b
+	case "record-separator":
+		rs, err := parseSeparator(val)
+		if err != nil {
+			return fmt.Errorf("bad stream record-separator: %s", val)
+		}
+		o.recordSeparator = rs
+	case "aggregate":
+		a, err := newAggregator(val)
+		if err != nil {
+			return err
+		}
+		o.aggregate = a
+	case "tail-from":
+		if val != "end" && val != "beginning" {
+			return fmt.Errorf("bad stream tail-from: %s", val)
+		}
+		o.tailFrom = val
+	case "path-fields":
+		re, err := parsePathPattern(val)
+		if err != nil {
+			return err
+		}
+		o.pathPattern = re
+	case "priority":
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("bad stream priority: %s", val)
+		}
+		o.priority = n
+	case "reconnect-backoff", "reconnect-backoff-max", "reconnect-attempts":
+		if o.reconnect == nil {
+			o.reconnect = &backoff{first: -1, max: -1, attempts: -1}
+		}
+		return o.reconnect.set(key, val)
+	case "timestamp-pattern", "timestamp-layout", "timestamp-zone", "strip-timestamp":
+		if o.timestamp == nil {
+			o.timestamp = &timestampParser{}
+		}
+		return o.timestamp.set(key, val)
+	default:
+		return fmt.Errorf("unknown stream option: %s", key)
+	}
+	return nil
+}
+
+// Options returns the per-stream settings for this incoming log stream.
+func (b *BaseStream) Options() *StreamOptions {
+	return &b.opts
+}
+
+// Pending returns the multiline event that's being assembled off of this
+// stream.
+func (b *BaseStream) Pending() *bytes.Buffer {
+	return &b.pending
+}
+
+// Source returns the buffered IO reader that's the source of this incoming
+// log stream.
+func (b *BaseStream) Source() *bufio.Reader {
+	return b.source
+}
+
+// MarkClosed marks this Stream as closed.
+func (b *BaseStream) MarkClosed() {
+	b.source = nil
+}
+
+// Raw returns the raw string specification of what this stream is.
+func (b *BaseStream) Raw() string {
+	return b.raw
+}
+
+// Tag returns the 'tag' that identifies this incoming log stream. Examples
+// might include 'ngingx.access' or 'app.error'.
+func (b *BaseStream) Tag() string {
+	return b.tag
+}
+
+// NamedPipeStream is a subclass of a BaseStream that's made from opening a
+// named pipe at the given path.
+type NamedPipeStream struct {
+	BaseStream
+	path string
+
+	// reopens, if non-nil, is a semaphore shared by all named pipes that
+	// limits how many of them can be blocked reopening at once.
+	reopens chan struct{}
+}
+
+// Open a NamedPipeStream. If no file exists, then make a FIFO. If one exists,
+// that's a FIFO, then return it. Otherwise, error out.
+func (n *NamedPipeStream) Open() error {
+	s, err := os.Stat(n.path)
+
+	if err != nil {
+		err = syscall.Mkfifo(n.path, 0666)
+	} else if (s.Mode() & os.ModeNamedPipe) == 0 {
+		err = fmt.Errorf("not overwriting non-named pipe: %s", n.path)
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Preread is called before every read. It allows us to reopen a
+// NamedPipeStream if it had been closed the previous iteration in the read
+// loop.
+func (n *NamedPipeStream) Preread() error {
+	if n.source != nil {
+		return nil
+	}
+	if n.reopens != nil {
+		n.reopens <- struct{}{}
+		defer func() { <-n.reopens }()
+	}
+	file, err := os.OpenFile(n.path, os.O_RDONLY, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "opened named pipe for tag %s: %s\n", n.tag, n.path)
+	n.source = newBufferedReader(n.decompress(file))
+	return nil
+}
+
+// PipeStream wraps a standard nameless pipe, as handed to the process by a
+// file descript. It can't be reopened once it closes. Like named pipes, it's
+// decompressed on the fly if it turns out to be gzipped, with line framing.
+type PipeStream struct {
+	BaseStream
+	fd     int64
+	reader *bufio.Reader
+
+	// eofGrace, if non-zero, is how long to keep checking for a live write
+	// end after an EOF, in case the fd isn't really done.
+	eofGrace time.Duration
+}
+
+// Preread is called before a PipeStream incoming log stream is read from.
+// If the source has been closed, then we just return EOF and abandon ship,
+// since we can't reopen it. With an EOF grace, we first check for that long
+// whether the pipe has a write end again (on Linux, where we can tell), and
+// keep reading if it does.
+func (p *PipeStream) Preread() error {
+	if p.source != nil {
+		return nil
+	}
+	if p.eofGrace == 0 || p.reader == nil {
+		return io.EOF
+	}
+	if !pipeHasWriter(int(p.fd), p.eofGrace) {
+		p.reader = nil
+		return io.EOF
+	}
+	p.source = p.reader
+	return nil
+}
+
+// Open is called to open a PipeStream, which simply wraps the given file descriptor
+// in a buffered reader.
+func (p *PipeStream) Open() error {
+	p.reader = newBufferedReader(p.decompress(os.NewFile(uintptr(p.fd), fmt.Sprintf("fd=%d", p.fd))))
+	p.source = p.reader
+	return nil
+}
+
+// Stream is the interface to either a PipeStream or a NamedPipeStream. Most
+// methods are handled by the BaseStream class, but openings and prereads
+// are handled by the subclasses.
+type Stream interface {
+	Open() error
+	Preread() error
+	Raw() string
+	MarkClosed()
+	Source() *bufio.Reader
+	Tag() string
+	Options() *StreamOptions
+	Stats() *StreamStats
+	Pending() *bytes.Buffer
+}
+
+// PipeStream and NamedPipeStream are the two instantiations of the Stream interface.
+var _ Stream = (*PipeStream)(nil)
+var _ Stream = (*NamedPipeStream)(nil)
+
+// Mux is the high level object that has all of the configuration for this run
+// of logmux. Meaning, it knows where the logs are coming from, and to which
+// logstash service they are going to.
+type Mux struct {
+	logstash LogstashService
+	streams  []Stream
+	opts     Options
+
+	// streamsLock guards streams, which a --config reload changes while
+	// the status server reads them.
+	streamsLock sync.Mutex
+
+	duration time.Duration
+	done     chan struct{}
+	httpAddr string
+
+	// fdEOFGrace, if non-zero, is how long pipes passed as FDs get after an
+	// EOF to show more data before they're given up on.
+	fdEOFGrace time.Duration
+
+	// maxReopens, if non-zero, caps how many named pipes can be waiting to
+	// reopen at once.
+	maxReopens int
+
+	// maxConns, if non-zero, caps how many connections can be open at once
+	// across all of the listener streams.
+	maxConns int
+
+	// stateDir, if set, is where tailed files' offsets are checkpointed, in
+	// state, so that a restart resumes where we left off.
+	stateDir string
+	state    *tailState
+
+	// maxOpenFiles, if non-zero, caps how many file:// streams' files are
+	// open at once, with files parking the ones that have been idle
+	// longest.
+	maxOpenFiles int
+	files        *fileScheduler
+
+	// configPath, if set, is the --config file of file:// streams, which is
+	// reread on SIGHUP, or whenever it changes with watchConfig. config is
+	// the streams from it that are running, by specifier, and configStream
+	// sets up a stream from one, as parseArgs does those on the command
+	// line.
+	configPath   string
+	watchConfig  bool
+	config       map[string]*TailStream
+	configStream func(spec string) (*TailStream, error)
+
+	// allowNoStreams lets us run with no incoming streams at all, in which
+	// case we idle until we get SIGINT or SIGTERM.
+	allowNoStreams bool
+
+	// defaults are the stream options that the global flags give streams
+	// without their own, for Submitters.
+	defaults StreamOptions
+
+	// emitFooter, if set, sends a footer event with the number of events
+	// sent over each logstash connection before it's closed, and over the
+	// ones still open when the run ends cleanly.
+	emitFooter bool
+
+	// flushDeadline, if non-zero, bounds how long a clean stop waits for
+	// buffered lines and the footer to be written out, so that a stuck
+	// logstash can't keep us from exiting. flushBy is closed once it's up.
+	flushDeadline time.Duration
+	flushBy       <-chan struct{}
+
+	// pause holds up writes to logstash while we're paused, by SIGUSR2 or
+	// the /pause endpoint.
+	pause pauser
+
+	// ingestSecret, if set, is the shared secret that listen-http clients
+	// must send, and ingestMaxBody is the biggest POST body they can send.
+	ingestSecret  string
+	ingestMaxBody int64
+
+	// connPerStream, if set, gives each stream its own connection to
+	// logstash, kept in sinks, so that backpressure on one stream's
+	// connection never holds up another's.
+	connPerStream bool
+	sinks         map[Stream]*LogstashService
+
+	// listenTLS is the server config for listen-tls streams, if any.
+	listenTLS *tls.Config
+
+	// auditPath, if set, is the --audit-file that audit records our own
+	// actions to.
+	auditPath string
+	audit     *auditLog
+
+	// configTest, if set, stops after the command line has been parsed and
+	// validated, without opening any streams or dialing logstash.
+	configTest bool
+
+	// probe, if set, only checks that logstash is reachable, and then
+	// exits. If probeSend is set too, it sends a probe event.
+	probe     bool
+	probeSend bool
+}
+
+// Options control how lines are read off of the incoming streams and
+// processed on their way to logstash. They're set from the command line.
+type Options struct {
+	// inputBufferLines, if non-zero, is the number of lines to prefetch from
+	// each stream while previous lines are being written to logstash.
+	inputBufferLines int
+
+	// sanitizeControl is "escape" or "strip" to escape or strip control
+	// characters in lines, or empty to pass them through.
+	sanitizeControl string
+
+	// format is the output format for streams that don't specify their own.
+	format string
+
+	// messageField is the key that plain lines go under when they're
+	// wrapped into JSON.
+	messageField string
+
+	// missingMessage is what to do with JSON lines that don't have a
+	// messageField: "fill" it in with messagePlaceholder, "drop" the line,
+	// or ship it as is if it's empty.
+	missingMessage     string
+	messagePlaceholder string
+
+	// minLineBytes is the minimum line length for streams that don't specify
+	// their own.
+	minLineBytes int
+
+	// preserveWhitespace, if set, strips only the trailing line delimiter off
+	// of plain lines, rather than all surrounding whitespace, so that leading
+	// indentation survives. Blank lines are still dropped.
+	preserveWhitespace bool
+
+	// collapseWhitespace, if set, squeezes runs of spaces and tabs in plain
+	// lines down to a single space. Leading indentation is kept if
+	// preserveWhitespace is set too.
+	collapseWhitespace bool
+
+	// normalizeNewlines, if set, turns CRLF line endings within a line (as in
+	// a joined multiline event) into plain LF.
+	normalizeNewlines bool
+
+	// addLag, if set, adds a logmux_lag_ms field to JSON events, with how long
+	// the line sat in logmux between being read and being written out.
+	addLag bool
+
+	// runID, if set, is added to JSON events as logmux_run_id, to tell
+	// events from one run of logmux apart from another's. It's a random
+	// UUID unless --run-id or --run-id-from-env says otherwise.
+	runID string
+
+	// explodeArrays, if set, ships each element of a line that's a JSON array
+	// of objects as its own event. Other arrays are shipped as usual.
+	explodeArrays bool
+
+	// splitObjects, if set, ships each of the JSON objects concatenated
+	// together on a line (like {"a":1}{"b":2}) as its own event.
+	splitObjects bool
+
+	// trimTag, if set, strips the stream's tag off of the front of plain
+	// lines that already start with it, along with one of the separator
+	// characters in trimTagSeparators. trimTagIgnoreCase makes the match
+	// case-insensitive.
+	trimTag           bool
+	trimTagSeparators string
+	trimTagIgnoreCase bool
+
+	// codec is "gelf" to shape events into NUL-delimited GELF messages for
+	// Graylog, which overrides any output format, "msgpack" to ship every
+	// event as a msgpack map, or "syslog" to wrap every event in an RFC 5424
+	// syslog message. It's empty for the usual newline-delimited output.
+	codec string
+
+	// syslogFacility is the facility that syslog messages go out with.
+	syslogFacility int
+
+	// host is our hostname, as reported in GELF and syslog messages. It's
+	// os.Hostname() unless --host-override or --host-from-env says
+	// otherwise.
+	host string
+
+	// reorderWindow, if non-zero, holds JSON lines with an @timestamp for up
+	// to this long, so that they can be shipped in timestamp order.
+	reorderWindow time.Duration
+
+	// redactKeys are the dotted paths of fields to redact from JSON lines,
+	// by masking their values, or removing them if redactRemove is set.
+	redactKeys   [][]string
+	redactRemove bool
+
+	// mapFields are rules to rename fields in JSON lines.
+	mapFields fieldMaps
+
+	// addFields are static string fields to add to every JSON event, and
+	// addJSON are static fields with arbitrary JSON values, like nested
+	// objects.
+	addFields staticFields
+	addJSON   jsonFields
+
+	// extractFields are rules to pull fields out of plain lines, which then
+	// ship as JSON. If extractRemove is set, then the matches are cut out of
+	// the message.
+	extractFields fieldExtracts
+	extractRemove bool
+
+	// detectLevel, if set, adds a level field to plain lines that name a
+	// log level, which then ship as JSON. addSeverity adds a severity field
+	// with the level's syslog number as well, to those lines and to JSON
+	// lines with a level field, with severities overriding the numbers.
+	detectLevel bool
+	addSeverity bool
+	severities  severityMap
+
+	// tagQuotas are daily byte quotas by tag. quotaWindow is "calendar" for
+	// windows that reset at midnight, or "rolling" for 24 hour windows.
+	tagQuotas   tagQuotas
+	quotaWindow string
+
+	// splitTag, if set, adds fields to JSON events from the components of
+	// the stream's tag.
+	splitTag tagSplit
+
+	// fieldOrder, if set, puts the top-level fields of JSON events in a
+	// fixed order: these fields first, then the rest sorted by key.
+	fieldOrder []string
+
+	// includeRaw, if set, adds a raw field with the line as it arrived
+	// (after trimming and sanitizing) to events whose fields we extracted
+	// or reparsed.
+	includeRaw bool
+
+	// addHash, if set, adds a logmux_hash field to JSON events, so that a
+	// consumer can dedup replayed lines.
+	addHash bool
+
+	// maxFields, if non-zero, caps the number of top-level fields in JSON
+	// lines. If maxFieldsAction is "trim", then only the first maxFields are
+	// kept; if it's "drop", then the whole line is dropped.
+	maxFields       int
+	maxFieldsAction string
+}
+
+// Configure a Mux, opening the logstash connection and all of the incoming
+// log streams. The logstash connection is fully up before any stream is
+// opened.
+func (m *Mux) Configure() error {
+	if m.stateDir != "" {
+		state, err := openState(m.stateDir)
+		if err != nil {
+			return err
+		}
+		m.state = state
+	}
+	err := m.logstash.Open()
+	if err != nil {
+		return err
+	}
+	if m.logstash.idleTimeout > 0 {
+		go m.logstash.closeWhenIdle()
+	}
+	if m.connPerStream {
+		m.sinks = make(map[Stream]*LogstashService)
+		for _, s := range m.streams {
+			l := m.logstash.clone()
+			if err := l.Open(); err != nil {
+				return err
+			}
+			if l.idleTimeout > 0 {
+				go l.closeWhenIdle()
+			}
+			m.sinks[s] = l
+		}
+	}
+	if m.httpAddr != "" {
+		if err := m.openHTTP(); err != nil {
+			return err
+		}
+	}
+	var reopens chan struct{}
+	if m.maxReopens > 0 {
+		reopens = make(chan struct{}, m.maxReopens)
+	}
+	var conns chan struct{}
+	if m.maxConns > 0 {
+		conns = make(chan struct{}, m.maxConns)
+	}
+	if m.maxOpenFiles > 0 {
+		m.files = newFileScheduler(m.maxOpenFiles)
+	}
+	for _, s := range m.streams {
+		if n, ok := s.(*NamedPipeStream); ok {
+			n.reopens = reopens
+		}
+		if h, ok := s.(*HTTPStream); ok {
+			h.secret = m.ingestSecret
+			h.maxBody = m.ingestMaxBody
+			h.conns = conns
+		}
+		if t, ok := s.(*TLSStream); ok {
+			t.config = m.listenTLS
+			t.conns = conns
+		}
+		if a, ok := s.(*ActivatedStream); ok {
+			a.conns = conns
+		}
+		if u, ok := s.(*UnixStream); ok {
+			u.conns = conns
+		}
+		if t, ok := s.(*TailStream); ok {
+			t.state = m.state
+			t.files = m.files
+		}
+		if p, ok := s.(*PipeStream); ok {
+			p.eofGrace = m.fdEOFGrace
+		}
+	}
+	return m.openStreams()
+}
+
+// openStreams opens all of the incoming streams at once, since some of them
+// (like message queues, or listeners) can take a while. It returns the first
+// error, if any, once they've all been tried.
+func (m *Mux) openStreams() error {
+	errs := make(chan error, len(m.streams))
+	for _, s := range m.streams {
+		go func(s Stream) {
+			err := s.Open()
+			if err == nil {
+				m.audit.record("stream_open", "tag", s.Tag(), "source", s.Raw())
+			}
+			errs <- err
+		}(s)
+	}
+	var ret error
+	for range m.streams {
+		if err := <-errs; err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func newBufferedReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, 1024*1024*4)
+}
+
+func hasNonSpace(buf []byte) bool {
+	for _, b := range buf {
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseWhitespace replaces each run of spaces and tabs in buf with a
+// single space. If keepIndent is set, then runs at the start of a line are
+// left alone.
+func collapseWhitespace(buf []byte, keepIndent bool) []byte {
+	ret := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		if buf[i] != ' ' && buf[i] != '\t' {
+			ret = append(ret, buf[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(buf) && (buf[j] == ' ' || buf[j] == '\t') {
+			j++
+		}
+		if keepIndent && (i == 0 || buf[i-1] == '\n') {
+			ret = append(ret, buf[i:j]...)
+		} else {
+			ret = append(ret, ' ')
+		}
+		i = j
+	}
+	return ret
+}
+
+// sanitizeControl escapes or strips the C0 control characters in buf, other
+// than tab and newline. Escapes are JSON-style (\u000c), so that they're
+// valid inside of JSON strings too.
+func sanitizeControl(buf []byte, mode string) []byte {
+	var out []byte
+	for i, b := range buf {
+		if b >= 0x20 || b == '\t' || b == '\n' {
+			if out != nil {
+				out = append(out, b)
+			}
+			continue
+		}
+		if out == nil {
+			out = append(make([]byte, 0, len(buf)+16), buf[:i]...)
+		}
+		if mode == "escape" {
+			out = append(out, []byte(fmt.Sprintf("\\u%04x", b))...)
+		}
+	}
+	if out == nil {
+		return buf
+	}
+	return out
+}
+
+// trimTag strips a redundant copy of the tag off of the front of buf, along
+// with a single separator character from seps and any whitespace around it.
+// The tag only matches if it's followed by the end of the line, a separator,
+// or whitespace, so tag "app" doesn't match "apple".
+func trimTag(buf []byte, tag string, seps string, ignoreCase bool) []byte {
+	if len(buf) < len(tag) {
+		return buf
+	}
+	pfx, rest := buf[:len(tag)], buf[len(tag):]
+	if ignoreCase && !bytes.EqualFold(pfx, []byte(tag)) {
+		return buf
+	}
+	if !ignoreCase && !bytes.Equal(pfx, []byte(tag)) {
+		return buf
+	}
+	if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' && strings.IndexByte(seps, rest[0]) < 0 {
+		return buf
+	}
+	rest = bytes.TrimLeft(rest, " \t")
+	if len(rest) > 0 && strings.IndexByte(seps, rest[0]) >= 0 {
+		rest = bytes.TrimLeft(rest[1:], " \t")
+	}
+	return rest
+}
+
+// looksLikeObject returns true if the trimmed line buf looks like a JSON
+// object, in which case we splice the tag into it rather than prefixing it.
+func looksLikeObject(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == '{' && buf[len(buf)-1] == '}'
+}
+
+// split breaks a raw line up into the records that should each be shipped as
+// their own event. Usually that's just the line itself, and it's always just
+// the record itself for binary streams.
+func (o *Options) split(buf []byte, s Stream) [][]byte {
+	if s.Options().framing == "length" {
+		return [][]byte{buf}
+	}
+	if rs := s.Options().recordSeparator; rs != "" {
+		var ret [][]byte
+		for _, rec := range bytes.Split(buf, []byte(rs)) {
+			ret = append(ret, o.splitRecord(rec)...)
+		}
+		return ret
+	}
+	return o.splitRecord(buf)
+}
+
+// splitRecord breaks a single record up into the JSON values that should
+// each be shipped as their own event.
+func (o *Options) splitRecord(buf []byte) [][]byte {
+	if o.explodeArrays {
+		if elems := explodeArray(bytes.TrimSpace(buf)); elems != nil {
+			return elems
+		}
+	}
+	if o.splitObjects {
+		if objs := splitObjects(bytes.TrimSpace(buf)); objs != nil {
+			return objs
+		}
+	}
+	return [][]byte{buf}
+}
+
+// splitObjects splits a line that starts with a JSON object into the objects
+// that are concatenated together on it, like {"a":1}{"b":2}. If anything
+// other than an object follows, that's returned as the last record, to be
+// shipped as is. It returns nil if there's nothing to split.
+func splitObjects(buf []byte) [][]byte {
+	if len(buf) == 0 || buf[0] != '{' {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	var ret [][]byte
+	for {
+		start := dec.InputOffset()
+		var obj json.RawMessage
+		err := dec.Decode(&obj)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || !looksLikeObject(obj) {
+			if len(ret) == 0 {
+				return nil
+			}
+			if rest := bytes.TrimSpace(buf[start:]); len(rest) > 0 {
+				ret = append(ret, rest)
+			}
+			break
+		}
+		ret = append(ret, obj)
+	}
+	if len(ret) < 2 {
+		return nil
+	}
+	return ret
+}
+
+// explodeArray returns the elements of buf if it's a non-empty JSON array of
+// objects, or nil otherwise.
+func explodeArray(buf []byte) [][]byte {
+	if len(buf) == 0 || buf[0] != '[' || buf[len(buf)-1] != ']' {
+		return nil
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(buf, &elems); err != nil || len(elems) == 0 {
+		return nil
+	}
+	ret := make([][]byte, len(elems))
+	for i, e := range elems {
+		if !looksLikeObject(e) {
+			return nil
+		}
+		ret[i] = e
+	}
+	return ret
+}
+
+// isObjectEvent returns true if the processed event ev is a JSON object, and
+// so can carry extra fields. Events end in a delimiter byte, which is a
+// newline except for GELF, which uses NUL.
+func isObjectEvent(ev []byte) bool {
+	return len(ev) > 2 && ev[0] == '{' && ev[len(ev)-2] == '}'
+}
+
+// addField splices a "key":val pair onto the end of the JSON object event ev.
+// val must already be JSON-encoded. GELF messages get key as an additional
+// field.
+func (o *Options) addField(ev []byte, key string, val []byte) []byte {
+	if o.codec == "gelf" {
+		key = gelfField(key)
+	}
+	delim := ev[len(ev)-1]
+	ev = append(ev[:len(ev)-2], ',')
+	ev = append(ev, jsonString([]byte(key))...)
+	ev = append(ev, ':')
+	ev = append(ev, val...)
+	return append(ev, '}', delim)
+}
+
+// spliceFields splices each of the given fields into an object event. Plain
+// text events are left as they are.
+func (o *Options) spliceFields(ev []byte, fields []field) []byte {
+	if !isObjectEvent(ev) {
+		return ev
+	}
+	for _, f := range fields {
+		ev = o.addField(ev, f.key, f.val)
+	}
+	return ev
+}
+
+// enrich adds fields to a processed JSON object event for a line that was
+// read at the given time. Plain text events are left as they are.
+func (o *Options) enrich(ev []byte, at time.Time) []byte {
+	if !isObjectEvent(ev) {
+		return ev
+	}
+	ev = o.spliceFields(ev, o.addFields)
+	ev = o.spliceFields(ev, o.addJSON)
+	if o.addLag {
+		lag := time.Since(at) / time.Millisecond
+		ev = o.addField(ev, "logmux_lag_ms", []byte(strconv.FormatInt(int64(lag), 10)))
+	}
+	if o.runID != "" {
+		ev = o.addField(ev, "logmux_run_id", jsonString([]byte(o.runID)))
+	}
+	return ev
+}
+
+// newRunID returns a random (version 4) UUID for --add-run-id.
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// jsonString encodes buf as a JSON string.
+func jsonString(buf []byte) []byte {
+	ret, _ := json.Marshal(string(buf))
+	return ret
+}
+
+// processLine tags the given line from the given stream. JSON lines are only
+// decoded if a transform needs their fields, and even then their values are
+// kept raw; the tag is spliced in before the closing brace, so numeric fields
+// (like 64-bit IDs) pass through byte-for-byte.
+func (o *Options) processLine(buf []byte, s Stream) []byte {
+	tag := s.Tag()
+	format := s.Options().format
+	if o.codec == "msgpack" {
+		// Every event has to be a map, so plain lines are always wrapped.
+		format = "json"
+	}
+	if s.Options().framing == "length" {
+		return []byte(fmt.Sprintf("{\"data\":%q,\"tag\":%q}\n", base64.StdEncoding.EncodeToString(buf), tag))
+	}
+	trimmed := bytes.TrimSpace(buf)
+	if o.preserveWhitespace && len(trimmed) > 0 && !looksLikeObject(trimmed) {
+		buf = bytes.TrimRight(buf, "\r\n")
+	} else {
+		buf = trimmed
+	}
+	if o.normalizeNewlines {
+		buf = bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+	}
+	if o.collapseWhitespace && !looksLikeObject(buf) {
+		buf = collapseWhitespace(buf, o.preserveWhitespace)
+	}
+	if o.sanitizeControl != "" {
+		buf = sanitizeControl(buf, o.sanitizeControl)
+	}
+	if len(buf) == 0 {
+		return buf
+	}
+	if s.Options().dropBadJSON && !json.Valid(buf) {
+		s.Stats().drop()
+		return buf[:0]
+	}
+	if min := s.Options().minLineBytes; min > 0 && len(bytes.TrimSpace(buf)) < min {
+		s.Stats().drop()
+		return buf[:0]
+	}
+	if o.trimTag && !looksLikeObject(buf) {
+		if buf = trimTag(buf, tag, o.trimTagSeparators, o.trimTagIgnoreCase); len(buf) == 0 {
+			return buf
+		}
+	}
+	content := buf
+	var extracted []field
+	if format != "plain" && !looksLikeObject(buf) {
+		var stamp []field
+		buf, stamp = s.Options().timestamp.apply(buf, time.Now())
+		if s.Options().timestamp != nil {
+			s.Options().parseErrors.record(tag, content, len(stamp) > 0)
+		}
+		if len(o.extractFields) > 0 {
+			buf, extracted = o.extractFields.apply(buf, o.extractRemove)
+		}
+		if o.detectLevel {
+			extracted = append(extracted, o.levelFields(buf)...)
+		}
+		extracted = append(stamp, extracted...)
+	}
+	fields := append(extracted, o.splitTag.fields(tag)...)
+	var pathFields []field
+	if format != "plain" {
+		pathFields = s.Options().pathFields
+		fields = append(fields, pathFields...)
+	}
+	if o.includeRaw && len(extracted) > 0 {
+		fields = append(fields, field{key: "raw", val: jsonString(content)})
+	}
+	if o.addHash {
+		// The hash is of what we ship, so that it can't give away a
+		// redacted value.
+		fields = append(fields, hashField(tag, o.redactJSON(content)))
+	}
+	// GELF messages take JSON lines apart into fields whatever the format,
+	// so they're always reparsed. Plain lines that look like objects are
+	// still redacted, as the secrets in them ship all the same.
+	plain := format == "plain" && o.codec != "gelf"
+	if looksLikeObject(buf) && (len(o.redactKeys) > 0 || !plain && o.needsReparse()) {
+		var keep bool
+		if buf, keep = o.reparse(buf, plain); !keep {
+			s.Stats().drop()
+			return buf[:0]
+		}
+		if o.includeRaw && !plain {
+			fields = append(fields, field{key: "raw", val: jsonString(o.redactJSON(content))})
+		}
+	}
+	if o.addSeverity && !plain && looksLikeObject(buf) {
+		fields = append(fields, o.objectSeverity(buf)...)
+	}
+	if o.codec == "gelf" {
+		return o.spliceFields(o.gelfEvent(buf, tag), fields)
+	}
+	if format != "plain" && looksLikeObject(buf) && o.missingMessage != "" {
+		if obj, err := decodeObject(buf); err == nil && findField(obj, o.messageField) < 0 {
+			if o.missingMessage == "drop" {
+				s.Stats().drop()
+				return buf[:0]
+			}
+			fields = append(fields, field{key: o.messageField, val: jsonString([]byte(o.messagePlaceholder))})
+		}
+	}
+	lst := len(buf) - 1
+	if format != "plain" && looksLikeObject(buf) {
+		if hasNonSpace(buf[1:lst]) {
+			buf = append(buf[0:lst], []byte(fmt.Sprintf(",\"tag\":%q}", tag))...)
+		} else {
+			buf = []byte(fmt.Sprintf("{\"tag\":%q}", tag))
+		}
+	} else if format == "json" || len(extracted) > 0 || len(pathFields) > 0 {
+		buf = []byte(fmt.Sprintf("{%s:%s,\"tag\":%q}", jsonString([]byte(o.messageField)), jsonString(buf), tag))
+	} else {
+		tmp := append([]byte(tag), []byte(": ")...)
+		buf = append(tmp, buf...)
+	}
+	buf = append(buf, '\n')
+	return o.spliceFields(buf, fields)
+}
+
+// joinLine takes the next raw line read off of the given stream, and
+// returns the lines to write out for it: just the line itself, unless the
+// stream has a multiline-start pattern, in which case lines are joined into
+// multiline events. An event is only complete once the line that starts the
+// next one is read, so it's held in the stream's pending buffer until then,
+// or until the stream closes.
+func joinLine(s Stream, ln line) []line {
+	start := s.Options().multilineStart
+	if f := s.Options().framing; start == nil || (f != "" && f != "line") {
+		return []line{ln}
+	}
+	p := s.Pending()
+	var ret []line
+	if p.Len() > 0 && len(ln.buf) > 0 && start.Match(bytes.TrimRight(ln.buf, "\r\n")) {
+		ret = append(ret, flushPending(s, ln.at)...)
+	}
+	p.Write(ln.buf)
+	if ln.closed || ln.err != nil {
+		ret = append(ret, flushPending(s, ln.at)...)
+	}
+	return ret
+}
+
+// flushPending returns the multiline event that's being assembled off of the
+// given stream, if there is one, as a line read at the given time.
+func flushPending(s Stream, at time.Time) []line {
+	p := s.Pending()
+	if p.Len() == 0 {
+		return nil
+	}
+	ev := append([]byte(nil), p.Bytes()...)
+	p.Reset()
+	return []line{{buf: ev, at: at}}
+}
+
+// readRetries is how many times in a row a line-framed stream retries a read
+// that failed with one of the --retryable-errors before it ends on the error,
+// and readBackoff is how long it waits before the first retry. The wait
+// doubles after each.
+const readRetries = 5
+
+var readBackoff = 50 * time.Millisecond
+
+// readRaw reads the next raw line off of the given stream. An EOF marks the
+// stream as closed, but isn't itself an error, since some streams (like named
+// pipes) can be reopened on the next Preread.
+func readRaw(s Stream) ([]byte, error) {
+	err := s.Preread()
+	if err != nil {
+		return nil, err
+	}
+	s.Stats().setState("open")
+	var buf []byte
+	switch s.Options().framing {
+	case "length":
+		buf, err = readFrame(s.Source())
+	case "journal-export":
+		buf, err = readJournalEntry(s.Source())
+	case "raw":
+		buf, err = readChunk(s.Source())
+	default:
+		buf, err = s.Source().ReadBytes('\n')
+		wait := readBackoff
+		for retry := 1; err != nil && s.Options().retryable.has(err); retry++ {
+			if retry > readRetries {
+				err = fmt.Errorf("still failing after %d retries: %s", readRetries, err)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "%s: retrying read in %s after: %s\n", s.Tag(), wait, err)
+			time.Sleep(wait)
+			wait *= 2
+			var more []byte
+			more, err = s.Source().ReadBytes('\n')
+			buf = append(buf, more...)
+		}
+	}
+	if errors.Is(err, os.ErrClosed) {
+		// The file was closed out from under us, most likely while
+		// shutting down, which is as good as an EOF.
+		err = io.EOF
+	}
+	if err == io.EOF {
+		s.MarkClosed()
+		s.Stats().setState("closed")
+		err = nil
+	}
+	return buf, err
+}
+
+// rawChunkSize is the most that a raw stream reads at a time.
+const rawChunkSize = 32 * 1024
+
+// readChunk reads whatever bytes are ready off of a raw stream, up to
+// rawChunkSize, waiting for at least one.
+func readChunk(r *bufio.Reader) ([]byte, error) {
+	buf := make([]byte, rawChunkSize)
+	n, err := r.Read(buf)
+	return buf[:n], err
+}
+
+// maxFrameSize is the biggest length-framed record we'll read; anything bigger
+// is more likely a corrupt length prefix than a real record.
+const maxFrameSize = 1024 * 1024 * 4
+
+// readFrame reads a single binary record, prefixed by its 4-byte big-endian
+// length. It returns EOF only if the stream ends cleanly between records.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("length-framed record too big (%d bytes)", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeLine tags the given raw line, which was read at the given time, and
+// writes it out to logstash.
+func (m *Mux) writeLine(s Stream, buf []byte, at time.Time) error {
+	return m.writeLineAck(s, buf, at, nil)
+}
+
+// writeLineAck is writeLine for a line with an ack, if it's not nil, which
+// is called once all of the events made from it are done with.
+func (m *Mux) writeLineAck(s Stream, buf []byte, at time.Time, ack func(error)) error {
+	if ack == nil {
+		ack = func(error) {}
+	}
+	if len(buf) == 0 {
+		ack(nil)
+		return nil
+	}
+	if s.Options().framing == "raw" {
+		// Raw streams have their own connection, and skip everything
+		// that would touch their bytes.
+		m.pause.wait(s)
+		return m.write(s, []event{{tag: s.Tag(), buf: buf, ack: ack}})
+	}
+	if a := s.Options().aggregate; a != nil {
+		for _, rec := range m.opts.split(buf, s) {
+			a.add(rec)
+		}
+		ack(nil)
+		return nil
+	}
+	var out []event
+	n := 0
+	for _, rec := range m.opts.split(buf, s) {
+		ev := m.opts.processLine(rec, s)
+		if err := s.Options().parseErrors.check(); err != nil {
+			ack(err)
+			return err
+		}
+		if len(ev) == 0 {
+			continue
+		}
+		ev = m.opts.enrich(ev, at)
+		if len(m.opts.fieldOrder) > 0 {
+			ev = m.opts.orderEvent(ev)
+		}
+		if m.opts.codec == "msgpack" {
+			ev = msgpackEvent(ev)
+		}
+		if m.opts.codec == "syslog" {
+			ev = m.opts.syslogEvent(ev, s.Tag())
+		}
+		if ok, first := m.opts.tagQuotas.take(s.Tag(), len(ev), at, m.opts.quotaWindow); !ok {
+			s.Stats().drop()
+			if first {
+				out = append(out, event{tag: s.Tag(), buf: m.opts.quotaNotice(s.Tag()), priority: s.Options().priority})
+			}
+			continue
+		}
+		out = append(out, event{tag: s.Tag(), buf: ev, priority: s.Options().priority})
+		n++
+	}
+	if len(out) == 0 {
+		ack(nil)
+		return nil
+	}
+	each := ackAfter(len(out), ack)
+	for i := range out {
+		out[i].ack = each
+	}
+	m.pause.wait(s)
+	err := m.write(s, out)
+	if err == nil && n > 0 {
+		s.Stats().shipped(n)
+	}
+	return err
+}
+
+// sink returns the logstash connection that the given stream writes to.
+func (m *Mux) sink(s Stream) *LogstashService {
+	if l := m.sinks[s]; l != nil {
+		return l
+	}
+	return &m.logstash
+}
+
+// line is a raw line read off of an incoming stream, along with when it was
+// read, whether the stream closed right after it, and the error that ended
+// the read loop, if any. mark is where the line ends in a tailed file, for
+// the --state-dir checkpoint.
+type line struct {
+	buf    []byte
+	at     time.Time
+	closed bool
+	err    error
+	mark   tailMark
+}
+
+// prefetch starts reading lines off of the given stream into a queue of at
+// most n lines, so that reads can run ahead of writes to logstash. Lines come
+// out of the queue in the order they were read. The last line on the queue
+// carries the error that ended the read loop. Closing stop lets the reader go
+// if nothing's taking lines off of the queue anymore.
+func prefetch(s Stream, n int, stop <-chan struct{}) <-chan line {
+	q := make(chan line, n)
+	go func() {
+		defer close(q)
+		for {
+			buf, err := readRaw(s)
+			ln := line{buf: buf, at: time.Now(), closed: s.Source() == nil, err: err}
+			if t, ok := s.(*TailStream); ok {
+				ln.mark = t.mark()
+			}
+			if len(buf) > 0 || ln.closed || err != nil {
+				select {
+				case q <- ln:
+				case <-stop:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// runLines is the read loop for a stream. Lines are read off of the stream
+// in the background, into a queue of up to --input-buffer-lines, and written
+// out as they come off of it, joined into multiline events if need be. With a
+// --reorder-window, lines with an @timestamp are held back in a reorderer,
+// and other lines are written out right away. Once the run is stopped, or
+// the stream is taken out of the --config file, everything that's already
+// been read is written out, and we return EOF.
+// A tailed file is checkpointed as its lines are written out.
+func (m *Mux) runLines(s Stream) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	q := prefetch(s, m.opts.inputBufferLines, stop)
+	var r *reorderer
+	var tick <-chan time.Time
+	if m.opts.reorderWindow > 0 {
+		r = &reorderer{window: m.opts.reorderWindow}
+		every := m.opts.reorderWindow / 4
+		if every < time.Millisecond {
+			every = time.Millisecond
+		}
+		t := time.NewTicker(every)
+		defer t.Stop()
+		tick = t.C
+	}
+	var removed <-chan struct{}
+	if t, ok := s.(*TailStream); ok {
+		removed = t.removed
+	}
+	var mark tailMark
+	for {
+		select {
+		case <-m.done:
+			return m.drain(s, q, r, mark)
+		case <-removed:
+			return m.drain(s, q, r, mark)
+		default:
+		}
+		select {
+		case <-m.done:
+			return m.drain(s, q, r, mark)
+		case <-removed:
+			return m.drain(s, q, r, mark)
+		case ln := <-q:
+			if err := m.takeLine(s, ln, r); err != nil {
+				return err
+			}
+			if ln.mark != (tailMark{}) {
+				mark = ln.mark
+			}
+			m.checkpoint(s, mark, r)
+			if ln.err != nil {
+				if err := m.writeHeld(s, r); err != nil {
+					return err
+				}
+				return ln.err
+			}
+		case now := <-tick:
+			if err := m.writeLines(s, r.expired(now)); err != nil {
+				return err
+			}
+			m.checkpoint(s, mark, r)
+		}
+	}
+}
+
+// takeLine writes out a line that was read off of the given stream, or
+// holds it back to join into a multiline event, or to reorder.
+func (m *Mux) takeLine(s Stream, ln line, r *reorderer) error {
+	for _, ev := range joinLine(s, ln) {
+		if err := m.reorderLine(s, ev, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorderLine holds a line back in the reorderer if there is one and the
+// line has an @timestamp, and writes it out otherwise.
+func (m *Mux) reorderLine(s Stream, ln line, r *reorderer) error {
+	if r != nil {
+		if ts, ok := eventTimestamp(ln.buf); ok {
+			r.push(ln, ts)
+			return nil
+		}
+	}
+	return m.writeLine(s, ln.buf, ln.at)
+}
+
+// writeHeld writes out everything held back for the given stream: its
+// pending multiline event, and then its lines held for reordering.
+func (m *Mux) writeHeld(s Stream, r *reorderer) error {
+	for _, ev := range flushPending(s, time.Now()) {
+		if err := m.reorderLine(s, ev, r); err != nil {
+			return err
+		}
+	}
+	if r == nil {
+		return nil
+	}
+	return m.writeLines(s, r.flush())
+}
+
+// drain writes out the lines already waiting on a prefetch queue, without
+// waiting for any more to be read, and then everything held back. Once
+// that's all out, a tailed file is checkpointed past the last line, which
+// was at mark if there weren't any waiting. It returns EOF once it's done.
+func (m *Mux) drain(s Stream, q <-chan line, r *reorderer, mark tailMark) error {
+	for more := true; more; {
+		select {
+		case ln, ok := <-q:
+			if !ok {
+				more = false
+			} else if err := m.takeLine(s, ln, r); err != nil {
+				return err
+			} else if ln.mark != (tailMark{}) {
+				mark = ln.mark
+			}
+		default:
+			more = false
+		}
+	}
+	if err := m.writeHeld(s, r); err != nil {
+		return err
+	}
+	m.checkpoint(s, mark, nil)
+	return io.EOF
+}
+
+// runStream runs the given stream, reading incoming log lines from it, and
+// outputting tagged lines to logstash.  If there's an error, the send it to
+// the given channel.
+func (m *Mux) runStream(s Stream, ch chan<- error, single bool) {
+	var err error
+	a := s.Options().aggregate
+	stop := make(chan struct{})
+	if a != nil {
+		go m.runAggregate(s, a, stop)
+	}
+	err = m.runLines(s)
+	close(stop)
+	if t, ok := s.(*TailStream); ok {
+		t.close()
+	}
+	if a != nil {
+		if e2 := m.writeSummary(s, a); err == io.EOF && e2 != nil {
+			err = e2
+		}
+	}
+	s.Stats().setState("ended")
+	m.audit.record("stream_end", "tag", s.Tag(), "condition", fmt.Sprint(err))
+	if !single {
+		fmt.Fprintf(os.Stderr, "%s: ending log read loop on condition: %s\n", s.Tag(), err)
+	}
+	ch <- err
+}
+
+// Run the logmux, by first configuring it, and then by running each incoming
+// log stream in its own go routine. End the program with an error when the first
+// incoming stream dies on an non-EOF error. If a duration was given, stop
+// cleanly once it's up. On a clean stop, send a footer if we were asked to.
+// Either way, our sink connections are closed on the way out. The start and
+// exit go in the audit file, if there is one.
+func (m *Mux) Run() (err error) {
+	if m.auditPath != "" {
+		if m.audit, err = openAudit(m.auditPath); err != nil {
+			return err
+		}
+		for _, l := range m.logstash.each() {
+			l.audit = m.audit
+		}
+	}
+	m.audit.record("start", "args", strings.Join(redactArgs(os.Args[1:]), " "))
+	defer func() {
+		if err != nil {
+			m.audit.record("exit", "error", err.Error())
+		} else {
+			m.audit.record("exit")
+		}
+	}()
+	defer m.closeSinks()
+	err = m.Configure()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.pauseOnSignal(stop)
+	go m.state.saveEvery(stop)
+	err = m.runStreams()
+	if err == nil && m.emitFooter {
+		err = m.writeFooter()
+	}
+	if ferr := m.flushSinks(); err == nil {
+		err = ferr
+	}
+	if serr := m.state.save(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// allSinks is every connection we write to: each logstash, with its mirrors
+// and fallback, and each --sink.
+func (m *Mux) allSinks() []*LogstashService {
+	all := m.logstash.each()
+	for _, l := range m.sinks {
+		all = append(all, l.each()...)
+	}
+	return all
+}
+
+// closeSinks closes our connections once the run is over. A sink that's
+// still stuck in a write past the flush deadline keeps its connection, as
+// we'd rather exit than wait on it.
+func (m *Mux) closeSinks() {
+	for _, l := range m.allSinks() {
+		if l.TryLock() {
+			l.shutdown()
+			l.Unlock()
+			l.runHooks()
+		}
+	}
+}
+
+// flushSinks sends out anything that's batched up for any of our sinks,
+// within the --flush-deadline.
+func (m *Mux) flushSinks() error {
+	m.startFlush()
+	done := make(chan error, 1)
+	go func() {
+		err := m.logstash.Flush()
+		for _, l := range m.sinks {
+			if ferr := l.Flush(); err == nil {
+				err = ferr
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-m.flushBy:
+		return fmt.Errorf("flush deadline of %s passed before batched events were sent; they're lost", m.flushDeadline)
+	}
+}
+
+// ownEvent shapes an event of logmux's own, from a JSON object body, for
+// the configured codec.
+func (o *Options) ownEvent(body []byte, tag string) []byte {
+	if o.codec == "gelf" {
+		return o.gelfEvent(body, tag)
+	}
+	ev := append(body[:len(body)-1], fmt.Sprintf(",\"tag\":%q}\n", tag)...)
+	if !hasNonSpace(body[1 : len(body)-1]) {
+		ev = []byte(fmt.Sprintf("{\"tag\":%q}\n", tag))
+	}
+	if o.codec == "msgpack" {
+		ev = msgpackEvent(ev)
+	}
+	if o.codec == "syslog" {
+		ev = o.syslogEvent(ev, tag)
+	}
+	return ev
+}
+
+// probeTag is the reserved tag for the event sent by --probe-send.
+const probeTag = "logmux.probe"
+
+// runProbe opens the logstash connection the same way a run would, sends a
+// probe event if asked to, and closes it again. Over beats://, the event is
+// only sent once logstash acks it.
+func (m *Mux) runProbe() error {
+	for _, l := range m.logstash.each() {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if m.probeSend {
+		if err := m.logstash.Write([]event{{tag: probeTag, buf: m.opts.ownEvent([]byte("{}"), probeTag)}}); err != nil {
+			return err
+		}
+		if err := m.logstash.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, l := range m.logstash.each() {
+		if l.conn == nil {
+			// Elasticsearch is only reached when a batch is sent.
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "logmux: logstash at %s is reachable (%s)\n", l.redacted(), l.conn.RemoteAddr())
+		l.conn.Close()
+	}
+	return nil
+}
+
+// footerTag is the reserved tag for the footer event sent by --emit-footer.
+const footerTag = "logmux.footer"
+
+// writeFooter sends the footer over every logstash connection that's open
+// as we're exiting, which for batching sinks goes out with the last batch.
+func (m *Mux) writeFooter() error {
+	m.startFlush()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for _, l := range m.allSinks() {
+			l.Lock()
+			if ferr := l.writeFooter(); ferr != nil && err == nil {
+				err = fmt.Errorf("footer for %s: %s", l.redacted(), ferr)
+			}
+			l.Unlock()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-m.flushBy:
+		return fmt.Errorf("flush deadline of %s passed before the footer was written", m.flushDeadline)
+	}
+}
+
+// startFlush starts the clock on the --flush-deadline, if there is one and
+// it isn't already running.
+func (m *Mux) startFlush() {
+	if m.flushDeadline > 0 && m.flushBy == nil {
+		by := make(chan struct{})
+		time.AfterFunc(m.flushDeadline, func() { close(by) })
+		m.flushBy = by
+	}
+}
+
+// runStreams runs each incoming log stream in its own go routine, until
+// they've all ended or the run is stopped. With a --config file, we keep
+// going as long as we might be told to reload it, running the streams that
+// are added to it.
+func (m *Mux) runStreams() error {
+	// Every stream has room to send its terminal error, so none of them is
+	// left blocked if we return early. Streams started by a reload don't,
+	// so once we've returned, whatever they send is thrown away.
+	ch := make(chan error, len(m.streams))
+	m.done = make(chan struct{})
+	n := 0
+	isSingle := len(m.streams) == 1 && m.configPath == ""
+	for _, s := range m.streams {
+		n++
+		go m.runStream(s, ch, isSingle)
+	}
+	var timeout <-chan time.Time
+	if m.duration > 0 {
+		timeout = time.After(m.duration)
+	}
+	// SIGINT and SIGTERM stop the run cleanly, like the end of --duration.
+	// A second one kills us outright, as usual.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	// SIGHUP reloads the --config file, as does its changing, with
+	// --watch-config.
+	var hups chan os.Signal
+	var reload chan struct{}
+	if m.configPath != "" {
+		hups = make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		defer signal.Stop(hups)
+		reload = make(chan struct{}, 1)
+		if m.watchConfig {
+			stop := make(chan struct{})
+			defer close(stop)
+			go m.watchConfigFile(reload, stop)
+		}
+		defer func() {
+			go func() {
+				for range ch {
+				}
+			}()
+		}()
+	}
+	if n == 0 && reload == nil {
+		// With no streams, just hold the logstash connection open until
+		// we're told to stop.
+		select {
+		case <-sigs:
+		case <-timeout:
+		}
+		return nil
+	}
+	for n > 0 || reload != nil {
+		var added []Stream
+		select {
+		case err := <-ch:
+			n--
+			if err != io.EOF {
+				return err
+			}
+		case <-hups:
+			added = m.reloadConfig()
+		case <-reload:
+			added = m.reloadConfig()
+		case <-timeout:
+			return m.stop(ch, n)
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			fmt.Fprintf(os.Stderr, "logmux: stopping on %s\n", sig)
+			return m.stop(ch, n)
+		}
+		for _, s := range added {
+			n++
+			go m.runStream(s, ch, false)
+		}
+	}
+	return nil
+}
+
+// stop ends a run early, but cleanly. Every stream writes out what it has
+// already read, along with anything it's holding back (like a multiline event,
+// or lines waiting to be reordered), before we return, unless the
+// --flush-deadline passes first.
+func (m *Mux) stop(ch <-chan error, n int) error {
+	close(m.done)
+	m.startFlush()
+	for ; n > 0; n-- {
+		select {
+		case err := <-ch:
+			if err != io.EOF {
+				return err
+			}
+		case <-m.flushBy:
+			return fmt.Errorf("flush deadline of %s passed with %d streams still writing out what they'd read; their lines are lost", m.flushDeadline, n)
+		}
+	}
+	return nil
+}
+
+// streamScheme matches the scheme at the start of a URL stream specifier,
+// and streamSchemes are the ones we know, marked "port" if their address has
+// a port of its own.
+var (
+	streamScheme  = regexp.MustCompile(`^[a-z][a-z0-9+.-]*://`)
+	streamSchemes = map[string]string{"listen-http://": "port", "listen-tls://": "port", "listen-fd://": "", "listen-unix://": "", "mq://": "", "file://": ""}
+)
+
+// parseStreamArg takes an input a raw stream specification (as collected
+// from the OS CLI), and returns a stream object that represents an incoming
+// log stream. The format is <specifier>:<tag>, optionally followed by
+// ;key=value stream options. Integer specifiers are treated as nameless pipes,
+// as is "-" for stdin, and listen-http://, listen-tls://, listen-fd:// and
+// listen-unix:// specifiers as endpoints to listen on. mq:// specifiers are POSIX message
+// queues, and file:// specifiers are regular files to tail. Other string
+// specifiers are treated as paths that indicate named pipes.
+func parseStreamArg(raw string) (ret Stream, err error) {
+	opts := strings.Split(raw, ";")
+	parts := strings.Split(opts[0], ":")
+	if scheme := streamScheme.FindString(opts[0]); scheme != "" {
+		// URL specifiers have colons of their own, so the tag is whatever
+		// comes after the last one past the scheme. Without one, the URL
+		// would be taken apart as a path and a tag.
+		if _, ok := streamSchemes[scheme]; !ok {
+			return nil, fmt.Errorf("Specified stream %s has an unknown scheme %s", raw, scheme)
+		}
+		addr := opts[0][len(scheme):]
+		i := strings.LastIndex(addr, ":")
+		if streamSchemes[scheme] == "port" && i >= 0 && !strings.Contains(addr[:i], ":") {
+			// That was the port's colon.
+			i = -1
+		}
+		if i < 0 || i == len(addr)-1 {
+			return nil, fmt.Errorf("Specified stream %s has no tag; want %s...:<tag>", raw, scheme)
+		}
+		parts = []string{scheme + addr[:i], addr[i+1:]}
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Specified stream %s has wrong number of components (%d)", raw, len(parts))
+	}
+	var base *BaseStream
+	fd, err := strconv.ParseInt(parts[0], 10, 64)
+	if parts[0] == "-" {
+		fd, err = 0, nil
+	}
+	if strings.HasPrefix(parts[0], "listen-http://") {
+		u, err := url.Parse(parts[0])
+		if err != nil || u.Port() == "" {
+			return nil, fmt.Errorf("Specified stream %s: bad listen-http address", raw)
+		}
+		h := &HTTPStream{url: u}
+		ret, base = h, &h.BaseStream
+	} else if strings.HasPrefix(parts[0], "listen-tls://") {
+		addr := strings.TrimPrefix(parts[0], "listen-tls://")
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return nil, fmt.Errorf("Specified stream %s: bad listen-tls address", raw)
+		}
+		t := &TLSStream{addr: addr}
+		ret, base = t, &t.BaseStream
+	} else if strings.HasPrefix(parts[0], "listen-fd://") {
+		name := strings.TrimPrefix(parts[0], "listen-fd://")
+		if name == "" {
+			return nil, fmt.Errorf("Specified stream %s: bad listen-fd socket", raw)
+		}
+		a := &ActivatedStream{name: name}
+		ret, base = a, &a.BaseStream
+	} else if strings.HasPrefix(parts[0], "listen-unix://") {
+		path := strings.TrimPrefix(parts[0], "listen-unix://")
+		if path == "" || path == "@" {
+			return nil, fmt.Errorf("Specified stream %s: bad listen-unix socket", raw)
+		}
+		u := &UnixStream{path: path}
+		ret, base = u, &u.BaseStream
+	} else if strings.HasPrefix(parts[0], "mq://") {
+		name := strings.TrimPrefix(parts[0], "mq://")
+		if name == "" || strings.Contains(strings.TrimPrefix(name, "/"), "/") {
+			return nil, fmt.Errorf("Specified stream %s: bad message queue name", raw)
+		}
+		q := &MQStream{name: name}
+		ret, base = q, &q.BaseStream
+	} else if strings.HasPrefix(parts[0], "file://") {
+		path := strings.TrimPrefix(parts[0], "file://")
+		if path == "" {
+			return nil, fmt.Errorf("Specified stream %s: bad file path", raw)
+		}
+		t := &TailStream{path: path}
+		ret, base = t, &t.BaseStream
+	} else if err == nil {
+		p := &PipeStream{fd: fd}
+		ret, base = p, &p.BaseStream
+	} else {
+		n := &NamedPipeStream{path: parts[0]}
+		ret, base = n, &n.BaseStream
+	}
+	base.tag = parts[1]
+	base.raw = raw
+	for _, kv := range opts[1:] {
+		if err := base.opts.set(kv); err != nil {
+			return nil, fmt.Errorf("Specified stream %s: %s", raw, err)
+		}
+	}
+	return ret, nil
+}
+
+// expandFdList turns a stream specification for a comma-separated list of
+// FDs, like 6,7,8:app.log, into one specification per FD, each with the
+// same tag and options. Other specifications come back as they are.
+func expandFdList(raw string) []string {
+	spec := strings.SplitN(raw, ";", 2)
+	parts := strings.SplitN(spec[0], ":", 2)
+	if len(parts) != 2 || !strings.Contains(parts[0], ",") {
+		return []string{raw}
+	}
+	fds := strings.Split(parts[0], ",")
+	for _, fd := range fds {
+		if _, err := strconv.ParseInt(fd, 10, 64); err != nil {
+			// It's a named pipe with a comma in its path.
+			return []string{raw}
+		}
+	}
+	var ret []string
+	for _, fd := range fds {
+		one := fd + ":" + parts[1]
+		if len(spec) > 1 {
+			one += ";" + spec[1]
+		}
+		ret = append(ret, one)
+	}
+	return ret
+}
+
+func printHelp(fs *flag.FlagSet) {
+	fmt.Printf(`NAME
+	logmux -- mux several input log streams into one
+
+OVERVIEW
+	A simple program that takes one or more log streams, and smashes them
+	together into one stream that's sent into a logstash server process.
+	Likely that process is on localhost, but it doesn't have to be. Each
+	incoming stream gets it own tag so that the streams can be disambiguated
+	in ELK.
+
+	Specify the logstash location with:
 
 		--logstash tcp://<hostname>:<port>
 
+	Or, to connect over TLS, checking that logstash has a cert for
+	<hostname> (signed by a system CA, or one in --logstash-tls-ca):
+
+		--logstash tls://<hostname>:<port>
+
+	To dial logstash at one address, but check its cert for another name
+	(and send that name for SNI), as behind a load balancer, add
+	--tls-server-name <name>.
+
+	If logstash wants a client cert, give it, along with its key, as PEM
+	files with --client-cert <path> and --client-key <path>, or as a
+	PKCS#12 bundle with --client-pkcs12 <path>, with its passphrase in the
+	environment variable named by --client-pkcs12-passphrase-env
+	(LOGMUX_PKCS12_PASSPHRASE by default). The files are read again for
+	each new connection, so a rotated cert is picked up at the next
+	reconnect without a restart.
+
+	Or, to send each event as a UDP datagram to logstash's udp input (events
+	over --udp-max-packet bytes are dropped):
+
+		--logstash udp://<hostname>:<port>
+
+	With --udp-max-datagram, events are packed into datagrams of up to that
+	many bytes instead, each sent once the next event wouldn't fit, or after
+	--udp-flush-interval. If the socket fails with a datagram half packed, it
+	goes out once, on the new socket, rather than being lost.
+
+	Or, to connect to logstash's unix socket input:
+
+		--logstash unix:///var/run/logstash.sock
+
+	Or, to find logstash through DNS SRV records:
+
+		--logstash srv://_logstash._tcp.example.com
+
+	Or, to feed logstash's beats input (lumberjack v2) rather than its tcp
+	input, use:
+
+		--logstash beats://<hostname>:<port>
+
+	Or, to skip logstash and index events straight into Elasticsearch with
+	its bulk API (in batches of --es-batch-size, into the --es-index for
+	their tag, with events turned away by a 429 retried):
+
+		--logstash https://<user>:<password>@<hostname>:9200/_bulk
+
+	Or, to feed a syslog collector (like rsyslog or syslog-ng) over TCP, with
+	each event in an RFC 5424 message whose APP-NAME is its tag:
+
+		--logstash syslog://<hostname>:<port>
+
+	Only what goes to syslog:// is framed that way; mirrors get events as
+	usual. (--codec syslog frames what goes to every tcp-like URL.)
+
+	Or, to RPUSH events onto a redis list, for logstash's redis input (with
+	data_type => "list") to pop off, as a buffer in front of logstash:
+
+		--logstash redis://:<password>@<hostname>:6379/<key>
+
+	Or, to publish each event to NATS, on a subject made of the path and the
+	event's tag (like logs.app.error for the app.error tag, by default):
+
+		--logstash nats://<user>:<password>@<hostname>:4222/logs
+
+	Or, to publish each event to a RabbitMQ exchange (--amqp-exchange), with
+	its tag as the routing key, waiting for the broker to confirm it:
+
+		--logstash amqp://<user>:<password>@<hostname>:5672/<vhost>
+
+	Or, to produce each event as a message to a Kafka topic, in batches of
+	up to --kafka-batch-size, held for up to --kafka-linger, with the
+	brokers to look the topic's partitions up with (9092 is the default
+	port):
+
+		--logstash kafka://<broker>,<broker>/<topic>
+
+	With --kafka-key-tag, each message is keyed by its tag, so that each
+	tag's events go to one partition, in order. Produces that fail for a
+	broker being down or a partition's leader moving are retried, with
+	backoff.
+
+	Or, to skip logstash and ship events to an AWS Kinesis Data Firehose
+	delivery stream, in PutRecordBatch calls, with credentials from the
+	usual AWS_* environment variables:
+
+		--logstash firehose://<delivery-stream> --firehose-region us-east-1
+
+	Or, to ship events to AWS CloudWatch Logs in PutLogEvents calls, into a
+	log stream (made for you) in a log group (which has to exist), where a
+	{tag} in the log stream's name is filled in with each event's tag:
+
+		--logstash cloudwatch://us-east-1/<log-group>/<log-stream>
+
+	A log group that starts with a slash, like /aws/lambda/fn, takes two
+	after the region: cloudwatch://us-east-1//aws/lambda/fn/main.
+
+	Or, to write the muxed events to our own stdout, as for a container
+	whose runtime collects its output, or to see what would be shipped:
+
+		--logstash stdout://
+
+	or just --logstash -.
+
+	Or, to append events to a local file, rotated to <path>.1 and so on once
+	it would grow past --file-max-bytes, keeping --file-backups of them:
+
+		--logstash file:///var/log/logmux/archive.log
+
+	Give --logstash more than once to mirror every event to each of them, of
+	whatever kinds, as while moving to a new cluster, or to keep a file://
+	archive of what goes to logstash. If one of them can't be written to, the
+	others still get their copy, and it's tried again with the next write;
+	only once none of them can be written to does the stream end as usual.
+
+	To keep shipping through an outage, give a second logstash to fail over
+	to with --logstash-fallback. Once a write to --logstash fails, writes go
+	to the fallback, and --logstash is tried again every
+	--logstash-fallback-retry until it takes them again.
+
 	And specify incoming streams in <specifier>:<tag> pairs.  For instance:
 
 	    logmux --logstash tcp://localhost:5000 \
 	    	6:app.error 7:launch.log \
 	    	/ngingx/log/access_log:nginx.access
 
+	Several FDs that share a tag can be given as a comma-separated list, like
+	6,7,8:app.log, and each is read on its own.
+
+	To take lines POSTed over HTTP, use a listen-http specifier:
+
+	    logmux --logstash tcp://localhost:5000 \
+	    	listen-http://127.0.0.1:8080/ingest:job.logs
+
+	Or, to take lines over mutually-authenticated TLS connections, use a
+	listen-tls specifier along with --listen-tls-cert, --listen-tls-key and
+	--listen-tls-client-ca:
+
+	    logmux --logstash tcp://localhost:5000 --listen-tls-cert server.pem \
+	    	--listen-tls-key server.key --listen-tls-client-ca clients.pem \
+	    	listen-tls://0.0.0.0:6514:net.secure
+
+	Under systemd socket activation, use a listen-fd specifier to take lines
+	over a passed-in socket, given by its index or FileDescriptorName:
+
+	    logmux --logstash tcp://localhost:5000 listen-fd://0:app.logs
+
+	To take lines over connections to a Unix socket, use a listen-unix
+	specifier, with a path, or on Linux, an @name in the abstract namespace,
+	which leaves no socket file behind:
+
+	    logmux --logstash tcp://localhost:5000 listen-unix://@logmux:app.logs
+
+	On Linux, use an mq specifier to read each message off of a POSIX message
+	queue as a line:
+
+	    logmux --logstash tcp://localhost:5000 mq://sensor.logs:sensor
+
+	Use a file specifier to tail a regular file, following it when it's
+	rotated or truncated:
+
+	    logmux --logstash tcp://localhost:5000 file:///var/log/app.log:app
+
+	Only lines written to the file from then on are shipped, as with tail
+	-F. To ship what's already in it too, use --tail-from beginning, or
+	tail-from=beginning for the one stream.
+
+	With --state-dir, how far into each file its lines have been shipped is
+	checkpointed there, keyed by the file's inode, and a restart resumes
+	from the checkpoint. If the file was rotated since, the rest of the old
+	one is read first, if it's still in the same directory; if it was
+	truncated, it's read from the top. The checkpoint takes precedence over
+	--tail-from, which only applies to files that don't have one yet.
+
+	To tail more files than the open file limit allows, use
+	--max-open-files to cap how many are open at once. The files idle
+	longest are closed to make room, and each is reopened where it left off
+	once it has more lines, or has been rotated or truncated.
+
+	File specifiers can go in a --config file instead, one per line, with
+	blank lines and # comments skipped. On SIGHUP, logmux rereads it: the
+	streams taken out of it are stopped, once they've written out what
+	they've read, and the ones added to it are started. A stream whose
+	options change is restarted. With --watch-config, it's reread whenever
+	it changes, once it's stopped changing for a moment, with no SIGHUP
+	needed. If it can't be read, or has a bad stream in it, the streams stay
+	as they were. Either way, the reload goes in the --audit-file.
+
+	Use - as the specifier to read from stdin, for instance:
+
+	    mytool | logmux --logstash tcp://localhost:5000 -:ci.build
+
+	To hold off shipping for a while, as for maintenance on logstash, send
+	logmux a SIGUSR2, or POST to /pause on the --http-addr. Streams and
+	connections stay up, but reads back up until another SIGUSR2, or a POST
+	to /resume. Paused streams show as "paused" in /streams.
+
+	On SIGINT or SIGTERM, logmux stops cleanly, as it does once --duration
+	is up: every stream writes out what it has read (and its aggregate
+	summary), within the --flush-deadline. A second signal kills it
+	outright.
+
 	You can specify 1 or more incoming log streams. Named pipes are reopened
 	indefinitely, but pipes passed as FDs are left close as soon as they crash.
 	The program exits on the first non-EOF exit condition.
 
+	Streams can override global settings with ;key=value options after the
+	tag. For instance, to ship a stream as plain text even if its lines look
+	like JSON:
+
+	    logmux --logstash tcp://localhost:5000 --format json \
+	    	'6:app.error;format=plain'
+
+	The supported stream options are:
+
+		format=auto|plain|json
+		framing=line|length|journal-export|raw
+		min-line-bytes=<n>
+		multiline-start=<regexp>
+		drop-unparseable-json=true|false
+		aggregate=<interval>[,by=<field>]
+		record-separator=<separator, like \x1e>
+		timestamp-pattern=<regexp>
+		timestamp-layout=<Go time layout>
+		timestamp-zone=<zone, like UTC or America/New_York>
+		strip-timestamp=true|false
+		priority=<n>
+		tail-from=end|beginning
+		path-fields=k8s-pod-path|<regexp>
+		reconnect-backoff=<duration>
+		reconnect-backoff-max=<duration>
+		reconnect-attempts=<n>
+
+	A timestamp-pattern finds an app's own timestamp in its plain lines (its
+	first capture group if it has one, the whole match otherwise), which is
+	parsed with timestamp-layout (RFC 3339 by default) and shipped as the
+	event's @timestamp. Timestamps without a zone are taken to be in
+	timestamp-zone (the local zone by default), and ones without a year are
+	taken to be from the last year. Lines without a timestamp that parses
+	are shipped as usual, and logstash stamps them with when it took them in,
+	unless --fail-on-parse-error says to fail the stream on them, as for a
+	pattern that's wrong for the stream. For instance:
+
+	    logmux --logstash tcp://localhost:5000 \
+	    	'6:app;timestamp-pattern=^(\w{3} [ \d]\d \d\d:\d\d:\d\d) ;timestamp-layout=Jan _2 15:04:05;strip-timestamp=true'
+
+	With a sink that sends events in batches, like Elasticsearch's bulk
+	API, a stream with a higher priority has its events go out in the next
+	batch ahead of any backlog from streams with a lower one (0 by default),
+	as for an error stream that shouldn't wait behind a burst of debug lines.
+	Each stream's own events still go out in order. For instance:
+
+	    logmux --logstash https://es:9200/_bulk '6:app.error;priority=1' 7:app.debug
+
+	A file:// stream's path-fields option adds fields taken from its path to
+	each of its events, which ships its plain lines as JSON. With a regexp,
+	each named capture group, like (?P<service>\w+), is a field. With
+	k8s-pod-path, a Kubernetes container log at the kubelet's
+	/var/log/pods/<namespace>_<pod>_<uid>/<container>/<n>.log gets
+	namespace, pod, pod_uid and container fields. A path that the pattern
+	doesn't match is an error. For instance:
+
+	    logmux --logstash tcp://localhost:5000 \
+	    	'file:///var/log/pods/web_api-7d9f_1b2c/api/0.log:k8s;path-fields=k8s-pod-path'
+
+	Normally, a stream ends once a write to logstash fails. With
+	--reconnect-backoff, the connection is closed, and the write is tried
+	again on a new one once the backoff has passed, with the wait doubling
+	each time it fails again, up to --reconnect-backoff-max, until it goes
+	through or --reconnect-attempts run out. A stream's reconnect-backoff,
+	reconnect-backoff-max and reconnect-attempts options each override the
+	global flag of the same name for just that stream, and the flags apply
+	to whichever of them it leaves out; reconnect-backoff=0 doesn't retry.
+	With --connection-per-stream, each stream reconnects on its own. For
+	instance, to retry errors quickly but let debug lines wait:
+
+	    logmux --logstash tcp://localhost:5000 --reconnect-backoff 100ms \
+	    	'6:app.error;reconnect-backoff-max=1s' \
+	    	'7:app.debug;reconnect-backoff=5s;reconnect-backoff-max=5m;reconnect-attempts=20'
+
+	A stream with framing=raw is relayed byte for byte, without being split
+	into lines, tagged or framed, for a protocol that's already framed. Its
+	bytes go over a connection of its own, so it needs
+	--connection-per-stream, and none of the other options apply to it.
+
 	That's it!
 
 OPTIONS
@@ -340,15 +3186,136 @@ OPTIONS
 	fmt.Printf("\n")
 }
 
+// stdinArgs makes room for stdin stream specifications like -:tag, which the
+// flag package would otherwise take for a flag, by ending the flags right
+// before the first one.
+func stdinArgs(args []string) []string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-:") {
+			return append(append(args[:i:i], "--"), args[i:]...)
+		}
+	}
+	return args
+}
+
 // parseArgs parses the command line arguments and outputs a Mux object,
 // which should have a logstash service to output to, and one or more incoming
 // log streams.
 func parseArgs() (*Mux, error) {
 	var ret Mux
 	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
-	fs.Var(&ret.logstash, "logstash", "A URI for logstash in tcp://<hostname>:<port> format")
+	fs.Var(&ret.logstash, "logstash", "A URI for logstash in tcp://<hostname>:<port> format; give it more than once to mirror events to each")
+	fs.IntVar(&ret.logstash.udpMax, "udp-max-packet", maxUDPPacket, "Biggest event to send to a udp:// logstash, in bytes; keep it within the udp input's buffer_size")
+	fs.IntVar(&ret.logstash.udpPack, "udp-max-datagram", 0, "Pack events sent to a udp:// logstash into datagrams of up to this many bytes, like the MTU, rather than one per event; bigger events go alone, truncated to fit (0 to disable)")
+	fs.DurationVar(&ret.logstash.udpEvery, "udp-flush-interval", 200*time.Millisecond, "Longest to hold events for a --udp-max-datagram datagram before sending it")
+	fs.StringVar(&ret.logstash.esIndex, "es-index", "logmux-{tag}", "Index to send each event to with an http(s):// Elasticsearch bulk API URL, where {tag} is the event's tag and {date} its UTC date, like 2006.01.02")
+	fs.IntVar(&ret.logstash.esBatch, "es-batch-size", 500, "Most events to send in one Elasticsearch bulk request")
+	fs.StringVar(&ret.logstash.amqpExchange, "amqp-exchange", "amq.topic", "Exchange for an amqp:// logstash to publish events to, with their tag as the routing key")
+	fs.Int64Var(&ret.logstash.fileMaxBytes, "file-max-bytes", 100<<20, "Rotate a file:// logstash's file once it would grow past this many bytes (0 to never rotate)")
+	fs.IntVar(&ret.logstash.fileBackups, "file-backups", 5, "How many rotated files to keep for a file:// logstash, as <path>.1 (the newest) on up")
+	fs.IntVar(&ret.logstash.kafkaBatch, "kafka-batch-size", 500, "Most events to produce at once to a kafka:// logstash")
+	fs.DurationVar(&ret.logstash.kafkaLinger, "kafka-linger", 100*time.Millisecond, "Longest to hold events for a kafka:// logstash before producing them")
+	fs.BoolVar(&ret.logstash.kafkaKeyTag, "kafka-key-tag", false, "Key each message produced to a kafka:// logstash by its event's tag, so that each tag's events go to one partition, in order")
+	fs.StringVar(&ret.logstash.firehoseRegion, "firehose-region", os.Getenv("AWS_REGION"), "AWS region of a firehose:// delivery stream (default is $AWS_REGION)")
+	fs.DurationVar(&ret.logstash.esEvery, "es-flush-interval", time.Second, "Longest to hold events for an Elasticsearch bulk request before sending it")
+	fallback := fs.String("logstash-fallback", "", "A URI for a logstash to write to instead while writes to --logstash fail")
+	fs.DurationVar(&ret.logstash.fallbackRetry, "logstash-fallback-retry", 30*time.Second, "While on the --logstash-fallback, how often to try --logstash again")
+	logstashCA := fs.String("logstash-tls-ca", "", "PEM CA bundle that a tls:// logstash's cert must be signed by, instead of the system's CAs")
+	clientCertFile := fs.String("client-cert", "", "PEM client cert to present to a tls:// logstash or an https:// Elasticsearch, reread for each connection")
+	clientKeyFile := fs.String("client-key", "", "PEM key for --client-cert")
+	clientPKCS12 := fs.String("client-pkcs12", "", "PKCS#12 (.p12) bundle with a client cert and key to present to a tls:// logstash or an https:// Elasticsearch")
+	pkcs12PassEnv := fs.String("client-pkcs12-passphrase-env", "LOGMUX_PKCS12_PASSPHRASE", "Environment variable that holds the passphrase for --client-pkcs12")
+	tlsServerName := fs.String("tls-server-name", "", "Name that a tls:// logstash's cert must be for, and that's sent to it for SNI, instead of the host it's dialed at (like behind a load balancer reached by IP)")
+	fs.StringVar(&ret.logstash.encoding, "output-encoding", "utf-8", "Encoding of the output to logstash (utf-8|utf-16le)")
+	fs.BoolVar(&ret.logstash.bom, "output-bom", false, "Write a byte order mark at the start of each connection to logstash")
+	fs.DurationVar(&ret.logstash.idleTimeout, "sink-idle-timeout", 0, "Close the connection to logstash after this long without writes, and reopen it on the next write (0 to keep it open)")
+	fs.IntVar(&ret.opts.inputBufferLines, "input-buffer-lines", 0, "Prefetch up to this many lines per stream while writing to logstash (0 to disable)")
+	recordSep := fs.String("record-separator", "", "Split lines further into records on this separator (like \\x1e), for streams without their own record-separator option")
+	parse := fs.String("parse", "line", "Record framing for streams without their own framing option (line|length|journal-export|raw)")
+	fs.StringVar(&ret.opts.messageField, "message-field", "message", "Field that plain lines go under when they're wrapped into JSON, and that a GELF short_message is taken from")
+	requireMessage := fs.Bool("require-message", false, "Give JSON lines without a --message-field one, set to --message-placeholder")
+	fs.StringVar(&ret.opts.messagePlaceholder, "message-placeholder", "", "Value for the message field that --require-message fills in")
+	dropNoMessage := fs.Bool("drop-no-message", false, "Drop (and count) JSON lines without a --message-field")
+	fs.StringVar(&ret.opts.format, "format", "auto", "Output format for streams without their own format option (auto|plain|json)")
+	fs.BoolVar(&ret.opts.preserveWhitespace, "preserve-whitespace", false, "Keep leading and trailing whitespace on plain lines, stripping only the line delimiter")
+	fs.BoolVar(&ret.opts.collapseWhitespace, "collapse-whitespace", false, "Squeeze runs of spaces and tabs in plain lines down to one space (leading indentation is kept with --preserve-whitespace)")
+	fs.BoolVar(&ret.opts.normalizeNewlines, "normalize-newlines", false, "Convert CRLF to LF within lines, such as multiline events from Windows producers")
+	fs.BoolVar(&ret.opts.addLag, "add-lag", false, "Add a logmux_lag_ms field to JSON events with the time from read to write")
+	addRunID := fs.Bool("add-run-id", false, "Add a logmux_run_id field to JSON events, with a random UUID that's the same for the whole run")
+	fs.StringVar(&ret.opts.runID, "run-id", "", "Run ID to add to JSON events instead of a random one; implies --add-run-id")
+	runIDEnv := fs.String("run-id-from-env", "", "Name of an environment variable holding the run ID to add to JSON events, if --run-id isn't given; implies --add-run-id")
+	fieldOrder := fs.String("field-order", "", "Comma-separated fields to put first in JSON events, in order, with the rest sorted after them (like tag,@timestamp,level,message)")
+	fs.BoolVar(&ret.opts.includeRaw, "include-raw", false, "Add a raw field with the original line to events changed by --extract-field, --map-field or --max-fields")
+	fs.BoolVar(&ret.opts.addHash, "add-hash", false, "Add a logmux_hash field to JSON events: the hex SHA-256 of the tag, a NUL, and the trimmed line, after --redact-json-keys")
+	fs.Var(&ret.opts.tagQuotas, "tag-quota", "Drop a tag's lines once it has shipped this many bytes in a day, in tag=bytes/day format (can be repeated)")
+	fs.StringVar(&ret.opts.quotaWindow, "tag-quota-window", "calendar", "When --tag-quota windows reset: at local midnight, or 24 hours after they start (calendar|rolling)")
+	fs.BoolVar(&ret.opts.explodeArrays, "explode-arrays", false, "Ship each object in a line that's a JSON array of objects as its own event")
+	fs.IntVar(&ret.opts.minLineBytes, "min-line-bytes", 0, "Drop lines shorter than this many bytes after trimming, for streams without their own min-line-bytes option")
+	fs.BoolVar(&ret.opts.trimTag, "trim-tag-from-message", false, "Strip the stream's tag off of the front of plain lines that already start with it")
+	fs.StringVar(&ret.opts.trimTagSeparators, "trim-tag-separators", ":-|", "Separator characters that can follow a tag trimmed by --trim-tag-from-message")
+	fs.BoolVar(&ret.opts.trimTagIgnoreCase, "trim-tag-ignore-case", false, "Match the tag case-insensitively for --trim-tag-from-message")
+	fs.StringVar(&ret.opts.codec, "codec", "", "Shape events for a different consumer: gelf for Graylog, msgpack for a msgpack codec, or syslog for RFC 5424 syslog (default is logstash's json_lines)")
+	syslogFacility := fs.String("syslog-facility", "user", "Facility for --codec syslog messages, like user, daemon or local0")
+	fs.StringVar(&ret.opts.host, "host-override", "", "Hostname to report in events (like GELF's host field) instead of the OS hostname")
+	hostEnv := fs.String("host-from-env", "", "Name of an environment variable holding the hostname to report in events, if --host-override isn't given")
+	fs.DurationVar(&ret.opts.reorderWindow, "reorder-window", 0, "Hold JSON lines with an @timestamp for up to this long to ship them in timestamp order (0 to disable)")
+	fs.Var(&ret.opts.addFields, "add-field", "Add a static string field to every JSON event, in key=value format (can be repeated)")
+	fs.Var(&ret.opts.splitTag, "split-tag", "Add fields to JSON events from the parts of the tag, like sep=.,fields=service,env,level (add missing=empty to add empty fields for missing parts)")
+	fs.Var(&ret.opts.extractFields, "extract-field", "Pull the first capture group of a regexp out of plain lines into a JSON field, in pattern=field format (can be repeated)")
+	fs.BoolVar(&ret.opts.extractRemove, "extract-remove", false, "Cut what --extract-field matched out of the message")
+	fs.BoolVar(&ret.opts.detectLevel, "detect-level", false, "Add a level field to plain lines that name a log level (like ERROR or [warn]), shipping them as JSON")
+	fs.BoolVar(&ret.opts.addSeverity, "add-severity", false, "Add a numeric severity field, the syslog number for the level (error=3, warn=4, info=6 and so on), to lines given a level by --detect-level and to JSON lines with a level field")
+	fs.Var(&ret.opts.severities, "severity-map", "Override the --add-severity number for a level, in level=number format, from 0 to 7 (can be repeated)")
+	fs.Var(&ret.opts.addJSON, "add-json", "Add a static field with a JSON value (like a nested object) to every JSON event, in field=json format (can be repeated)")
+	redactKeys := fs.String("redact-json-keys", "", "Comma-separated fields (or dotted paths to nested fields, like headers.authorization) to redact from JSON lines, whatever their stream's format; lines that look like JSON objects but don't decode are dropped")
+	redactMode := fs.String("redact-mode", "mask", "How --redact-json-keys redacts: mask the value as \"[REDACTED]\", or remove the field (mask|remove)")
+	fs.Var(&ret.opts.mapFields, "map-field", "Rename a field in JSON lines, in from=to format (can be repeated)")
+	fs.IntVar(&ret.opts.maxFields, "max-fields", 0, "Cap the number of top-level fields in JSON lines (0 for no cap)")
+	fs.StringVar(&ret.opts.maxFieldsAction, "max-fields-action", "trim", "What to do with JSON lines over --max-fields: trim to the first fields, or drop the line (trim|drop)")
+	fs.BoolVar(&ret.opts.splitObjects, "split-concatenated", false, "Ship each of the JSON objects concatenated together on a line as its own event")
+	fs.StringVar(&ret.opts.sanitizeControl, "sanitize-control", "", "Escape or strip control characters other than tab and newline in lines (escape|strip)")
+	fs.BoolVar(&ret.connPerStream, "connection-per-stream", false, "Give each stream its own connection to logstash, so one stream's backpressure never holds up another's")
+	fs.StringVar(&ret.httpAddr, "http-addr", "", "Serve status endpoints (like /streams) over HTTP on this <hostname>:<port>")
+	var retryable errnos
+	var reconnect backoff
+	fs.DurationVar(&reconnect.first, "reconnect-backoff", 0, "After a write to logstash fails, retry it on a new connection after this long, doubling the wait each time it fails again, for streams without their own reconnect-backoff option (0 to not retry, ending the stream)")
+	fs.DurationVar(&reconnect.max, "reconnect-backoff-max", 30*time.Second, "Longest wait between --reconnect-backoff retries, for streams without their own reconnect-backoff-max option")
+	fs.IntVar(&reconnect.attempts, "reconnect-attempts", 5, "Most times to retry a failed write with --reconnect-backoff before giving up on it, for streams without their own reconnect-attempts option")
+	fs.Var(&retryable, "retryable-errors", "Comma-separated read errors that streams retry (with backoff, up to 5 times in a row) rather than end on, out of EAGAIN, EIO, ECONNRESET and ETIMEDOUT (EINTR always is)")
+	fs.DurationVar(&ret.fdEOFGrace, "fd-eof-grace", 0, "After an EOF on a pipe passed as an FD, keep checking this long for a live write end (on Linux) before giving up on it (0 to give up right away)")
+	fs.IntVar(&ret.maxReopens, "max-concurrent-reopens", 0, "Cap how many named pipes can be blocked reopening at once (0 for no cap)")
+	tailFrom := fs.String("tail-from", "end", "Where file:// streams without their own tail-from option start in a file that has no --state-dir checkpoint (end|beginning)")
+	fs.IntVar(&ret.maxOpenFiles, "max-open-files", 0, "Cap how many file:// streams' files are open at once, closing the ones idle longest and reopening them where they left off once they have more lines (0 for no cap)")
+	fs.StringVar(&ret.configPath, "config", "", "File of file:// streams to tail, one per line, on top of any on the command line; it's reread on SIGHUP, starting the streams added to it and stopping the ones taken out")
+	fs.BoolVar(&ret.watchConfig, "watch-config", false, "Reread --config whenever it changes, once it's stopped changing, rather than only on SIGHUP")
+	fs.StringVar(&ret.stateDir, "state-dir", "", "Checkpoint how far into each file:// stream's file its lines have been shipped in this directory, and resume from there on a restart")
+	fs.IntVar(&ret.maxConns, "max-connections", 0, "Cap how many connections can be open at once across all listen-tls, listen-fd, listen-unix and listen-http streams; others are closed right away (0 for no cap)")
+	fs.BoolVar(&ret.allowNoStreams, "allow-no-streams", false, "Start even with no incoming streams, and idle until SIGINT or SIGTERM")
+	fs.BoolVar(&ret.emitFooter, "emit-footer", false, "Before closing each logstash connection, and on a clean exit, send a footer event tagged "+footerTag+" with the number of events sent over it")
+	fs.DurationVar(&ret.flushDeadline, "flush-deadline", 0, "On a clean stop, give up on writing out buffered lines, batched events and the footer after this long, and exit with an error (0 to wait indefinitely)")
+	ingestSecretEnv := fs.String("ingest-secret-env", "", "Name of an environment variable holding a shared secret that listen-http clients must send in the "+ingestSecretHeader+" header")
+	fs.Int64Var(&ret.ingestMaxBody, "ingest-max-body", 1024*1024, "Biggest POST body that listen-http streams accept, in bytes")
+	multilineStart := fs.String("multiline-start-pattern", "", "Join lines into multiline events that each start with a line matching this regexp, for streams without their own multiline-start option")
+	stampPattern := fs.String("timestamp-pattern", "", "Take plain lines' @timestamp from the timestamp this regexp finds in them (its first capture group, or the whole match), for streams without their own timestamp-pattern option")
+	stampLayout := fs.String("timestamp-layout", "", "Go time layout that --timestamp-pattern timestamps are written in (default RFC 3339)")
+	stampZone := fs.String("timestamp-zone", "", "Zone that timestamps without one are taken to be in, like UTC or America/New_York (default the local zone)")
+	stripStamp := fs.Bool("strip-timestamp", false, "Take the timestamp that --timestamp-pattern finds out of the message")
+	var failOnParse parseErrors
+	fs.Var(&failOnParse, "fail-on-parse-error", "Fail a stream, rather than ship the line as usual, on a plain line that its timestamp-pattern finds no timestamp in; or, given a threshold like 10%/1000, once over that share of its first lines don't parse")
+	listenCert := fs.String("listen-tls-cert", "", "PEM cert file that listen-tls streams present to clients")
+	listenKey := fs.String("listen-tls-key", "", "PEM key file for --listen-tls-cert")
+	listenClientCA := fs.String("listen-tls-client-ca", "", "PEM CA bundle that listen-tls clients' certs must be signed by")
+	allowDupFifos := fs.Bool("allow-duplicate-fifos", false, "Let several streams read from the same named pipe, in which case their lines interleave unpredictably")
+	fs.DurationVar(&ret.duration, "duration", 0, "Run for this long, then flush and exit cleanly (0 to run until the streams end)")
+	fs.StringVar(&ret.auditPath, "audit-file", "", "Append a JSON line for each of logmux's own actions (connections, streams, exits) to this file")
+	fs.BoolVar(&ret.configTest, "config-test", false, "Validate the command line, and that the paths it names can be opened, and exit with every problem found, without opening any streams or dialing logstash")
+	fs.BoolVar(&ret.probe, "probe", false, "Check that logstash is reachable, then exit, without opening any streams")
+	fs.BoolVar(&ret.probeSend, "probe-send", false, "With --probe, also send a probe event tagged "+probeTag)
 	helpPtr := fs.Bool("help", false, "print help")
-	err := fs.Parse(os.Args[1:])
+	err := fs.Parse(stdinArgs(os.Args[1:]))
 	if err != nil {
 		return nil, err
 	}
@@ -356,21 +3323,562 @@ func parseArgs() (*Mux, error) {
 		printHelp(fs)
 		return nil, errors.New("help wanted")
 	}
+	// Every problem with the command line is reported at once, rather than
+	// one per run.
+	var errs []error
 
 	if ret.logstash.url == nil {
-		return nil, errors.New("require a --logstash parameter")
+		errs = append(errs, errors.New("require a --logstash parameter"))
+	}
+	if e := ret.logstash.encoding; e != "utf-8" && e != "utf-16le" {
+		errs = append(errs, fmt.Errorf("bad --output-encoding value: %s", e))
+	}
+	if *fallback != "" {
+		l := &LogstashService{}
+		if err := l.Set(*fallback); err != nil {
+			errs = append(errs, fmt.Errorf("bad --logstash-fallback value: %s", err))
+		} else if ret.logstash.url != nil {
+			ret.logstash.fallback = l
+		}
+	}
+	if ret.logstash.fallbackRetry <= 0 {
+		errs = append(errs, fmt.Errorf("bad --logstash-fallback-retry value: %s", ret.logstash.fallbackRetry))
+	}
+	if ret.logstash.udpMax <= 0 || ret.logstash.udpMax > maxUDPPacket {
+		errs = append(errs, fmt.Errorf("bad --udp-max-packet value: %d", ret.logstash.udpMax))
+	}
+	if ret.logstash.udpPack < 0 || ret.logstash.udpPack > maxUDPPacket {
+		errs = append(errs, fmt.Errorf("bad --udp-max-datagram value: %d", ret.logstash.udpPack))
+	}
+	if ret.logstash.udpEvery <= 0 {
+		errs = append(errs, fmt.Errorf("bad --udp-flush-interval value: %s", ret.logstash.udpEvery))
+	}
+	if *logstashCA != "" && !ret.logstash.hasScheme("tls") && !ret.logstash.hasScheme("https") {
+		errs = append(errs, errors.New("--logstash-tls-ca needs a tls:// logstash or an https:// Elasticsearch"))
+	}
+	if *tlsServerName != "" && !ret.logstash.hasScheme("tls") && !ret.logstash.hasScheme("https") {
+		errs = append(errs, errors.New("--tls-server-name needs a tls:// logstash or an https:// Elasticsearch"))
+	}
+	var client *clientCert
+	if *clientPKCS12 != "" {
+		if !ret.logstash.hasScheme("tls") && !ret.logstash.hasScheme("https") {
+			errs = append(errs, errors.New("--client-pkcs12 needs a tls:// logstash or an https:// Elasticsearch"))
+		} else if *clientCertFile != "" || *clientKeyFile != "" {
+			errs = append(errs, errors.New("can't use --client-pkcs12 with --client-cert or --client-key"))
+		} else if client, err = newClientCert(func() (tls.Certificate, error) {
+			return loadPKCS12(*clientPKCS12, *pkcs12PassEnv)
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("--client-pkcs12: %s", err))
+		}
+	} else if *clientCertFile != "" || *clientKeyFile != "" {
+		if !ret.logstash.hasScheme("tls") && !ret.logstash.hasScheme("https") {
+			errs = append(errs, errors.New("--client-cert needs a tls:// logstash or an https:// Elasticsearch"))
+		} else if *clientCertFile == "" || *clientKeyFile == "" {
+			errs = append(errs, errors.New("--client-cert and --client-key go together"))
+		} else if client, err = newClientCert(func() (tls.Certificate, error) {
+			return tls.LoadX509KeyPair(*clientCertFile, *clientKeyFile)
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("--client-cert: %s", err))
+		}
+	}
+	if ret.logstash.fileMaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("bad --file-max-bytes value: %d", ret.logstash.fileMaxBytes))
+	}
+	if ret.logstash.fileBackups < 0 {
+		errs = append(errs, fmt.Errorf("bad --file-backups value: %d", ret.logstash.fileBackups))
+	}
+	if ret.logstash.esBatch <= 0 {
+		errs = append(errs, fmt.Errorf("bad --es-batch-size value: %d", ret.logstash.esBatch))
+	}
+	if ret.logstash.kafkaBatch <= 0 {
+		errs = append(errs, fmt.Errorf("bad --kafka-batch-size value: %d", ret.logstash.kafkaBatch))
+	}
+	if ret.logstash.kafkaLinger <= 0 {
+		errs = append(errs, fmt.Errorf("bad --kafka-linger value: %s", ret.logstash.kafkaLinger))
+	}
+	if ret.logstash.esEvery <= 0 {
+		errs = append(errs, fmt.Errorf("bad --es-flush-interval value: %s", ret.logstash.esEvery))
+	}
+	if ret.logstash.idleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("bad --sink-idle-timeout value: %s", ret.logstash.idleTimeout))
+	}
+	if ret.opts.inputBufferLines < 0 {
+		errs = append(errs, fmt.Errorf("bad --input-buffer-lines value: %d", ret.opts.inputBufferLines))
+	}
+	if *tailFrom != "end" && *tailFrom != "beginning" {
+		errs = append(errs, fmt.Errorf("bad --tail-from value: %s", *tailFrom))
+	}
+	if !validFraming(*parse) {
+		errs = append(errs, fmt.Errorf("bad --parse value: %s", *parse))
+	}
+	if f := ret.opts.messageField; f == "" || f == "tag" || strings.TrimSpace(f) != f {
+		errs = append(errs, fmt.Errorf("bad --message-field value: %q", f))
+	}
+	if *requireMessage && *dropNoMessage {
+		errs = append(errs, errors.New("can't use both --require-message and --drop-no-message"))
+	}
+	if *requireMessage {
+		ret.opts.missingMessage = "fill"
+	} else if *dropNoMessage {
+		ret.opts.missingMessage = "drop"
+	}
+	if !validFormat(ret.opts.format) {
+		errs = append(errs, fmt.Errorf("bad --format value: %s", ret.opts.format))
+	}
+	if ret.opts.minLineBytes < 0 {
+		errs = append(errs, fmt.Errorf("bad --min-line-bytes value: %d", ret.opts.minLineBytes))
+	}
+	if *redactKeys != "" {
+		for _, key := range strings.Split(*redactKeys, ",") {
+			path := strings.Split(key, ".")
+			for _, step := range path {
+				if step == "" {
+					errs = append(errs, fmt.Errorf("bad --redact-json-keys key: %q", key))
+				}
+			}
+			ret.opts.redactKeys = append(ret.opts.redactKeys, path)
+		}
+	}
+	switch *redactMode {
+	case "mask":
+	case "remove":
+		ret.opts.redactRemove = true
+	default:
+		errs = append(errs, fmt.Errorf("bad --redact-mode value: %s", *redactMode))
+	}
+	if *fieldOrder != "" {
+		ret.opts.fieldOrder = strings.Split(*fieldOrder, ",")
+	}
+	if w := ret.opts.quotaWindow; w != "calendar" && w != "rolling" {
+		errs = append(errs, fmt.Errorf("bad --tag-quota-window value: %s", w))
+	}
+	if ret.opts.maxFields < 0 {
+		errs = append(errs, fmt.Errorf("bad --max-fields value: %d", ret.opts.maxFields))
+	}
+	if a := ret.opts.maxFieldsAction; a != "trim" && a != "drop" {
+		errs = append(errs, fmt.Errorf("bad --max-fields-action value: %s", a))
+	}
+	if ret.opts.runID == "" && *runIDEnv != "" {
+		if ret.opts.runID = os.Getenv(*runIDEnv); ret.opts.runID == "" {
+			errs = append(errs, fmt.Errorf("--run-id-from-env: %s is not set", *runIDEnv))
+		}
+	}
+	if ret.opts.runID == "" && *addRunID {
+		if ret.opts.runID, err = newRunID(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if ret.opts.host == "" && *hostEnv != "" {
+		if ret.opts.host = os.Getenv(*hostEnv); ret.opts.host == "" {
+			errs = append(errs, fmt.Errorf("--host-from-env: %s is not set", *hostEnv))
+		}
+	}
+	if f, ok := syslogFacilities[*syslogFacility]; ok {
+		ret.opts.syslogFacility = f
+	} else {
+		errs = append(errs, fmt.Errorf("bad --syslog-facility value: %s", *syslogFacility))
+	}
+	codecOK := true
+	switch ret.opts.codec {
+	case "":
+	case "msgpack", "syslog":
+		if ret.logstash.encoding != "utf-8" || ret.logstash.bom {
+			errs = append(errs, fmt.Errorf("can't use --codec %s with another output encoding", ret.opts.codec))
+		}
+		if ret.opts.codec == "syslog" && ret.opts.host == "" {
+			if ret.opts.host, err = os.Hostname(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case "gelf":
+		if len(ret.opts.addJSON) > 0 {
+			errs = append(errs, errors.New("can't use --add-json with --codec gelf, whose fields can't be nested"))
+		}
+		if ret.opts.host == "" {
+			if ret.opts.host, err = os.Hostname(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("bad --codec value: %s", ret.opts.codec))
+		codecOK = false
+	}
+	// What each sink takes comes from its scheme; framedBy is the first one
+	// that frames events itself, which can't take raw streams' bytes.
+	esOutput, framedBy := false, ""
+	for _, l := range ret.logstash.each() {
+		if l.url == nil {
+			continue
+		}
+		l.encoding, l.bom, l.idleTimeout, l.udpMax = ret.logstash.encoding, ret.logstash.bom, ret.logstash.idleTimeout, ret.logstash.udpMax
+		l.udpPack, l.udpEvery = ret.logstash.udpPack, ret.logstash.udpEvery
+		l.esIndex, l.esBatch, l.esEvery = ret.logstash.esIndex, ret.logstash.esBatch, ret.logstash.esEvery
+		l.firehoseRegion, l.amqpExchange = ret.logstash.firehoseRegion, ret.logstash.amqpExchange
+		l.kafkaBatch, l.kafkaLinger, l.kafkaKeyTag = ret.logstash.kafkaBatch, ret.logstash.kafkaLinger, ret.logstash.kafkaKeyTag
+		l.fileMaxBytes, l.fileBackups = ret.logstash.fileMaxBytes, ret.logstash.fileBackups
+		l.opts, l.emitFooter = &ret.opts, ret.emitFooter
+		scheme, ok := sinkSchemes[l.url.Scheme]
+		if !ok {
+			errs = append(errs, fmt.Errorf("bad --logstash value: %s; unknown scheme %q", l.redacted(), l.url.Scheme))
+			continue
+		}
+		if scheme.check != nil {
+			if err := scheme.check(l); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if codecOK && !scheme.takes(ret.opts.codec) {
+			errs = append(errs, fmt.Errorf("can't use --codec %s with %s", ret.opts.codec, scheme.what))
+		}
+		if scheme.framed {
+			if ret.logstash.encoding != "utf-8" || ret.logstash.bom {
+				errs = append(errs, fmt.Errorf("can't change the output encoding for %s", scheme.what))
+			}
+			if framedBy == "" {
+				framedBy = scheme.what
+			}
+		}
+		esOutput = esOutput || scheme.documents
+		if l.url.Scheme == "tls" || l.url.Scheme == "https" {
+			name := l.url.Hostname()
+			if *tlsServerName != "" {
+				name = *tlsServerName
+			}
+			if l.tlsConfig, err = logstashTLSConfig(name, *logstashCA, client); err != nil {
+				errs = append(errs, fmt.Errorf("--logstash-tls-ca: %s", err))
+			}
+		}
+		if l.url.Scheme == "syslog" && ret.opts.host == "" {
+			if ret.opts.host, err = os.Hostname(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	switch ret.opts.sanitizeControl {
+	case "", "escape", "strip":
+	default:
+		errs = append(errs, fmt.Errorf("bad --sanitize-control value: %s", ret.opts.sanitizeControl))
+	}
+	if ret.fdEOFGrace < 0 {
+		errs = append(errs, fmt.Errorf("bad --fd-eof-grace value: %s", ret.fdEOFGrace))
+	}
+	if ret.maxReopens < 0 {
+		errs = append(errs, fmt.Errorf("bad --max-concurrent-reopens value: %d", ret.maxReopens))
+	}
+	if ret.flushDeadline < 0 {
+		errs = append(errs, fmt.Errorf("bad --flush-deadline value: %s", ret.flushDeadline))
+	}
+	if ret.maxConns < 0 {
+		errs = append(errs, fmt.Errorf("bad --max-connections value: %d", ret.maxConns))
+	}
+	if ret.maxOpenFiles < 0 {
+		errs = append(errs, fmt.Errorf("bad --max-open-files value: %d", ret.maxOpenFiles))
+	}
+	if reconnect.first < 0 {
+		errs = append(errs, fmt.Errorf("bad --reconnect-backoff value: %s", reconnect.first))
+	}
+	if reconnect.max < 0 {
+		errs = append(errs, fmt.Errorf("bad --reconnect-backoff-max value: %s", reconnect.max))
+	}
+	if reconnect.attempts < 0 {
+		errs = append(errs, fmt.Errorf("bad --reconnect-attempts value: %d", reconnect.attempts))
+	}
+	if ret.watchConfig && ret.configPath == "" {
+		errs = append(errs, errors.New("--watch-config needs a --config file to watch"))
 	}
-	if n := len(fs.Args()); n == 0 {
-		return nil, fmt.Errorf("neet at least 1 stream for input; got 0")
+	if ret.configPath != "" && ret.connPerStream {
+		errs = append(errs, errors.New("can't use --config with --connection-per-stream"))
 	}
+	if ret.opts.reorderWindow < 0 {
+		errs = append(errs, fmt.Errorf("bad --reorder-window value: %s", ret.opts.reorderWindow))
+	}
+	if *ingestSecretEnv != "" {
+		if ret.ingestSecret = os.Getenv(*ingestSecretEnv); ret.ingestSecret == "" {
+			errs = append(errs, fmt.Errorf("--ingest-secret-env: %s is not set", *ingestSecretEnv))
+		}
+	}
+	if ret.ingestMaxBody <= 0 {
+		errs = append(errs, fmt.Errorf("bad --ingest-max-body value: %d", ret.ingestMaxBody))
+	}
+	if ret.duration < 0 {
+		errs = append(errs, fmt.Errorf("bad --duration value: %s", ret.duration))
+	}
+	var rs string
+	if *recordSep != "" {
+		if rs, err = parseSeparator(*recordSep); err != nil {
+			errs = append(errs, fmt.Errorf("bad --record-separator value: %s", *recordSep))
+		}
+	}
+	var defaultStamp *timestampParser
+	if *stampPattern != "" || *stampLayout != "" || *stampZone != "" || *stripStamp {
+		defaultStamp = &timestampParser{layout: *stampLayout, strip: *stripStamp}
+		if *stampPattern != "" {
+			if defaultStamp.pattern, err = regexp.Compile(*stampPattern); err != nil {
+				errs = append(errs, fmt.Errorf("bad --timestamp-pattern value: %s", err))
+			}
+		}
+		if *stampZone != "" {
+			if defaultStamp.loc, err = time.LoadLocation(*stampZone); err != nil {
+				errs = append(errs, fmt.Errorf("bad --timestamp-zone value: %s", err))
+			}
+		}
+	}
+	var start *regexp.Regexp
+	if *multilineStart != "" {
+		if start, err = regexp.Compile(*multilineStart); err != nil {
+			errs = append(errs, fmt.Errorf("bad --multiline-start-pattern value: %s", err))
+		}
+	}
+	ret.defaults = StreamOptions{
+		format:          ret.opts.format,
+		minLineBytes:    ret.opts.minLineBytes,
+		recordSeparator: rs,
+		timestamp:       defaultStamp,
+		retryable:       retryable,
+		reconnect:       &reconnect,
+	}
+	// parsed is set once a stream has a timestamp parser for
+	// --fail-on-parse-error to check.
+	parsed := false
+	if n := len(fs.Args()); n == 0 && !ret.allowNoStreams && !ret.probe && ret.configPath == "" {
+		errs = append(errs, fmt.Errorf("neet at least 1 stream for input; got 0"))
+	}
+	var args []string
 	for _, arg := range fs.Args() {
+		args = append(args, expandFdList(arg)...)
+	}
+	// setup parses a stream specifier, and fills in whatever it doesn't set
+	// from the global flags, with the errors in it, if any.
+	setup := func(arg string) (Stream, []error) {
 		stream, err := parseStreamArg(arg)
 		if err != nil {
-			return nil, err
+			return nil, []error{err}
+		}
+		var errs []error
+		if stream.Options().format == "" {
+			stream.Options().format = ret.opts.format
+		}
+		if stream.Options().framing == "" {
+			stream.Options().framing = *parse
+		}
+		if _, ok := stream.(*TailStream); ok && stream.Options().tailFrom == "" {
+			stream.Options().tailFrom = *tailFrom
+		} else if !ok && stream.Options().tailFrom != "" {
+			errs = append(errs, fmt.Errorf("Specified stream %s: tail-from is only for file:// streams", arg))
+		}
+		if re := stream.Options().pathPattern; re != nil {
+			if t, ok := stream.(*TailStream); !ok {
+				errs = append(errs, fmt.Errorf("Specified stream %s: path-fields is only for file:// streams", arg))
+			} else if stream.Options().pathFields, err = pathFields(re, t.path); err != nil {
+				errs = append(errs, fmt.Errorf("Specified stream %s: %s", arg, err))
+			}
+		}
+		if ret.opts.codec != "" && stream.Options().framing == "length" {
+			errs = append(errs, fmt.Errorf("Specified stream %s: can't use length framing with --codec %s", arg, ret.opts.codec))
+		}
+		if esOutput {
+			// Elasticsearch only takes JSON documents, and the tag picks
+			// their index, so plain lines are always wrapped.
+			if stream.Options().format == "plain" || stream.Options().framing == "raw" {
+				errs = append(errs, fmt.Errorf("Specified stream %s: can't ship plain text or raw bytes to Elasticsearch", arg))
+			}
+			stream.Options().format = "json"
+		}
+		if stream.Options().framing == "raw" {
+			if !ret.connPerStream {
+				errs = append(errs, fmt.Errorf("Specified stream %s: raw framing needs --connection-per-stream, so that other events can't land in the middle of its bytes", arg))
+			}
+			if framedBy != "" {
+				errs = append(errs, fmt.Errorf("Specified stream %s: can't use raw framing with %s", arg, framedBy))
+			}
+			if ret.opts.codec != "" || ret.logstash.encoding != "utf-8" || ret.logstash.bom {
+				errs = append(errs, fmt.Errorf("Specified stream %s: can't use raw framing with --codec or another output encoding", arg))
+			}
+		}
+		if stream.Options().minLineBytes == 0 {
+			stream.Options().minLineBytes = ret.opts.minLineBytes
+		}
+		if stream.Options().multilineStart == nil {
+			stream.Options().multilineStart = start
+		}
+		stream.Options().retryable = retryable
+		if stream.Options().recordSeparator == "" {
+			stream.Options().recordSeparator = rs
+		}
+		stream.Options().timestamp = stream.Options().timestamp.withDefaults(defaultStamp)
+		if err := stream.Options().timestamp.check(); err != nil {
+			errs = append(errs, fmt.Errorf("Specified stream %s: %s", arg, err))
+		}
+		stream.Options().reconnect = stream.Options().reconnect.withDefaults(&reconnect)
+		if stream.Options().timestamp != nil {
+			stream.Options().parseErrors = failOnParse.forStream()
+			parsed = true
+		}
+		if _, ok := stream.(*TLSStream); ok && ret.listenTLS == nil {
+			if ret.listenTLS, err = listenTLSConfig(*listenCert, *listenKey, *listenClientCA); err != nil {
+				errs = append(errs, fmt.Errorf("Specified stream %s: %s", arg, err))
+			}
+		}
+		return stream, errs
+	}
+	for _, arg := range args {
+		stream, serrs := setup(arg)
+		errs = append(errs, serrs...)
+		if stream != nil {
+			ret.streams = append(ret.streams, stream)
+		}
+	}
+	if esOutput {
+		if err := checkIndex(ret.logstash.esIndex, ret.streams); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Streams from the --config file are set up the same way, now and when
+	// it's reloaded.
+	ret.configStream = func(spec string) (*TailStream, error) {
+		if !strings.HasPrefix(spec, "file://") {
+			return nil, fmt.Errorf("Specified stream %s: only file:// streams can go in --config", spec)
+		}
+		stream, serrs := setup(spec)
+		if esOutput && stream != nil {
+			if err := checkIndex(ret.logstash.esIndex, []Stream{stream}); err != nil {
+				serrs = append(serrs, err)
+			}
+		}
+		if len(serrs) > 0 {
+			return nil, errors.Join(serrs...)
+		}
+		t := stream.(*TailStream)
+		t.removed = make(chan struct{})
+		return t, nil
+	}
+	if ret.configPath != "" {
+		specs, err := readConfig(ret.configPath)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		ret.config = make(map[string]*TailStream)
+		for _, spec := range specs {
+			t, err := ret.configStream(spec)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			ret.config[spec] = t
+			ret.streams = append(ret.streams, t)
+		}
+	}
+	if failOnParse.enabled && !parsed && len(ret.streams) > 0 {
+		errs = append(errs, errors.New("--fail-on-parse-error needs a --timestamp-pattern, or a stream with a timestamp-pattern option"))
+	}
+	if !*allowDupFifos {
+		if err := checkDuplicateFifos(ret.streams); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if ret.configTest {
+		errs = append(errs, ret.checkPaths()...)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &ret, nil
+}
+
+// checkDuplicateFifos makes sure no two streams read from the same named
+// pipe. If they did, they'd race to read each line, and lines would be
+// tagged with one tag or the other at random.
+func checkDuplicateFifos(streams []Stream) error {
+	seen := make(map[string]Stream)
+	for _, s := range streams {
+		n, ok := s.(*NamedPipeStream)
+		if !ok {
+			continue
+		}
+		path, err := filepath.Abs(n.path)
+		if err != nil {
+			return err
+		}
+		if prev, ok := seen[path]; ok {
+			return fmt.Errorf("Specified streams %s and %s read from the same named pipe (pass --allow-duplicate-fifos to allow it anyway)", prev.Raw(), s.Raw())
+		}
+		seen[path] = s
+	}
+	return nil
+}
+
+// Modes for syscall.Access, which doesn't name them.
+const (
+	accessWrite = 2
+	accessRead  = 4
+)
+
+// checkPaths checks, for --config-test, that the paths we'd open can be
+// opened, without opening them. Named pipes and the audit file are made if
+// they aren't there yet, so it's enough that their directory is. A unix://
+// logstash's socket only has to be a socket if it's there, as logstash
+// needn't be running where the configuration's being tested.
+func (m *Mux) checkPaths() []error {
+	var errs []error
+	for _, s := range m.streams {
+		if n, ok := s.(*NamedPipeStream); ok {
+			if err := checkPath(n.path, os.ModeNamedPipe, accessRead); err != nil {
+				errs = append(errs, fmt.Errorf("Specified stream %s: %s", s.Raw(), err))
+			}
+		}
+	}
+	if m.auditPath != "" {
+		if err := checkPath(m.auditPath, 0, accessWrite); err != nil {
+			errs = append(errs, fmt.Errorf("--audit-file: %s", err))
+		}
+	}
+	for _, l := range m.logstash.each() {
+		if l.url != nil && l.url.Scheme == "file" {
+			if err := checkPath(l.url.Path, 0, accessWrite); err != nil {
+				errs = append(errs, fmt.Errorf("--logstash %s: %s", l.raw, err))
+			}
+		}
+		if l.url == nil || l.url.Scheme != "unix" {
+			continue
+		}
+		if fi, err := os.Stat(l.url.Path); err == nil && fi.Mode().Type() != os.ModeSocket {
+			errs = append(errs, fmt.Errorf("--logstash %s: %s isn't a socket", l.raw, l.url.Path))
+		}
+	}
+	return errs
+}
+
+// checkPath checks that path is a file of the given type (0 for a regular
+// file) that we can read or write, as mode says, or that there's nothing
+// there yet, but a directory we can make it in.
+func checkPath(path string, typ os.FileMode, mode uint32) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		dir := filepath.Dir(path)
+		if fi, err := os.Stat(dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		if err := syscall.Access(dir, accessWrite); err != nil {
+			return fmt.Errorf("can't make %s: %s", path, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != typ {
+		kind := "regular file"
+		if typ == os.ModeNamedPipe {
+			kind = "named pipe"
 		}
-		ret.streams = append(ret.streams, stream)
+		return fmt.Errorf("%s isn't a %s", path, kind)
+	}
+	if err := syscall.Access(path, mode); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
 	}
-	return &ret, err
+	return nil
 }
 
 // mainInner is the main loop that returns an error when the program
@@ -380,6 +3888,13 @@ func mainInner() error {
 	if err != nil {
 		return err
 	}
+	if mux.configTest {
+		fmt.Fprintf(os.Stderr, "logmux: configuration OK\n")
+		return nil
+	}
+	if mux.probe {
+		return mux.runProbe()
+	}
 	return mux.Run()
 }
 
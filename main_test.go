@@ -0,0 +1,3158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testStream parses a stream specifier, and fills in the defaults that
+// parseArgs would.
+func testStream(t testing.TB, spec string) Stream {
+	s, err := parseStreamArg(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Options().format == "" {
+		s.Options().format = "auto"
+	}
+	if s.Options().framing == "" {
+		s.Options().framing = "line"
+	}
+	return s
+}
+
+// testOptions are Options as parseArgs sets them up with the default flags.
+func testOptions() Options {
+	return Options{format: "auto", messageField: "message", maxFieldsAction: "trim", host: "testhost"}
+}
+
+// gelfFields decodes a NUL-terminated GELF message.
+func gelfFields(t *testing.T, ev []byte) map[string]interface{} {
+	if len(ev) == 0 || ev[len(ev)-1] != 0 {
+		t.Fatalf("GELF message isn't NUL-terminated: %q", ev)
+	}
+	var ret map[string]interface{}
+	if err := json.Unmarshal(ev[:len(ev)-1], &ret); err != nil {
+		t.Fatalf("bad GELF message %q: %s", ev, err)
+	}
+	return ret
+}
+
+func TestGELFRedacts(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   [][]string
+		remove bool
+		line   string
+		want   map[string]interface{}
+		absent []string
+	}{
+		{
+			name: "top-level mask",
+			keys: [][]string{{"password"}},
+			line: `{"message":"login","password":"hunter2"}`,
+			want: map[string]interface{}{"short_message": "login", "_password": "[REDACTED]"},
+		},
+		{
+			name: "nested mask",
+			keys: [][]string{{"headers", "authorization"}},
+			line: `{"message":"req","headers":{"authorization":"Bearer abc","accept":"*/*"}}`,
+			want: map[string]interface{}{
+				"_headers": map[string]interface{}{"authorization": "[REDACTED]", "accept": "*/*"},
+			},
+		},
+		{
+			name:   "remove",
+			keys:   [][]string{{"password"}},
+			remove: true,
+			line:   `{"message":"login","password":"hunter2"}`,
+			want:   map[string]interface{}{"short_message": "login"},
+			absent: []string{"_password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.codec = "gelf"
+			o.redactKeys = tt.keys
+			o.redactRemove = tt.remove
+			ev := o.processLine([]byte(tt.line), testStream(t, "0:app"))
+			if bytes.Contains(ev, []byte("hunter2")) || bytes.Contains(ev, []byte("Bearer")) {
+				t.Fatalf("secret leaked: %s", ev)
+			}
+			got := gelfFields(t, ev)
+			for k, v := range tt.want {
+				gotJSON, _ := json.Marshal(got[k])
+				wantJSON, _ := json.Marshal(v)
+				if !bytes.Equal(gotJSON, wantJSON) {
+					t.Errorf("%s = %s, want %s", k, gotJSON, wantJSON)
+				}
+			}
+			for _, k := range tt.absent {
+				if _, ok := got[k]; ok {
+					t.Errorf("%s should have been removed: %s", k, ev)
+				}
+			}
+		})
+	}
+}
+
+func TestHashIsOfRedactedLine(t *testing.T) {
+	o := testOptions()
+	o.addHash = true
+	o.redactKeys = [][]string{{"password"}}
+	s := testStream(t, "0:app")
+	a := o.processLine([]byte(`{"password":"hunter2"}`), s)
+	b := o.processLine([]byte(`{"password":"swordfish"}`), s)
+	if !bytes.Equal(a, b) {
+		t.Errorf("lines that differ only in a redacted value should hash the same:\n%s%s", a, b)
+	}
+	want := hashField("app", []byte(`{"password":"[REDACTED]"}`))
+	if !bytes.Contains(a, want.val) {
+		t.Errorf("hash isn't of the redacted line: %s", a)
+	}
+}
+
+func TestRedacts(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		keys   [][]string
+		remove bool
+		line   string
+		want   string
+	}{
+		{
+			name: "duplicate keys",
+			spec: "0:app",
+			keys: [][]string{{"password"}},
+			line: `{"password":"hunter2","n":1,"password":"swordfish"}`,
+			want: `{"password":"[REDACTED]","n":1,"password":"[REDACTED]","tag":"app"}`,
+		},
+		{
+			name:   "duplicate keys removed",
+			spec:   "0:app",
+			keys:   [][]string{{"password"}},
+			remove: true,
+			line:   `{"password":"hunter2","n":1,"password":"swordfish"}`,
+			want:   `{"n":1,"tag":"app"}`,
+		},
+		{
+			name: "duplicate nested keys",
+			spec: "0:app",
+			keys: [][]string{{"headers", "authorization"}},
+			line: `{"headers":{"authorization":"Bearer abc"},"headers":{"authorization":"Bearer def"}}`,
+			want: `{"headers":{"authorization":"[REDACTED]"},"headers":{"authorization":"[REDACTED]"},"tag":"app"}`,
+		},
+		{
+			name: "plain format",
+			spec: "0:app;format=plain",
+			keys: [][]string{{"password"}},
+			line: `{"user":"bob","password":"hunter2"}`,
+			want: `app: {"user":"bob","password":"[REDACTED]"}`,
+		},
+		{
+			name: "undecodable",
+			spec: "0:app",
+			keys: [][]string{{"password"}},
+			line: `{"password":"hunter2",}`,
+		},
+		{
+			name: "undecodable plain",
+			spec: "0:app;format=plain",
+			keys: [][]string{{"password"}},
+			line: `{"password":"hunter2" "n":1}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.redactKeys = tt.keys
+			o.redactRemove = tt.remove
+			s := testStream(t, tt.spec)
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), s), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if tt.want == "" && s.Stats().dropped != 1 {
+				t.Errorf("%d lines dropped, want 1", s.Stats().dropped)
+			}
+		})
+	}
+}
+
+func TestGELFMapsFields(t *testing.T) {
+	tests := []struct {
+		name string
+		maps string
+		line string
+		want []string
+		gone []string
+	}{
+		{"rename", "lvl=level", `{"message":"hi","lvl":"warn"}`, []string{"_level"}, []string{"_lvl"}},
+		{"into message", "msg=message", `{"msg":"hi"}`, []string{"short_message"}, []string{"_msg"}},
+		{"untouched", "lvl=level", `{"message":"hi","level":"warn"}`, []string{"_level"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.codec = "gelf"
+			if err := o.mapFields.Set(tt.maps); err != nil {
+				t.Fatal(err)
+			}
+			got := gelfFields(t, o.processLine([]byte(tt.line), testStream(t, "0:app")))
+			for _, k := range tt.want {
+				if _, ok := got[k]; !ok {
+					t.Errorf("missing %s: %v", k, got)
+				}
+			}
+			for _, k := range tt.gone {
+				if _, ok := got[k]; ok {
+					t.Errorf("%s should have been renamed: %v", k, got)
+				}
+			}
+			if got["short_message"] != "hi" {
+				t.Errorf("short_message = %v, want hi", got["short_message"])
+			}
+		})
+	}
+}
+
+func TestGELFShortMessageIsMessageField(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		line  string
+		short string
+		extra string
+	}{
+		{"default", "message", `{"message":"hi","msg":"other"}`, "hi", "_msg"},
+		{"configured", "msg", `{"message":"other","msg":"hi"}`, "hi", "_message"},
+		{"not a string", "msg", `{"msg":{"a":1}}`, `{"msg":{"a":1}}`, "_msg"},
+		{"missing", "msg", `{"message":"hi"}`, `{"message":"hi"}`, "_message"},
+		{"plain", "msg", "hi there", "hi there", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.codec = "gelf"
+			o.messageField = tt.field
+			got := gelfFields(t, o.gelfEvent([]byte(tt.line), "app"))
+			if got["short_message"] != tt.short {
+				t.Errorf("short_message = %v, want %s", got["short_message"], tt.short)
+			}
+			if _, ok := got[tt.extra]; tt.extra != "" && !ok {
+				t.Errorf("missing %s: %v", tt.extra, got)
+			}
+		})
+	}
+}
+
+func TestGELFMaxFields(t *testing.T) {
+	line := []byte(`{"message":"hi","a":1,"b":2,"c":3}`)
+	tests := []struct {
+		action string
+		want   []string
+		gone   []string
+	}{
+		{"trim", []string{"short_message", "_a"}, []string{"_b", "_c"}},
+		{"drop", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			o := testOptions()
+			o.codec = "gelf"
+			o.maxFields = 2
+			o.maxFieldsAction = tt.action
+			s := testStream(t, "0:app")
+			ev := o.processLine(append([]byte(nil), line...), s)
+			if tt.action == "drop" {
+				if len(ev) != 0 || s.Stats().dropped != 1 {
+					t.Fatalf("line over --max-fields wasn't dropped: %q", ev)
+				}
+				return
+			}
+			got := gelfFields(t, ev)
+			for _, k := range tt.want {
+				if _, ok := got[k]; !ok {
+					t.Errorf("missing %s: %v", k, got)
+				}
+			}
+			for _, k := range tt.gone {
+				if _, ok := got[k]; ok {
+					t.Errorf("%s is over --max-fields: %v", k, got)
+				}
+			}
+		})
+	}
+}
+
+// tcpCapture is a local stand-in for logstash's tcp input, which keeps the
+// lines read over each connection it takes.
+type tcpCapture struct {
+	ln net.Listener
+
+	sync.Mutex
+	conns [][]string
+}
+
+func captureTCP(t testing.TB) *tcpCapture {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &tcpCapture{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Lock()
+			i := len(c.conns)
+			c.conns = append(c.conns, nil)
+			c.Unlock()
+			go func() {
+				defer conn.Close()
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					c.Lock()
+					c.conns[i] = append(c.conns[i], r.Text())
+					c.Unlock()
+				}
+			}()
+		}
+	}()
+	return c
+}
+
+// url is the tcp:// URL to reach the capture at.
+func (c *tcpCapture) url() *url.URL {
+	return &url.URL{Scheme: "tcp", Host: c.ln.Addr().String()}
+}
+
+// lines waits for n lines to have come in over the i'th connection, and
+// returns them.
+func (c *tcpCapture) lines(t testing.TB, i, n int) []string {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		c.Lock()
+		var got []string
+		if i < len(c.conns) {
+			got = append(got, c.conns[i]...)
+		}
+		c.Unlock()
+		if len(got) >= n {
+			return got
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	t.Fatalf("timed out waiting for %d lines on connection %d: %q", n, i, c.conns)
+	return nil
+}
+
+func TestFooterPerConnection(t *testing.T) {
+	c := captureTCP(t)
+	opts := testOptions()
+	m := &Mux{opts: opts}
+	m.logstash.url, m.logstash.raw = c.url(), c.url().String()
+	m.logstash.opts, m.logstash.emitFooter = &m.opts, true
+	if err := m.logstash.Open(); err != nil {
+		t.Fatal(err)
+	}
+	write := func(lines ...string) {
+		var evs []event
+		for _, l := range lines {
+			evs = append(evs, event{tag: "app", buf: []byte("app: " + l + "\n")})
+		}
+		if err := m.logstash.Write(evs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("one", "two")
+	write("three")
+	// As when the connection's closed for being idle, and reopened by the
+	// next write.
+	m.logstash.Lock()
+	m.logstash.close(nil)
+	m.logstash.Unlock()
+	write("four", "five")
+	if err := m.writeFooter(); err != nil {
+		t.Fatal(err)
+	}
+
+	footer := func(n int) string {
+		return fmt.Sprintf(`{"lines":%d,"tag":"%s"}`, n, footerTag)
+	}
+	want := [][]string{
+		{"app: one", "app: two", "app: three", footer(3)},
+		{"app: four", "app: five", footer(2)},
+	}
+	for i, w := range want {
+		if got := c.lines(t, i, len(w)); strings.Join(got, "\n") != strings.Join(w, "\n") {
+			t.Errorf("connection %d got %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	// Logstash's cert is only for its name, not for the address we dial.
+	ca := newTestCA(t, "logstash CA")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "logstash.internal"},
+		DNSNames:     []string{"logstash.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni := make(chan string, 10)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			sni <- hello.ServerName
+			return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	caFile := writeFile(t, t.TempDir(), "ca.pem", ca.pem())
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "127.0.0.1"},
+		{"logstash.internal", ""},
+		{"other.internal", "other.internal"},
+	}
+	for _, tt := range tests {
+		args := []string{"--logstash", "tls://" + ln.Addr().String(), "--logstash-tls-ca", caFile, "0:app"}
+		if tt.name != "" {
+			args = append([]string{"--tls-server-name", tt.name}, args...)
+		}
+		m, err := parseTestArgs(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.logstash.Open()
+		if tt.want == "" && err != nil {
+			t.Errorf("%q: %s", tt.name, err)
+		} else if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%q: got %v, want a cert error for %s", tt.name, err, tt.want)
+		}
+		if got := <-sni; got != tt.name {
+			t.Errorf("%q: sent %q for SNI", tt.name, got)
+		}
+		if m.logstash.conn != nil {
+			m.logstash.conn.Close()
+		}
+	}
+
+	if _, err := parseTestArgs("--tls-server-name", "logstash.internal", "--logstash", "tcp://localhost:5000", "0:app"); err == nil || !strings.Contains(err.Error(), "--tls-server-name needs") {
+		t.Errorf("got %v, want an error for a tcp:// logstash", err)
+	}
+}
+
+func TestTLSLogstash(t *testing.T) {
+	ca := newTestCA(t, "logstash CA")
+	cert, _, _ := ca.issue(t, "logstash", x509.ExtKeyUsageServerAuth)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					got <- r.Text()
+				}
+			}()
+		}
+	}()
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem())
+	otherCA := writeFile(t, dir, "other.pem", newTestCA(t, "other CA").pem())
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"trusted", []string{"--logstash-tls-ca", caFile}, ""},
+		{"signed by another CA", []string{"--logstash-tls-ca", otherCA}, "certificate"},
+		{"system CAs", nil, "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--logstash", "tls://" + ln.Addr().String()}, tt.args...)
+			m, err := parseTestArgs(append(args, pipeSpec(t, "app", []string{"one", "two"}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.Run()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want a %s error", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"app: one", "app: two"} {
+				select {
+				case line := <-got:
+					if line != want {
+						t.Errorf("got %q, want %q", line, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no %q over TLS", want)
+				}
+			}
+		})
+	}
+
+	if _, err := parseTestArgs("--logstash", "tls://"+ln.Addr().String(), "--logstash-tls-ca", writeFile(t, dir, "bad.pem", []byte("not a cert")), "0:app"); err == nil {
+		t.Error("no error for a CA file without certs")
+	}
+}
+
+func TestClientCertReload(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	server, _, _ := ca.issue(t, "logstash", x509.ExtKeyUsageServerAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Each connection reports the name on the client cert it got.
+	names := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := conn.(*tls.Conn)
+				if err := tc.Handshake(); err != nil {
+					names <- err.Error()
+					return
+				}
+				names <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem())
+	_, certPEM, keyPEM := ca.issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	certFile := writeFile(t, dir, "client.crt", certPEM)
+	keyFile := writeFile(t, dir, "client.key", keyPEM)
+
+	m, err := parseTestArgs("--logstash", "tls://"+ln.Addr().String(), "--logstash-tls-ca", caFile,
+		"--client-cert", certFile, "--client-key", keyFile, "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func(want string) {
+		t.Helper()
+		if err := m.logstash.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.logstash.conn.Close()
+		// The handshake only finishes on the client's first write.
+		m.logstash.conn.Write([]byte("x\n"))
+		select {
+		case got := <-names:
+			if got != want {
+				t.Errorf("got a cert for %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no connection")
+		}
+	}
+	connect("client-1")
+
+	// The cert is rotated, and the next connection picks it up.
+	_, certPEM, keyPEM = ca.issue(t, "client-2", x509.ExtKeyUsageClientAuth)
+	writeFile(t, dir, "client.crt", certPEM)
+	writeFile(t, dir, "client.key", keyPEM)
+	connect("client-2")
+
+	// Halfway through a rotation, the cert and key don't match, so the
+	// last one that loaded is presented.
+	_, _, keyPEM = ca.issue(t, "client-3", x509.ExtKeyUsageClientAuth)
+	writeFile(t, dir, "client.key", keyPEM)
+	connect("client-2")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-cert", certFile}, "--client-cert and --client-key go together"},
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-cert", certFile, "--client-key", keyFile}, "--client-cert: tls: private key does not match public key"},
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-cert", certFile, "--client-key", keyFile, "--client-pkcs12", certFile}, "can't use --client-pkcs12 with --client-cert"},
+		{[]string{"--logstash", "tcp://localhost:5000", "--client-cert", certFile, "--client-key", keyFile}, "--client-cert needs a tls:// logstash"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTestArgs(append(tt.args, "0:app")...); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+// parseTestArgs runs parseArgs on the given command line.
+func parseTestArgs(args ...string) (*Mux, error) {
+	saved := os.Args
+	defer func() { os.Args = saved }()
+	os.Args = append([]string{"logmux"}, args...)
+	return parseArgs()
+}
+
+func TestConfigTestReportsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "flags",
+			args: []string{"--config-test", "--logstash", "tcp://localhost:5000", "--codec", "nope", "--output-encoding", "latin1", "--max-fields", "-1", "0:app"},
+			want: []string{"bad --codec value: nope", "bad --output-encoding value: latin1", "bad --max-fields value: -1"},
+		},
+		{
+			name: "no logstash",
+			args: []string{"--config-test", "--reorder-window", "-1s", "0:app"},
+			want: []string{"require a --logstash parameter", "bad --reorder-window value"},
+		},
+		{
+			name: "sinks",
+			args: []string{"--config-test", "--logstash", "bogus://x", "--logstash", "redis://localhost/", "--logstash-fallback", "udp://localhost:5000", "--codec", "gelf", "0:app"},
+			want: []string{`unknown scheme "bogus"`, "want redis://<hostname>:<port>/<key>", "can't use --codec gelf with a udp://"},
+		},
+		{
+			name: "streams",
+			args: []string{"--config-test", "--logstash", "tcp://localhost:5000", "--multiline-start-pattern", "(", "app", "0:app;framing=raw", "1:app;format=nope"},
+			want: []string{"bad --multiline-start-pattern value", "Specified stream app", "raw framing needs --connection-per-stream", "1:app;format=nope"},
+		},
+		{
+			name: "paths",
+			args: []string{"--config-test", "--logstash", "unix://" + plain, "--audit-file", filepath.Join(dir, "missing", "audit"), plain + ":a", filepath.Join(dir, "missing", "fifo") + ":b"},
+			want: []string{plain + " isn't a socket", "--audit-file: stat " + filepath.Join(dir, "missing"), plain + " isn't a named pipe", "Specified stream " + filepath.Join(dir, "missing", "fifo")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestArgs(tt.args...)
+			if err == nil {
+				t.Fatal("parsed without an error")
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error doesn't mention %q:\n%s", w, err)
+				}
+			}
+		})
+	}
+
+	// Paths that aren't there yet are fine if we could make them.
+	m, err := parseTestArgs("--config-test", "--logstash", "unix://"+filepath.Join(dir, "no-logstash.sock"), "--audit-file", filepath.Join(dir, "audit"), fifo+":a", filepath.Join(dir, "new")+":b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.configTest {
+		t.Error("--config-test isn't set")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("--config-test made a named pipe: %v", err)
+	}
+}
+
+// pipeSpec makes a pipe with the given lines written into it, and returns
+// a stream specifier for its read end, with the given tag.
+func pipeSpec(t testing.TB, tag string, lines []string) string {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	w := os.NewFile(uintptr(fds[1]), "pipe")
+	go func() {
+		defer w.Close()
+		for _, l := range lines {
+			if _, err := io.WriteString(w, l+"\n"); err != nil {
+				return
+			}
+		}
+	}()
+	return fmt.Sprintf("%d:%s", fds[0], tag)
+}
+
+// runMux runs logmux with the given command line until its streams end.
+func runMux(t testing.TB, args ...string) {
+	t.Helper()
+	m, err := parseTestArgs(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventField decodes a JSON event, and returns one of its fields.
+func eventField(t testing.TB, ev, name string) interface{} {
+	t.Helper()
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(ev), &fields); err != nil {
+		t.Fatalf("bad JSON event %q: %s", ev, err)
+	}
+	return fields[name]
+}
+
+func TestPrefetchKeepsOrder(t *testing.T) {
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n":%d}`, i))
+	}
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--input-buffer-lines", "64", pipeSpec(t, "app", lines))
+	for i, ev := range c.lines(t, 0, len(lines)) {
+		if n := eventField(t, ev, "n"); n != float64(i) {
+			t.Fatalf("line %d is %s", i, ev)
+		}
+	}
+}
+
+func TestReorderWindowOrdersPrefetchedLines(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	// Each line is timestamped n seconds after base, and they come in out
+	// of order.
+	order := []int{3, 1, 2, 0, 7, 5, 6, 4, 9, 8}
+	var lines []string
+	for _, n := range order {
+		lines = append(lines, fmt.Sprintf(`{"n":%d,"@timestamp":%q}`, n, base.Add(time.Duration(n)*time.Second).Format(time.RFC3339Nano)))
+	}
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--input-buffer-lines", "4", "--reorder-window", "1m", pipeSpec(t, "app", lines))
+	for i, ev := range c.lines(t, 0, len(lines)) {
+		if n := eventField(t, ev, "n"); n != float64(i) {
+			t.Errorf("line %d is %s", i, ev)
+		}
+	}
+}
+
+// slowSink is a sink that takes a while over each write, like logstash
+// over a busy network.
+type slowSink struct {
+	delay time.Duration
+}
+
+func (w slowSink) writeEvents(evs []event) error {
+	time.Sleep(w.delay)
+	return nil
+}
+
+// BenchmarkBurstySource reads a pipe whose writer sends lines in bursts
+// several times bigger than the pipe's buffer, with a pause between them,
+// into a sink that's slow to write to, with and without
+// --input-buffer-lines. Without prefetching, the writer is held up until
+// most of a burst is written out before it starts its pause; with it, the
+// burst is read in right away, and the pause overlaps the writes.
+func BenchmarkBurstySource(b *testing.B) {
+	const burst = 32
+	line := append(bytes.Repeat([]byte("x"), 8<<10), '\n')
+	for _, n := range []int{0, burst} {
+		b.Run(fmt.Sprintf("input-buffer-lines=%d", n), func(b *testing.B) {
+			var fds [2]int
+			if err := syscall.Pipe(fds[:]); err != nil {
+				b.Fatal(err)
+			}
+			w := os.NewFile(uintptr(fds[1]), "pipe")
+			go func() {
+				defer w.Close()
+				out := bytes.Repeat(line, burst)
+				for sent := 0; sent < b.N; sent += burst {
+					if _, err := w.Write(out); err != nil {
+						return
+					}
+					time.Sleep(30 * time.Millisecond)
+				}
+			}()
+			m := &Mux{opts: testOptions()}
+			m.opts.inputBufferLines = n
+			m.logstash.url = &url.URL{Scheme: "tcp"}
+			m.logstash.sink = slowSink{time.Millisecond}
+			s := testStream(b, fmt.Sprintf("%d:app;format=plain", fds[0]))
+			if err := s.Open(); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(line)))
+			b.ResetTimer()
+			if err := m.runLines(s); err != io.EOF {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDurationFlushesBufferedLines(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	// The pipe stays open, so the run only ends when its duration is up.
+	w := os.NewFile(uintptr(fds[1]), "pipe")
+	defer w.Close()
+	ts := func(s int) string {
+		return time.Date(2024, 1, 2, 3, 4, s, 0, time.UTC).Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "{\"n\":1,\"@timestamp\":%q}\n", ts(2))
+	fmt.Fprintf(w, "{\"n\":0,\"@timestamp\":%q}\n", ts(1))
+	fmt.Fprintf(w, "start of a multiline event\n  and the rest of it\n")
+
+	c := captureTCP(t)
+	start := time.Now()
+	runMux(t, "--logstash", c.url().String(), "--duration", "200ms", "--input-buffer-lines", "8",
+		"--reorder-window", "1h", "--multiline-start-pattern", "^[^ ]",
+		fmt.Sprintf("%d:app", fds[0]))
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("a 200ms run took %s", took)
+	}
+	// The pending multiline event goes out first, as the lines held for
+	// reordering are only released after it, in timestamp order.
+	want := []string{
+		"app: start of a multiline event",
+		"  and the rest of it",
+		fmt.Sprintf(`{"n":0,"@timestamp":%q,"tag":"app"}`, ts(1)),
+		fmt.Sprintf(`{"n":1,"@timestamp":%q,"tag":"app"}`, ts(2)),
+	}
+	if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// brokenStream is a stream that reads a few lines, and then fails, or that
+// fails to open at all.
+type brokenStream struct {
+	BaseStream
+	openErr error
+	reads   int
+}
+
+func (b *brokenStream) Open() error {
+	b.source = bufio.NewReader(strings.NewReader("one\ntwo\nthree\n"))
+	return b.openErr
+}
+
+func (b *brokenStream) Preread() error {
+	if b.reads++; b.reads > 3 {
+		return errors.New("broken stream")
+	}
+	return nil
+}
+
+func TestRunLeavesNoGoroutinesBehind(t *testing.T) {
+	c := captureTCP(t)
+	run := func(openErr error) {
+		m, err := parseTestArgs("--logstash", c.url().String(), "--connection-per-stream",
+			"--sink-idle-timeout", "1h", "--allow-no-streams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 20; j++ {
+			b := &brokenStream{BaseStream: BaseStream{tag: fmt.Sprintf("s%d", j)}}
+			if j == 10 {
+				b.openErr = openErr
+			}
+			m.streams = append(m.streams, b)
+		}
+		if err := m.Run(); err == nil {
+			t.Fatal("run succeeded")
+		}
+	}
+	// The first run starts os/signal's watcher, which is there for good.
+	run(nil)
+	time.Sleep(10 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		run(nil)
+		run(errors.New("no such stream"))
+	}
+	// Goroutines take a moment to notice that they're done.
+	var n int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if n = runtime.NumGoroutine(); n <= baseline {
+			return
+		}
+	}
+	buf := make([]byte, 1<<20)
+	t.Errorf("%d goroutines left after the runs, from %d before them:\n%s", n, baseline, buf[:runtime.Stack(buf, true)])
+}
+
+func TestSanitizeControl(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		spec string
+		line string
+		want string
+	}{
+		{"escape plain", "escape", "0:app;format=plain", "a\x00b\x0cc", `app: a\u0000b\u000cc`},
+		{"strip plain", "strip", "0:app;format=plain", "a\x00b\x0cc", "app: abc"},
+		{"tabs stay", "strip", "0:app;format=plain", "a\tb\x0b", "app: a\tb"},
+		{"off", "", "0:app;format=plain", "a\x0cb", "app: a\x0cb"},
+		{"escape json", "escape", "0:app;format=json", "a\x00b", `{"message":"a\\u0000b","tag":"app"}`},
+		{"strip json", "strip", "0:app;format=json", "a\x00b\x0c", `{"message":"ab","tag":"app"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.sanitizeControl = tt.mode
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, tt.spec)), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		global string
+		spec   string
+		line   string
+		want   string
+	}{
+		{"stream plain over global json", "json", "0:app;format=plain", `{"n":1}`, `app: {"n":1}`},
+		{"stream plain over default", "", "0:app;format=plain", `{"n":1}`, `app: {"n":1}`},
+		{"stream json over global plain", "plain", "0:app;format=json", "hi", `{"message":"hi","tag":"app"}`},
+		{"global plain", "plain", "0:app", `{"n":1}`, `app: {"n":1}`},
+		{"global json", "json", "0:app", "hi", `{"message":"hi","tag":"app"}`},
+		{"auto plain line", "", "0:app", "hi", "app: hi"},
+		{"auto json line", "", "0:app", `{"n":1}`, `{"n":1,"tag":"app"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"--logstash", "tcp://localhost:5000"}
+			if tt.global != "" {
+				args = append(args, "--format", tt.global)
+			}
+			m, err := parseTestArgs(append(args, tt.spec)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(bytes.TrimSuffix(m.opts.processLine([]byte(tt.line), m.streams[0]), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// frame prefixes a record with its 4-byte big-endian length.
+func frame(rec []byte) []byte {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(rec)))
+	return append(hdr[:], rec...)
+}
+
+func TestReadFrame(t *testing.T) {
+	binaryRec := []byte{0, 1, 0xff, '\n', 0x80, '"'}
+	tests := []struct {
+		name string
+		in   []byte
+		want [][]byte
+		err  string
+	}{
+		{"records", append(frame(binaryRec), frame([]byte("two"))...), [][]byte{binaryRec, []byte("two")}, ""},
+		{"empty record", frame(nil), [][]byte{{}}, ""},
+		{"truncated record", frame(binaryRec)[:5], nil, io.ErrUnexpectedEOF.Error()},
+		{"truncated length", []byte{0, 0}, nil, io.ErrUnexpectedEOF.Error()},
+		{"too big", []byte{0xff, 0xff, 0xff, 0xff}, nil, "too big"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.in))
+			for _, want := range tt.want {
+				got, err := readFrame(r)
+				if err != nil || !bytes.Equal(got, want) {
+					t.Fatalf("got %q, %v, want %q", got, err, want)
+				}
+			}
+			_, err := readFrame(r)
+			if tt.err == "" && err != io.EOF {
+				t.Errorf("got %v after the last record, want EOF", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLengthFramedRecordsRoundTrip(t *testing.T) {
+	o := testOptions()
+	s := testStream(t, "0:blobs;framing=length")
+	for _, rec := range [][]byte{{0, 1, 2, 0xff}, []byte("{\"looks\":\"like json\"}"), []byte("line\nbreak"), {}} {
+		var got struct {
+			Data string `json:"data"`
+			Tag  string `json:"tag"`
+		}
+		ev := o.processLine(append([]byte(nil), rec...), s)
+		if err := json.Unmarshal(ev, &got); err != nil {
+			t.Fatalf("bad event %q: %s", ev, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(got.Data)
+		if err != nil || !bytes.Equal(data, rec) || got.Tag != "blobs" {
+			t.Errorf("%q came out as %s", rec, ev)
+		}
+	}
+}
+
+func TestPreserveWhitespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		preserve bool
+		line     string
+		want     string
+	}{
+		{"indentation kept", true, "    at main.go:12\n", "app:     at main.go:12"},
+		{"trailing spaces kept", true, "\tx  \r\n", "app: \tx  "},
+		{"blank line", true, "   \t\r\n", ""},
+		{"json still trimmed", true, "  {\"n\":1}  \n", `{"n":1,"tag":"app"}`},
+		{"off", false, "    at main.go:12  \n", "app: at main.go:12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.preserveWhitespace = tt.preserve
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, "0:app")), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddLag(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   string
+		ago  time.Duration
+		min  int64
+	}{
+		{"just read", `{"n":1,"tag":"app"}` + "\n", 0, 0},
+		{"read a while ago", `{"n":1,"tag":"app"}` + "\n", 250 * time.Millisecond, 250},
+		{"plain", "app: hi\n", time.Second, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.addLag = true
+			ev := o.enrich([]byte(tt.ev), time.Now().Add(-tt.ago))
+			if tt.min < 0 {
+				if string(ev) != tt.ev {
+					t.Errorf("plain event changed to %q", ev)
+				}
+				return
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(ev, &got); err != nil {
+				t.Fatalf("bad event %q: %s", ev, err)
+			}
+			lag, ok := got["logmux_lag_ms"].(float64)
+			if !ok || lag < float64(tt.min) || lag > float64(tt.min)+5000 {
+				t.Errorf("logmux_lag_ms = %v, want at least %d", got["logmux_lag_ms"], tt.min)
+			}
+		})
+	}
+}
+
+func TestExplodeArrays(t *testing.T) {
+	tests := []struct {
+		name    string
+		explode bool
+		line    string
+		want    []string
+	}{
+		{"objects", true, `[{"a":1}, {"b":[1,2]}]`, []string{`{"a":1}`, `{"b":[1,2]}`}},
+		{"mixed types", true, `[{"a":1},2,"x"]`, []string{`[{"a":1},2,"x"]`}},
+		{"empty", true, `[]`, []string{`[]`}},
+		{"not an array", true, `{"a":1}`, []string{`{"a":1}`}},
+		{"malformed", true, `[{"a":1},]`, []string{`[{"a":1},]`}},
+		{"off", false, `[{"a":1},{"b":2}]`, []string{`[{"a":1},{"b":2}]`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.explodeArrays = tt.explode
+			var got []string
+			for _, rec := range o.split([]byte(tt.line), testStream(t, "0:app")) {
+				got = append(got, string(rec))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplodedArraysShipAsEvents(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--explode-arrays",
+		pipeSpec(t, "app", []string{`[{"a":1},{"b":2}]`, `[1,2]`}))
+	want := []string{`{"a":1,"tag":"app"}`, `{"b":2,"tag":"app"}`, `app: [1,2]`}
+	if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMaxConcurrentReopens(t *testing.T) {
+	const streams, max = 8, 2
+	dir := t.TempDir()
+	reopens := make(chan struct{}, max)
+	done := make(chan int, streams)
+	var fifos []string
+	for i := 0; i < streams; i++ {
+		fifo := filepath.Join(dir, fmt.Sprintf("fifo%d", i))
+		if err := syscall.Mkfifo(fifo, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fifos = append(fifos, fifo)
+		n := testStream(t, fifo+":app").(*NamedPipeStream)
+		n.reopens = reopens
+		go func(i int) {
+			if err := n.Preread(); err != nil {
+				t.Error(err)
+			}
+			n.source = nil
+			done <- i
+		}(i)
+	}
+	// Writers open each FIFO read-write, which never blocks, and lets a
+	// reader that's blocked opening it through.
+	var writers []*os.File
+	defer func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
+	unblock := func(fifo string) {
+		w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers = append(writers, w)
+	}
+
+	// With no writers, every stream is stuck: max of them opening their
+	// FIFOs, and the rest queued behind them.
+	time.Sleep(100 * time.Millisecond)
+	if n := len(reopens); n != max {
+		t.Fatalf("%d reopens in progress, want %d", n, max)
+	}
+	select {
+	case i := <-done:
+		t.Fatalf("stream %d reopened with no writer", i)
+	default:
+	}
+	for _, fifo := range fifos {
+		unblock(fifo)
+	}
+	for finished := 0; finished < streams; finished++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d reopens finished", finished, streams)
+		}
+	}
+	if n := len(reopens); n != 0 {
+		t.Errorf("%d reopen slots still held", n)
+	}
+}
+
+func TestMinLineBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		line string
+		want string
+	}{
+		{"plain under", "0:app;min-line-bytes=3", "..", ""},
+		{"plain at", "0:app;min-line-bytes=3", "...", "app: ..."},
+		{"counted after trimming", "0:app;min-line-bytes=3", "  ..  \n", ""},
+		{"json under", "0:app;min-line-bytes=8", `{"n":1}`, ""},
+		{"json at", "0:app;min-line-bytes=7", `{"n":1}`, `{"n":1,"tag":"app"}`},
+		{"json format plain line", "0:app;format=json;min-line-bytes=2", "x", ""},
+		{"off", "0:app", ".", "app: ."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			s := testStream(t, tt.spec)
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), s), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if dropped := s.Stats().dropped; (tt.want == "") != (dropped == 1) {
+				t.Errorf("%d lines dropped", dropped)
+			}
+		})
+	}
+}
+
+func TestGlobalMinLineBytes(t *testing.T) {
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--min-line-bytes", "4", "0:app", "1:web;min-line-bytes=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{4, 2} {
+		if got := m.streams[i].Options().minLineBytes; got != want {
+			t.Errorf("stream %d min-line-bytes = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestTrimTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		seps       string
+		ignoreCase bool
+		want       string
+	}{
+		{"separator", "app: started", ":-|", false, "started"},
+		{"space only", "app started", ":-|", false, "started"},
+		{"other separator", "app | started", ":-|", false, "started"},
+		{"one separator only", "app:: started", ":-|", false, ": started"},
+		{"tag alone", "app", ":-|", false, ""},
+		{"longer word", "apples: 3", ":-|", false, "apples: 3"},
+		{"separator not configured", "app|started", ":", false, "app|started"},
+		{"not a prefix", "the app: started", ":-|", false, "the app: started"},
+		{"case differs", "APP: started", ":-|", false, "APP: started"},
+		{"case ignored", "APP: started", ":-|", true, "started"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(trimTag([]byte(tt.line), "app", tt.seps, tt.ignoreCase)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimTagFromMessage(t *testing.T) {
+	o := testOptions()
+	o.trimTag, o.trimTagSeparators = true, ":"
+	s := testStream(t, "0:app")
+	for line, want := range map[string]string{
+		"app: started":        "app: started",
+		"app:":                "",
+		`{"msg":"app: hi"}`:   `{"msg":"app: hi","tag":"app"}`,
+		"worker: app started": "app: worker: app started",
+	} {
+		got := string(bytes.TrimSuffix(o.processLine([]byte(line), s), []byte("\n")))
+		if got != want {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestGELFMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want map[string]interface{}
+	}{
+		{"plain", "hi there", map[string]interface{}{"short_message": "hi there"}},
+		{"json", `{"message":"hi","level":"warn","id":7}`, map[string]interface{}{"short_message": "hi", "_level": "warn", "_id_": 7.0}},
+		{"odd field names", `{"message":"hi","a b":1,"c/d":2}`, map[string]interface{}{"_a_b": 1.0, "_c_d": 2.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.codec = "gelf"
+			got := gelfFields(t, o.processLine([]byte(tt.line), testStream(t, "0:app")))
+			if got["version"] != "1.1" || got["host"] != "testhost" || got["_tag"] != "app" {
+				t.Errorf("bad GELF header fields: %v", got)
+			}
+			if ts, ok := got["timestamp"].(float64); !ok || time.Since(time.Unix(int64(ts), 0)) > time.Minute {
+				t.Errorf("timestamp = %v", got["timestamp"])
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestGELFFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := io.ReadAll(conn)
+		got <- buf
+	}()
+	runMux(t, "--logstash", "tcp://"+ln.Addr().String(), "--codec", "gelf", pipeSpec(t, "app", []string{"one", `{"message":"two"}`}))
+	var buf []byte
+	select {
+	case buf = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing shipped")
+	}
+	msgs := bytes.SplitAfter(buf, []byte{0})
+	if len(msgs) != 3 || len(msgs[2]) != 0 {
+		t.Fatalf("want two NUL-terminated messages, got %q", buf)
+	}
+	for i, want := range []string{"one", "two"} {
+		if bytes.Contains(msgs[i], []byte("\n")) {
+			t.Errorf("message %d has a newline in it: %q", i, msgs[i])
+		}
+		if f := gelfFields(t, msgs[i]); f["short_message"] != want {
+			t.Errorf("message %d short_message = %v, want %s", i, f["short_message"], want)
+		}
+	}
+}
+
+func TestAllowNoStreams(t *testing.T) {
+	c := captureTCP(t)
+	if _, err := parseTestArgs("--logstash", c.url().String()); err == nil {
+		t.Fatal("started with no streams without --allow-no-streams")
+	}
+	start := time.Now()
+	runMux(t, "--logstash", c.url().String(), "--allow-no-streams", "--duration", "200ms")
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("returned after %s, rather than idling", d)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.conns) == 0 {
+		t.Error("never connected to logstash")
+	}
+}
+
+func TestStdinNDJSONWithAddedFields(t *testing.T) {
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "-:ci.build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := m.streams[0].(*PipeStream); !ok || p.fd != 0 || p.Tag() != "ci.build" {
+		t.Fatalf("- isn't stdin: %#v", m.streams[0])
+	}
+
+	// Stdin is just a pipe on fd 0, so any pipe goes through the same path.
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--add-field", "build=1234",
+		pipeSpec(t, "ci.build", []string{`{"step":"test","ok":true}`, `{}`, "plain output"}))
+	want := []string{
+		`{"step":"test","ok":true,"tag":"ci.build","build":"1234"}`,
+		`{"tag":"ci.build","build":"1234"}`,
+		`ci.build: plain output`,
+	}
+	if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSplitObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"two objects", `{"a":1}{"b":2}`, []string{`{"a":1}`, `{"b":2}`}},
+		{"with space between", `{"a":1} {"b":{"c":"}{"}}`, []string{`{"a":1}`, `{"b":{"c":"}{"}}`}},
+		{"three objects", `{"a":1}{"b":2}{"c":3}`, []string{`{"a":1}`, `{"b":2}`, `{"c":3}`}},
+		{"trailing garbage", `{"a":1}{"b":2} oops`, []string{`{"a":1}`, `{"b":2}`, `oops`}},
+		{"trailing truncated object", `{"a":1}{"b":`, []string{`{"a":1}`, `{"b":`}},
+		{"single object", `{"a":1}`, []string{`{"a":1}`}},
+		{"single object with garbage", `{"a":1} oops`, []string{`{"a":1}`, `oops`}},
+		{"not an object", `[1]{"a":1}`, []string{`[1]{"a":1}`}},
+		{"plain", "hello", []string{"hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.splitObjects = true
+			var got []string
+			for _, rec := range o.split([]byte(tt.line), testStream(t, "0:app")) {
+				got = append(got, string(rec))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateFifos(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, p := range []string{a, b} {
+		if err := syscall.Mkfifo(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		dupes bool
+	}{
+		{"distinct", []string{a + ":app", b + ":web"}, false},
+		{"same path", []string{a + ":app", a + ":web"}, true},
+		{"same path, spelled differently", []string{a + ":app", filepath.Join(dir, ".", "x", "..", "a") + ":web"}, true},
+		{"allowed", []string{"--allow-duplicate-fifos", a + ":app", a + ":web"}, false},
+		{"fds aren't fifos", []string{"3:app", "3:web"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestArgs(append([]string{"--logstash", "tcp://localhost:5000"}, tt.args...)...)
+			if tt.dupes && (err == nil || !strings.Contains(err.Error(), "read from the same named pipe")) {
+				t.Errorf("got %v, want a duplicate named pipe error", err)
+			}
+			if !tt.dupes && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSRVLogstash(t *testing.T) {
+	saved := srvLookupWait
+	defer func() { srvLookupWait = saved }()
+	srvLookupWait = time.Millisecond
+
+	c := captureTCP(t)
+	// A target is a host and port for an SRV record; the dead one has
+	// nothing listening on it.
+	target := func(addr string) (string, uint16) {
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		return host, uint16(n)
+	}
+	live, port := target(c.ln.Addr().String())
+	dead, deadPort := target(freeAddr(t))
+
+	tests := []struct {
+		name    string
+		records []*net.SRV
+		err     error
+		lookups int
+		want    string
+	}{
+		{
+			name:    "first target",
+			records: []*net.SRV{{Target: live + ".", Port: port}, {Target: dead, Port: deadPort}},
+			lookups: 1,
+		},
+		{
+			name:    "falls through to a later target",
+			records: []*net.SRV{{Target: dead, Port: deadPort, Priority: 1}, {Target: live, Port: port, Priority: 2}},
+			lookups: 1,
+		},
+		{
+			name:    "no records",
+			lookups: srvLookupAttempts,
+			want:    "no SRV records for _logstash._tcp.example.com",
+		},
+		{
+			name:    "lookup fails",
+			err:     errors.New("no such host"),
+			lookups: srvLookupAttempts,
+			want:    "resolving logstash SRV records: no such host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := 0
+			u, _ := url.Parse("srv://_logstash._tcp.example.com")
+			opts := testOptions()
+			l := &LogstashService{url: u, raw: u.String(), opts: &opts}
+			l.lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+				lookups++
+				if name != "_logstash._tcp.example.com" {
+					t.Errorf("looked up %s", name)
+				}
+				return "", tt.records, tt.err
+			}
+			err := l.Write([]event{{tag: "app", buf: []byte("app: " + tt.name + "\n")}})
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("got %v, want %s", err, tt.want)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if lookups != tt.lookups {
+				t.Errorf("%d lookups, want %d", lookups, tt.lookups)
+			}
+			if tt.want != "" {
+				return
+			}
+			// The next connection looks the records up again.
+			l.Lock()
+			l.close(nil)
+			l.Unlock()
+			if err := l.Write([]event{{tag: "app", buf: []byte("app: again\n")}}); err != nil {
+				t.Fatal(err)
+			}
+			if lookups != tt.lookups+1 {
+				t.Errorf("%d lookups after reconnecting, want %d", lookups, tt.lookups+1)
+			}
+			l.Lock()
+			l.close(nil)
+			l.Unlock()
+		})
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.conns) != 4 {
+		t.Errorf("live target got %d connections, want 4", len(c.conns))
+	}
+}
+
+func TestSinkIdleTimeout(t *testing.T) {
+	c := captureTCP(t)
+	opts := testOptions()
+	l := &LogstashService{url: c.url(), raw: c.url().String(), opts: &opts, idleTimeout: 100 * time.Millisecond}
+	write := func(line string) {
+		if err := l.Write([]event{{tag: "app", buf: []byte("app: " + line + "\n")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connected := func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return l.conn != nil
+	}
+	waitClosed := func() {
+		for start := time.Now(); connected(); time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("idle connection never closed")
+			}
+		}
+	}
+	go l.closeWhenIdle()
+	defer func() {
+		l.Lock()
+		l.shutdown()
+		l.Unlock()
+	}()
+
+	// Writes within the timeout keep the connection open.
+	for _, line := range []string{"one", "two", "three"} {
+		write(line)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !connected() {
+		t.Fatal("closed a connection that wasn't idle")
+	}
+	waitClosed()
+	write("four")
+	waitClosed()
+	want := [][]string{{"app: one", "app: two", "app: three"}, {"app: four"}}
+	for i, w := range want {
+		if got := c.lines(t, i, len(w)); strings.Join(got, "\n") != strings.Join(w, "\n") {
+			t.Errorf("connection %d got %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestConnectionHooks(t *testing.T) {
+	c := captureTCP(t)
+	l := &LogstashService{}
+	if err := l.Set(c.url().String()); err != nil {
+		t.Fatal(err)
+	}
+	l.fallbackRetry = time.Hour
+	var got []string
+	// The hooks lock the service, which would deadlock if they were
+	// called with the lock held.
+	l.OnConnect = func(addr string) {
+		l.Lock()
+		defer l.Unlock()
+		got = append(got, "connect "+addr)
+	}
+	l.OnDisconnect = func(err error) {
+		l.Lock()
+		defer l.Unlock()
+		got = append(got, fmt.Sprintf("disconnect %v", err))
+	}
+	hooks := func() string {
+		l.Lock()
+		defer l.Unlock()
+		ret := strings.Join(got, ", ")
+		got = nil
+		return ret
+	}
+	write := func() error {
+		return l.Write([]event{{tag: "app", buf: []byte("app: one\n")}})
+	}
+	addr := c.url().Host
+
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if h := hooks(); h != "connect "+addr {
+		t.Errorf("opening: got %q", h)
+	}
+	// As when the connection's closed for being idle, and reopened by the
+	// next write.
+	l.Lock()
+	l.close(nil)
+	l.Unlock()
+	l.runHooks()
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+	if h := hooks(); h != "disconnect <nil>, connect "+addr {
+		t.Errorf("reconnecting: got %q", h)
+	}
+	// As when the peer hangs up on a logstash with a fallback.
+	l.fallback = &LogstashService{url: &url.URL{Scheme: "stdout"}, raw: "stdout://"}
+	l.Lock()
+	conn := l.conn
+	l.Unlock()
+	l.closedByPeer(conn)
+	if h := hooks(); h != "disconnect connection closed by logstash" {
+		t.Errorf("closed by the peer: got %q", h)
+	}
+	l.fallback, l.failedAt = nil, time.Time{}
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+	if h := hooks(); h != "connect "+addr {
+		t.Errorf("reconnecting after the peer hung up: got %q", h)
+	}
+	l.Lock()
+	l.shutdown()
+	l.Unlock()
+	l.runHooks()
+	if h := hooks(); h != "disconnect <nil>" {
+		t.Errorf("exiting: got %q", h)
+	}
+}
+
+func TestMultilineStartPattern(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "events with continuations",
+			lines: []string{"2024-01-02 panic: oops", "  at main.go:12", "", "  at run.go:3", "2024-01-02 next", "2024-01-02 last", "  more"},
+			want:  []string{"2024-01-02 panic: oops\n  at main.go:12\n\n  at run.go:3\n", "2024-01-02 next\n", "2024-01-02 last\n  more\n"},
+		},
+		{
+			name:  "lines before the first start",
+			lines: []string{"stray", "more stray", "2024-01-02 first"},
+			want:  []string{"stray\nmore stray\n", "2024-01-02 first\n"},
+		},
+		{
+			name:  "no continuations",
+			lines: []string{"2024-01-02 a", "2024-01-02 b"},
+			want:  []string{"2024-01-02 a\n", "2024-01-02 b\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStream(t, "0:app")
+			s.Options().multilineStart = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `)
+			var got []string
+			for i, l := range tt.lines {
+				ln := line{buf: []byte(l + "\n"), closed: i == len(tt.lines)-1}
+				for _, ev := range joinLine(s, ln) {
+					got = append(got, string(ev.buf))
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultilineEventsShip(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--format", "json", "--multiline-start-pattern", `^\[`,
+		pipeSpec(t, "app", []string{"[1] Traceback:", "  File x.py", "[2] fine"}))
+	got := c.lines(t, 0, 2)
+	for i, want := range []string{"[1] Traceback:\n  File x.py", "[2] fine"} {
+		if msg := eventField(t, got[i], "message"); msg != want {
+			t.Errorf("event %d message = %q, want %q", i, msg, want)
+		}
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		line      string
+		want      string
+	}{
+		{"single line", true, "hello\r\n", `{"message":"hello","tag":"app"}`},
+		{"multiline", true, "first\r\n  second\r\n  third\r\n", `{"message":"first\n  second\n  third","tag":"app"}`},
+		{"lone cr kept", true, "a\rb\r\n", `{"message":"a\rb","tag":"app"}`},
+		{"off", false, "first\r\n  second\r\n", `{"message":"first\r\n  second","tag":"app"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.normalizeNewlines = tt.normalize
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, "0:app;format=json")), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		remove bool
+		line   string
+		want   string
+	}{
+		{
+			name:  "present",
+			rules: []string{`trace_id=(\w+)=trace_id`},
+			line:  "GET / trace_id=abc123 200",
+			want:  `{"message":"GET / trace_id=abc123 200","tag":"app","trace_id":"abc123"}`,
+		},
+		{
+			name:  "absent",
+			rules: []string{`trace_id=(\w+)=trace_id`},
+			line:  "GET / 200",
+			want:  "app: GET / 200",
+		},
+		{
+			name:  "several rules, one absent",
+			rules: []string{`trace_id=(\w+)=trace_id`, `span_id=(\w+)=span_id`, `user=(\w+)=user`},
+			line:  "span_id=s1 ok trace_id=t1",
+			want:  `{"message":"span_id=s1 ok trace_id=t1","tag":"app","trace_id":"t1","span_id":"s1"}`,
+		},
+		{
+			name:   "removed from the message",
+			rules:  []string{` ?trace_id=(\w+)=trace_id`},
+			remove: true,
+			line:   "GET / trace_id=abc123 200",
+			want:   `{"message":"GET / 200","tag":"app","trace_id":"abc123"}`,
+		},
+		{
+			name:  "json lines untouched",
+			rules: []string{`trace_id=(\w+)=trace_id`},
+			line:  `{"msg":"trace_id=abc"}`,
+			want:  `{"msg":"trace_id=abc","tag":"app"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			for _, r := range tt.rules {
+				if err := o.extractFields.Set(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			o.extractRemove = tt.remove
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, "0:app")), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadExtractField(t *testing.T) {
+	for _, r := range []string{"trace_id", "(x)=", "=field", "trace_id=field", "(=field"} {
+		var f fieldExtracts
+		if err := f.Set(r); err == nil {
+			t.Errorf("%q: no error", r)
+		}
+	}
+}
+
+// stalledSink takes no writes until it's released, like a connection to a
+// logstash that's backed up.
+type stalledSink struct {
+	release chan struct{}
+}
+
+func (s stalledSink) writeEvents(evs []event) error {
+	<-s.release
+	return nil
+}
+
+func TestConnectionPerStream(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--connection-per-stream",
+		pipeSpec(t, "a", []string{"1", "2"}), pipeSpec(t, "b", []string{"1", "2"}))
+	// The first connection is the shared one, which the streams don't use.
+	byTag := map[string]int{}
+	for i := 1; i <= 2; i++ {
+		got := c.lines(t, i, 2)
+		tag := strings.SplitN(got[0], ":", 2)[0]
+		if want := []string{tag + ": 1", tag + ": 2"}; strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("connection %d got %q, want %q", i, got, want)
+		}
+		byTag[tag] = i
+	}
+	if len(byTag) != 2 {
+		t.Errorf("streams shared a connection: %v", byTag)
+	}
+}
+
+func TestConnectionPerStreamIsolatesBackpressure(t *testing.T) {
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--connection-per-stream",
+		pipeSpec(t, "stuck", []string{"1"}), pipeSpec(t, "free", []string{"1", "2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.closeSinks()
+	release := make(chan struct{})
+	stuck := m.sinks[m.streams[0]]
+	stuck.Lock()
+	stuck.sink = stalledSink{release}
+	stuck.Unlock()
+
+	done := make(chan error, 1)
+	go func() { done <- m.runStreams() }()
+	// The free stream's lines go out while the stuck one's write is held.
+	var got []string
+	for start := time.Now(); len(got) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("free stream's lines held up: %q", got)
+		}
+		got = nil
+		c.Lock()
+		for _, conn := range c.conns {
+			for _, l := range conn {
+				if strings.HasPrefix(l, "free: ") {
+					got = append(got, l)
+				}
+			}
+		}
+		c.Unlock()
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("run ended with a write still stuck: %v", err)
+	default:
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkDrainsWhatLogstashSendsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const lines = 200
+	got := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Logstash talks back after every line, in the same loop that
+		// reads them, so if nobody reads what it sends, it stops reading
+		// once its send buffer fills.
+		junk := bytes.Repeat([]byte("x"), 64*1024)
+		r := bufio.NewScanner(conn)
+		n := 0
+		for n < lines && r.Scan() {
+			n++
+			if _, err := conn.Write(junk); err != nil {
+				break
+			}
+		}
+		got <- n
+	}()
+	u := &url.URL{Scheme: "tcp", Host: ln.Addr().String()}
+	opts := testOptions()
+	l := &LogstashService{url: u, raw: u.String(), opts: &opts}
+	defer func() {
+		l.Lock()
+		l.shutdown()
+		l.Unlock()
+	}()
+	wrote := make(chan error, 1)
+	go func() {
+		for i := 0; i < lines; i++ {
+			if err := l.Write([]event{{tag: "app", buf: []byte(fmt.Sprintf("app: %d\n", i))}}); err != nil {
+				wrote <- err
+				return
+			}
+		}
+		wrote <- nil
+	}()
+	select {
+	case n := <-got:
+		if n != lines {
+			t.Errorf("logstash got %d lines, want %d", n, lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection stalled")
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	t.Setenv("LOGMUX_TEST_NODE", "node-7")
+	osHost, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		codec string
+		args  []string
+		want  string
+	}{
+		{"gelf override", "gelf", []string{"--host-override", "web-svc"}, "web-svc"},
+		{"gelf from env", "gelf", []string{"--host-from-env", "LOGMUX_TEST_NODE"}, "node-7"},
+		{"gelf override wins", "gelf", []string{"--host-override", "web-svc", "--host-from-env", "LOGMUX_TEST_NODE"}, "web-svc"},
+		{"gelf default", "gelf", nil, osHost},
+		{"syslog override", "syslog", []string{"--host-override", "web-svc"}, "web-svc"},
+		{"syslog from env", "syslog", []string{"--host-from-env", "LOGMUX_TEST_NODE"}, "node-7"},
+		{"syslog default", "syslog", nil, osHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--logstash", "tcp://localhost:5000", "--codec", tt.codec}, tt.args...)
+			m, err := parseTestArgs(append(args, "0:app")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev := m.opts.processLine([]byte("hi"), m.streams[0])
+			var got string
+			if tt.codec == "gelf" {
+				got, _ = gelfFields(t, ev)["host"].(string)
+			} else {
+				// <pri>1 timestamp host app - - - msg
+				got = strings.Fields(string(m.opts.syslogEvent(ev, "app")))[3]
+			}
+			if got != tt.want {
+				t.Errorf("host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--host-from-env", "LOGMUX_TEST_UNSET", "0:app"); err == nil || !strings.Contains(err.Error(), "LOGMUX_TEST_UNSET is not set") {
+		t.Errorf("got %v for an unset --host-from-env", err)
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		preserve bool
+		line     string
+		want     string
+	}{
+		{"columns", false, "pid    user\t\tcmd   ", "app: pid user cmd"},
+		{"single spaces", false, "a b c", "app: a b c"},
+		{"json untouched", false, `{"msg":"a    b"}`, `{"msg":"a    b","tag":"app"}`},
+		{"indent trimmed without preserve", false, "    a    b", "app: a b"},
+		{"indent kept with preserve", true, "    a    b", "app:     a b"},
+		{"continuation indent kept with preserve", true, "a   b\n\t  c  d", "app: a b\n\t  c d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.collapseWhitespace = true
+			o.preserveWhitespace = tt.preserve
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), testStream(t, "0:app")), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropUnparseableJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		line string
+		want string
+	}{
+		{"valid object", "0:app;drop-unparseable-json=true", `{"n":1}`, `{"n":1,"tag":"app"}`},
+		{"valid non-object", "0:app;drop-unparseable-json=true", `[1,2]`, "app: [1,2]"},
+		{"truncated object", "0:app;drop-unparseable-json=true", `{"n":1`, ""},
+		{"broken object", "0:app;drop-unparseable-json=true", `{"n":1,}`, ""},
+		{"plain text", "0:app;drop-unparseable-json=true", "oops", ""},
+		{"off wraps plain text", "0:app;drop-unparseable-json=false", "oops", "app: oops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			s := testStream(t, tt.spec)
+			got := string(bytes.TrimSuffix(o.processLine([]byte(tt.line), s), []byte("\n")))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if dropped := s.Stats().dropped; (tt.want == "") != (dropped == 1) {
+				t.Errorf("%d lines dropped", dropped)
+			}
+		})
+	}
+	if _, err := parseStreamArg("0:app;drop-unparseable-json=maybe"); err == nil {
+		t.Error("no error for a bad drop-unparseable-json value")
+	}
+}
+
+func TestAddHash(t *testing.T) {
+	o := testOptions()
+	o.addHash = true
+	hash := func(spec, line string, lagAgo time.Duration) string {
+		t.Helper()
+		ev := o.processLine([]byte(line), testStream(t, spec))
+		if lagAgo > 0 {
+			o.addLag = true
+			ev = o.enrich(ev, time.Now().Add(-lagAgo))
+			o.addLag = false
+		}
+		h, _ := eventField(t, string(ev), "logmux_hash").(string)
+		if len(h) != 64 {
+			t.Fatalf("bad logmux_hash %q in %s", h, ev)
+		}
+		return h
+	}
+	tests := []struct {
+		name string
+		a, b [2]string
+		same bool
+	}{
+		{"identical plain lines", [2]string{"0:app;format=json", "hello"}, [2]string{"0:app;format=json", "hello"}, true},
+		{"identical json lines", [2]string{"0:app", `{"n":1}`}, [2]string{"0:app", `{"n":1}`}, true},
+		{"surrounding whitespace", [2]string{"0:app", `{"n":1}`}, [2]string{"0:app", "  {\"n\":1}\n"}, true},
+		{"different lines", [2]string{"0:app", `{"n":1}`}, [2]string{"0:app", `{"n":2}`}, false},
+		{"different tags", [2]string{"0:app", `{"n":1}`}, [2]string{"0:web", `{"n":1}`}, false},
+		{"tag and line boundary", [2]string{"0:ab;format=json", "c"}, [2]string{"0:a;format=json", "bc"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := hash(tt.a[0], tt.a[1], 0), hash(tt.b[0], tt.b[1], 0); (a == b) != tt.same {
+				t.Errorf("hashes %s and %s", a, b)
+			}
+		})
+	}
+	// Fields that vary from one replay to the next aren't part of it.
+	if a, b := hash("0:app", `{"n":1}`, time.Millisecond), hash("0:app", `{"n":1}`, time.Second); a != b {
+		t.Errorf("lag changed the hash: %s and %s", a, b)
+	}
+}
+
+func TestIncludeRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		extract string
+		maps    string
+		redact  [][]string
+		line    string
+		raw     interface{}
+	}{
+		{
+			name:    "extracted",
+			extract: `id=(\d+)=id`,
+			line:    "GET / id=7",
+			raw:     "GET / id=7",
+		},
+		{
+			name: "reparsed",
+			maps: "lvl=level",
+			line: `{"lvl":"warn","msg":"x"}`,
+			raw:  `{"lvl":"warn","msg":"x"}`,
+		},
+		{
+			name:   "redacted",
+			redact: [][]string{{"password"}},
+			line:   `{"user":"bob","password":"hunter2"}`,
+			raw:    `{"user":"bob","password":"[REDACTED]"}`,
+		},
+		{
+			name:   "nested redacted",
+			redact: [][]string{{"headers", "authorization"}},
+			line:   `{"headers":{"authorization":"Bearer abc"}}`,
+			raw:    `{"headers":{"authorization":"[REDACTED]"}}`,
+		},
+		{
+			name: "nothing parsed",
+			line: `{"n":1}`,
+		},
+		{
+			name:    "no match",
+			extract: `id=(\d+)=id`,
+			line:    "GET /",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.includeRaw = true
+			o.redactKeys = tt.redact
+			if tt.extract != "" {
+				if err := o.extractFields.Set(tt.extract); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.maps != "" {
+				if err := o.mapFields.Set(tt.maps); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ev := o.processLine([]byte(tt.line), testStream(t, "0:app"))
+			if bytes.Contains(ev, []byte("hunter2")) || bytes.Contains(ev, []byte("Bearer")) {
+				t.Fatalf("secret leaked: %s", ev)
+			}
+			var raw interface{}
+			if isObjectEvent(ev) {
+				raw = eventField(t, string(ev), "raw")
+			}
+			if raw != tt.raw {
+				t.Errorf("raw = %v, want %v in %s", raw, tt.raw, ev)
+			}
+		})
+	}
+}
+
+func TestFieldOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		ev    string
+		want  string
+	}{
+		{"listed first, rest sorted", []string{"tag", "@timestamp", "level", "message"}, `{"z":1,"message":"hi","a":2,"tag":"app","level":"warn","@timestamp":"t"}`,
+			`{"tag":"app","@timestamp":"t","level":"warn","message":"hi","a":2,"z":1}`},
+		{"missing listed fields", []string{"tag", "level"}, `{"message":"hi","tag":"app"}`, `{"tag":"app","message":"hi"}`},
+		{"values kept byte for byte", []string{"id"}, `{"big":12345678901234567890,"id":1.50}`, `{"id":1.50,"big":12345678901234567890}`},
+		{"nested objects untouched", []string{"tag"}, `{"b":{"z":1,"a":2},"tag":"app"}`, `{"tag":"app","b":{"z":1,"a":2}}`},
+		{"plain untouched", []string{"tag"}, "app: hi", "app: hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.fieldOrder = tt.order
+			got := string(o.orderEvent([]byte(tt.ev + "\n")))
+			if got != tt.want+"\n" {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			// The same fields in any order come out the same.
+			if again := string(o.orderEvent([]byte(got))); again != got {
+				t.Errorf("reordering changed %s to %s", got, again)
+			}
+		})
+	}
+}
+
+func TestFieldOrderIsStableAcrossRuns(t *testing.T) {
+	var runs []string
+	for i := 0; i < 5; i++ {
+		c := captureTCP(t)
+		runMux(t, "--logstash", c.url().String(), "--field-order", "tag,level,message",
+			"--add-field", "env=prod", "--add-field", "dc=east", "--map-field", "lvl=level",
+			pipeSpec(t, "app", []string{`{"message":"hi","lvl":"warn","z":1,"a":2}`}))
+		runs = append(runs, c.lines(t, 0, 1)[0])
+	}
+	want := `{"tag":"app","level":"warn","message":"hi","a":2,"dc":"east","env":"prod","z":1}`
+	for i, got := range runs {
+		if got != want {
+			t.Errorf("run %d got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	c := captureTCP(t)
+	tests := []struct {
+		name string
+		args []string
+		sent bool
+		err  bool
+	}{
+		{"reachable", []string{"--logstash", c.url().String()}, false, false},
+		{"reachable with a probe event", []string{"--logstash", c.url().String(), "--probe-send"}, true, false},
+		{"unreachable", []string{"--logstash", "tcp://" + freeAddr(t)}, false, true},
+		{"unreachable mirror", []string{"--logstash", c.url().String(), "--logstash", "tcp://" + freeAddr(t)}, false, true},
+		{"unresolvable srv", []string{"--logstash", "srv://_logstash._tcp.invalid"}, false, true},
+	}
+	saved := srvLookupWait
+	defer func() { srvLookupWait = saved }()
+	srvLookupWait = time.Millisecond
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseTestArgs(append(tt.args, "--probe")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.streams) != 0 {
+				t.Errorf("--probe set up %d streams", len(m.streams))
+			}
+			err = m.runProbe()
+			if (err != nil) != tt.err {
+				t.Fatalf("got %v", err)
+			}
+			if tt.sent {
+				got := c.lines(t, i, 1)
+				if tag := eventField(t, got[0], "tag"); tag != probeTag {
+					t.Errorf("probe event %s", got[0])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitTag(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		tag  string
+		want map[string]interface{}
+	}{
+		{
+			name: "full",
+			spec: "sep=.,fields=service,env,level",
+			tag:  "api.prod.info",
+			want: map[string]interface{}{"service": "api", "env": "prod", "level": "info"},
+		},
+		{
+			name: "partial, absent",
+			spec: "sep=.,fields=service,env,level",
+			tag:  "api.prod",
+			want: map[string]interface{}{"service": "api", "env": "prod", "level": nil},
+		},
+		{
+			name: "partial, empty",
+			spec: "sep=.,fields=service,env,level,missing=empty",
+			tag:  "api",
+			want: map[string]interface{}{"service": "api", "env": "", "level": ""},
+		},
+		{
+			name: "extra components stay in the last field",
+			spec: "sep=.,fields=service,env",
+			tag:  "api.prod.info.v2",
+			want: map[string]interface{}{"service": "api", "env": "prod.info.v2"},
+		},
+		{
+			name: "other separator",
+			spec: "sep=-,fields=service,env",
+			tag:  "api-prod",
+			want: map[string]interface{}{"service": "api", "env": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--split-tag", tt.spec, "0:"+tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev := string(m.opts.processLine([]byte(`{"message":"hi"}`), m.streams[0]))
+			for k, want := range tt.want {
+				if got := eventField(t, ev, k); got != want {
+					t.Errorf("%s = %#v, want %#v in %s", k, got, want, ev)
+				}
+			}
+			if got := eventField(t, ev, "tag"); got != tt.tag {
+				t.Errorf("tag = %#v in %s", got, ev)
+			}
+		})
+	}
+}
+
+func TestBadSplitTag(t *testing.T) {
+	for _, spec := range []string{
+		"sep=.",
+		"fields=",
+		"sep=,fields=a",
+		"sep=.,fields=a,,b",
+		"sep=.,fields=a,missing=zero",
+		"sep=.,fields=a,bogus=1",
+	} {
+		var ts tagSplit
+		if err := ts.Set(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+// flakyReader reads "one\n", then fails with err the given number of times,
+// and then reads "two\n".
+type flakyReader struct {
+	err   error
+	fails int
+	reads int
+}
+
+func (f *flakyReader) Read(buf []byte) (int, error) {
+	f.reads++
+	switch {
+	case f.reads == 1:
+		return copy(buf, "one\n"), nil
+	case f.reads <= 1+f.fails:
+		return 0, f.err
+	case f.reads == 2+f.fails:
+		return copy(buf, "two\n"), nil
+	}
+	return 0, io.EOF
+}
+
+func TestRetryableReadErrors(t *testing.T) {
+	saved := readBackoff
+	readBackoff = time.Millisecond
+	defer func() { readBackoff = saved }()
+
+	tests := []struct {
+		name      string
+		retryable string
+		err       error
+		fails     int
+		wantErr   string
+	}{
+		{"EINTR is always retried", "", syscall.EINTR, 2, ""},
+		{"EIO isn't by default", "", syscall.EIO, 1, "input/output error"},
+		{"EIO when it's retryable", "EIO", syscall.EIO, 1, ""},
+		{"wrapped", "EAGAIN", &os.PathError{Op: "read", Path: "fd", Err: syscall.EAGAIN}, 3, ""},
+		{"gives up after a few", "", syscall.EINTR, readRetries + 1, "still failing after 5 retries"},
+		{"a closed file is an EOF", "", os.ErrClosed, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStream(t, "0:app")
+			if tt.retryable != "" {
+				if err := s.Options().retryable.Set(tt.retryable); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.(*PipeStream).source = bufio.NewReader(&flakyReader{err: tt.err, fails: tt.fails})
+			var got []string
+			var err error
+			for i := 0; i < 3 && err == nil && s.Source() != nil; i++ {
+				var buf []byte
+				buf, err = readRaw(s)
+				if len(buf) > 0 {
+					got = append(got, string(buf))
+				}
+			}
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("got error %s", err)
+			case errors.Is(tt.err, os.ErrClosed):
+				if strings.Join(got, "") != "one\n" || s.Source() != nil {
+					t.Errorf("got %q, and the stream isn't closed", got)
+				}
+			case strings.Join(got, "") != "one\ntwo\n":
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestBadRetryableErrors(t *testing.T) {
+	var e errnos
+	if err := e.Set("EINTR,ENOENT"); err == nil {
+		t.Error("ENOENT is retryable")
+	}
+	e = nil
+	if err := e.Set("eio, econnreset"); err != nil || len(e) != 2 || !e.has(syscall.ECONNRESET) || e.has(syscall.EPIPE) {
+		t.Errorf("got %v, %v", e, err)
+	}
+}
+
+func TestAddJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		ev   string
+		want string
+	}{
+		{
+			name: "nested object",
+			args: []string{`kubernetes={"labels": {"app": "web", "tier": "front"}, "namespace": "prod"}`},
+			ev:   `{"message":"hi"}` + "\n",
+			want: `{"message":"hi","kubernetes":{"labels":{"app":"web","tier":"front"},"namespace":"prod"}}` + "\n",
+		},
+		{
+			name: "array and number",
+			args: []string{`zones=["a", "b"]`, "shard=3"},
+			ev:   `{"message":"hi"}` + "\n",
+			want: `{"message":"hi","zones":["a","b"],"shard":3}` + "\n",
+		},
+		{
+			name: "plain events are left alone",
+			args: []string{`kubernetes={"namespace":"prod"}`},
+			ev:   "app: hi\n",
+			want: "app: hi\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			for _, a := range tt.args {
+				if err := o.addJSON.Set(a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := string(o.enrich([]byte(tt.ev), time.Now())); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadAddJSON(t *testing.T) {
+	for _, arg := range []string{`k8s={"labels":`, "k8s", `={"a":1}`, "k8s=bare"} {
+		if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--add-json", arg, "0:app"); err == nil {
+			t.Errorf("%q: no error at startup", arg)
+		}
+	}
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--codec", "gelf", "--add-json", `k8s={"a":1}`, "0:app"); err == nil {
+		t.Error("--add-json with --codec gelf: no error")
+	}
+}
+
+// slowStream takes a while to open, and notes whether logstash was
+// connected by then.
+type slowStream struct {
+	BaseStream
+	delay     time.Duration
+	logstash  *LogstashService
+	connected bool
+}
+
+func (s *slowStream) Open() error {
+	s.connected = s.logstash.conn != nil
+	time.Sleep(s.delay)
+	s.source = bufio.NewReader(strings.NewReader(""))
+	return nil
+}
+
+func (s *slowStream) Preread() error {
+	return nil
+}
+
+func TestStreamsOpenAtOnceAfterLogstash(t *testing.T) {
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--allow-no-streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n, delay = 10, 200 * time.Millisecond
+	for i := 0; i < n; i++ {
+		m.streams = append(m.streams, &slowStream{
+			BaseStream: BaseStream{tag: fmt.Sprintf("s%d", i)},
+			delay:      delay,
+			logstash:   &m.logstash,
+		})
+	}
+	start := time.Now()
+	if err := m.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.closeSinks()
+	// One at a time, they'd take n times as long.
+	if took := time.Since(start); took > n*delay/2 {
+		t.Errorf("opening %d streams took %s", n, took)
+	}
+	for _, s := range m.streams {
+		if !s.(*slowStream).connected {
+			t.Errorf("%s opened before logstash was connected", s.Tag())
+		}
+	}
+}
+
+func TestStreamOpenErrorAfterTheRest(t *testing.T) {
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--allow-no-streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := &slowStream{BaseStream: BaseStream{tag: "good"}, delay: 50 * time.Millisecond, logstash: &m.logstash}
+	m.streams = append(m.streams, &brokenStream{BaseStream: BaseStream{tag: "bad"}, openErr: errors.New("no such stream")}, good)
+	err = m.Configure()
+	defer m.closeSinks()
+	if err == nil || err.Error() != "no such stream" {
+		t.Errorf("got %v", err)
+	}
+	if good.source == nil {
+		t.Error("the good stream wasn't opened")
+	}
+}
+
+func TestRecordSeparator(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		tag   string
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "several records a line",
+			tag:   `app;record-separator=\x1e`,
+			lines: []string{"one\x1etwo\x1ethree", "four"},
+			want:  []string{"app: one", "app: two", "app: three", "app: four"},
+		},
+		{
+			name:  "empty trailing records",
+			tag:   `app;record-separator=\x1e`,
+			lines: []string{"one\x1etwo\x1e", "three\x1e\x1e", "\x1e"},
+			want:  []string{"app: one", "app: two", "app: three"},
+		},
+		{
+			name:  "JSON records",
+			tag:   `app;record-separator=\x1e`,
+			lines: []string{`{"n":1}` + "\x1e" + `{"n":2}`},
+			want:  []string{`{"n":1,"tag":"app"}`, `{"n":2,"tag":"app"}`},
+		},
+		{
+			name:  "global separator",
+			args:  []string{"--record-separator", "|"},
+			tag:   "app",
+			lines: []string{"one|two"},
+			want:  []string{"app: one", "app: two"},
+		},
+		{
+			name:  "the stream's own separator wins",
+			args:  []string{"--record-separator", "|"},
+			tag:   "app;record-separator=#",
+			lines: []string{"one|two#three"},
+			want:  []string{"app: one|two", "app: three"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := captureTCP(t)
+			args := append([]string{"--logstash", c.url().String()}, tt.args...)
+			runMux(t, append(args, pipeSpec(t, tt.tag, tt.lines))...)
+			got := c.lines(t, 0, len(tt.want))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlushDeadline(t *testing.T) {
+	// A logstash that takes a connection but never reads from it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unbuffered", nil, "1 streams still writing"},
+		{"buffered lines", []string{"--input-buffer-lines", "8"}, "1 streams still writing"},
+		{"with a footer", []string{"--emit-footer"}, "flush deadline of 300ms passed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fds [2]int
+			if err := syscall.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			// More than the socket buffers take, so that writes to
+			// logstash back up, from a pipe that stays open until the
+			// run's duration is up.
+			w := os.NewFile(uintptr(fds[1]), "pipe")
+			defer w.Close()
+			line := append(bytes.Repeat([]byte("x"), 1<<20), '\n')
+			go func() {
+				for i := 0; i < 64; i++ {
+					if _, err := w.Write(line); err != nil {
+						return
+					}
+				}
+			}()
+			args := append([]string{"--logstash", "tcp://" + ln.Addr().String(), "--duration", "200ms",
+				"--flush-deadline", "300ms"}, tt.args...)
+			m, err := parseTestArgs(append(args, fmt.Sprintf("%d:app;format=plain", fds[0]))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			err = m.Run()
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("run took %s with a 300ms flush deadline", took)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadFlushDeadline(t *testing.T) {
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--flush-deadline", "-1s", "0:app"); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestRunID(t *testing.T) {
+	t.Setenv("LOGMUX_TEST_RUN_ID", "deploy-42")
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"random", []string{"--add-run-id"}, ""},
+		{"given", []string{"--run-id", "deploy-7"}, "deploy-7"},
+		{"from env", []string{"--run-id-from-env", "LOGMUX_TEST_RUN_ID"}, "deploy-42"},
+		{"given wins over env", []string{"--run-id", "deploy-7", "--run-id-from-env", "LOGMUX_TEST_RUN_ID"}, "deploy-7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := captureTCP(t)
+			args := append([]string{"--logstash", c.url().String()}, tt.args...)
+			runMux(t, append(args,
+				pipeSpec(t, "a", []string{`{"n":1}`, `{"n":2}`}),
+				pipeSpec(t, "b;format=json", []string{"three"}))...)
+			ids := map[interface{}]bool{}
+			for _, ev := range c.lines(t, 0, 3) {
+				ids[eventField(t, ev, "logmux_run_id")] = true
+			}
+			if len(ids) != 1 {
+				t.Fatalf("got run IDs %v, want one for the whole run", ids)
+			}
+			for id := range ids {
+				s, _ := id.(string)
+				if tt.want == "" && !uuid.MatchString(s) {
+					t.Errorf("run ID %q isn't a random UUID", s)
+				}
+				if tt.want != "" && s != tt.want {
+					t.Errorf("run ID %q, want %q", s, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunIDsDiffer(t *testing.T) {
+	a, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("two runs got the same ID %s", a)
+	}
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--run-id-from-env", "LOGMUX_TEST_NO_SUCH_VAR", "0:app"); err == nil {
+		t.Error("no error for an unset --run-id-from-env")
+	}
+}
+
+func TestExpandFdList(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{"6,7,8:app.log", []string{"6:app.log", "7:app.log", "8:app.log"}},
+		{"6,7:app;format=plain", []string{"6:app;format=plain", "7:app;format=plain"}},
+		{"6:app", []string{"6:app"}},
+		{"/var/run/a,b:app", []string{"/var/run/a,b:app"}},
+		{"6,x:app", []string{"6,x:app"}},
+		{"listen-http://127.0.0.1:80:app", []string{"listen-http://127.0.0.1:80:app"}},
+	}
+	for _, tt := range tests {
+		if got := expandFdList(tt.raw); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestFdListReadsEveryFd(t *testing.T) {
+	var fds []string
+	for i := 0; i < 3; i++ {
+		spec := pipeSpec(t, "app", []string{fmt.Sprintf("from %d", i)})
+		fds = append(fds, strings.SplitN(spec, ":", 2)[0])
+	}
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), strings.Join(fds, ",")+":app;format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.streams) != 3 {
+		t.Fatalf("got %d streams, want 3", len(m.streams))
+	}
+	for i, s := range m.streams {
+		if s.Tag() != "app" || s.Options().format != "json" || s.Raw() != fds[i]+":app;format=json" {
+			t.Errorf("stream %d is %s, tagged %s, format %s", i, s.Raw(), s.Tag(), s.Options().format)
+		}
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got := c.lines(t, 0, 3)
+	sort.Strings(got)
+	want := []string{
+		`{"message":"from 0","tag":"app"}`,
+		`{"message":"from 1","tag":"app"}`,
+		`{"message":"from 2","tag":"app"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMissingMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		line    string
+		want    string
+		dropped int64
+	}{
+		{"present, required", []string{"--require-message"}, `{"message":"hi"}`, `{"message":"hi","tag":"app"}`, 0},
+		{"present, dropping", []string{"--drop-no-message"}, `{"message":"hi"}`, `{"message":"hi","tag":"app"}`, 0},
+		{"absent, synthesized", []string{"--require-message"}, `{"n":1}`, `{"n":1,"tag":"app","message":""}`, 0},
+		{"absent, placeholder", []string{"--require-message", "--message-placeholder", "-"}, `{"n":1}`, `{"n":1,"tag":"app","message":"-"}`, 0},
+		{"absent, dropped", []string{"--drop-no-message"}, `{"n":1}`, ``, 1},
+		{"absent, left alone", nil, `{"n":1}`, `{"n":1,"tag":"app"}`, 0},
+		{"another message field", []string{"--require-message", "--message-field", "msg"}, `{"message":"hi"}`, `{"message":"hi","tag":"app","msg":""}`, 0},
+		{"plain text", []string{"--drop-no-message"}, `hi`, "app: hi", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--logstash", "tcp://localhost:5000"}, tt.args...)
+			m, err := parseTestArgs(append(args, "0:app")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := m.streams[0]
+			got := string(m.opts.processLine([]byte(tt.line), s))
+			want := tt.want
+			if want != "" {
+				want += "\n"
+			}
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if s.Stats().dropped != tt.dropped {
+				t.Errorf("dropped %d, want %d", s.Stats().dropped, tt.dropped)
+			}
+		})
+	}
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--require-message", "--drop-no-message", "0:app"); err == nil {
+		t.Error("no error for both --require-message and --drop-no-message")
+	}
+}
+
+// serveUnix listens on a unix socket at path, and sends every line that
+// comes in on it to got, until the returned func stops it like a restart
+// would, closing its connections too.
+func serveUnix(t *testing.T, path string, got chan<- string) func() {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					got <- r.Text()
+				}
+			}()
+		}
+	}()
+	return func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestUnixLogstash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logstash.sock")
+	got := make(chan string, 10)
+	stop := serveUnix(t, path, got)
+	m, err := parseTestArgs("--logstash", "unix://"+path, "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logstash.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.closeSinks()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case line := <-got:
+			if line != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %q over the unix socket", want)
+		}
+	}
+	if err := m.logstash.Write([]event{{tag: "app", buf: []byte("app: one\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	expect("app: one")
+
+	// Logstash restarts, and recreates its socket file.
+	stop()
+	os.Remove(path)
+	stop = serveUnix(t, path, got)
+	defer stop()
+	for i := 0; i < 3; i++ {
+		if err := m.logstash.Write([]event{{tag: "app", buf: []byte(fmt.Sprintf("app: after %d\n", i))}}); err != nil {
+			t.Fatalf("write %d after the restart: %s", i, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		expect(fmt.Sprintf("app: after %d", i))
+	}
+
+	if _, err := parseTestArgs("--logstash", "unix://", "0:app"); err == nil {
+		t.Error("no error for a unix:// logstash without a path")
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	a, b := captureTCP(t), captureTCP(t)
+	runMux(t, "--logstash", a.url().String(), "--logstash", b.url().String(), "--emit-footer",
+		pipeSpec(t, "app", []string{"one", "two"}))
+	want := []string{"app: one", "app: two", fmt.Sprintf(`{"lines":2,"tag":"%s"}`, footerTag)}
+	for name, c := range map[string]*tcpCapture{"logstash": a, "mirror": b} {
+		if got := c.lines(t, 0, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMirrorsPerStream(t *testing.T) {
+	a, b := captureTCP(t), captureTCP(t)
+	runMux(t, "--logstash", a.url().String(), "--logstash", b.url().String(), "--connection-per-stream",
+		pipeSpec(t, "app", []string{"one"}))
+	// The first connection to each is the shared one.
+	for name, c := range map[string]*tcpCapture{"logstash": a, "mirror": b} {
+		if got := c.lines(t, 1, 1); len(got) != 1 || got[0] != "app: one" {
+			t.Errorf("%s's stream connection got %q", name, got)
+		}
+	}
+}
+
+// failingSink fails every write.
+type failingSink struct{}
+
+func (failingSink) writeEvents(evs []event) error {
+	return errors.New("sink is down")
+}
+
+func TestFailingSinkDoesNotStarveTheOthers(t *testing.T) {
+	a, b, c := captureTCP(t), captureTCP(t), captureTCP(t)
+	m, err := parseTestArgs("--logstash", a.url().String(), "--logstash", b.url().String(), "--logstash", c.url().String(), "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logstash.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.closeSinks()
+	m.logstash.mirrors[0].sink = failingSink{}
+	if err := m.logstash.Write([]event{{tag: "app", buf: []byte("app: one\n")}}); err != nil {
+		t.Errorf("one mirror failing failed the write: %s", err)
+	}
+	// The failed mirror is redialed for the next write.
+	if err := m.logstash.Write([]event{{tag: "app", buf: []byte("app: two\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*tcpCapture{"logstash": a, "second mirror": c} {
+		if got := c.lines(t, 0, 2); strings.Join(got, ",") != "app: one,app: two" {
+			t.Errorf("%s got %q", name, got)
+		}
+	}
+	if got := b.lines(t, 1, 1); got[0] != "app: two" {
+		t.Errorf("the failed mirror got %q once it was redialed", got)
+	}
+
+	for _, l := range m.logstash.each() {
+		l.sink = failingSink{}
+	}
+	err = m.logstash.Write([]event{{tag: "app", buf: []byte("app: three\n")}})
+	if err == nil || !strings.Contains(err.Error(), "sink is down") {
+		t.Errorf("got %v with every sink failing, want their error", err)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	primary, fallback := captureTCP(t), captureTCP(t)
+	m, err := parseTestArgs("--logstash", primary.url().String(), "--logstash-fallback", fallback.url().String(),
+		"--logstash-fallback-retry", "50ms", "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logstash.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.closeSinks()
+	write := func(line string) {
+		t.Helper()
+		if err := m.logstash.Write([]event{{tag: "app", buf: []byte("app: " + line + "\n")}}); err != nil {
+			t.Fatalf("writing %s: %s", line, err)
+		}
+	}
+
+	write("one")
+	// A write to logstash fails, and goes to the fallback instead, as do
+	// the writes after it until it's time to retry.
+	m.logstash.Lock()
+	m.logstash.sink = failingSink{}
+	m.logstash.Unlock()
+	write("two")
+	write("three")
+	time.Sleep(100 * time.Millisecond)
+	// Logstash takes the retry on a new connection, and we switch back.
+	write("four")
+	write("five")
+
+	want := []struct {
+		c     *tcpCapture
+		conn  int
+		lines []string
+	}{
+		{primary, 0, []string{"app: one"}},
+		{fallback, 0, []string{"app: two", "app: three"}},
+		{primary, 1, []string{"app: four", "app: five"}},
+	}
+	for _, w := range want {
+		if got := w.c.lines(t, w.conn, len(w.lines)); strings.Join(got, "|") != strings.Join(w.lines, "|") {
+			t.Errorf("got %q, want %q", got, w.lines)
+		}
+	}
+}
+
+func TestFallbackAtStartup(t *testing.T) {
+	fallback := captureTCP(t)
+	runMux(t, "--logstash", "tcp://"+freeAddr(t), "--logstash-fallback", fallback.url().String(),
+		pipeSpec(t, "app", []string{"one", "two"}))
+	if got := fallback.lines(t, 0, 2); strings.Join(got, "|") != "app: one|app: two" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// captureStdout runs f with os.Stdout going to a pipe, and returns what it
+// wrote there.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	saved := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte, 1)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		out <- buf
+	}()
+	func() {
+		defer func() { os.Stdout = saved }()
+		f()
+	}()
+	w.Close()
+	return string(<-out)
+}
+
+func TestStdoutSink(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"stdout://", []string{"--logstash", "stdout://"}, "app: one\n{\"n\":2,\"tag\":\"app\"}\n"},
+		{"dash", []string{"--logstash", "-"}, "app: one\n{\"n\":2,\"tag\":\"app\"}\n"},
+		{"as a mirror", []string{"--logstash", "tcp://" + captureTCP(t).url().Host, "--logstash", "-"}, "app: one\n{\"n\":2,\"tag\":\"app\"}\n"},
+		{"json format", []string{"--logstash", "-", "--format", "json"}, "{\"message\":\"one\",\"tag\":\"app\"}\n{\"n\":2,\"tag\":\"app\"}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(tt.args, pipeSpec(t, "app", []string{"one", `{"n":2}`}))
+			got := captureStdout(t, func() { runMux(t, args...) })
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLargeIntegersRoundTrip(t *testing.T) {
+	const line = `{"id":9007199254740993,"max":18446744073709551615,"min":-9223372036854775808,"f":1.0000000000000001,"nested":{"id":12345678901234567891}}`
+	nums := []string{"9007199254740993", "18446744073709551615", "-9223372036854775808", "1.0000000000000001", "12345678901234567891"}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"spliced", nil},
+		{"added fields", []string{"--add-field", "env=prod", "--add-json", `meta={"shard":9007199254740995}`}},
+		{"mapped field", []string{"--map-field", "max=maximum"}},
+		{"max fields", []string{"--max-fields", "10"}},
+		{"redacted", []string{"--redact-json-keys", "nested.secret"}},
+		{"field order", []string{"--field-order", "nested,min"}},
+		{"split objects", []string{"--split-concatenated"}},
+		{"gelf", []string{"--codec", "gelf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--logstash", "tcp://localhost:5000"}, tt.args...)
+			m, err := parseTestArgs(append(args, "0:app")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ev []byte
+			for _, rec := range m.opts.split([]byte(line), m.streams[0]) {
+				ev = m.opts.enrich(m.opts.processLine(rec, m.streams[0]), time.Now())
+				ev = m.opts.orderEvent(ev)
+			}
+			for _, n := range nums {
+				if !bytes.Contains(ev, []byte(n)) {
+					t.Errorf("%s didn't round-trip in %s", n, ev)
+				}
+			}
+		})
+	}
+
+	// msgpack has integer types of its own for them.
+	got, _ := msgpackDecode(t, msgpackEvent([]byte(`{"id":9007199254740993,"max":18446744073709551615,"min":-9223372036854775808}`)))
+	if want := "{id=9007199254740993 max=0xffffffffffffffff min=-9223372036854775808}"; fmt.Sprint(got) != want {
+		t.Errorf("msgpack got %v, want %s", got, want)
+	}
+}
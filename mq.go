@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// MQStream is a subclass of a BaseStream that's made from reading a POSIX
+// message queue, as given by an mq://<queuename> specifier. Each message is
+// taken as a line; messages are expected not to hold newlines of their own.
+// Message queues are only supported on Linux.
+type MQStream struct {
+	BaseStream
+	name string
+	fd   int
+}
+
+// Open an MQStream by opening its queue, so that a missing queue or a
+// permissions problem is an error at startup. Messages are read off of the
+// queue into a pipe that the read loop reads lines from.
+func (q *MQStream) Open() error {
+	fd, size, err := mqOpen(q.name)
+	if err != nil {
+		return fmt.Errorf("%s: %s", q.raw, err)
+	}
+	q.fd = fd
+	r, w := io.Pipe()
+	q.source = newBufferedReader(r)
+	go func() {
+		buf := make([]byte, size+1)
+		for {
+			n, err := mqReceive(q.fd, buf[:size])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "message queue for tag %s stopped: %s\n", q.tag, err)
+				w.CloseWithError(err)
+				return
+			}
+			msg := buf[:n]
+			if n == 0 || msg[n-1] != '\n' {
+				msg = append(msg, '\n')
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Preread is called before an MQStream is read from. Its source only
+// closes on an error, so there's nothing to do.
+func (q *MQStream) Preread() error {
+	return nil
+}
+
+var _ Stream = (*MQStream)(nil)
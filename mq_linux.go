@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// mqAttr mirrors the kernel's struct mq_attr.
+type mqAttr struct {
+	flags   int
+	maxmsg  int
+	msgsize int
+	curmsgs int
+	_       [4]int
+}
+
+// mqOpen opens the named POSIX message queue for reading, and returns its
+// descriptor and biggest message size.
+func mqOpen(name string) (int, int, error) {
+	name = strings.TrimPrefix(name, "/")
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	fd, _, errno := syscall.Syscall6(syscall.SYS_MQ_OPEN, uintptr(unsafe.Pointer(p)), syscall.O_RDONLY|syscall.O_CLOEXEC, 0, 0, 0, 0)
+	switch errno {
+	case 0:
+	case syscall.ENOENT:
+		return 0, 0, fmt.Errorf("no message queue named /%s", name)
+	case syscall.EACCES:
+		return 0, 0, fmt.Errorf("permission denied opening message queue /%s", name)
+	default:
+		return 0, 0, fmt.Errorf("opening message queue /%s: %s", name, errno)
+	}
+	var attr mqAttr
+	if _, _, errno := syscall.Syscall(syscall.SYS_MQ_GETSETATTR, fd, 0, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		syscall.Close(int(fd))
+		return 0, 0, fmt.Errorf("reading message queue /%s attributes: %s", name, errno)
+	}
+	return int(fd), attr.msgsize, nil
+}
+
+// mqReceive blocks for the next message on the queue, and reads it into
+// buf, which must hold the queue's biggest message.
+func mqReceive(fd int, buf []byte) (int, error) {
+	for {
+		n, _, errno := syscall.Syscall6(syscall.SYS_MQ_TIMEDRECEIVE, uintptr(fd), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// testMQ makes a message queue for a test, and returns its name and a
+// descriptor to send on it.
+func testMQ(t *testing.T) (string, int) {
+	t.Helper()
+	name := fmt.Sprintf("logmux-test-%d-%s", os.Getpid(), strings.ReplaceAll(t.Name(), "/", "-"))
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, _, errno := syscall.Syscall6(syscall.SYS_MQ_OPEN, uintptr(unsafe.Pointer(p)), syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_CLOEXEC, 0600, 0, 0, 0)
+	if errno == syscall.ENOSYS {
+		t.Skip("no message queues on this kernel")
+	}
+	if errno != 0 {
+		t.Fatalf("creating message queue: %s", errno)
+	}
+	t.Cleanup(func() {
+		syscall.Close(int(fd))
+		syscall.Syscall(syscall.SYS_MQ_UNLINK, uintptr(unsafe.Pointer(p)), 0, 0)
+	})
+	return name, int(fd)
+}
+
+func mqSend(t *testing.T, fd int, msg string) {
+	t.Helper()
+	buf := []byte(msg)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_MQ_TIMEDSEND, uintptr(fd), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0, 0); errno != 0 {
+		t.Fatalf("sending %q: %s", msg, errno)
+	}
+}
+
+func TestMQStream(t *testing.T) {
+	name, fd := testMQ(t)
+	s := testStream(t, "mq:///"+name+":app")
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []string{"one", "two\n", `{"n":3}`}
+	for _, m := range msgs {
+		mqSend(t, fd, m)
+	}
+	o := testOptions()
+	want := []string{"app: one", "app: two", `{"n":3,"tag":"app"}`}
+	for _, w := range want {
+		if err := s.Preread(); err != nil {
+			t.Fatal(err)
+		}
+		ln, err := s.Source().ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(string(o.processLine(ln, s)), "\n"); got != w {
+			t.Errorf("got %q, want %q", got, w)
+		}
+	}
+}
+
+func TestMQStreamErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		mode uint32
+		want string
+	}{
+		{"missing", 0, "no message queue named"},
+		{"unreadable", 0200, "permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("logmux-test-%d-missing", os.Getpid())
+			if tt.mode != 0 {
+				if os.Geteuid() == 0 {
+					t.Skip("root can read any message queue")
+				}
+				var fd int
+				name, fd = testMQ(t)
+				syscall.Fchmod(fd, tt.mode)
+			}
+			err := testStream(t, "mq://"+name+":app").Open()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
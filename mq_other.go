@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoMQ = errors.New("message queue streams are only supported on Linux")
+
+func mqOpen(name string) (int, int, error) {
+	return 0, 0, errNoMQ
+}
+
+func mqReceive(fd int, buf []byte) (int, error) {
+	return 0, errNoMQ
+}
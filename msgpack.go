@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// msgpackEvent re-encodes a processed JSON object event as a msgpack map,
+// for --codec msgpack. Fields keep their order. Events are written back to
+// back, since msgpack values are self-delimiting. An event that isn't valid
+// JSON is shipped as a map with its text under "message".
+func msgpackEvent(ev []byte) []byte {
+	ev = bytes.TrimRight(ev, "\n")
+	dec := json.NewDecoder(bytes.NewReader(ev))
+	dec.UseNumber()
+	out, err := msgpackValue(dec, nil)
+	if err == nil && dec.More() {
+		err = errors.New("trailing data after JSON value")
+	}
+	if err != nil {
+		out = msgpackMapHeader(nil, 1)
+		out = msgpackString(out, "message")
+		out = msgpackString(out, string(ev))
+	}
+	return out
+}
+
+// msgpackValue reads the next JSON value off of dec, and appends it to out
+// as msgpack.
+func msgpackValue(dec *json.Decoder, out []byte) ([]byte, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		// Containers need their length up front, so encode their contents
+		// on their own first.
+		var body []byte
+		n := 0
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				body = msgpackString(body, key.(string))
+			}
+			if body, err = msgpackValue(dec, body); err != nil {
+				return nil, err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if t == '{' {
+			out = msgpackMapHeader(out, n)
+		} else {
+			out = msgpackArrayHeader(out, n)
+		}
+		return append(out, body...), nil
+	case string:
+		return msgpackString(out, t), nil
+	case json.Number:
+		return msgpackNumber(out, t)
+	case bool:
+		if t {
+			return append(out, 0xc3), nil
+		}
+		return append(out, 0xc2), nil
+	case nil:
+		return append(out, 0xc0), nil
+	}
+	return nil, errors.New("unexpected JSON token")
+}
+
+// msgpackNumber appends a JSON number as the smallest msgpack integer that
+// holds it, or as a float64 if it isn't an integer.
+func msgpackNumber(out []byte, n json.Number) ([]byte, error) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return msgpackInt(out, i), nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		out = append(out, 0xcf)
+		return binary.BigEndian.AppendUint64(out, u), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, 0xcb)
+	return binary.BigEndian.AppendUint64(out, math.Float64bits(f)), nil
+}
+
+func msgpackInt(out []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(out, byte(i))
+	case i < 0 && i >= -32:
+		return append(out, byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(out, 0xd0, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(out, 0xd1), uint16(int16(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(out, 0xd2), uint32(int32(i)))
+	}
+	return binary.BigEndian.AppendUint64(append(out, 0xd3), uint64(i))
+}
+
+func msgpackString(out []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		out = append(out, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		out = append(out, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		out = binary.BigEndian.AppendUint16(append(out, 0xda), uint16(n))
+	default:
+		out = binary.BigEndian.AppendUint32(append(out, 0xdb), uint32(n))
+	}
+	return append(out, s...)
+}
+
+func msgpackArrayHeader(out []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(out, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(out, 0xdd), uint32(n))
+}
+
+func msgpackMapHeader(out []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(out, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(out, 0xdf), uint32(n))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+)
+
+// msgpackDecode decodes the msgpack value at the front of buf, with maps as
+// their key-value pairs in order, and returns the rest of buf.
+func msgpackDecode(t *testing.T, buf []byte) (interface{}, []byte) {
+	t.Helper()
+	need := func(n int) []byte {
+		if len(buf) < n {
+			t.Fatalf("truncated msgpack: % x", buf)
+		}
+		ret := buf[:n]
+		buf = buf[n:]
+		return ret
+	}
+	b := need(1)[0]
+	var n int
+	switch {
+	case b <= 0x7f:
+		return int64(b), buf
+	case b >= 0xe0:
+		return int64(int8(b)), buf
+	case b&0xe0 == 0xa0:
+		return string(need(int(b & 0x1f))), buf
+	case b&0xf0 == 0x90:
+		n = int(b & 0x0f)
+	case b&0xf0 == 0x80:
+		n = -int(b & 0x0f)
+	case b == 0xc0:
+		return nil, buf
+	case b == 0xc2 || b == 0xc3:
+		return b == 0xc3, buf
+	case b == 0xd0:
+		return int64(int8(need(1)[0])), buf
+	case b == 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(need(2)))), buf
+	case b == 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(need(4)))), buf
+	case b == 0xd3:
+		return int64(binary.BigEndian.Uint64(need(8))), buf
+	case b == 0xcf:
+		return binary.BigEndian.Uint64(need(8)), buf
+	case b == 0xcb:
+		return math.Float64frombits(binary.BigEndian.Uint64(need(8))), buf
+	case b == 0xd9:
+		return string(need(int(need(1)[0]))), buf
+	case b == 0xda:
+		return string(need(int(binary.BigEndian.Uint16(need(2))))), buf
+	case b == 0xdb:
+		return string(need(int(binary.BigEndian.Uint32(need(4))))), buf
+	case b == 0xdc:
+		n = int(binary.BigEndian.Uint16(need(2)))
+	case b == 0xde:
+		n = -int(binary.BigEndian.Uint16(need(2)))
+	default:
+		t.Fatalf("unexpected msgpack byte %#x", b)
+	}
+	if n >= 0 {
+		arr := []interface{}{}
+		for i := 0; i < n; i++ {
+			var v interface{}
+			v, buf = msgpackDecode(t, buf)
+			arr = append(arr, v)
+		}
+		return arr, buf
+	}
+	var pairs []string
+	for i := 0; i < -n; i++ {
+		var k, v interface{}
+		k, buf = msgpackDecode(t, buf)
+		v, buf = msgpackDecode(t, buf)
+		pairs = append(pairs, fmt.Sprintf("%v=%#v", k, v))
+	}
+	return "{" + strings.Join(pairs, " ") + "}", buf
+}
+
+func TestMsgpackEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   string
+		want string
+	}{
+		{"strings", `{"message":"hi","tag":"app"}`, `{message="hi" tag="app"}`},
+		{"order kept", `{"z":1,"a":2}`, `{z=1 a=2}`},
+		{"integers", `{"a":0,"b":127,"c":-32,"d":-100,"e":300,"f":-40000,"g":70000,"h":9007199254740993}`,
+			`{a=0 b=127 c=-32 d=-100 e=300 f=-40000 g=70000 h=9007199254740993}`},
+		{"big unsigned", `{"id":18446744073709551615}`, `{id=0xffffffffffffffff}`},
+		{"floats", `{"x":1.5,"y":-2e3}`, `{x=1.5 y=-2000}`},
+		{"literals", `{"t":true,"f":false,"n":null}`, `{t=true f=false n=<nil>}`},
+		{"nested", `{"a":[1,"two",{"b":[]}]}`, `{a=[]interface {}{1, "two", "{b=[]interface {}{}}"}}`},
+		{"long string", `{"s":"` + strings.Repeat("x", 40) + `"}`, `{s="` + strings.Repeat("x", 40) + `"}`},
+		{"not json", "app: plain line", `{message="app: plain line"}`},
+		{"trailing garbage", `{"a":1} x`, `{message="{\"a\":1} x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rest := msgpackDecode(t, msgpackEvent([]byte(tt.ev+"\n")))
+			if len(rest) > 0 {
+				t.Errorf("% x left over", rest)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackCodecShipsMaps(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := io.ReadAll(conn)
+		got <- buf
+	}()
+	runMux(t, "--logstash", "tcp://"+ln.Addr().String(), "--codec", "msgpack",
+		pipeSpec(t, "app", []string{`{"n":1}`, "plain"}))
+	buf := <-got
+	var evs []interface{}
+	for len(buf) > 0 {
+		var ev interface{}
+		ev, buf = msgpackDecode(t, buf)
+		evs = append(evs, ev)
+	}
+	want := []interface{}{`{n=1 tag="app"}`, `{message="plain" tag="app"}`}
+	if fmt.Sprint(evs) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", evs, want)
+	}
+}
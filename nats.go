@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// natsWriter publishes each event to a NATS subject for its tag, for
+// nats://host:port/prefix URLs: an event tagged app.error goes to
+// prefix.app.error (logs.app.error by default). NATS doesn't ack what's
+// published to it, so errors from the server are only returned by the
+// Write after they come in.
+type natsWriter struct {
+	prefix     string
+	maxPayload int
+	replies    *bufio.Reader
+
+	sync.Mutex
+	conn net.Conn
+	err  error
+}
+
+// natsInfo is the part of the server's INFO that we look at.
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+// newNatsWriter says hello to NATS over conn, logging in with the URL's user
+// and password, or its user as a token, and waits for the server to take
+// it.
+func newNatsWriter(conn net.Conn, u *url.URL) (*natsWriter, error) {
+	n := &natsWriter{
+		prefix:  strings.Trim(u.Path, "/"),
+		replies: bufio.NewReader(conn),
+		conn:    conn,
+	}
+	if n.prefix == "" {
+		n.prefix = "logs"
+	}
+	line, err := n.replies.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return nil, fmt.Errorf("nats: unexpected greeting: %s", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return nil, fmt.Errorf("nats: bad INFO: %s", err)
+	}
+	if info.TLSRequired {
+		return nil, errors.New("nats: the server requires TLS, which we don't speak")
+	}
+	n.maxPayload = info.MaxPayload
+
+	hello := map[string]interface{}{"verbose": false, "pedantic": false, "name": "logmux", "lang": "go"}
+	if pass, ok := u.User.Password(); ok {
+		hello["user"], hello["pass"] = u.User.Username(), pass
+	} else if u.User != nil {
+		hello["auth_token"] = u.User.Username()
+	}
+	connect, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := n.replies.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return n, nil
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, fmt.Errorf("nats: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+	}
+}
+
+// openNats makes a nats:// sink over conn, which serves the server until
+// the connection closes.
+func openNats(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	n, err := newNatsWriter(conn, s.url)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		n.serve()
+		s.closedByPeer(conn)
+	}()
+	return n, nil
+}
+
+// subject makes a subject out of our prefix and an event's tag. Tags
+// with dots make for deeper subjects; whitespace and wildcards can't be in
+// one, so they're replaced.
+func (n *natsWriter) subject(tag string) string {
+	sub := []byte(n.prefix + "." + tag)
+	for i, c := range sub {
+		if c <= ' ' || c == '*' || c == '>' {
+			sub[i] = '_'
+		}
+	}
+	return strings.Trim(strings.ReplaceAll(string(sub), "..", "."), ".")
+}
+
+// writeEvents publishes events, each on the subject for its stream's tag.
+// Events bigger than the server's max_payload are dropped, as it'd close the
+// connection on us.
+func (n *natsWriter) writeEvents(evs []event) error {
+	var out bytes.Buffer
+	for _, ev := range evs {
+		payload := bytes.TrimSuffix(ev.buf, []byte("\n"))
+		if n.maxPayload > 0 && len(payload) > n.maxPayload {
+			fmt.Fprintf(os.Stderr, "dropping a %d-byte event that's over the NATS server's max_payload of %d bytes\n", len(payload), n.maxPayload)
+			continue
+		}
+		fmt.Fprintf(&out, "PUB %s %d\r\n", n.subject(ev.tag), len(payload))
+		out.Write(payload)
+		out.WriteString("\r\n")
+	}
+	n.Lock()
+	defer n.Unlock()
+	if err := n.err; err != nil {
+		n.err = nil
+		return err
+	}
+	_, err := n.conn.Write(out.Bytes())
+	return err
+}
+
+// serve reads what the server sends us once we're connected, answering its
+// PINGs (it drops clients that don't) and keeping any error for the next
+// write. It returns once the connection is closed.
+func (n *natsWriter) serve() {
+	for {
+		line, err := n.replies.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		n.Lock()
+		switch {
+		case line == "PING":
+			n.conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "-ERR"):
+			n.err = fmt.Errorf("nats: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+		n.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNats is a NATS server that sends info as its INFO, answers the
+// client's CONNECT with connectErr if it's set, and sends on every PUB it
+// takes as "subject payload".
+type fakeNats struct {
+	ln         net.Listener
+	info       string
+	connectErr string
+	connects   chan map[string]interface{}
+	pubs       chan string
+}
+
+func newFakeNats(t *testing.T, info, connectErr string) *fakeNats {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	n := &fakeNats{ln: ln, info: info, connectErr: connectErr,
+		connects: make(chan map[string]interface{}, 10), pubs: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNats) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO %s\r\n", n.info)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			var connect map[string]interface{}
+			json.Unmarshal([]byte(line[len("CONNECT "):]), &connect)
+			n.connects <- connect
+		case line == "PING":
+			if n.connectErr != "" {
+				fmt.Fprintf(conn, "-ERR '%s'\r\n", n.connectErr)
+				return
+			}
+			io.WriteString(conn, "PONG\r\n")
+		case strings.HasPrefix(line, "PUB "):
+			parts := strings.Fields(line)
+			size, _ := strconv.Atoi(parts[len(parts)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			n.pubs <- parts[1] + " " + string(payload[:size])
+		}
+	}
+}
+
+func (n *fakeNats) url(userinfo, path string) string {
+	return "nats://" + userinfo + n.ln.Addr().String() + path
+}
+
+func TestNatsSubject(t *testing.T) {
+	tests := []struct {
+		prefix, tag, want string
+	}{
+		{"logs", "app", "logs.app"},
+		{"logs", "app.error", "logs.app.error"},
+		{"events.prod", "app", "events.prod.app"},
+		{"logs", "my app", "logs.my_app"},
+		{"logs", "app.*", "logs.app._"},
+		{"logs", "a>b", "logs.a_b"},
+		{"logs", ".app..error.", "logs.app.error"},
+	}
+	for _, tt := range tests {
+		n := &natsWriter{prefix: tt.prefix}
+		if got := n.subject(tt.tag); got != tt.want {
+			t.Errorf("%s + %s: got %s, want %s", tt.prefix, tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestNatsSink(t *testing.T) {
+	n := newFakeNats(t, `{"max_payload":32}`, "")
+	runMux(t, "--logstash", n.url("", ""),
+		pipeSpec(t, "app.error", []string{"one", strings.Repeat("x", 40), `{"n":2}`}),
+	)
+	want := []string{"logs.app.error app.error: one", `logs.app.error {"n":2,"tag":"app.error"}`}
+	for _, w := range want {
+		select {
+		case got := <-n.pubs:
+			if got != w {
+				t.Errorf("got %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing published for %q", w)
+		}
+	}
+}
+
+func TestNatsConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		userinfo string
+		want     map[string]interface{}
+	}{
+		{"anonymous", "", map[string]interface{}{"user": nil, "pass": nil, "auth_token": nil}},
+		{"user and password", "app:s3cret@", map[string]interface{}{"user": "app", "pass": "s3cret"}},
+		{"token", "t0ken@", map[string]interface{}{"auth_token": "t0ken", "user": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newFakeNats(t, `{}`, "")
+			m, err := parseTestArgs("--logstash", n.url(tt.userinfo, "/logs"), "0:app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.logstash.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer m.closeSinks()
+			connect := <-n.connects
+			for k, v := range tt.want {
+				if connect[k] != v {
+					t.Errorf("CONNECT has %s = %#v, want %#v", k, connect[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestNatsConnectErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		info       string
+		connectErr string
+		want       string
+	}{
+		{"TLS required", `{"tls_required":true}`, "", "requires TLS"},
+		{"bad login", `{}`, "Authorization Violation", "Authorization Violation"},
+		{"bad INFO", `{`, "", "bad INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newFakeNats(t, tt.info, tt.connectErr)
+			m, err := parseTestArgs("--logstash", n.url("", ""), "0:app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.logstash.Open(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// pauser holds up writes to logstash while logmux is paused, as for a
+// maintenance window downstream. Streams stay open and connections stay up;
+// a paused stream's writer just waits, so its reads back up behind it (or
+// fill its --input-buffer-lines) until we're resumed.
+type pauser struct {
+	sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+// pause stops writes until resume is called.
+func (p *pauser) pause() {
+	p.Lock()
+	defer p.Unlock()
+	if !p.paused {
+		p.paused, p.resumed = true, make(chan struct{})
+	}
+}
+
+// resume lets writes go on again.
+func (p *pauser) resume() {
+	p.Lock()
+	defer p.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resumed)
+	}
+}
+
+// toggle pauses if we're running, and resumes if we're paused.
+func (p *pauser) toggle() {
+	if p.isPaused() {
+		p.resume()
+	} else {
+		p.pause()
+	}
+}
+
+// isPaused returns true while writes are held up.
+func (p *pauser) isPaused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// wait blocks until we're not paused, marking the stream as paused in the
+// meantime.
+func (p *pauser) wait(s Stream) {
+	p.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.Unlock()
+	if !paused {
+		return
+	}
+	s.Stats().setState("paused")
+	<-resumed
+	s.Stats().setState("open")
+}
+
+// pauseOnSignal toggles pausing on every SIGUSR2, until stop is closed.
+func (m *Mux) pauseOnSignal(stop <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			m.pause.toggle()
+			fmt.Fprintf(os.Stderr, "logmux: paused=%t\n", m.pause.isPaused())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handlePause serves whether we're paused as JSON, and pauses us on a POST.
+func (m *Mux) handlePause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		m.pause.pause()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.writePaused(w)
+}
+
+// handleResume resumes us on a POST.
+func (m *Mux) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.pause.resume()
+	m.writePaused(w)
+}
+
+// writePaused writes out whether we're paused as JSON.
+func (m *Mux) writePaused(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Paused bool `json:"paused"`
+	}{m.pause.isPaused()})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPauseEndpoints(t *testing.T) {
+	m := &Mux{}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		code    int
+		paused  bool
+	}{
+		{"not paused to start with", m.handlePause, "GET", http.StatusOK, false},
+		{"pause", m.handlePause, "POST", http.StatusOK, true},
+		{"still paused", m.handlePause, "GET", http.StatusOK, true},
+		{"pausing twice", m.handlePause, "POST", http.StatusOK, true},
+		{"resume needs a POST", m.handleResume, "GET", http.StatusMethodNotAllowed, true},
+		{"resume", m.handleResume, "POST", http.StatusOK, false},
+		{"resuming twice", m.handleResume, "POST", http.StatusOK, false},
+		{"pause takes GET and POST", m.handlePause, "DELETE", http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.method, "/", nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if tt.code == http.StatusOK {
+			var got struct{ Paused bool }
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Paused != tt.paused {
+				t.Errorf("%s: got %s, want paused=%t", tt.name, w.Body, tt.paused)
+			}
+		}
+		if m.pause.isPaused() != tt.paused {
+			t.Errorf("%s: paused=%t", tt.name, m.pause.isPaused())
+		}
+	}
+}
+
+func TestPauseToggle(t *testing.T) {
+	var p pauser
+	for _, want := range []bool{true, false, true, false} {
+		p.toggle()
+		if p.isPaused() != want {
+			t.Errorf("got paused=%t, want %t", p.isPaused(), want)
+		}
+	}
+}
+
+func TestPauseHoldsOffShipping(t *testing.T) {
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), pipeSpec(t, "app", []string{"one", "two"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.pause.pause()
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+
+	s := m.streams[0]
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.Stats().Lock()
+		state := s.Stats().state
+		s.Stats().Unlock()
+		if state == "paused" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream is %q, not paused", state)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Lock()
+	for _, lines := range c.conns {
+		if len(lines) > 0 {
+			t.Errorf("shipped %q while paused", lines)
+		}
+	}
+	c.Unlock()
+
+	m.handleResume(httptest.NewRecorder(), httptest.NewRequest("POST", "/resume", nil))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't end after resuming")
+	}
+	if got := c.lines(t, 0, 2); len(got) != 2 || got[0] != "app: one" || got[1] != "app: two" {
+		t.Errorf("got %q after resuming", got)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// pollFd mirrors the kernel's struct pollfd.
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// Poll events, which syscall doesn't name, and how often pipeHasWriter
+// looks again for a writer.
+const (
+	pollIn      = 0x1
+	pollHup     = 0x10
+	pipeRecheck = 10 * time.Millisecond
+)
+
+// pipeHasWriter checks, for up to grace, whether the pipe at fd has data to
+// read, or a live write end, after a read of it hit EOF. A pipe reports a
+// hangup for as long as it has no writers, so we keep checking until one
+// comes back (as when the pipe is reopened for writing through /proc), or
+// the grace is up.
+func pipeHasWriter(fd int, grace time.Duration) bool {
+	for deadline := time.Now().Add(grace); ; {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false
+		}
+		p := pollFd{fd: int32(fd), events: pollIn}
+		ts := syscall.NsecToTimespec(int64(left))
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&p)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+		switch {
+		case errno == syscall.EINTR:
+		case errno != 0:
+			return false
+		case p.revents&pollIn != 0:
+			return true
+		case p.revents&pollHup == 0:
+			// No data came, but there's a writer, so a read will
+			// block until it sends some.
+			return true
+		default:
+			// Still no writer; a hangup's reported right away, so we
+			// wait a moment before looking again.
+			time.Sleep(pipeRecheck)
+		}
+	}
+}
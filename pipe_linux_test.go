@@ -0,0 +1,76 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPipeEOFGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		reopen   bool
+		wantNext string
+	}{
+		{"a writer comes back", true, "two\n"},
+		{"no writer comes back", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fds [2]int
+			if err := syscall.Pipe(fds[:]); err != nil {
+				t.Fatal(err)
+			}
+			p := testStream(t, fmt.Sprintf("%d:app", fds[0])).(*PipeStream)
+			p.eofGrace = time.Second
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			w := os.NewFile(uintptr(fds[1]), "pipe")
+			w.WriteString("one\n")
+			w.Close()
+			if line, err := p.Source().ReadString('\n'); line != "one\n" || err != nil {
+				t.Fatalf("got %q, %v", line, err)
+			}
+			if _, err := p.Source().ReadString('\n'); err != io.EOF {
+				t.Fatalf("got %v, want EOF", err)
+			}
+			p.MarkClosed()
+
+			if tt.reopen {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					w, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fds[0]), os.O_WRONLY, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer w.Close()
+					w.WriteString("two\n")
+				}()
+			}
+			start := time.Now()
+			err := p.Preread()
+			if !tt.reopen {
+				if err != io.EOF {
+					t.Fatalf("got %v, want EOF", err)
+				}
+				if d := time.Since(start); d < p.eofGrace {
+					t.Errorf("gave up after %s, before the grace was up", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line, err := p.Source().ReadString('\n'); line != tt.wantNext || err != nil {
+				t.Errorf("got %q, %v, want %q", line, err, tt.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// pipeHasWriter can't tell whether a pipe has a live write end without
+// Linux's poll semantics for pipes, which report a hangup only while there
+// are no writers; elsewhere, a hangup can stick once the last writer's gone.
+// So an EOF is always the end of a pipe.
+func pipeHasWriter(fd int, grace time.Duration) bool {
+	return false
+}
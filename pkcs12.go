@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"unicode/utf16"
+)
+
+// The parts of PKCS#12 (RFC 7292) that a client identity, as exported by
+// openssl pkcs12 -export or a PKI's tooling, is made of: a cert and its
+// key, each in a bag of a safe that's either plain or encrypted with a
+// passphrase, under a MAC keyed by the same passphrase.
+var (
+	oidData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Cert       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBE3DES        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA1           = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+// errWrongPassphrase is returned for a PKCS#12 bundle whose MAC, or
+// encryption, doesn't check out with the passphrase we were given.
+var errWrongPassphrase = errors.New("wrong passphrase, or a corrupt bundle")
+
+type p12PFX struct {
+	Version  int
+	AuthSafe p12ContentInfo
+	MacData  p12MacData `asn1:"optional"`
+}
+
+type p12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type p12MacData struct {
+	Mac struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type p12EncryptedData struct {
+	Version int
+	Info    struct {
+		ContentType asn1.ObjectIdentifier
+		Algorithm   pkix.AlgorithmIdentifier
+		Content     []byte `asn1:"tag:0,optional"`
+	}
+}
+
+type p12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type p12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// p12Shrouded is an EncryptedPrivateKeyInfo, a PKCS#8 key encrypted with a
+// passphrase.
+type p12Shrouded struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type p12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type p12PBES2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type p12PBKDF2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// loadPKCS12 loads the client cert and key in the PKCS#12 bundle at path,
+// decrypting it with the passphrase in the passEnv environment variable.
+func loadPKCS12(path, passEnv string) (tls.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := decodePKCS12(buf, os.Getenv(passEnv))
+	if err == errWrongPassphrase {
+		return tls.Certificate{}, fmt.Errorf("%s: %s, for the passphrase in $%s", path, err, passEnv)
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return cert, nil
+}
+
+// decodePKCS12 decodes a PKCS#12 bundle into the cert that goes with the
+// key in it, followed by any other certs in it, as its chain. The bundle
+// can be encrypted with AES (PBES2, as newer openssl exports by default),
+// or triple DES (as older openssl does); the RC2 that older openssl also
+// uses for certs by default isn't supported.
+func decodePKCS12(buf []byte, passphrase string) (tls.Certificate, error) {
+	var pfx p12PFX
+	if rest, err := asn1.Unmarshal(buf, &pfx); err != nil || len(rest) > 0 {
+		return tls.Certificate{}, errors.New("not a PKCS#12 bundle")
+	}
+	if pfx.Version != 3 {
+		return tls.Certificate{}, fmt.Errorf("unsupported PKCS#12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return tls.Certificate{}, errors.New("only bundles protected by a passphrase are supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return tls.Certificate{}, fmt.Errorf("bad contents: %s", err)
+	}
+	if pfx.MacData.Mac.Algorithm.Algorithm != nil {
+		if err := pfx.MacData.verify(authSafe, passphrase); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	var safes []p12ContentInfo
+	if _, err := asn1.Unmarshal(authSafe, &safes); err != nil {
+		return tls.Certificate{}, fmt.Errorf("bad contents: %s", err)
+	}
+	var bags []p12SafeBag
+	for _, safe := range safes {
+		var data []byte
+		switch {
+		case safe.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(safe.Content.Bytes, &data); err != nil {
+				return tls.Certificate{}, fmt.Errorf("bad contents: %s", err)
+			}
+		case safe.ContentType.Equal(oidEncryptedData):
+			var enc p12EncryptedData
+			if _, err := asn1.Unmarshal(safe.Content.Bytes, &enc); err != nil {
+				return tls.Certificate{}, fmt.Errorf("bad contents: %s", err)
+			}
+			var err error
+			if data, err = p12Decrypt(enc.Info.Algorithm, enc.Info.Content, passphrase); err != nil {
+				return tls.Certificate{}, err
+			}
+		default:
+			return tls.Certificate{}, fmt.Errorf("unsupported content type %s", safe.ContentType)
+		}
+		var more []p12SafeBag
+		if _, err := asn1.Unmarshal(data, &more); err != nil {
+			return tls.Certificate{}, fmt.Errorf("bad contents: %s", err)
+		}
+		bags = append(bags, more...)
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	for _, bag := range bags {
+		var der []byte
+		switch {
+		case bag.ID.Equal(oidCertBag):
+			var c p12CertBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &c); err != nil {
+				return tls.Certificate{}, fmt.Errorf("bad cert: %s", err)
+			}
+			if !c.ID.Equal(oidX509Cert) {
+				continue
+			}
+			cert, err := x509.ParseCertificate(c.Data)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			certs = append(certs, cert)
+			continue
+		case bag.ID.Equal(oidKeyBag):
+			der = bag.Value.Bytes
+		case bag.ID.Equal(oidShroudedKeyBag):
+			var s p12Shrouded
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &s); err != nil {
+				return tls.Certificate{}, fmt.Errorf("bad key: %s", err)
+			}
+			var err error
+			if der, err = p12Decrypt(s.Algorithm, s.Data, passphrase); err != nil {
+				return tls.Certificate{}, err
+			}
+		default:
+			continue
+		}
+		if key != nil {
+			return tls.Certificate{}, errors.New("more than one key in it")
+		}
+		k, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("bad key: %s", err)
+		}
+		var ok bool
+		if key, ok = k.(crypto.Signer); !ok {
+			return tls.Certificate{}, fmt.Errorf("unsupported key type %T", k)
+		}
+	}
+	if key == nil {
+		return tls.Certificate{}, errors.New("no key in it")
+	}
+
+	ret := tls.Certificate{PrivateKey: key}
+	pub := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	for i, cert := range certs {
+		if pub.Equal(cert.PublicKey) {
+			ret.Leaf = cert
+			certs = append(certs[:i:i], certs[i+1:]...)
+			break
+		}
+	}
+	if ret.Leaf == nil {
+		return tls.Certificate{}, errors.New("no cert for its key in it")
+	}
+	ret.Certificate = [][]byte{ret.Leaf.Raw}
+	for _, cert := range certs {
+		ret.Certificate = append(ret.Certificate, cert.Raw)
+	}
+	return ret, nil
+}
+
+// verify checks the MAC over a bundle's contents, which is how a wrong
+// passphrase shows.
+func (m p12MacData) verify(content []byte, passphrase string) error {
+	h, err := p12Hash(m.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	size := h().Size()
+	check := func(password []byte) bool {
+		mac := hmac.New(h, p12KDF(h, m.MacSalt, password, m.Iterations, 3, size))
+		mac.Write(content)
+		return hmac.Equal(mac.Sum(nil), m.Mac.Digest)
+	}
+	password := bmpPassphrase(passphrase)
+	// Some tools key the MAC for an empty passphrase with no bytes at all,
+	// rather than the terminator alone.
+	if check(password) || (passphrase == "" && check(nil)) {
+		return nil
+	}
+	return errWrongPassphrase
+}
+
+// p12Decrypt decrypts something in a bundle with the passphrase, with the
+// algorithm that it was encrypted with.
+func p12Decrypt(alg pkix.AlgorithmIdentifier, data []byte, passphrase string) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case alg.Algorithm.Equal(oidPBE3DES):
+		var params p12PBEParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("bad encryption parameters: %s", err)
+		}
+		password := bmpPassphrase(passphrase)
+		key := p12KDF(sha1.New, params.Salt, password, params.Iterations, 1, 24)
+		iv = p12KDF(sha1.New, params.Salt, password, params.Iterations, 2, 8)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBES2):
+		var err error
+		if block, iv, err = pbes2Cipher(alg, passphrase); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption %s; re-export the bundle with AES or triple DES", alg.Algorithm)
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, errWrongPassphrase
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	// Take off the PKCS#7 padding, which only comes out right with the
+	// right passphrase.
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errWrongPassphrase
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, errWrongPassphrase
+		}
+	}
+	return out[:len(out)-pad], nil
+}
+
+// pbes2Cipher derives the AES key for PBES2 encryption from the passphrase
+// with PBKDF2, and returns the cipher and its IV. Unlike the older PKCS#12
+// algorithms, PBES2 takes the passphrase as it is, not as UTF-16.
+func pbes2Cipher(alg pkix.AlgorithmIdentifier, passphrase string) (cipher.Block, []byte, error) {
+	var params p12PBES2Params
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, fmt.Errorf("bad encryption parameters: %s", err)
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported key derivation %s", params.KDF.Algorithm)
+	}
+	var kdf p12PBKDF2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("bad key derivation parameters: %s", err)
+	}
+	var h func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		h = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		h = sha256.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported key derivation hash %s", kdf.PRF.Algorithm)
+	}
+	var size int
+	switch {
+	case params.Scheme.Algorithm.Equal(oidAES128CBC):
+		size = 16
+	case params.Scheme.Algorithm.Equal(oidAES256CBC):
+		size = 32
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption %s; re-export the bundle with AES or triple DES", params.Scheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("bad encryption parameters: %s", err)
+	}
+	key, err := pbkdf2.Key(h, passphrase, kdf.Salt, kdf.Iterations, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, iv, nil
+}
+
+// p12Hash returns the hash for a MAC's digest algorithm.
+func p12Hash(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidSHA256):
+		return sha256.New, nil
+	}
+	return nil, fmt.Errorf("unsupported MAC algorithm %s", oid)
+}
+
+// bmpPassphrase encodes a passphrase the way PKCS#12's own key derivation
+// takes it: as big-endian UTF-16, with a zero terminator.
+func bmpPassphrase(s string) []byte {
+	var ret []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		ret = append(ret, byte(c>>8), byte(c))
+	}
+	return append(ret, 0, 0)
+}
+
+// p12KDF derives size bytes of key material for the given purpose (1 for a
+// key, 2 for an IV, 3 for a MAC key) from a password and salt, as in RFC
+// 7292, appendix B.2.
+func p12KDF(h func() hash.Hash, salt, password []byte, iterations int, id byte, size int) []byte {
+	const v = 64 // the block size of SHA-1 and SHA-256
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		ret := make([]byte, v*((len(b)+v-1)/v))
+		for i := range ret {
+			ret[i] = b[i%len(b)]
+		}
+		return ret
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	in := append(fill(salt), fill(password)...)
+
+	var ret []byte
+	for len(ret) < size {
+		a := h()
+		a.Write(d)
+		a.Write(in)
+		sum := a.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			a.Reset()
+			a.Write(sum)
+			sum = a.Sum(nil)
+		}
+		ret = append(ret, sum...)
+		// Each v-byte block of the input gets the sum, repeated out to v
+		// bytes, plus one added to it, for the next round.
+		for j := 0; j < len(in); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(in[j+k]) + int(sum[k%len(sum)])
+				in[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+	return ret[:size]
+}
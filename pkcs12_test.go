@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testContentInfo and testSafeBag are p12ContentInfo and p12SafeBag, with
+// their [0] tags spelled out, for encoding.
+type testContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type testSafeBag struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+func explicit0(inner []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	buf, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// encodePKCS12 makes a PKCS#12 bundle of a client cert and its key, the
+// way openssl pkcs12 -export does: with AES and a SHA-256 MAC like newer
+// versions, or with triple DES and a SHA-1 MAC like older ones.
+func encodePKCS12(t *testing.T, cert tls.Certificate, passphrase string, useAES bool) []byte {
+	t.Helper()
+	const iterations = 2048
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	encrypt := func(plain []byte) (pkix.AlgorithmIdentifier, []byte) {
+		salt := random(8)
+		var alg pkix.AlgorithmIdentifier
+		var block cipher.Block
+		var iv []byte
+		if useAES {
+			iv = random(aes.BlockSize)
+			key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block, err = aes.NewCipher(key); err != nil {
+				t.Fatal(err)
+			}
+			kdf := p12PBKDF2Params{Salt: salt, Iterations: iterations, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue}}
+			params := p12PBES2Params{
+				KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: marshal(t, kdf)}},
+				Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: marshal(t, iv)}},
+			}
+			alg = pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: marshal(t, params)}}
+		} else {
+			password := bmpPassphrase(passphrase)
+			iv = p12KDF(sha1.New, salt, password, iterations, 2, 8)
+			var err error
+			if block, err = des.NewTripleDESCipher(p12KDF(sha1.New, salt, password, iterations, 1, 24)); err != nil {
+				t.Fatal(err)
+			}
+			params := p12PBEParams{Salt: salt, Iterations: iterations}
+			alg = pkix.AlgorithmIdentifier{Algorithm: oidPBE3DES, Parameters: asn1.RawValue{FullBytes: marshal(t, params)}}
+		}
+		pad := block.BlockSize() - len(plain)%block.BlockSize()
+		out := append([]byte(nil), plain...)
+		for i := 0; i < pad; i++ {
+			out = append(out, byte(pad))
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+		return alg, out
+	}
+
+	// The key goes in a shrouded key bag, in a plain safe.
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alg, enc := encrypt(keyDER)
+	keyBag := testSafeBag{ID: oidShroudedKeyBag, Value: explicit0(marshal(t, p12Shrouded{alg, enc}))}
+	keySafe := testContentInfo{ContentType: oidData, Content: explicit0(marshal(t, marshal(t, []testSafeBag{keyBag})))}
+
+	// The certs go in cert bags, in an encrypted safe.
+	var certBags []testSafeBag
+	for _, der := range cert.Certificate {
+		certBag := struct {
+			ID   asn1.ObjectIdentifier
+			Data asn1.RawValue
+		}{oidX509Cert, explicit0(marshal(t, der))}
+		certBags = append(certBags, testSafeBag{ID: oidCertBag, Value: explicit0(marshal(t, certBag))})
+	}
+	alg, enc = encrypt(marshal(t, certBags))
+	encrypted := struct {
+		Version int
+		Info    struct {
+			ContentType asn1.ObjectIdentifier
+			Algorithm   pkix.AlgorithmIdentifier
+			Content     asn1.RawValue
+		}
+	}{}
+	encrypted.Info.ContentType = oidData
+	encrypted.Info.Algorithm = alg
+	encrypted.Info.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: enc}
+	certSafe := testContentInfo{ContentType: oidEncryptedData, Content: explicit0(marshal(t, encrypted))}
+
+	authSafe := marshal(t, []testContentInfo{certSafe, keySafe})
+	var mac p12MacData
+	var h func() hash.Hash
+	if useAES {
+		h, mac.Mac.Algorithm.Algorithm = sha256.New, oidSHA256
+	} else {
+		h, mac.Mac.Algorithm.Algorithm = sha1.New, oidSHA1
+	}
+	mac.Mac.Algorithm.Parameters = asn1.NullRawValue
+	mac.MacSalt, mac.Iterations = random(8), iterations
+	m := hmac.New(h, p12KDF(h, mac.MacSalt, bmpPassphrase(passphrase), iterations, 3, h().Size()))
+	m.Write(authSafe)
+	mac.Mac.Digest = m.Sum(nil)
+	return marshal(t, struct {
+		Version  int
+		AuthSafe testContentInfo
+		MacData  p12MacData
+	}{3, testContentInfo{ContentType: oidData, Content: explicit0(marshal(t, authSafe))}, mac})
+}
+
+func TestDecodePKCS12(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	client, _, _ := ca.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	client.Certificate = append(client.Certificate, ca.cert.Raw)
+
+	for _, useAES := range []bool{true, false} {
+		for _, passphrase := range []string{"correct horse", "", "pässwörd"} {
+			buf := encodePKCS12(t, client, passphrase, useAES)
+			got, err := decodePKCS12(buf, passphrase)
+			if err != nil {
+				t.Errorf("aes=%t, %q: %s", useAES, passphrase, err)
+				continue
+			}
+			if len(got.Certificate) != 2 || string(got.Certificate[0]) != string(client.Certificate[0]) || string(got.Certificate[1]) != string(ca.cert.Raw) {
+				t.Errorf("aes=%t, %q: got the wrong certs", useAES, passphrase)
+			}
+			gotKey, _ := x509.MarshalPKCS8PrivateKey(got.PrivateKey)
+			wantKey, _ := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+			if string(got.Leaf.Raw) != string(client.Certificate[0]) || string(gotKey) != string(wantKey) {
+				t.Errorf("aes=%t, %q: got the wrong leaf or key", useAES, passphrase)
+			}
+			if _, err := decodePKCS12(buf, passphrase+"x"); err != errWrongPassphrase {
+				t.Errorf("aes=%t, %q: with the wrong passphrase, got %v", useAES, passphrase, err)
+			}
+		}
+	}
+
+	for _, buf := range [][]byte{nil, []byte("not a bundle"), client.Certificate[0]} {
+		if _, err := decodePKCS12(buf, ""); err == nil || !strings.Contains(err.Error(), "not a PKCS#12 bundle") {
+			t.Errorf("%.10q: got %v", buf, err)
+		}
+	}
+}
+
+func TestClientPKCS12(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	server, _, _ := ca.issue(t, "logstash", x509.ExtKeyUsageServerAuth)
+	client, _, _ := ca.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					got <- r.Text()
+				}
+			}()
+		}
+	}()
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem())
+	p12 := writeFile(t, dir, "client.p12", encodePKCS12(t, client, "s3cret", true))
+	t.Setenv("CLIENT_PASS", "s3cret")
+
+	runMux(t, "--logstash", "tls://"+ln.Addr().String(), "--logstash-tls-ca", caFile,
+		"--client-pkcs12", p12, "--client-pkcs12-passphrase-env", "CLIENT_PASS",
+		pipeSpec(t, "app", []string{"one"}))
+	select {
+	case line := <-got:
+		if line != "app: one" {
+			t.Errorf("got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing over TLS with a client cert")
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-pkcs12", p12}, "wrong passphrase, or a corrupt bundle, for the passphrase in $LOGMUX_PKCS12_PASSPHRASE"},
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-pkcs12", caFile, "--client-pkcs12-passphrase-env", "CLIENT_PASS"}, "not a PKCS#12 bundle"},
+		{[]string{"--logstash", "tls://" + ln.Addr().String(), "--client-pkcs12", dir + "/missing.p12"}, "no such file"},
+		{[]string{"--logstash", "tcp://localhost:5000", "--client-pkcs12", p12}, "--client-pkcs12 needs a tls:// logstash"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTestArgs(append(tt.args, "0:app")...); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tagQuota is a daily byte quota for a single tag. Once it's used up, the
+// tag's lines are dropped until the window resets.
+type tagQuota struct {
+	limit int64
+
+	sync.Mutex
+	used   int64
+	resets time.Time
+	// dropping is set once a line's been dropped in the current window,
+	// so that the notice only goes out for the first.
+	dropping bool
+}
+
+// tagQuotas are the --tag-quota quotas, by tag.
+type tagQuotas map[string]*tagQuota
+
+// We can parse command line flags directly into a tagQuotas value
+var _ flag.Value = (*tagQuotas)(nil)
+
+// Set adds a tag=bytes/day quota as read in from the command line. The
+// /day is optional.
+func (q *tagQuotas) Set(r string) error {
+	parts := strings.SplitN(r, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("bad tag quota %q; want tag=bytes/day", r)
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(parts[1], "/day"), 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("bad tag quota %q; want tag=bytes/day", r)
+	}
+	if *q == nil {
+		*q = make(tagQuotas)
+	}
+	(*q)[parts[0]] = &tagQuota{limit: n}
+	return nil
+}
+
+// String representation of the tag quotas
+func (q *tagQuotas) String() string {
+	var parts []string
+	for tag, tq := range *q {
+		parts = append(parts, fmt.Sprintf("%s=%d/day", tag, tq.limit))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// nextReset returns when a quota window that starts at now ends. Calendar
+// windows end at the next local midnight; rolling windows last 24 hours
+// from the first line they count.
+func nextReset(now time.Time, window string) time.Time {
+	if window == "calendar" {
+		y, m, d := now.Date()
+		return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	}
+	return now.Add(24 * time.Hour)
+}
+
+// take counts n bytes for the given tag at the given time. It returns false
+// if the bytes are over the tag's quota, in which case the line should be
+// dropped; first is true for the first line dropped in a window. Tags
+// without a quota always fit.
+func (q tagQuotas) take(tag string, n int, now time.Time, window string) (ok bool, first bool) {
+	tq := q[tag]
+	if tq == nil {
+		return true, false
+	}
+	tq.Lock()
+	defer tq.Unlock()
+	if !now.Before(tq.resets) {
+		tq.used, tq.resets, tq.dropping = 0, nextReset(now, window), false
+	}
+	if tq.used+int64(n) > tq.limit {
+		// A line that doesn't fit uses up what's left, so that the tag
+		// doesn't trickle on with shorter lines.
+		tq.used = tq.limit
+		first = !tq.dropping
+		tq.dropping = true
+		return false, first
+	}
+	tq.used += int64(n)
+	return true, false
+}
+
+// quotaNotice is the event sent once per window when a tag runs over its
+// quota.
+func (o *Options) quotaNotice(tag string) []byte {
+	tq := o.tagQuotas[tag]
+	tq.Lock()
+	resets := tq.resets
+	tq.Unlock()
+	body := fmt.Sprintf("{%s:%s,\"logmux_quota_bytes\":%d,\"logmux_quota_resets\":%q}", jsonString([]byte(o.messageField)),
+		jsonString([]byte("daily quota exceeded; dropping lines until it resets")), tq.limit, resets.Format(time.RFC3339))
+	return o.ownEvent([]byte(body), tag)
+}
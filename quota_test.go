@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagQuotaFlag(t *testing.T) {
+	var q tagQuotas
+	for _, v := range []string{"app=100", "web=2048/day"} {
+		if err := q.Set(v); err != nil {
+			t.Fatalf("%s: %s", v, err)
+		}
+	}
+	if got := q.String(); got != "app=100/day,web=2048/day" {
+		t.Errorf("got %s", got)
+	}
+	for _, v := range []string{"app", "=100", "app=", "app=0", "app=-5", "app=100/hour", "app=lots"} {
+		if err := q.Set(v); err == nil {
+			t.Errorf("%s: no error", v)
+		}
+	}
+}
+
+func TestTagQuotaWindows(t *testing.T) {
+	day := time.Date(2024, 3, 9, 22, 0, 0, 0, time.UTC)
+	type take struct {
+		at        time.Duration
+		n         int
+		ok, first bool
+	}
+	tests := []struct {
+		window string
+		takes  []take
+	}{
+		{"calendar", []take{
+			{0, 40, true, false},
+			{time.Minute, 60, true, false},
+			// The quota's used up exactly, so the next line is over it,
+			// and it's the first one dropped.
+			{2 * time.Minute, 1, false, true},
+			{3 * time.Minute, 1, false, false},
+			{time.Hour, 50, false, false},
+			// Midnight starts a new window.
+			{2 * time.Hour, 50, true, false},
+			{2*time.Hour + time.Minute, 50, true, false},
+			{2*time.Hour + 2*time.Minute, 1, false, true},
+		}},
+		{"calendar", []take{
+			{0, 90, true, false},
+			// A line that doesn't fit uses up what's left, so smaller ones
+			// after it are dropped too.
+			{time.Minute, 20, false, true},
+			{2 * time.Minute, 5, false, false},
+		}},
+		{"rolling", []take{
+			{0, 100, true, false},
+			{time.Minute, 1, false, true},
+			// Midnight means nothing to a rolling window...
+			{2 * time.Hour, 1, false, false},
+			// ...which lasts a day from its first line.
+			{24*time.Hour - time.Second, 1, false, false},
+			{24 * time.Hour, 100, true, false},
+			{24*time.Hour + time.Second, 1, false, true},
+		}},
+	}
+	for _, tt := range tests {
+		q := tagQuotas{"app": {limit: 100}}
+		for i, tk := range tt.takes {
+			ok, first := q.take("app", tk.n, day.Add(tk.at), tt.window)
+			if ok != tk.ok || first != tk.first {
+				t.Errorf("%s: take %d of %d bytes at +%s = %t, %t, want %t, %t", tt.window, i, tk.n, tk.at, ok, first, tk.ok, tk.first)
+			}
+		}
+		if ok, _ := q.take("other", 1<<30, day, tt.window); !ok {
+			t.Errorf("%s: a tag without a quota was dropped", tt.window)
+		}
+	}
+}
+
+func TestTagQuotaDropsLines(t *testing.T) {
+	c := captureTCP(t)
+	runMux(t, "--logstash", c.url().String(), "--tag-quota", "app=40",
+		pipeSpec(t, "app", []string{"first line", "second line", "third line", "fourth line"}),
+		pipeSpec(t, "web", []string{"web line"}))
+	var app []string
+	for _, ln := range c.lines(t, 0, 4) {
+		if !strings.HasPrefix(ln, "web: ") {
+			app = append(app, ln)
+		}
+	}
+	if len(app) != 3 || app[0] != "app: first line" || app[1] != "app: second line" {
+		t.Fatalf("got %q, want two lines and a notice", app)
+	}
+	if msg := eventField(t, app[2], "message"); msg != "daily quota exceeded; dropping lines until it resets" {
+		t.Errorf("got notice %s", app[2])
+	}
+	if limit := eventField(t, app[2], "logmux_quota_bytes"); limit != float64(40) {
+		t.Errorf("notice has a limit of %v", limit)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// backoff is how a stream's writes to logstash are retried once they fail,
+// each on a new connection, for --reconnect-backoff: after waiting first,
+// and then twice as long each time, up to max, for up to attempts tries.
+// With no first wait, a failed write isn't retried. A stream's own
+// reconnect-* options override the global flags one by one, and any it
+// doesn't set are negative until they're filled in from them.
+type backoff struct {
+	first    time.Duration
+	max      time.Duration
+	attempts int
+}
+
+// reconnectSleep waits out a backoff; it's swapped out by tests.
+var reconnectSleep = time.Sleep
+
+// set parses one of a stream's reconnect-* options.
+func (b *backoff) set(key, val string) error {
+	if key == "reconnect-attempts" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad stream %s: %s", key, val)
+		}
+		b.attempts = n
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return fmt.Errorf("bad stream %s: %s", key, val)
+	}
+	if key == "reconnect-backoff" {
+		b.first = d
+	} else {
+		b.max = d
+	}
+	return nil
+}
+
+// withDefaults fills in whatever a stream didn't set from the global
+// --reconnect-* flags, d. Either can be nil.
+func (b *backoff) withDefaults(d *backoff) *backoff {
+	if b == nil || d == nil {
+		return d
+	}
+	ret := *b
+	if ret.first < 0 {
+		ret.first = d.first
+	}
+	if ret.max < 0 {
+		ret.max = d.max
+	}
+	if ret.attempts < 0 {
+		ret.attempts = d.attempts
+	}
+	return &ret
+}
+
+// wait returns how long to wait before the given retry, counting from 0.
+func (b *backoff) wait(retry int) time.Duration {
+	d := b.first
+	for i := 0; i < retry && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return d
+}
+
+// write writes a stream's events to its logstash, and acks them. If the
+// write fails, and the stream has a reconnect backoff, the connection is
+// closed, and the events are written again over a new one once the backoff
+// has passed, until they go through or the attempts run out. Events that a
+// sink has taken to send later (along with their acks), like those in a
+// half-packed datagram, aren't written again.
+func (m *Mux) write(s Stream, evs []event) error {
+	l := m.sink(s)
+	err := l.writeAll(evs)
+	b := s.Options().reconnect
+	for retry := 0; err != nil && b != nil && b.first > 0 && retry < b.attempts; retry++ {
+		wait := b.wait(retry)
+		fmt.Fprintf(os.Stderr, "%s: couldn't write to logstash (%s); reconnecting in %s\n", s.Tag(), err, wait)
+		l.reconnect(err)
+		reconnectSleep(wait)
+		var unsent []event
+		var at []int
+		for i, ev := range evs {
+			if ev.ack != nil {
+				unsent, at = append(unsent, ev), append(at, i)
+			}
+		}
+		err = l.writeAll(unsent)
+		for j, i := range at {
+			evs[i].ack = unsent[j].ack
+		}
+	}
+	ackEvents(evs, err)
+	return err
+}
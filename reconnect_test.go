@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffSchedule(t *testing.T) {
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--reconnect-backoff", "10ms", "--reconnect-backoff-max", "50ms",
+		"0:global", "1:slow;reconnect-backoff=1s;reconnect-backoff-max=1m;reconnect-attempts=8", "2:capped;reconnect-backoff-max=20ms", "3:off;reconnect-backoff=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"global": "10ms,20ms,40ms,50ms,50ms",
+		"slow":   "1s,2s,4s,8s,16s,32s,1m0s,1m0s",
+		"capped": "10ms,20ms,20ms,20ms,20ms",
+		"off":    "",
+	}
+	for _, s := range m.streams {
+		b := s.Options().reconnect
+		var waits []string
+		for i := 0; b.first > 0 && i < b.attempts; i++ {
+			waits = append(waits, b.wait(i).String())
+		}
+		if got := strings.Join(waits, ","); got != want[s.Tag()] {
+			t.Errorf("%s: got %s, want %s", s.Tag(), got, want[s.Tag()])
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--reconnect-backoff", "-1s"},
+		{"--reconnect-backoff-max", "-1s"},
+		{"--reconnect-attempts", "-1"},
+		{"0:app;reconnect-backoff=soon"},
+		{"0:app;reconnect-backoff-max=-1s"},
+		{"0:app;reconnect-attempts=many"},
+	} {
+		if _, err := parseTestArgs(append([]string{"--logstash", "tcp://localhost:5000"}, args...)...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestReconnectPerStream(t *testing.T) {
+	var waits []string
+	saved := reconnectSleep
+	defer func() { reconnectSleep = saved }()
+	reconnectSleep = func(d time.Duration) { waits = append(waits, d.String()) }
+
+	// Nothing's listening, so every dial fails.
+	addr := freeAddr(t)
+	m, err := parseTestArgs("--logstash", "tcp://"+addr, "--reconnect-backoff", "10ms", "--reconnect-backoff-max", "20ms", "--reconnect-attempts", "3",
+		"0:error", "1:debug;reconnect-backoff=1s;reconnect-backoff-max=4s;reconnect-attempts=4", "2:off;reconnect-backoff=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"error": "10ms,20ms,20ms",
+		"debug": "1s,2s,4s,4s",
+		"off":   "",
+	}
+	for _, s := range m.streams {
+		waits = nil
+		if err := m.writeLine(s, []byte("lost"), time.Now()); err == nil {
+			t.Errorf("%s: no error", s.Tag())
+		}
+		if got := strings.Join(waits, ","); got != want[s.Tag()] {
+			t.Errorf("%s: waited %s, want %s", s.Tag(), got, want[s.Tag()])
+		}
+	}
+
+	// logstash comes up during the second wait, and takes the line once.
+	lines := make(chan string, 10)
+	reconnectSleep = func(d time.Duration) {
+		waits = append(waits, d.String())
+		if len(waits) != 2 {
+			return
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for r := bufio.NewScanner(conn); r.Scan(); {
+				lines <- r.Text()
+			}
+		}()
+	}
+	waits = nil
+	if err := m.writeLine(m.streams[1], []byte("kept"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(waits, ","); got != "1s,2s" {
+		t.Errorf("waited %s", got)
+	}
+	select {
+	case got := <-lines:
+		if got != "debug: kept" {
+			t.Errorf("got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line")
+	}
+	m.closeSinks()
+	select {
+	case got := <-lines:
+		t.Errorf("got %q again", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
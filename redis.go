@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// redisWriter RPUSHes events onto a redis list, for logstash's redis input
+// (with data_type => "list") to pop them off of, for redis://host:port/key
+// URLs. That input's codec is json by default, so plain events are wrapped
+// into JSON, with the line under messageField.
+type redisWriter struct {
+	conn         net.Conn
+	key          string
+	messageField string
+	replies      *bufio.Reader
+}
+
+// newRedisWriter starts talking to redis over conn, authenticating with the
+// URL's password (and username, for a redis with ACLs) if it has one.
+func newRedisWriter(conn net.Conn, u *url.URL, messageField string) (*redisWriter, error) {
+	r := &redisWriter{
+		conn:         conn,
+		key:          strings.TrimPrefix(u.Path, "/"),
+		messageField: messageField,
+		replies:      bufio.NewReader(conn),
+	}
+	if pass, ok := u.User.Password(); ok {
+		args := []string{"AUTH", pass}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, pass}
+		}
+		var cmd bytes.Buffer
+		writeRedisCommand(&cmd, args)
+		if _, err := conn.Write(cmd.Bytes()); err != nil {
+			return nil, err
+		}
+		if _, err := r.reply(); err != nil {
+			return nil, fmt.Errorf("redis AUTH: %s", err)
+		}
+	}
+	return r, nil
+}
+
+func openRedis(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	return newRedisWriter(conn, s.url, s.opts.messageField)
+}
+
+// checkRedis checks that a redis:// URL names the list to push onto.
+func checkRedis(s *LogstashService) error {
+	if strings.Trim(s.url.Path, "/") == "" {
+		return fmt.Errorf("bad --logstash value: %s; want redis://<hostname>:<port>/<key>", s.redacted())
+	}
+	return nil
+}
+
+// writeRedisCommand writes a command to buf as a RESP array of bulk strings.
+func writeRedisCommand(buf *bytes.Buffer, args []string) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// writeEvents pushes events with a single RPUSH, one list entry apiece, and
+// doesn't return until redis has them.
+func (r *redisWriter) writeEvents(evs []event) error {
+	args := []string{"RPUSH", r.key}
+	for _, ev := range evs {
+		args = append(args, string(jsonEvent(ev, r.messageField)))
+	}
+	var cmd bytes.Buffer
+	writeRedisCommand(&cmd, args)
+	if _, err := r.conn.Write(cmd.Bytes()); err != nil {
+		return err
+	}
+	if _, err := r.reply(); err != nil {
+		return fmt.Errorf("redis RPUSH: %s", err)
+	}
+	return nil
+}
+
+// reply reads a simple string or integer reply off of the connection, and
+// turns an error reply into an error.
+func (r *redisWriter) reply() (string, error) {
+	line, err := r.replies.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	}
+	return "", fmt.Errorf("unexpected reply: %s", strconv.Quote(line))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis takes RESP commands, answering AUTH with the given password and
+// RPUSH with the length of the list, and records them.
+type fakeRedis struct {
+	sync.Mutex
+	ln       net.Listener
+	password string
+	cmds     [][]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &fakeRedis{ln: ln, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	pushed := 0
+	for {
+		cmd, err := readRedisCommand(br)
+		if err != nil {
+			return
+		}
+		r.Lock()
+		r.cmds = append(r.cmds, cmd)
+		r.Unlock()
+		switch cmd[0] {
+		case "AUTH":
+			if cmd[len(cmd)-1] != r.password {
+				io.WriteString(conn, "-WRONGPASS invalid username-password pair\r\n")
+				continue
+			}
+			io.WriteString(conn, "+OK\r\n")
+		case "RPUSH":
+			pushed += len(cmd) - 2
+			fmt.Fprintf(conn, ":%d\r\n", pushed)
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// readRedisCommand reads a RESP array of bulk strings.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		ret = append(ret, string(buf[:size]))
+	}
+	return ret, nil
+}
+
+// pushed returns everything RPUSHed onto key.
+func (r *fakeRedis) pushed(key string) []string {
+	r.Lock()
+	defer r.Unlock()
+	var ret []string
+	for _, cmd := range r.cmds {
+		if cmd[0] == "RPUSH" && cmd[1] == key {
+			ret = append(ret, cmd[2:]...)
+		}
+	}
+	return ret
+}
+
+func TestRedisSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		user     string
+		auth     string
+	}{
+		{"no password", "", "", ""},
+		{"password", "s3cret", ":s3cret@", "AUTH s3cret"},
+		{"ACL user", "s3cret", "app:s3cret@", "AUTH app s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRedis(t, tt.password)
+			runMux(t, "--logstash", "redis://"+tt.user+r.ln.Addr().String()+"/logs", "--message-field", "msg",
+				pipeSpec(t, "app", []string{"one", `{"n":2}`, "three"}))
+			want := []string{`{"msg":"one","tag":"app"}`, `{"n":2,"tag":"app"}`, `{"msg":"three","tag":"app"}`}
+			if got := r.pushed("logs"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("pushed %q, want %q", got, want)
+			}
+			r.Lock()
+			defer r.Unlock()
+			if got := strings.Join(r.cmds[0], " "); tt.auth != "" && got != tt.auth {
+				t.Errorf("first command was %q, want %q", got, tt.auth)
+			}
+		})
+	}
+}
+
+func TestRedisSinkErrors(t *testing.T) {
+	r := newFakeRedis(t, "s3cret")
+	m, err := parseTestArgs("--logstash", "redis://:wrong@"+r.ln.Addr().String()+"/logs", "0:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logstash.Open(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("got %v, want an AUTH error", err)
+	}
+	if _, err := parseTestArgs("--logstash", "redis://"+r.ln.Addr().String(), "0:app"); err == nil {
+		t.Error("no error for a redis:// URL without a key")
+	}
+}
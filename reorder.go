@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"time"
+)
+
+// eventTimestamp returns the @timestamp of a JSON line, if it has one.
+func eventTimestamp(buf []byte) (time.Time, bool) {
+	buf = bytes.TrimSpace(buf)
+	if !looksLikeObject(buf) {
+		return time.Time{}, false
+	}
+	var ev struct {
+		Timestamp string `json:"@timestamp"`
+	}
+	if json.Unmarshal(buf, &ev) != nil || ev.Timestamp == "" {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, ev.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// held is a line held back in a reorderer, waiting to be released.
+type held struct {
+	line
+	ts       time.Time
+	seq      int
+	released bool
+}
+
+// heldHeap orders held lines by timestamp, and by arrival for equal
+// timestamps, so that reordering is stable.
+type heldHeap []*held
+
+func (h heldHeap) Len() int { return len(h) }
+func (h heldHeap) Less(i, j int) bool {
+	if h[i].ts.Equal(h[j].ts) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].ts.Before(h[j].ts)
+}
+func (h heldHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *heldHeap) Push(x interface{}) { *h = append(*h, x.(*held)) }
+func (h *heldHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// reorderer holds timestamped lines for up to a window after they arrive,
+// and releases them in timestamp order. When the oldest line's window is up,
+// it's released along with every held line with an earlier timestamp, so no
+// line is held for much longer than the window.
+type reorderer struct {
+	window  time.Duration
+	byTime  heldHeap
+	arrived []*held
+	seq     int
+}
+
+// push holds a line with the given timestamp.
+func (r *reorderer) push(ln line, ts time.Time) {
+	h := &held{line: ln, ts: ts, seq: r.seq}
+	r.seq++
+	heap.Push(&r.byTime, h)
+	r.arrived = append(r.arrived, h)
+}
+
+// expired releases the lines whose window is up as of now, in timestamp
+// order.
+func (r *reorderer) expired(now time.Time) []line {
+	var ret []line
+	for len(r.arrived) > 0 && now.Sub(r.arrived[0].at) >= r.window {
+		oldest := r.arrived[0]
+		r.arrived = r.arrived[1:]
+		for !oldest.released {
+			h := heap.Pop(&r.byTime).(*held)
+			h.released = true
+			ret = append(ret, h.line)
+		}
+	}
+	return ret
+}
+
+// flush releases all held lines, in timestamp order.
+func (r *reorderer) flush() []line {
+	var ret []line
+	for r.byTime.Len() > 0 {
+		ret = append(ret, heap.Pop(&r.byTime).(*held).line)
+	}
+	r.arrived = nil
+	return ret
+}
+
+// writeLines writes out lines released from a reorderer.
+func (m *Mux) writeLines(s Stream, lines []line) error {
+	for _, ln := range lines {
+		if err := m.writeLine(s, ln.buf, ln.at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventTimestamp(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"@timestamp":"2024-01-02T03:04:05Z","n":1}`, "2024-01-02T03:04:05Z"},
+		{`  {"@timestamp":"2024-01-02T03:04:05.123456+01:00"}` + "\n", "2024-01-02T02:04:05.123456Z"},
+		{`{"n":1}`, ""},
+		{`{"@timestamp":""}`, ""},
+		{`{"@timestamp":"yesterday"}`, ""},
+		{`{"@timestamp":1704164645}`, ""},
+		{`{"@timestamp":"2024-01-02T03:04:05Z"`, ""},
+		{`app: {"@timestamp":"2024-01-02T03:04:05Z"}`, ""},
+	}
+	for _, tt := range tests {
+		ts, ok := eventTimestamp([]byte(tt.line))
+		if ok != (tt.want != "") {
+			t.Errorf("%s: ok = %t", tt.line, ok)
+			continue
+		}
+		if ok && ts.UTC().Format(time.RFC3339Nano) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.line, ts.UTC().Format(time.RFC3339Nano), tt.want)
+		}
+	}
+}
+
+func TestReorderer(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	// A push is a line named for its timestamp, in seconds after start,
+	// arriving some milliseconds after start; a check is when expired is
+	// called, in milliseconds, and the lines it should release.
+	type push struct {
+		arrives int
+		name    string
+		ts      int
+	}
+	type check struct {
+		at   int
+		want string
+	}
+	tests := []struct {
+		name   string
+		pushes []push
+		checks []check
+		flush  string
+	}{
+		{
+			name:   "in order",
+			pushes: []push{{0, "a", 1}, {10, "b", 2}, {20, "c", 3}},
+			checks: []check{{99, ""}, {100, "a"}, {115, "b"}, {200, "c"}},
+		},
+		{
+			name:   "out of order within the window",
+			pushes: []push{{0, "b", 2}, {10, "a", 1}, {20, "c", 3}},
+			checks: []check{{100, "a b"}, {119, ""}, {120, "c"}},
+		},
+		{
+			// The oldest arrival takes every earlier timestamp with it,
+			// even ones that have only just arrived.
+			name:   "late arrival with an early timestamp",
+			pushes: []push{{0, "c", 3}, {50, "b", 2}, {90, "a", 1}},
+			checks: []check{{100, "a b c"}, {200, ""}},
+		},
+		{
+			// A later timestamp stays held until its own window is up.
+			name:   "later timestamps stay held",
+			pushes: []push{{0, "b", 2}, {50, "c", 3}, {60, "a", 1}},
+			checks: []check{{100, "a b"}, {149, ""}, {150, "c"}},
+		},
+		{
+			name:   "equal timestamps keep their arrival order",
+			pushes: []push{{0, "x", 5}, {1, "y", 5}, {2, "z", 5}, {3, "w", 4}},
+			checks: []check{{100, "w x"}, {102, "y z"}},
+		},
+		{
+			name:   "flush releases everything still held",
+			pushes: []push{{0, "c", 3}, {10, "a", 1}, {20, "b", 2}, {500, "d", 4}},
+			checks: []check{{100, "a b c"}},
+			flush:  "d",
+		},
+		{
+			name:   "flush without expiry",
+			pushes: []push{{0, "c", 3}, {10, "a", 1}, {20, "b", 2}},
+			flush:  "a b c",
+		},
+		{
+			name:  "nothing held",
+			flush: "",
+		},
+	}
+	names := func(lines []line) string {
+		var ret []string
+		for _, ln := range lines {
+			ret = append(ret, string(ln.buf))
+		}
+		return strings.Join(ret, " ")
+	}
+	for _, tt := range tests {
+		r := &reorderer{window: 100 * time.Millisecond}
+		pushed := 0
+		pushUntil := func(ms int) {
+			for ; pushed < len(tt.pushes) && tt.pushes[pushed].arrives <= ms; pushed++ {
+				p := tt.pushes[pushed]
+				ln := line{buf: []byte(p.name), at: start.Add(time.Duration(p.arrives) * time.Millisecond)}
+				r.push(ln, start.Add(time.Duration(p.ts)*time.Second))
+			}
+		}
+		for _, c := range tt.checks {
+			pushUntil(c.at)
+			if got := names(r.expired(start.Add(time.Duration(c.at) * time.Millisecond))); got != c.want {
+				t.Errorf("%s: expired at %dms = %q, want %q", tt.name, c.at, got, c.want)
+			}
+		}
+		pushUntil(math.MaxInt32)
+		if got := names(r.flush()); got != tt.flush {
+			t.Errorf("%s: flush = %q, want %q", tt.name, got, tt.flush)
+		}
+		if got := names(r.flush()); got != "" {
+			t.Errorf("%s: second flush = %q", tt.name, got)
+		}
+	}
+}
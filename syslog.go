@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// syslogFacilities are the facility names that --syslog-facility takes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogInfo is the severity that all of our messages go out with.
+const syslogInfo = 6
+
+// syslogTime is RFC 5424's TIMESTAMP, which allows up to microseconds.
+const syslogTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// syslogName makes s fit a syslog header field: printable ASCII without
+// spaces, at most max bytes long, and "-" (the nil value) if it's empty.
+func syslogName(s string, max int) string {
+	ret := []byte(s)
+	for i, c := range ret {
+		if c < 33 || c > 126 {
+			ret[i] = '_'
+		}
+	}
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	if len(ret) == 0 {
+		return "-"
+	}
+	return string(ret)
+}
+
+// syslogWriter frames events as syslog messages on their way to a syslog://
+// collector, whatever the other sinks get. With --codec syslog, they're
+// already framed.
+type syslogWriter struct {
+	w    io.Writer
+	opts *Options
+}
+
+func (s syslogWriter) writeEvents(evs []event) error {
+	var buf []byte
+	for _, ev := range evs {
+		if s.opts.codec == "syslog" {
+			buf = append(buf, ev.buf...)
+		} else {
+			buf = append(buf, s.opts.syslogEvent(ev.buf, ev.tag)...)
+		}
+	}
+	_, err := s.w.Write(buf)
+	return err
+}
+
+// openSyslog makes a syslog:// sink over conn.
+func openSyslog(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	s.drain(conn)
+	return syslogWriter{w: conn, opts: s.opts}, nil
+}
+
+// syslogEvent wraps a processed event from the given tag into an RFC 5424
+// syslog message for --codec syslog, with the tag as its APP-NAME and the
+// event as its MSG. Plain events lose their "tag: " prefix, since the tag's
+// in the header. Messages are framed by octet counting (RFC 6587), so that
+// multiline events stay whole.
+func (o *Options) syslogEvent(ev []byte, tag string) []byte {
+	ev = bytes.TrimRight(ev, "\n")
+	if !looksLikeObject(ev) {
+		ev = bytes.TrimPrefix(ev, []byte(tag+": "))
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s - - - ", o.syslogFacility*8+syslogInfo,
+		time.Now().Format(syslogTime), syslogName(o.host, 255), syslogName(tag, 48))
+	msg += string(ev)
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogHeader matches an RFC 5424 message's header, up to its MSG.
+var syslogHeader = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) - - - `)
+
+// readSyslogFrame reads a message framed by octet counting.
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	n, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(n, " "))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestSyslogEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		facility int
+		host     string
+		tag      string
+		ev       string
+		pri      string
+		wantHost string
+		appName  string
+		msg      string
+	}{
+		{"plain", 1, "web-1", "app", "app: hi\n", "14", "web-1", "app", "hi"},
+		{"JSON", 1, "web-1", "app", `{"message":"hi","tag":"app"}` + "\n", "14", "web-1", "app", `{"message":"hi","tag":"app"}`},
+		{"multiline", 1, "web-1", "app", "app: one\n  two\n", "14", "web-1", "app", "one\n  two"},
+		{"local0", 16, "web-1", "app", "app: hi\n", "134", "web-1", "app", "hi"},
+		{"tag with spaces", 1, "web-1", "my app", "my app: hi\n", "14", "web-1", "my_app", "hi"},
+		{"long tag", 1, "web-1", strings.Repeat("a", 60), strings.Repeat("a", 60) + ": hi\n", "14", "web-1", strings.Repeat("a", 48), "hi"},
+		{"no host", 1, "", "app", "app: hi\n", "14", "-", "app", "hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			o.syslogFacility, o.host = tt.facility, tt.host
+			msg, err := readSyslogFrame(bufio.NewReader(strings.NewReader(string(o.syslogEvent([]byte(tt.ev), tt.tag)))))
+			if err != nil {
+				t.Fatalf("bad frame: %s", err)
+			}
+			m := syslogHeader.FindStringSubmatch(msg)
+			if m == nil {
+				t.Fatalf("bad header in %q", msg)
+			}
+			if m[1] != tt.pri || m[3] != tt.wantHost || m[4] != tt.appName {
+				t.Errorf("got PRI %s, HOSTNAME %s, APP-NAME %s", m[1], m[3], m[4])
+			}
+			if _, err := time.Parse(time.RFC3339Nano, m[2]); err != nil {
+				t.Errorf("bad TIMESTAMP %s: %s", m[2], err)
+			}
+			if got := msg[len(m[0]):]; got != tt.msg {
+				t.Errorf("got MSG %q, want %q", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readSyslogFrame(r)
+			if err != nil {
+				return
+			}
+			got <- msg
+		}
+	}()
+	// A mirror that isn't a syslog collector gets the events as they are.
+	mirror := captureTCP(t)
+	runMux(t, "--logstash", "syslog://"+ln.Addr().String(), "--logstash", mirror.url().String(), "--host-override", "web-1", "--syslog-facility", "local0",
+		pipeSpec(t, "app.error", []string{"one", `{"n":2}`}))
+	for _, want := range []string{"one", `{"n":2,"tag":"app.error"}`} {
+		select {
+		case msg := <-got:
+			m := syslogHeader.FindStringSubmatch(msg)
+			if m == nil || m[1] != "134" || m[3] != "web-1" || m[4] != "app.error" || msg[len(m[0]):] != want {
+				t.Errorf("got %q, want MSG %q", msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no message for %q", want)
+		}
+	}
+	if lines := mirror.lines(t, 0, 2); strings.Join(lines, "|") != `app.error: one|{"n":2,"tag":"app.error"}` {
+		t.Errorf("mirror got %q", lines)
+	}
+}
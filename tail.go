@@ -0,0 +1,625 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tailPoll is how often a tailed file that's been read to its end is
+// checked for more lines, and for having been rotated or truncated.
+var tailPoll = 250 * time.Millisecond
+
+// fileID is the device and inode of a file, which stay with it when it's
+// renamed by a log rotation, unlike its path.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// String formats a file ID the way the --state-dir keys it.
+func (f fileID) String() string {
+	return fmt.Sprintf("%d:%d", f.dev, f.ino)
+}
+
+// idOf returns the ID of the file that fi describes.
+func idOf(fi os.FileInfo) fileID {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// tailMark is a spot in a tailed file: the offset just past a line read off
+// of it.
+type tailMark struct {
+	id     fileID
+	offset int64
+}
+
+// TailStream is a subclass of a BaseStream that follows a regular file as
+// it's appended to, like tail -F, as given by a file://<path> specifier.
+// When the file is rotated, the rest of the old one is read before moving
+// on to the new one at the path, and when it's truncated, reading starts
+// over from the top. With --state-dir, how far into the file its lines
+// have been written out is checkpointed, and a restart picks up from there.
+type TailStream struct {
+	BaseStream
+	path string
+
+	// state, if set, is the --state-dir checkpoint that the stream resumes
+	// from, and records its progress in.
+	state *tailState
+
+	// files, if set, is the --max-open-files scheduler that the stream's
+	// file is opened through, which can park the stream by closing it.
+	files *fileScheduler
+
+	// removed is closed once the stream is taken out of the --config file,
+	// to stop it. It's nil for streams from the command line.
+	removed chan struct{}
+
+	// file is the file being read, id its ID, and read how far into it
+	// we've read. The lock guards the file against being closed while
+	// it's read. While the stream is parked, file is nil, and id and read
+	// are where it left off.
+	sync.Mutex
+	file   *os.File
+	id     fileID
+	read   int64
+	closed chan struct{}
+}
+
+// Open a TailStream at its checkpoint, if it has one that's still good, or
+// at the end of the file otherwise, unless its tail-from option says to
+// start at the top. If the file has been rotated since the checkpoint, and
+// the old one is still next to it, what's left of the old one is read
+// first.
+func (t *TailStream) Open() error {
+	return t.files.acquire(t, t.open)
+}
+
+func (t *TailStream) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("%s: %s", t.raw, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %s", t.raw, err)
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return fmt.Errorf("%s: not a regular file", t.raw)
+	}
+	t.file, t.id, t.read = f, idOf(fi), 0
+	if mark, ok := t.state.get(t.path); ok {
+		t.resume(mark, fi)
+	} else if t.opts.tailFrom != "beginning" {
+		t.read = fi.Size()
+	}
+	if t.read > 0 {
+		if _, err := t.file.Seek(t.read, io.SeekStart); err != nil {
+			t.file.Close()
+			return fmt.Errorf("%s: %s", t.raw, err)
+		}
+	}
+	t.closed = make(chan struct{})
+	t.source = newBufferedReader(tailReader{t})
+	return nil
+}
+
+// resume moves the stream to its checkpoint. fi is the file at the path,
+// which is already open.
+func (t *TailStream) resume(mark tailMark, fi os.FileInfo) {
+	if mark.id == t.id {
+		if mark.offset > fi.Size() {
+			fmt.Fprintf(os.Stderr, "%s: truncated since its checkpoint at %d bytes; reading it from the top\n", t.path, mark.offset)
+			return
+		}
+		t.read = mark.offset
+		return
+	}
+	old, ofi := findRotated(t.path, mark.id)
+	if old == nil {
+		fmt.Fprintf(os.Stderr, "%s: rotated since its checkpoint, and the old file is gone; reading the new one from the top\n", t.path)
+		return
+	}
+	if mark.offset >= ofi.Size() {
+		old.Close()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: rotated since its checkpoint; reading the rest of %s first\n", t.path, old.Name())
+	// The new file is opened again once the old one has been read.
+	t.file.Close()
+	t.file, t.id, t.read = old, mark.id, mark.offset
+}
+
+// findRotated looks for the file with the given ID next to path, where a
+// rotation would have left it, and opens it.
+func findRotated(path string, id fileID) (*os.File, os.FileInfo) {
+	dir := filepath.Dir(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		if fi, err := os.Stat(name); err != nil || idOf(fi) != id {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil
+		}
+		// It could have been rotated again since we looked.
+		if fi, err := f.Stat(); err == nil && idOf(fi) == id {
+			return f, fi
+		}
+		f.Close()
+	}
+	return nil, nil
+}
+
+// Preread is called before a TailStream is read from. Its source never
+// ends until the stream is closed, so there's nothing to do until then.
+func (t *TailStream) Preread() error {
+	if t.source == nil {
+		return io.EOF
+	}
+	return nil
+}
+
+// mark returns where the line that was just read off of the stream ends.
+// It's only good right after the read, on the goroutine that made it.
+func (t *TailStream) mark() tailMark {
+	if t.source == nil {
+		return tailMark{}
+	}
+	return tailMark{id: t.id, offset: t.read - int64(t.source.Buffered())}
+}
+
+// close stops the stream's reads, and closes its file.
+func (t *TailStream) close() {
+	t.Lock()
+	if t.closed == nil {
+		t.Unlock()
+		return
+	}
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+		if t.file != nil {
+			t.file.Close()
+		}
+	}
+	t.Unlock()
+	t.files.release(t)
+}
+
+// park closes the stream's file to make room for another one's, keeping
+// its place in it.
+func (t *TailStream) park() {
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case <-t.closed:
+		return
+	default:
+	}
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// changed returns true if a parked stream has more to read: the file at
+// the path has grown or shrunk, or it's a new one.
+func (t *TailStream) changed() bool {
+	fi, err := os.Stat(t.path)
+	return err == nil && (idOf(fi) != t.id || fi.Size() != t.read)
+}
+
+// reopen opens a parked stream's file again where it left off. If it's
+// been rotated since, the rest of the old one is read first, if it's still
+// next to the new one.
+func (t *TailStream) reopen() error {
+	var f *os.File
+	var fi os.FileInfo
+	read := t.read
+	if pfi, err := os.Stat(t.path); err == nil && idOf(pfi) != t.id {
+		// Only one file is opened at a time, to keep to the limit.
+		if f, fi = findRotated(t.path, t.id); f != nil && read >= fi.Size() {
+			f.Close()
+			f = nil
+		}
+		if f == nil {
+			fmt.Fprintf(os.Stderr, "%s: rotated; reading the new file\n", t.path)
+			read = 0
+		}
+	}
+	if f == nil {
+		var err error
+		if f, err = os.Open(t.path); err != nil {
+			return err
+		}
+		if fi, err = f.Stat(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(read, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case <-t.closed:
+		f.Close()
+		return os.ErrClosed
+	default:
+	}
+	t.file, t.id, t.read = f, idOf(fi), read
+	return nil
+}
+
+// tailReader reads a tailed file, waiting for more to be written at its end.
+type tailReader struct {
+	t *TailStream
+}
+
+// Read reads what it can from the tailed file, and once it's at the end,
+// waits for more, following the file through rotations and truncations.
+// A parked stream waits for its file to change before reopening it. It only
+// fails once the stream is closed.
+func (r tailReader) Read(buf []byte) (int, error) {
+	t := r.t
+	for {
+		t.Lock()
+		select {
+		case <-t.closed:
+			t.Unlock()
+			return 0, os.ErrClosed
+		default:
+		}
+		if t.file == nil {
+			t.Unlock()
+			if t.changed() && t.files.acquire(t, t.reopen) == nil {
+				continue
+			}
+			select {
+			case <-t.closed:
+				return 0, os.ErrClosed
+			case <-time.After(tailPoll):
+			}
+			continue
+		}
+		n, err := t.file.Read(buf)
+		t.read += int64(n)
+		if n == 0 && err == io.EOF {
+			if err = t.follow(); err == nil {
+				// There's a new file, or the top of this one, to read.
+				t.Unlock()
+				continue
+			}
+		}
+		t.Unlock()
+		if n > 0 {
+			t.files.touch(t)
+			return n, nil
+		}
+		if err != io.EOF {
+			return 0, err
+		}
+		select {
+		case <-t.closed:
+			return 0, os.ErrClosed
+		case <-time.After(tailPoll):
+		}
+	}
+}
+
+// follow is called at the end of the file, to check whether the file at the
+// path has been rotated out from under us, in which case we move on to the
+// new one, or whether it's been truncated, in which case we start over. It
+// returns EOF if there's nothing more to read yet.
+func (t *TailStream) follow() error {
+	fi, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < t.read {
+		fmt.Fprintf(os.Stderr, "%s: truncated; reading it from the top\n", t.path)
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		t.read = 0
+		return nil
+	}
+	pfi, err := os.Stat(t.path)
+	if err != nil || idOf(pfi) == t.id {
+		// Nothing's at the path for now, in the middle of a rotation,
+		// or it's still our file.
+		return io.EOF
+	}
+	f, err := os.Open(t.path)
+	if err != nil {
+		return io.EOF
+	}
+	if fi, err = f.Stat(); err != nil {
+		f.Close()
+		return io.EOF
+	}
+	fmt.Fprintf(os.Stderr, "%s: rotated; reading the new file\n", t.path)
+	t.file.Close()
+	t.file, t.id, t.read = f, idOf(fi), 0
+	return nil
+}
+
+var _ Stream = (*TailStream)(nil)
+
+// fileScheduler bounds how many tailed files are open at once, for
+// --max-open-files. The files that have had something to read most
+// recently are kept open; to open another past the limit, the stream
+// that's been idle longest is parked, and reopens its file where it left
+// off once there's more in it.
+type fileScheduler struct {
+	sync.Mutex
+	max   int
+	lru   *list.List
+	elems map[*TailStream]*list.Element
+}
+
+func newFileScheduler(max int) *fileScheduler {
+	return &fileScheduler{max: max, lru: list.New(), elems: map[*TailStream]*list.Element{}}
+}
+
+// acquire opens a stream's file with open, after parking streams to make
+// room for it. It's called without the stream's lock, since parking takes
+// the locks of other streams.
+func (s *fileScheduler) acquire(t *TailStream, open func() error) error {
+	if s == nil {
+		return open()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.elems[t]; ok {
+		s.lru.Remove(e)
+		delete(s.elems, t)
+	}
+	for s.lru.Len() >= s.max {
+		idle := s.lru.Remove(s.lru.Front()).(*TailStream)
+		delete(s.elems, idle)
+		idle.park()
+	}
+	if err := open(); err != nil {
+		return err
+	}
+	s.elems[t] = s.lru.PushBack(t)
+	return nil
+}
+
+// touch marks a stream as having just read something from its file.
+func (s *fileScheduler) touch(t *TailStream) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.elems[t]; ok {
+		s.lru.MoveToBack(e)
+	}
+}
+
+// release forgets a stream whose file has been closed for good.
+func (s *fileScheduler) release(t *TailStream) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.elems[t]; ok {
+		s.lru.Remove(e)
+		delete(s.elems, t)
+	}
+}
+
+// stateFile is the name of the file in --state-dir that tailed files'
+// checkpoints are kept in.
+const stateFile = "offsets.json"
+
+// checkpointEvery is how often the --state-dir checkpoints are saved while
+// we run. They're saved once more on the way out.
+var checkpointEvery = time.Second
+
+// tailCheckpoint is a tailed file's checkpoint, as it's saved: its path,
+// and the offset that its lines have been written out up to.
+type tailCheckpoint struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// tailState is the --state-dir, which holds a checkpoint for each tailed
+// file, keyed by its ID so that the offset into a file that's been rotated
+// since isn't taken for an offset into the one that replaced it. Each path
+// only has a checkpoint for the file it was last read from.
+type tailState struct {
+	sync.Mutex
+	path   string
+	byFile map[string]tailCheckpoint
+	dirty  bool
+}
+
+// openState loads the checkpoints in a --state-dir, which is made if it
+// doesn't exist yet.
+func openState(dir string) (*tailState, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("--state-dir: %s", err)
+	}
+	s := &tailState{path: filepath.Join(dir, stateFile), byFile: map[string]tailCheckpoint{}}
+	buf, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("--state-dir: %s", err)
+	}
+	if err := json.Unmarshal(buf, &s.byFile); err != nil {
+		return nil, fmt.Errorf("--state-dir: bad %s: %s", s.path, err)
+	}
+	return s, nil
+}
+
+// get returns the checkpoint for the file that was last read at path.
+func (s *tailState) get(path string) (tailMark, bool) {
+	if s == nil {
+		return tailMark{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for key, c := range s.byFile {
+		var id fileID
+		if c.Path != path {
+			continue
+		}
+		if _, err := fmt.Sscanf(key, "%d:%d", &id.dev, &id.ino); err != nil {
+			continue
+		}
+		return tailMark{id: id, offset: c.Offset}, true
+	}
+	return tailMark{}, false
+}
+
+// set checkpoints the file at path at the given mark, dropping the
+// checkpoint for the file that was at the path before it.
+func (s *tailState) set(path string, mark tailMark) {
+	s.Lock()
+	defer s.Unlock()
+	key := mark.id.String()
+	if c, ok := s.byFile[key]; ok && c.Path == path && c.Offset == mark.offset {
+		return
+	}
+	for k, c := range s.byFile {
+		if c.Path == path && k != key {
+			delete(s.byFile, k)
+		}
+	}
+	s.byFile[key] = tailCheckpoint{Path: path, Offset: mark.offset}
+	s.dirty = true
+}
+
+// save writes out the checkpoints if they've changed, to a temporary file
+// that's renamed into place, so that a crash can't leave them half written.
+func (s *tailState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	buf, err := json.Marshal(s.byFile)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("--state-dir: %s", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("--state-dir: %s", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// saveEvery saves the checkpoints every checkpointEvery until stop is
+// closed.
+func (s *tailState) saveEvery(stop <-chan struct{}) {
+	if s == nil {
+		return
+	}
+	t := time.NewTicker(checkpointEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := s.save(); err != nil {
+				fmt.Fprintf(os.Stderr, "logmux: can't save checkpoints: %s\n", err)
+			}
+		}
+	}
+}
+
+// checkpoint records how far into a tailed file the given stream has
+// written out its lines, as of the line that ends at mark. Nothing is
+// recorded while any line it has read is held back, in a multiline event
+// or for reordering, so that a restart never skips past a line that wasn't
+// written out.
+func (m *Mux) checkpoint(s Stream, mark tailMark, r *reorderer) {
+	t, ok := s.(*TailStream)
+	if !ok || t.state == nil || mark == (tailMark{}) {
+		return
+	}
+	if s.Pending().Len() > 0 || (r != nil && r.byTime.Len() > 0) {
+		return
+	}
+	t.state.set(t.path, mark)
+}
+
+// k8sPodPath is the path-fields pattern for k8s-pod-path: the kubelet's
+// /var/log/pods/<namespace>_<pod>_<uid>/<container>/<n>.log layout, where
+// none of the names can have an underscore in them.
+var k8sPodPath = regexp.MustCompile(`/(?P<namespace>[^_/]+)_(?P<pod>[^_/]+)_(?P<pod_uid>[^_/]+)/(?P<container>[^/]+)/[^/]+\.log$`)
+
+// parsePathPattern reads a path-fields option: k8s-pod-path, or a regexp
+// with at least one named capture group.
+func parsePathPattern(val string) (*regexp.Regexp, error) {
+	if val == "k8s-pod-path" {
+		return k8sPodPath, nil
+	}
+	re, err := regexp.Compile(val)
+	if err != nil {
+		return nil, fmt.Errorf("bad stream path-fields: %s", err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("bad stream path-fields %q: want k8s-pod-path, or a regexp with named groups like (?P<pod>...)", val)
+}
+
+// pathFields returns the fields that a path-fields pattern finds in a path:
+// one for each named group, which are left out if they match nothing.
+func pathFields(re *regexp.Regexp, path string) ([]field, error) {
+	m := re.FindStringSubmatchIndex(path)
+	if m == nil {
+		return nil, fmt.Errorf("path-fields pattern doesn't match %s", path)
+	}
+	var ret []field
+	for i, name := range re.SubexpNames() {
+		if name == "" || m[2*i] < 0 || m[2*i] == m[2*i+1] {
+			continue
+		}
+		ret = append(ret, field{key: name, val: jsonString([]byte(path[m[2*i]:m[2*i+1]]))})
+	}
+	return ret, nil
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openIn counts how many of our file descriptors are for files in dir.
+func openIn(dir string) int {
+	fds, _ := os.ReadDir("/proc/self/fd")
+	n := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink("/proc/self/fd/" + fd.Name()); err == nil && strings.HasPrefix(target, dir+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	fastTail(t)
+	const files, limit = 10, 3
+	dir := t.TempDir()
+	args := []string{"--max-open-files", fmt.Sprint(limit), "--tail-from", "beginning", "--duration", "2s"}
+	for i := 0; i < files; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("f%d.log", i))
+		appendFile(t, path, "a\n")
+		args = append(args, fmt.Sprintf("file://%s:f%d", path, i))
+	}
+	c := captureTCP(t)
+	m, err := parseTestArgs(append([]string{"--logstash", c.url().String()}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	most, stop := 0, make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if n := openIn(dir); n > most {
+				most = n
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+
+	c.lines(t, 0, files)
+	// Every file gets more lines, so each parked one has to be reopened
+	// where it left off, parking others in turn.
+	for round := 0; round < 2; round++ {
+		for i := files - 1; i >= 0; i-- {
+			appendFile(t, filepath.Join(dir, fmt.Sprintf("f%d.log", i)), fmt.Sprintf("%c\n", 'b'+round))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	got := c.lines(t, 0, 3*files)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-sampled
+	if most > limit {
+		t.Errorf("had %d files open at once, over the limit of %d", most, limit)
+	}
+	if most == 0 {
+		t.Error("never saw a file open")
+	}
+
+	byTag := map[string][]string{}
+	for _, line := range got {
+		parts := strings.SplitN(line, ": ", 2)
+		byTag[parts[0]] = append(byTag[parts[0]], parts[1])
+	}
+	var tags []string
+	for tag, lines := range byTag {
+		tags = append(tags, tag)
+		if s := strings.Join(lines, ","); s != "a,b,c" {
+			t.Errorf("%s got %q", tag, s)
+		}
+	}
+	if sort.Strings(tags); len(tags) != files {
+		t.Errorf("got lines for %q", tags)
+	}
+}
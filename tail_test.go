@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fastTail makes tailed files quick to notice new lines, for the length of
+// a test.
+func fastTail(t *testing.T) {
+	saved := tailPoll
+	tailPoll = 10 * time.Millisecond
+	t.Cleanup(func() { tailPoll = saved })
+}
+
+// tailOnce runs logmux for a moment, tailing the file at path from the top
+// or from the given --state-dir's checkpoint, and returns what it shipped.
+func tailOnce(t *testing.T, state, path string) string {
+	t.Helper()
+	return captureStdout(t, func() {
+		runMux(t, "--logstash", "-", "--state-dir", state, "--duration", "200ms", "--tail-from", "beginning", "file://"+path+":app")
+	})
+}
+
+func appendFile(t *testing.T, path, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailResumesFromCheckpoint(t *testing.T) {
+	fastTail(t)
+	dir := t.TempDir()
+	path, state := filepath.Join(dir, "app.log"), filepath.Join(dir, "state")
+	appendFile(t, path, "one\ntwo\n")
+	if got := tailOnce(t, state, path); got != "app: one\napp: two\n" {
+		t.Fatalf("first run: got %q", got)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(state, stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]tailCheckpoint
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := saved[idOf(fi).String()]; c.Path != path || c.Offset != 8 || len(saved) != 1 {
+		t.Errorf("checkpoints are %s", buf)
+	}
+
+	appendFile(t, path, "three\n")
+	if got := tailOnce(t, state, path); got != "app: three\n" {
+		t.Errorf("second run: got %q", got)
+	}
+	if got := tailOnce(t, state, path); got != "" {
+		t.Errorf("third run: got %q", got)
+	}
+}
+
+func TestTailCheckpointAfterChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string)
+		want   string
+	}{
+		{
+			name: "rotated, with the old file still there",
+			change: func(t *testing.T, path string) {
+				appendFile(t, path, "three\n")
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "four\n")
+			},
+			want: "app: three\napp: four\n",
+		},
+		{
+			name: "rotated, with the old file read to its end",
+			change: func(t *testing.T, path string) {
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "four\n")
+			},
+			want: "app: four\n",
+		},
+		{
+			name: "rotated, with the old file gone",
+			change: func(t *testing.T, path string) {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "four\n")
+			},
+			want: "app: four\n",
+		},
+		{
+			name: "truncated",
+			change: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "app: x\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastTail(t)
+			dir := t.TempDir()
+			path, state := filepath.Join(dir, "app.log"), filepath.Join(dir, "state")
+			appendFile(t, path, "one\ntwo\n")
+			if got := tailOnce(t, state, path); got != "app: one\napp: two\n" {
+				t.Fatalf("first run: got %q", got)
+			}
+			tt.change(t, path)
+			if got := tailOnce(t, state, path); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailFollowsRotationAndTruncation(t *testing.T) {
+	fastTail(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "one\n")
+	c := captureTCP(t)
+	m, err := parseTestArgs("--logstash", c.url().String(), "--duration", "2s", "file://"+path+":app;tail-from=beginning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+
+	c.lines(t, 0, 1)
+	appendFile(t, path, "two\n")
+	c.lines(t, 0, 2)
+	// The old file gets another line after it's rotated out, which has
+	// to be read before the new one.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "three\n")
+	appendFile(t, path, "four\n")
+	c.lines(t, 0, 4)
+	// Truncation shows as the file being shorter than what we've read of
+	// it.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "x\n")
+	got := c.lines(t, 0, 5)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(got, ","); s != "app: one,app: two,app: three,app: four,app: x" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestTailFrom(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string
+		checkpoint bool
+		want       string
+	}{
+		{"end by default", ":app", false, "three\n"},
+		{"end", ":app;tail-from=end", false, "three\n"},
+		{"beginning", ":app;tail-from=beginning", false, "one\n"},
+		{"end, with a checkpoint", ":app;tail-from=end", true, "two\n"},
+		{"beginning, with a checkpoint", ":app;tail-from=beginning", true, "two\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastTail(t)
+			path := filepath.Join(t.TempDir(), "app.log")
+			appendFile(t, path, "one\ntwo\n")
+			m, err := parseTestArgs("--logstash", "-", "file://"+path+tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := m.streams[0].(*TailStream)
+			if tt.checkpoint {
+				fi, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.state = &tailState{byFile: map[string]tailCheckpoint{idOf(fi).String(): {Path: path, Offset: 4}}}
+			}
+			if err := s.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			appendFile(t, path, "three\n")
+			if got, err := s.Source().ReadString('\n'); err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"--tail-from", "middle", "file:///var/log/app.log:app"},
+		{"file:///var/log/app.log:app;tail-from=start"},
+		{"0:app;tail-from=beginning"},
+	} {
+		if _, err := parseTestArgs(append([]string{"--logstash", "-"}, args...)...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestCheckpointWaitsForHeldLines(t *testing.T) {
+	s := &TailStream{path: "app.log", state: &tailState{byFile: map[string]tailCheckpoint{}}}
+	m := &Mux{}
+	mark := tailMark{id: fileID{1, 2}, offset: 10}
+
+	s.Pending().WriteString("held\n")
+	m.checkpoint(s, mark, nil)
+	s.Pending().Reset()
+	r := &reorderer{window: time.Second}
+	r.push(line{buf: []byte("held\n")}, time.Now())
+	m.checkpoint(s, mark, r)
+	if _, ok := s.state.get("app.log"); ok {
+		t.Fatal("checkpointed with lines held back")
+	}
+
+	m.checkpoint(s, mark, nil)
+	if got, ok := s.state.get("app.log"); !ok || got != mark {
+		t.Errorf("got %v, want %v", got, mark)
+	}
+	// A new file at the path replaces the old one's checkpoint.
+	next := tailMark{id: fileID{1, 3}, offset: 4}
+	m.checkpoint(s, next, nil)
+	if got, _ := s.state.get("app.log"); got != next || len(s.state.byFile) != 1 {
+		t.Errorf("got %v with %d checkpoints, want %v", got, len(s.state.byFile), next)
+	}
+}
+
+func TestBadFileStream(t *testing.T) {
+	dir := t.TempDir()
+	for _, spec := range []string{"file://:app", "file://" + dir + "/missing:app", "file://" + dir + ":app"} {
+		s, err := parseStreamArg(spec)
+		if err == nil {
+			err = s.Open()
+		}
+		if err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
+
+func TestPathFields(t *testing.T) {
+	tests := []struct {
+		path, pattern string
+		want          string
+	}{
+		{
+			"/var/log/pods/default_web-6d4cf56db6-xk2lp_0c4e7f5a-9d2b-4b3e-8f1a-2a5c6e7d8f90/nginx/0.log", "k8s-pod-path",
+			`{"message":"GET /","tag":"app","namespace":"default","pod":"web-6d4cf56db6-xk2lp","pod_uid":"0c4e7f5a-9d2b-4b3e-8f1a-2a5c6e7d8f90","container":"nginx"}`,
+		},
+		{
+			"/var/log/pods/kube-system_coredns-5d78c9869d-4v7wz_d1e2/coredns/3.log", "k8s-pod-path",
+			`{"message":"GET /","tag":"app","namespace":"kube-system","pod":"coredns-5d78c9869d-4v7wz","pod_uid":"d1e2","container":"coredns"}`,
+		},
+		{
+			"/srv/billing/logs/worker.log", `^/srv/(?P<service>\w+)/logs/(?P<role>\w+)(?P<n>\d*)\.log$`,
+			`{"message":"GET /","tag":"app","service":"billing","role":"worker"}`,
+		},
+	}
+	for _, tt := range tests {
+		m, err := parseTestArgs("--logstash", "-", "file://"+tt.path+":app;path-fields="+tt.pattern)
+		if err != nil {
+			t.Errorf("%s: %s", tt.path, err)
+			continue
+		}
+		for line, want := range map[string]string{
+			"GET /":               tt.want,
+			`{"message":"GET /"}`: tt.want,
+		} {
+			got := strings.TrimSuffix(string(m.opts.processLine([]byte(line), m.streams[0])), "\n")
+			if got != want {
+				t.Errorf("%s, %s: got %s, want %s", tt.path, line, got, want)
+			}
+		}
+	}
+
+	// A plain stream is left be.
+	m, err := parseTestArgs("--logstash", "-", "file://"+tests[0].path+":app;format=plain;path-fields=k8s-pod-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(m.opts.processLine([]byte("GET /"), m.streams[0])); got != "app: GET /\n" {
+		t.Errorf("got %q", got)
+	}
+
+	for _, spec := range []string{
+		"file:///var/log/app.log:app;path-fields=k8s-pod-path",
+		"file:///var/log/pods/ns_pod_uid/c/0.log:app;path-fields=(",
+		"file:///var/log/pods/ns_pod_uid/c/0.log:app;path-fields=^/var/(log)/",
+		"0:app;path-fields=k8s-pod-path",
+	} {
+		if _, err := parseTestArgs("--logstash", "-", spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
+
+func TestParkedStreamReopens(t *testing.T) {
+	fastTail(t)
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	appendFile(t, a, "a1\n")
+	appendFile(t, b, "b1\n")
+	files := newFileScheduler(1)
+	var streams []*TailStream
+	for _, path := range []string{a, b} {
+		s := &TailStream{path: path, files: files}
+		s.opts.tailFrom = "beginning"
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.close()
+		streams = append(streams, s)
+	}
+	sa, sb := streams[0], streams[1]
+	// Opening b parked a, whose line hasn't been read yet.
+	if sa.file != nil || sb.file == nil {
+		t.Fatalf("a open: %t, b open: %t", sa.file != nil, sb.file != nil)
+	}
+	read := func(s *TailStream, want string) {
+		t.Helper()
+		if got, err := s.Source().ReadString('\n'); err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	read(sa, "a1\n")
+	if sa.file == nil || sb.file != nil {
+		t.Fatalf("a open: %t, b open: %t", sa.file != nil, sb.file != nil)
+	}
+	read(sb, "b1\n")
+
+	// a is rotated while it's parked, with more written to the old file
+	// first, which is read before the new one.
+	appendFile(t, a, "a2\n")
+	if err := os.Rename(a, a+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, a, "a3\n")
+	read(sa, "a2\n")
+	read(sa, "a3\n")
+
+	// A file that's gone quiet stays parked.
+	if sb.file != nil {
+		t.Error("b wasn't parked")
+	}
+	appendFile(t, b, "b2\n")
+	read(sb, "b2\n")
+}
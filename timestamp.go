@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timestampParser pulls an app's own timestamp out of the start (or
+// anywhere) of a plain line, to ship as the event's @timestamp. Lines
+// without one that parses are shipped as usual, so logstash stamps them
+// with when it took them in.
+type timestampParser struct {
+	// pattern finds the timestamp; its first capture group is the
+	// timestamp if it has one, and the whole match otherwise.
+	pattern *regexp.Regexp
+	// layout is how the timestamp is written, as a Go time layout. It
+	// defaults to RFC 3339.
+	layout string
+	// loc is the zone assumed for timestamps that don't give their own. It
+	// defaults to the local zone.
+	loc *time.Location
+	// strip, if set, takes the whole match out of the message.
+	strip bool
+}
+
+// set a single timestamp-* (or strip-timestamp) stream option.
+func (t *timestampParser) set(key, val string) error {
+	switch key {
+	case "timestamp-pattern":
+		re, err := regexp.Compile(val)
+		if err != nil {
+			return fmt.Errorf("bad stream timestamp-pattern: %s", err)
+		}
+		t.pattern = re
+	case "timestamp-layout":
+		if val == "" {
+			return fmt.Errorf("bad stream timestamp-layout: it's empty")
+		}
+		t.layout = val
+	case "timestamp-zone":
+		loc, err := time.LoadLocation(val)
+		if err != nil {
+			return fmt.Errorf("bad stream timestamp-zone: %s", err)
+		}
+		t.loc = loc
+	case "strip-timestamp":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("bad stream strip-timestamp: %s", val)
+		}
+		t.strip = b
+	}
+	return nil
+}
+
+// withDefaults fills in whatever a stream didn't set from the global
+// --timestamp-* flags, d. Either can be nil.
+func (t *timestampParser) withDefaults(d *timestampParser) *timestampParser {
+	if t == nil {
+		return d
+	}
+	if d == nil {
+		return t
+	}
+	ret := *t
+	if ret.pattern == nil {
+		ret.pattern = d.pattern
+	}
+	if ret.layout == "" {
+		ret.layout = d.layout
+	}
+	if ret.loc == nil {
+		ret.loc = d.loc
+	}
+	ret.strip = ret.strip || d.strip
+	return &ret
+}
+
+// check that a parser has a pattern to go with its other settings.
+func (t *timestampParser) check() error {
+	if t != nil && t.pattern == nil {
+		return fmt.Errorf("timestamp settings need a timestamp pattern")
+	}
+	return nil
+}
+
+// parse a timestamp as written in a line. Timestamps written without a year
+// are taken to be from the last year, counting back from now.
+func (t *timestampParser) parse(val string, now time.Time) (time.Time, error) {
+	layout, loc := t.layout, t.loc
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	ts, err := time.ParseInLocation(layout, val, loc)
+	if err != nil {
+		return ts, err
+	}
+	if ts.Year() == 0 {
+		ts = ts.AddDate(now.In(ts.Location()).Year(), 0, 0)
+		if ts.After(now.Add(24 * time.Hour)) {
+			ts = ts.AddDate(-1, 0, 0)
+		}
+	}
+	return ts, nil
+}
+
+// apply looks for a timestamp in buf, and returns the line (without the
+// timestamp if it's stripped) and an @timestamp field for it. If there's no
+// timestamp that parses, the line comes back as it was, with no field.
+func (t *timestampParser) apply(buf []byte, now time.Time) ([]byte, []field) {
+	if t == nil {
+		return buf, nil
+	}
+	m := t.pattern.FindSubmatchIndex(buf)
+	if m == nil {
+		return buf, nil
+	}
+	start, end := m[0], m[1]
+	if len(m) >= 4 && m[2] >= 0 {
+		start, end = m[2], m[3]
+	}
+	ts, err := t.parse(string(buf[start:end]), now)
+	if err != nil {
+		return buf, nil
+	}
+	f := field{key: "@timestamp", val: jsonString([]byte(ts.UTC().Format(time.RFC3339Nano)))}
+	if t.strip {
+		rest := append(append([]byte(nil), buf[:m[0]]...), buf[m[1]:]...)
+		buf = bytes.TrimSpace(rest)
+	}
+	return buf, []field{f}
+}
+
+// parseErrors is the --fail-on-parse-error check on a stream's timestamp
+// parser, which otherwise ships lines it can't find a timestamp in as
+// usual, hiding a pattern that's wrong for the stream. With no threshold,
+// the first such line fails the stream. With one, the stream fails if more
+// than maxPercent of its first of lines don't parse, and it's trusted after
+// that.
+type parseErrors struct {
+	sync.Mutex
+	enabled    bool
+	maxPercent float64
+	of         int
+
+	seen   int
+	failed int
+	err    error
+}
+
+// We can parse command line flags directly into a parseErrors value
+var _ flag.Value = (*parseErrors)(nil)
+
+// IsBoolFlag lets --fail-on-parse-error go without a threshold.
+func (p *parseErrors) IsBoolFlag() bool {
+	return true
+}
+
+// Set reads true or false, or a threshold like 10%/1000.
+func (p *parseErrors) Set(r string) error {
+	if b, err := strconv.ParseBool(r); err == nil {
+		*p = parseErrors{enabled: b}
+		return nil
+	}
+	parts := strings.SplitN(r, "/", 2)
+	if len(parts) != 2 || !strings.HasSuffix(parts[0], "%") {
+		return fmt.Errorf("bad threshold %q; want <percent>%%/<lines>, like 10%%/1000", r)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(parts[0], "%"), 64)
+	if err != nil || pct < 0 || pct >= 100 {
+		return fmt.Errorf("bad threshold percentage: %s", parts[0])
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("bad threshold line count: %s", parts[1])
+	}
+	*p = parseErrors{enabled: true, maxPercent: pct, of: n}
+	return nil
+}
+
+// String representation of the parseErrors
+func (p *parseErrors) String() string {
+	if p == nil || !p.enabled {
+		return "false"
+	}
+	if p.of == 0 {
+		return "true"
+	}
+	return fmt.Sprintf("%g%%/%d", p.maxPercent, p.of)
+}
+
+// forStream returns a fresh check with the same settings, for a stream to
+// count its own lines with. It's nil if the check is off.
+func (p *parseErrors) forStream() *parseErrors {
+	if !p.enabled {
+		return nil
+	}
+	return &parseErrors{enabled: true, maxPercent: p.maxPercent, of: p.of}
+}
+
+// record counts a plain line that the timestamp parser did or didn't find a
+// timestamp in.
+func (p *parseErrors) record(tag string, buf []byte, ok bool) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil || (p.of > 0 && p.seen >= p.of) {
+		return
+	}
+	p.seen++
+	if !ok {
+		p.failed++
+	}
+	switch {
+	case p.of == 0 && !ok:
+		p.err = fmt.Errorf("%s: no timestamp that the timestamp-pattern parses in line %q (--fail-on-parse-error)", tag, buf)
+	case p.of > 0 && float64(p.failed) > p.maxPercent*float64(p.of)/100:
+		p.err = fmt.Errorf("%s: over %g%% of the first %d lines have no timestamp that the timestamp-pattern parses (--fail-on-parse-error)", tag, p.maxPercent, p.of)
+	}
+}
+
+// check returns an error once the stream should fail.
+func (p *parseErrors) check() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
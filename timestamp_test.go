@@ -0,0 +1,224 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampParser(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		opts  map[string]string
+		line  string
+		want  string
+		stamp string
+	}{
+		{
+			name:  "RFC 3339",
+			opts:  map[string]string{"timestamp-pattern": `^\S+`},
+			line:  "2024-01-02T10:30:00.25+02:00 started",
+			want:  "2024-01-02T10:30:00.25+02:00 started",
+			stamp: "2024-01-02T08:30:00.25Z",
+		},
+		{
+			name: "no zone, in a given one",
+			opts: map[string]string{
+				"timestamp-pattern": `^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d`,
+				"timestamp-layout":  "2006-01-02 15:04:05",
+				"timestamp-zone":    "America/New_York",
+			},
+			line:  "2024-01-01 19:00:00 started",
+			want:  "2024-01-01 19:00:00 started",
+			stamp: "2024-01-02T00:00:00Z",
+		},
+		{
+			name: "no year",
+			opts: map[string]string{
+				"timestamp-pattern": `^\w{3} [ \d]\d \d\d:\d\d:\d\d`,
+				"timestamp-layout":  "Jan _2 15:04:05",
+				"timestamp-zone":    "UTC",
+			},
+			line:  "Jan  2 11:59:00 started",
+			want:  "Jan  2 11:59:00 started",
+			stamp: "2024-01-02T11:59:00Z",
+		},
+		{
+			name: "no year, from last year",
+			opts: map[string]string{
+				"timestamp-pattern": `^\w{3} [ \d]\d \d\d:\d\d:\d\d`,
+				"timestamp-layout":  "Jan _2 15:04:05",
+				"timestamp-zone":    "UTC",
+			},
+			line:  "Dec 31 23:59:59 started",
+			want:  "Dec 31 23:59:59 started",
+			stamp: "2023-12-31T23:59:59Z",
+		},
+		{
+			name: "a capture group, stripped",
+			opts: map[string]string{
+				"timestamp-pattern": `\[([^]]+)\]`,
+				"timestamp-layout":  "02/Jan/2006:15:04:05 -0700",
+				"strip-timestamp":   "true",
+			},
+			line:  `10.0.0.1 - - [02/Jan/2024:04:00:00 -0800] "GET / HTTP/1.1" 200`,
+			want:  `10.0.0.1 - -  "GET / HTTP/1.1" 200`,
+			stamp: "2024-01-02T12:00:00Z",
+		},
+		{
+			name:  "unix-style layout",
+			opts:  map[string]string{"timestamp-pattern": `^\S+ \S+ \d+ \S+ \S+ \d+`, "timestamp-layout": time.UnixDate},
+			line:  "Tue Jan 2 09:00:00 UTC 2024 started",
+			want:  "Tue Jan 2 09:00:00 UTC 2024 started",
+			stamp: "2024-01-02T09:00:00Z",
+		},
+		{
+			name: "unparseable",
+			opts: map[string]string{"timestamp-pattern": `^\S+`, "strip-timestamp": "true"},
+			line: "yesterday started",
+			want: "yesterday started",
+		},
+		{
+			name: "absent",
+			opts: map[string]string{"timestamp-pattern": `^\d+-\d+-\d+T\S+`},
+			line: "started",
+			want: "started",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &timestampParser{}
+			for k, v := range tt.opts {
+				if err := p.set(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			buf, fields := p.apply([]byte(tt.line), now)
+			if string(buf) != tt.want {
+				t.Errorf("got line %q, want %q", buf, tt.want)
+			}
+			switch {
+			case tt.stamp == "" && len(fields) > 0:
+				t.Errorf("got %s = %s, want none", fields[0].key, fields[0].val)
+			case tt.stamp != "" && len(fields) != 1:
+				t.Errorf("got %d fields, want an @timestamp", len(fields))
+			case tt.stamp != "" && string(fields[0].val) != `"`+tt.stamp+`"`:
+				t.Errorf("got %s = %s, want %s", fields[0].key, fields[0].val, tt.stamp)
+			}
+		})
+	}
+}
+
+func TestTimestampFromLine(t *testing.T) {
+	m, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--timestamp-zone", "UTC",
+		"0:app;timestamp-pattern=^\\S+ \\S+;timestamp-layout=2006-01-02 15:04:05;strip-timestamp=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := string(m.opts.processLine([]byte("2024-01-02 03:04:05 started"), m.streams[0]))
+	if got := eventField(t, ev, "@timestamp"); got != "2024-01-02T03:04:05Z" {
+		t.Errorf("@timestamp = %v in %s", got, ev)
+	}
+	if got := eventField(t, ev, "message"); got != "started" {
+		t.Errorf("message = %v in %s", got, ev)
+	}
+	// Lines without one ship as usual, to be stamped at ingestion.
+	if ev := string(m.opts.processLine([]byte("started"), m.streams[0])); strings.Contains(ev, "@timestamp") {
+		t.Errorf("got %s", ev)
+	}
+}
+
+func TestBadTimestampSettings(t *testing.T) {
+	for _, args := range [][]string{
+		{"--timestamp-pattern", "("},
+		{"0:app;timestamp-pattern=("},
+		{"--timestamp-zone", "Mars/Olympus_Mons"},
+		{"--timestamp-layout", "2006-01-02"},
+		{"0:app;timestamp-zone=UTC"},
+	} {
+		if _, err := parseTestArgs(append([]string{"--logstash", "tcp://localhost:5000", "1:app"}, args...)...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestParseErrorThreshold(t *testing.T) {
+	tests := []struct {
+		name  string
+		flag  string
+		lines string // y for a line that parses, n for one that doesn't
+		fails bool
+	}{
+		{"fail fast, all parse", "true", "yyyy", false},
+		{"fail fast, one doesn't", "true", "yyyn", true},
+		{"under the threshold", "20%/10", "ynyyyyynyy", false},
+		{"over the threshold", "20%/10", "ynyyynyyny", true},
+		{"over it before the count is up", "20%/10", "nnn", true},
+		{"only the first lines count", "20%/5", "yyyyynnnnn", false},
+		{"zero percent", "0%/5", "yyyyn", true},
+	}
+	for _, tt := range tests {
+		var p parseErrors
+		if err := p.Set(tt.flag); err != nil {
+			t.Fatal(err)
+		}
+		s := p.forStream()
+		for _, c := range tt.lines {
+			s.record("app", []byte("line"), c == 'y')
+		}
+		if err := s.check(); (err != nil) != tt.fails {
+			t.Errorf("%s: got %v, want failure %t", tt.name, err, tt.fails)
+		}
+	}
+
+	var p parseErrors
+	if p.Set("false"); p.forStream() != nil {
+		t.Error("--fail-on-parse-error=false still checks")
+	}
+	for _, bad := range []string{"10", "10%", "10/100", "x%/100", "100%/100", "-1%/100", "10%/0", "10%/x"} {
+		if err := p.Set(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestFailOnParseError(t *testing.T) {
+	lines := []string{"2024-01-02T03:04:05Z one", "two", "2024-01-02T03:04:06Z three"}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"lenient by default", nil, ""},
+		{"fail fast", []string{"--fail-on-parse-error"}, `app: no timestamp that the timestamp-pattern parses in line "two"`},
+		{"under a threshold", []string{"--fail-on-parse-error=50%/3"}, ""},
+		{"over a threshold", []string{"--fail-on-parse-error=10%/3"}, "app: over 10% of the first 3 lines"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := captureTCP(t)
+			args := append([]string{"--logstash", c.url().String(), "--timestamp-pattern", `^\S+`}, tt.args...)
+			m, err := parseTestArgs(append(args, pipeSpec(t, "app", lines))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.Run()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.lines(t, 0, 3)
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--fail-on-parse-error", "0:app"); err == nil {
+		t.Error("--fail-on-parse-error without a timestamp-pattern: no error")
+	}
+	if _, err := parseTestArgs("--logstash", "tcp://localhost:5000", "--fail-on-parse-error", `0:app;timestamp-pattern=^\S+`); err != nil {
+		t.Errorf("--fail-on-parse-error with a stream's timestamp-pattern: %s", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxUDPPacket is the biggest payload a UDP datagram can carry over IPv4.
+const maxUDPPacket = 65507
+
+// udpWriter sends each event written to it as a datagram of its own, as
+// logstash's udp input expects. Events bigger than max bytes are dropped,
+// since half of a JSON event is no use to anyone.
+type udpWriter struct {
+	w   io.Writer
+	max int
+}
+
+func openUDP(s *LogstashService, conn net.Conn) (eventWriter, error) {
+	if s.udpPack > 0 {
+		return &udpPacker{w: conn, max: s.udpPack, every: s.udpEvery}, nil
+	}
+	return udpWriter{w: conn, max: s.udpMax}, nil
+}
+
+// writeEvents sends events, one per datagram, so a multiline event stays in
+// one piece. There's nobody on the other end to refuse them, as far as UDP
+// goes, so a refused datagram (from an ICMP error on an earlier one) isn't an
+// error.
+func (u udpWriter) writeEvents(evs []event) error {
+	for _, ev := range evs {
+		if len(ev.buf) > u.max {
+			fmt.Fprintf(os.Stderr, "dropping a %d-byte event that's over the --udp-max-packet of %d bytes\n", len(ev.buf), u.max)
+			continue
+		}
+		if err := sendDatagram(u.w, ev.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDatagram writes one datagram. A refused one isn't an error, as it's
+// only refused because of an ICMP error on an earlier one.
+func sendDatagram(w io.Writer, buf []byte) error {
+	if _, err := w.Write(buf); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return nil
+}
+
+// udpPacker packs as many newline-delimited events into each datagram as
+// fit in max bytes, for --udp-max-datagram, rather than sending tiny events
+// in datagrams of their own. A datagram goes out once the next event
+// wouldn't fit, or once every has passed since its first event. An event
+// bigger than max goes in a datagram of its own, cut down to max bytes.
+type udpPacker struct {
+	w     io.Writer
+	max   int
+	every time.Duration
+
+	sync.Mutex
+	// evs are the events packed into the datagram so far, with their acks,
+	// and size is how many bytes they come to. A datagram that couldn't be
+	// sent is kept, to be tried again, or carried over to a new connection.
+	evs   []event
+	size  int
+	timer *time.Timer
+	// err is from a flush in the background, and is returned by the next
+	// write.
+	err error
+}
+
+// writeEvents adds events to the datagram being packed, sending it first
+// whenever the next event doesn't fit.
+func (u *udpPacker) writeEvents(evs []event) error {
+	u.Lock()
+	defer u.Unlock()
+	if err := u.err; err != nil {
+		u.err = nil
+		return err
+	}
+	for i, ev := range evs {
+		if u.size+len(ev.buf) > u.max {
+			if err := u.flush(); err != nil {
+				return err
+			}
+		}
+		if len(ev.buf) > u.max {
+			fmt.Fprintf(os.Stderr, "truncating a %d-byte event to the --udp-max-datagram of %d bytes\n", len(ev.buf), u.max)
+			cut := append(ev.buf[:u.max-1:u.max-1], '\n')
+			if err := sendDatagram(u.w, cut); err != nil {
+				return err
+			}
+			continue
+		}
+		u.evs, u.size = append(u.evs, ev), u.size+len(ev.buf)
+		evs[i].ack = nil
+	}
+	if len(u.evs) > 0 && u.timer == nil {
+		u.timer = time.AfterFunc(u.every, u.flushLater)
+	}
+	return nil
+}
+
+// flush sends the datagram being packed, if there's anything in it, and
+// acks its events once it's gone. If it can't be sent, it's kept. The lock
+// must be held.
+func (u *udpPacker) flush() error {
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+	if len(u.evs) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, u.size)
+	for _, ev := range u.evs {
+		buf = append(buf, ev.buf...)
+	}
+	if err := sendDatagram(u.w, buf); err != nil {
+		return err
+	}
+	ackEvents(u.evs, nil)
+	u.evs, u.size = nil, 0
+	return nil
+}
+
+// flushLater sends the datagram once it's been waiting long enough.
+func (u *udpPacker) flushLater() {
+	u.Lock()
+	defer u.Unlock()
+	if err := u.flush(); err != nil {
+		u.err = err
+	}
+}
+
+// Flush sends the datagram being packed, as when we're exiting. One that
+// can't be sent is dropped, for the error.
+func (u *udpPacker) Flush() error {
+	u.Lock()
+	defer u.Unlock()
+	err := u.flush()
+	if err != nil {
+		ackEvents(u.evs, err)
+		u.evs, u.size = nil, 0
+	}
+	return err
+}
+
+// carry takes the events packed so far, acks and all, for the packer on the
+// connection that replaces this one's.
+func (u *udpPacker) carry() []event {
+	u.Lock()
+	defer u.Unlock()
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+	evs := u.evs
+	u.evs, u.size, u.err = nil, 0, nil
+	return evs
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// datagrams records each write to it as a datagram.
+type datagrams struct {
+	sync.Mutex
+	sent []string
+}
+
+func (d *datagrams) Write(buf []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.sent = append(d.sent, string(buf))
+	return len(buf), nil
+}
+
+func (d *datagrams) all() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.sent...)
+}
+
+func udpEvents(lines ...string) []event {
+	var evs []event
+	for _, l := range lines {
+		evs = append(evs, event{tag: "app", buf: []byte(l + "\n")})
+	}
+	return evs
+}
+
+func TestUDPPacking(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes [][]string
+		want   []string
+	}{
+		{
+			name:   "small events share a datagram",
+			writes: [][]string{{"one", "two"}, {"three"}},
+			want:   []string{"one\ntwo\nthree\n"},
+		},
+		{
+			name:   "a datagram goes once the next event won't fit",
+			writes: [][]string{{"aaaaaaa", "bbbbbbb", "ccccccc"}},
+			want:   []string{"aaaaaaa\nbbbbbbb\n", "ccccccc\n"},
+		},
+		{
+			name:   "an event that fits exactly",
+			writes: [][]string{{"aaaaaaaaaaaaaaa", "b"}},
+			want:   []string{"aaaaaaaaaaaaaaa\n", "b\n"},
+		},
+		{
+			name:   "oversized events go alone, truncated",
+			writes: [][]string{{"one", strings.Repeat("x", 40), "two"}},
+			want:   []string{"one\n", strings.Repeat("x", 15) + "\n", "two\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &datagrams{}
+			u := &udpPacker{w: d, max: 16, every: time.Hour}
+			for _, w := range tt.writes {
+				if err := u.writeEvents(udpEvents(w...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := u.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := d.all(); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, dg := range d.all() {
+				if len(dg) > 16 {
+					t.Errorf("%d-byte datagram is over the max", len(dg))
+				}
+			}
+		})
+	}
+}
+
+func TestUDPPackingFlushesOnInterval(t *testing.T) {
+	d := &datagrams{}
+	u := &udpPacker{w: d, max: 1024, every: 10 * time.Millisecond}
+	if err := u.writeEvents(udpEvents("one", "two")); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.all(); len(got) != 0 {
+		t.Fatalf("sent %q before the interval was up", got)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(d.all()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing sent after the interval")
+		}
+	}
+	if got := d.all(); len(got) != 1 || got[0] != "one\ntwo\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestUDPSinkPacksDatagrams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	got := make(chan string, 10)
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+	runMux(t, "--logstash", "udp://"+pc.LocalAddr().String(), "--udp-max-datagram", "1400",
+		pipeSpec(t, "app", []string{"one", "two", "three"}))
+	select {
+	case dg := <-got:
+		if dg != "app: one\napp: two\napp: three\n" {
+			t.Errorf("got datagram %q", dg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram")
+	}
+}
+
+// refusingConn fails every write as refused, as a connected UDP socket does
+// after an ICMP error.
+type refusingConn struct{}
+
+func (refusingConn) Write(buf []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.ECONNREFUSED)}
+}
+
+func TestUDPWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		evs  []string
+		want []string
+	}{
+		{"one event per datagram", []string{"one", "two"}, []string{"one\n", "two\n"}},
+		{"multiline events stay whole", []string{"one\n  more"}, []string{"one\n  more\n"}},
+		{"oversized events are dropped", []string{"one", strings.Repeat("x", 16), "two"}, []string{"one\n", "two\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &datagrams{}
+			if err := (udpWriter{w: d, max: 16}).writeEvents(udpEvents(tt.evs...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := d.all(); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := (udpWriter{w: refusingConn{}, max: 16}).writeEvents(udpEvents("one")); err != nil {
+		t.Errorf("a refused datagram is an error: %s", err)
+	}
+}
+
+func TestUDPSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	got := make(chan string, 10)
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+	runMux(t, "--logstash", "udp://"+pc.LocalAddr().String(), "--udp-max-packet", "64",
+		pipeSpec(t, "app", []string{"one", strings.Repeat("x", 64), `{"n":2}`}))
+	for _, want := range []string{"app: one\n", `{"n":2,"tag":"app"}` + "\n"} {
+		select {
+		case dg := <-got:
+			if dg != want {
+				t.Errorf("got datagram %q, want %q", dg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no datagram for %q", want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--codec", "gelf"},
+		{"--udp-max-packet", "70000"},
+	} {
+		if _, err := parseTestArgs(append(append([]string{"--logstash", "udp://127.0.0.1:5000"}, args...), "0:app")...); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestUDPReconnectCarriesBatch(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	got := make(chan string, 10)
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+	// A mirror keeps writes going while the udp:// one fails, so that it's
+	// closed, and reopened by the next write.
+	c := captureTCP(t)
+	m := configuredMux(t, "--logstash", "udp://"+pc.LocalAddr().String(), "--logstash", c.url().String(),
+		"--udp-max-datagram", "16", "--udp-flush-interval", "1h")
+	l := &m.logstash
+	var acks ackLog
+	write := func(lines ...string) {
+		t.Helper()
+		evs := udpEvents(lines...)
+		for i := range evs {
+			evs[i].ack = acks.ack(lines[i])
+		}
+		if err := l.Write(evs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("aaaa", "bbbb", "cccc")
+	// The connection goes away with those three batched up for it, and the
+	// next event that doesn't fit can't send them.
+	l.Lock()
+	old := l.conn
+	old.Close()
+	l.Unlock()
+	write("dddd")
+	if l.conn != nil {
+		t.Fatal("the failed connection wasn't closed")
+	}
+	if got := acks.String(); got != "dddd" {
+		t.Errorf("got acks %q before the reconnect", got)
+	}
+	// The batch goes out once, first thing on the new connection.
+	write("eeee")
+	if l.conn == nil || l.conn == old {
+		t.Fatal("no new connection")
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"aaaa\nbbbb\ncccc\n", "eeee\n"} {
+		select {
+		case dg := <-got:
+			if dg != want {
+				t.Errorf("got datagram %q, want %q", dg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no datagram for %q", want)
+		}
+	}
+	select {
+	case dg := <-got:
+		t.Errorf("got extra datagram %q", dg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := acks.String(); got != "dddd,aaaa,bbbb,cccc,eeee" {
+		t.Errorf("got acks %q", got)
+	}
+	if got := c.lines(t, 0, 5); strings.Join(got, ",") != "aaaa,bbbb,cccc,dddd,eeee" {
+		t.Errorf("mirror got %q", got)
+	}
+}